@@ -0,0 +1,350 @@
+package dataforgebe
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	i "dataforge-be/integrations"
+	n "dataforge-be/nats"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi"
+)
+
+const (
+	ingestTokenKey      = "ingest-token"
+	ingestTokenHeader   = "X-Ingest-Token"
+	ingestBatchSize     = 500
+	ingestPublishWait   = 30 * time.Second
+	ingestSlotWait      = 5 * time.Second
+	maxIngestRequests   = 16
+	maxIngestBacklog    = 50000
+	ingestRetryAfter    = "5"
+	destinationsDurable = "CONS"
+)
+
+type ingestTokenState struct {
+	TokenHash string `json:"token_hash"`
+}
+
+type ingestTokenResponse struct {
+	Token string `json:"token"`
+}
+
+type ingestResponse struct {
+	Accepted int `json:"accepted"`
+}
+
+// createIngestToken issues a new ingest token for the pipeline, replacing any
+// previous one. Only a hash is kept, so the token is shown once.
+func (a *API) createIngestToken(w http.ResponseWriter, r *http.Request) {
+	pipelineID, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	_, err = a.db.GetPipelineById(context.Background(), pipelineID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			http.Error(w, fmt.Sprintf("pipeline %d not found", pipelineID), http.StatusNotFound)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	token := hex.EncodeToString(secret)
+
+	err = n.PutPipelineState(context.Background(), a.js, pipelineID, ingestTokenKey, ingestTokenState{TokenHash: hashIngestToken(token)})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	tokenBytes, err := json.Marshal(ingestTokenResponse{Token: token})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(tokenBytes)
+}
+
+// ingestEvents publishes records pushed by a client or SaaS webhook to the
+// pipeline's OUTPUT stream. The body may be a JSON array of records, NDJSON,
+// or an inputEventsBody envelope. Records are acked by JetStream before the
+// request succeeds; a client that retries after an error may deliver some
+// records twice.
+func (a *API) ingestEvents(w http.ResponseWriter, r *http.Request) {
+	pipelineID, err := strconv.ParseInt(chi.URLParam(r, "pipelineID"), 10, 64)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	pipeline, err := a.db.GetPipelineById(context.Background(), pipelineID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			http.Error(w, fmt.Sprintf("pipeline %d not found", pipelineID), http.StatusNotFound)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	source, err := a.db.GetSourceById(context.Background(), pipeline.SourceID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	ingester, ok := i.FetchSources()[source.SourceType].(i.Ingester)
+	if !ok {
+		http.Error(w, fmt.Sprintf("pipeline %d does not accept ingested records", pipelineID), http.StatusBadRequest)
+		return
+	}
+
+	var sourceConfig map[string]interface{}
+	err = json.Unmarshal(source.Config, &sourceConfig)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	err = ingester.(i.Source).Initialize(sourceConfig)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if !a.authorizeIngest(w, r, pipelineID, ingester.AllowsQueryToken()) {
+		return
+	}
+
+	if !a.acquireIngestSlot(r.Context()) {
+		w.Header().Set("Retry-After", ingestRetryAfter)
+		http.Error(w, "too many concurrent ingest requests", http.StatusTooManyRequests)
+		return
+	}
+	defer a.releaseIngestSlot()
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, ingester.MaxBodyBytes()))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	err = ingester.VerifyRequest(r.Header, body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	records, err := parseIngestBody(body, pipelineID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	backlog, err := a.outputBacklog(r.Context())
+	if err != nil {
+		w.Header().Set("Retry-After", ingestRetryAfter)
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	if backlog > maxIngestBacklog {
+		w.Header().Set("Retry-After", ingestRetryAfter)
+		http.Error(w, fmt.Sprintf("output backlog of %d messages, retry later", backlog), http.StatusTooManyRequests)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), ingestPublishWait)
+	defer cancel()
+	for start := 0; start < len(records); start += ingestBatchSize {
+		end := min(start+ingestBatchSize, len(records))
+		err = n.PublishRecords(ctx, a.js, n.DestinationRecord{
+			PipelineID: pipelineID,
+			Records:    records[start:end],
+			Stream:     ingester.Stream(),
+			PrimaryKey: ingester.PrimaryKey(),
+		})
+		if err != nil {
+			w.Header().Set("Retry-After", ingestRetryAfter)
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+	}
+
+	responseBytes, err := json.Marshal(ingestResponse{Accepted: len(records)})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	w.Write(responseBytes)
+}
+
+// authorizeIngest checks the request's token against the pipeline's stored
+// token hash. The token may be sent as a bearer token or in the X-Ingest-Token
+// header. Sources that opt in also accept it as a token query parameter, for
+// senders that cannot set headers; query strings end up in access logs and
+// proxies, so it is off by default.
+func (a *API) authorizeIngest(w http.ResponseWriter, r *http.Request, pipelineID int64, allowQueryToken bool) bool {
+	token := r.Header.Get(ingestTokenHeader)
+	if bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		token = bearer
+	}
+	if token == "" && allowQueryToken {
+		token = r.URL.Query().Get("token")
+	}
+	if token == "" {
+		http.Error(w, "missing ingest token", http.StatusUnauthorized)
+		return false
+	}
+
+	var state ingestTokenState
+	found, err := n.GetPipelineState(r.Context(), a.js, pipelineID, ingestTokenKey, &state)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return false
+	}
+	if !found || subtle.ConstantTimeCompare([]byte(hashIngestToken(token)), []byte(state.TokenHash)) != 1 {
+		http.Error(w, "invalid ingest token", http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+func hashIngestToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func (a *API) acquireIngestSlot(ctx context.Context) bool {
+	timer := time.NewTimer(ingestSlotWait)
+	defer timer.Stop()
+	select {
+	case a.ingestSlots <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func (a *API) releaseIngestSlot() {
+	<-a.ingestSlots
+}
+
+// outputBacklog is the number of OUTPUT messages the destinations consumer
+// has yet to process.
+func (a *API) outputBacklog(ctx context.Context) (uint64, error) {
+	consumer, err := a.os.Consumer(ctx, destinationsDurable)
+	if err != nil {
+		return 0, fmt.Errorf("failed to look up destinations consumer: %w", err)
+	}
+	info, err := consumer.Info(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get destinations consumer info: %w", err)
+	}
+	return info.NumPending + uint64(info.NumAckPending), nil
+}
+
+// parseIngestBody splits the body into records. It accepts a JSON array of
+// objects, newline-delimited objects, or a single inputEventsBody.
+func parseIngestBody(body []byte, pipelineID int64) ([][]byte, error) {
+	var values []json.RawMessage
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	for {
+		var value json.RawMessage
+		err := decoder.Decode(&value)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid JSON in body: %w", err)
+		}
+		values = append(values, value)
+	}
+	if len(values) == 0 {
+		return nil, errors.New("body contains no records")
+	}
+
+	if len(values) == 1 {
+		if envelope, ok := inputEventsEnvelope(values[0]); ok {
+			if envelope.PipelineID != 0 && envelope.PipelineID != pipelineID {
+				return nil, fmt.Errorf("body is for pipeline %d, not %d", envelope.PipelineID, pipelineID)
+			}
+			values = envelope.Records
+		}
+	}
+
+	records := make([][]byte, 0, len(values))
+	for _, value := range values {
+		if bytes.HasPrefix(value, []byte("[")) {
+			var elements []json.RawMessage
+			if err := json.Unmarshal(value, &elements); err != nil {
+				return nil, fmt.Errorf("invalid JSON array in body: %w", err)
+			}
+			for _, element := range elements {
+				if !bytes.HasPrefix(element, []byte("{")) {
+					return nil, errors.New("records must be JSON objects")
+				}
+				records = append(records, element)
+			}
+			continue
+		}
+		if !bytes.HasPrefix(value, []byte("{")) {
+			return nil, errors.New("records must be JSON objects")
+		}
+		records = append(records, value)
+	}
+	return records, nil
+}
+
+// inputEventsEnvelope reports whether value is an inputEventsBody rather than
+// a record: an object holding a records array and at most a pipeline_id.
+func inputEventsEnvelope(value json.RawMessage) (inputEventsBody, bool) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(value, &fields); err != nil {
+		return inputEventsBody{}, false
+	}
+	records, ok := fields["records"]
+	if !ok || !bytes.HasPrefix(bytes.TrimSpace(records), []byte("[")) {
+		return inputEventsBody{}, false
+	}
+	for key := range fields {
+		if key != "records" && key != "pipeline_id" {
+			return inputEventsBody{}, false
+		}
+	}
+
+	var envelope inputEventsBody
+	if err := json.Unmarshal(value, &envelope); err != nil {
+		return inputEventsBody{}, false
+	}
+	return envelope, true
+}
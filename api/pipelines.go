@@ -2,12 +2,20 @@ package dataforgebe
 
 import (
 	"context"
+	"database/sql"
 	"dataforge-be/db/migr"
 	i "dataforge-be/integrations"
+	n "dataforge-be/nats"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"log"
 	"net/http"
 	"strconv"
+	"time"
+
+	"github.com/go-chi/chi"
 )
 
 func (a *API) startPipeline(w http.ResponseWriter, r *http.Request) {
@@ -43,11 +51,143 @@ func (a *API) startPipeline(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	err = sourceToStart.Run(context.Background(), pipeline.ID, a.js)
+
+	runCtx := n.WithRun(context.Background(), strconv.FormatInt(time.Now().UnixNano(), 10))
+	ctx, cancel := context.WithCancel(runCtx)
+	a.runsMu.Lock()
+	if _, running := a.runs[pipeline.ID]; running {
+		a.runsMu.Unlock()
+		cancel()
+		if closer, ok := sourceToStart.(io.Closer); ok {
+			closer.Close()
+		}
+		http.Error(w, fmt.Sprintf("pipeline %d is already running", pipeline.ID), http.StatusConflict)
+		return
+	}
+	a.runs[pipeline.ID] = &pipelineRun{cancel: cancel, done: make(chan struct{})}
+	a.runsMu.Unlock()
+
+	status := pipelineRunStatus{
+		Run:       n.RunFromContext(runCtx),
+		State:     runStateRunning,
+		StartedAt: time.Now().UTC(),
+	}
+	a.putRunStatus(pipeline.ID, status)
+
+	go func() {
+		defer a.finishRun(pipeline.ID)
+		if closer, ok := sourceToStart.(io.Closer); ok {
+			defer closer.Close()
+		}
+		err := sourceToStart.Run(ctx, pipeline.ID, a.js)
+		switch {
+		case err != nil:
+			log.Printf("Pipeline %d run failed: %v", pipeline.ID, err)
+			status.State = runStateFailed
+			status.Error = err.Error()
+		case ctx.Err() != nil:
+			status.State = runStateStopped
+		default:
+			status.State = runStateCompleted
+			err = n.PublishRecords(runCtx, a.js, n.DestinationRecord{PipelineID: pipeline.ID, Complete: true})
+			if err != nil {
+				log.Printf("Failed to mark pipeline %d run as complete: %v", pipeline.ID, err)
+				status.State = runStateFailed
+				status.Error = fmt.Sprintf("failed to mark run as complete: %v", err)
+			}
+		}
+		if status.State != runStateCompleted {
+			err = n.PublishRecords(runCtx, a.js, n.DestinationRecord{PipelineID: pipeline.ID, Abandoned: true})
+			if err != nil {
+				log.Printf("Failed to mark pipeline %d run as abandoned: %v", pipeline.ID, err)
+			}
+		}
+		finishedAt := time.Now().UTC()
+		status.FinishedAt = &finishedAt
+		a.putRunStatus(pipeline.ID, status)
+	}()
+	w.WriteHeader(http.StatusOK)
+}
+
+// putRunStatus records the state of the pipeline's latest run. Failing to
+// record it only costs visibility, so it is logged rather than returned.
+func (a *API) putRunStatus(pipelineID int64, status pipelineRunStatus) {
+	err := n.PutPipelineState(context.Background(), a.js, pipelineID, runStatusState, status)
 	if err != nil {
+		log.Printf("Failed to record run status for pipeline %d: %v", pipelineID, err)
+	}
+}
+
+func (a *API) getPipeline(w http.ResponseWriter, r *http.Request) {
+	pipelineID, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	pipeline, err := a.db.GetPipelineById(context.Background(), pipelineID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			http.Error(w, fmt.Sprintf("pipeline %d not found", pipelineID), http.StatusNotFound)
+			return
+		}
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+
+	response := pipelineResponse{
+		ID:            pipeline.ID,
+		SourceID:      pipeline.SourceID,
+		DestinationID: pipeline.DestinationID,
+	}
+	var status pipelineRunStatus
+	found, err := n.GetPipelineState(context.Background(), a.js, pipeline.ID, runStatusState, &status)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if found {
+		response.LastRun = &status
+	}
+
+	a.runsMu.Lock()
+	_, response.Running = a.runs[pipeline.ID]
+	a.runsMu.Unlock()
+
+	responseBytes, err := json.Marshal(response)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Write(responseBytes)
+}
+
+func (a *API) finishRun(pipelineID int64) {
+	a.runsMu.Lock()
+	defer a.runsMu.Unlock()
+	if run, ok := a.runs[pipelineID]; ok {
+		run.cancel()
+		close(run.done)
+		delete(a.runs, pipelineID)
+	}
+}
+
+func (a *API) stopPipeline(w http.ResponseWriter, r *http.Request) {
+	var requestBody stopPipelineBody
+	err := json.NewDecoder(r.Body).Decode(&requestBody)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	a.runsMu.Lock()
+	run, ok := a.runs[requestBody.PipelineID]
+	a.runsMu.Unlock()
+	if !ok {
+		http.Error(w, fmt.Sprintf("pipeline %d is not running", requestBody.PipelineID), http.StatusNotFound)
+		return
+	}
+	run.cancel()
 	w.WriteHeader(http.StatusOK)
 }
 
@@ -103,3 +243,109 @@ func (a *API) createPipeline(w http.ResponseWriter, r *http.Request) {
 
 	w.WriteHeader(http.StatusOK)
 }
+
+func (a *API) deletePipeline(w http.ResponseWriter, r *http.Request) {
+	pipelineID, err := strconv.ParseInt(chi.URLParam(r, "id"), 10, 64)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	pipeline, err := a.db.GetPipelineById(context.Background(), pipelineID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			http.Error(w, fmt.Sprintf("pipeline %d not found", pipelineID), http.StatusNotFound)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Teardown must not race the run: a source still inside Run could
+	// recreate the objects teardown is about to drop.
+	a.runsMu.Lock()
+	run, running := a.runs[pipeline.ID]
+	a.runsMu.Unlock()
+	if running {
+		run.cancel()
+		select {
+		case <-run.done:
+		case <-r.Context().Done():
+			http.Error(w, fmt.Sprintf("pipeline %d is still stopping", pipeline.ID), http.StatusServiceUnavailable)
+			return
+		}
+	}
+
+	source, err := a.db.GetSourceById(context.Background(), pipeline.SourceID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if teardown, ok := i.FetchSources()[source.SourceType].(i.Teardown); ok {
+		var sourceConfig map[string]interface{}
+		err = json.Unmarshal(source.Config, &sourceConfig)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		err = teardown.(i.Source).Initialize(sourceConfig)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if closer, ok := teardown.(io.Closer); ok {
+			defer closer.Close()
+		}
+
+		err = teardown.Teardown(context.Background(), pipeline.ID, a.js)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	err = n.DeleteAllSnapshots(context.Background(), a.js, pipeline.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	err = n.DeleteAllPipelineState(context.Background(), a.kv, pipeline.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	err = a.db.DeletePipeline(context.Background(), pipeline.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
+
+func (a *API) reconcilePipelines(w http.ResponseWriter, r *http.Request) {
+	var requestBody reconcilePipelinesBody
+	err := json.NewDecoder(r.Body).Decode(&requestBody)
+	if err != nil && !errors.Is(err, io.EOF) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	orphans, err := i.ReconcileWarehouseObjects(context.Background(), a.db, a.js, requestBody.Drop)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	orphansBytes, err := json.Marshal(orphans)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(orphansBytes)
+}
@@ -1,8 +1,10 @@
 package dataforgebe
 
 import (
+	"context"
 	"dataforge-be/db"
 	"net/http"
+	"sync"
 
 	"github.com/go-chi/chi"
 	"github.com/go-chi/cors"
@@ -10,6 +12,13 @@ import (
 	"github.com/nats-io/nats.go/jetstream"
 )
 
+// pipelineRun is a run in progress. done is closed once its goroutine has
+// returned.
+type pipelineRun struct {
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
 type API struct {
 	httpC *http.Client
 	db    *db.DB
@@ -17,6 +26,11 @@ type API struct {
 	kv    jetstream.KeyValue
 	js    jetstream.JetStream
 	os    jetstream.Stream
+
+	runsMu sync.Mutex
+	runs   map[int64]*pipelineRun
+
+	ingestSlots chan struct{}
 }
 
 func NewAPIServer(db *db.DB, nats *nats.Conn, kv jetstream.KeyValue, js jetstream.JetStream, os jetstream.Stream) *chi.Mux {
@@ -27,6 +41,9 @@ func NewAPIServer(db *db.DB, nats *nats.Conn, kv jetstream.KeyValue, js jetstrea
 		kv:    kv,
 		js:    js,
 		os:    os,
+		runs:  make(map[int64]*pipelineRun),
+
+		ingestSlots: make(chan struct{}, maxIngestRequests),
 	}
 
 	r := chi.NewRouter()
@@ -34,7 +51,7 @@ func NewAPIServer(db *db.DB, nats *nats.Conn, kv jetstream.KeyValue, js jetstrea
 	r.Use(cors.Handler(cors.Options{
 		AllowedOrigins:   []string{"http://localhost:3001"},
 		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
-		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", "X-CSRF-Token"},
+		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", "X-CSRF-Token", "X-Ingest-Token"},
 		ExposedHeaders:   []string{"Link"},
 		AllowCredentials: true,
 		MaxAge:           300,
@@ -43,6 +60,7 @@ func NewAPIServer(db *db.DB, nats *nats.Conn, kv jetstream.KeyValue, js jetstrea
 	r.Route("/source", func(r chi.Router) {
 		r.Post("/", api.createSource)
 		r.Post("/id", api.getSourceById)
+		r.Post("/preview", api.previewSource)
 		r.Get("/", api.getSources)
 	})
 
@@ -55,7 +73,14 @@ func NewAPIServer(db *db.DB, nats *nats.Conn, kv jetstream.KeyValue, js jetstrea
 	r.Route("/pipelines", func(r chi.Router) {
 		r.Post("/", api.createPipeline)
 		r.Post("/start", api.startPipeline)
+		r.Post("/stop", api.stopPipeline)
+		r.Post("/reconcile", api.reconcilePipelines)
+		r.Post("/{id}/ingest-token", api.createIngestToken)
+		r.Get("/{id}", api.getPipeline)
+		r.Delete("/{id}", api.deletePipeline)
 	})
 
+	r.Post("/ingest/{pipelineID}", api.ingestEvents)
+
 	return r
 }
@@ -3,7 +3,10 @@ package dataforgebe
 import (
 	"context"
 	"dataforge-be/db/migr"
+	i "dataforge-be/integrations"
 	"encoding/json"
+	"fmt"
+	"io"
 	"net/http"
 )
 
@@ -78,3 +81,61 @@ func (a *API) getSources(w http.ResponseWriter, r *http.Request) {
 
 	w.Write(sourcesBytes)
 }
+
+func (a *API) previewSource(w http.ResponseWriter, r *http.Request) {
+	var requestBody previewSourceBody
+	err := json.NewDecoder(r.Body).Decode(&requestBody)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	sourceType, sourceConfig := requestBody.Type, requestBody.Config
+	if requestBody.SourceID != 0 {
+		source, err := a.db.GetSourceById(context.Background(), requestBody.SourceID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		sourceType = source.SourceType
+		err = json.Unmarshal(source.Config, &sourceConfig)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	source, ok := i.FetchSources()[sourceType]
+	if !ok {
+		http.Error(w, fmt.Sprintf("unknown source type: %s", sourceType), http.StatusBadRequest)
+		return
+	}
+	previewer, ok := source.(i.Previewer)
+	if !ok {
+		http.Error(w, fmt.Sprintf("source type %s does not support previews", sourceType), http.StatusBadRequest)
+		return
+	}
+
+	err = source.Initialize(sourceConfig)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if closer, ok := source.(io.Closer); ok {
+		defer closer.Close()
+	}
+
+	preview, err := previewer.Preview(r.Context(), requestBody.Query, requestBody.Limit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	previewBytes, err := json.Marshal(preview)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Write(previewBytes)
+}
@@ -13,6 +13,14 @@ type createSourceBody struct {
 	Type        string                 `json:"source_type"`
 }
 
+type previewSourceBody struct {
+	SourceID int64                  `json:"source_id"`
+	Config   map[string]interface{} `json:"config"`
+	Type     string                 `json:"source_type"`
+	Query    string                 `json:"query"`
+	Limit    int                    `json:"limit"`
+}
+
 type createTransformationBody struct {
 	Name        string `json:"name"`
 	Description string `json:"description"`
@@ -38,6 +46,42 @@ type startPipelineBody struct {
 	PipelineID int64 `json:"pipeline_id"`
 }
 
+type stopPipelineBody struct {
+	PipelineID int64 `json:"pipeline_id"`
+}
+
+// Run states recorded in pipelineRunStatus.
+const (
+	runStateRunning   = "running"
+	runStateCompleted = "completed"
+	runStateStopped   = "stopped"
+	runStateFailed    = "failed"
+
+	runStatusState = "run-status"
+)
+
+// pipelineRunStatus is kept in pipeline state for the latest run, so errors
+// from a run's goroutine are visible after startPipeline has returned.
+type pipelineRunStatus struct {
+	Run        string     `json:"run"`
+	State      string     `json:"state"`
+	Error      string     `json:"error,omitempty"`
+	StartedAt  time.Time  `json:"started_at"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+}
+
+type pipelineResponse struct {
+	ID            int64              `json:"id"`
+	SourceID      int64              `json:"source_id"`
+	DestinationID int64              `json:"destination_id"`
+	Running       bool               `json:"running"`
+	LastRun       *pipelineRunStatus `json:"last_run,omitempty"`
+}
+
+type reconcilePipelinesBody struct {
+	Drop bool `json:"drop"`
+}
+
 type createPipelineBody struct {
 	SourceID      int64 `json:"source_id"`
 	DestinationID int64 `json:"destination_id"`
@@ -70,3 +70,7 @@ func (d *DB) GetDestination(ctx context.Context, id int64) (migr.Destination, er
 func (d *DB) GetPipelineById(ctx context.Context, id int64) (migr.Pipeline, error) {
 	return d.migr.GetPipelineById(ctx, id)
 }
+
+func (d *DB) DeletePipeline(ctx context.Context, id int64) error {
+	return d.migr.DeletePipeline(ctx, id)
+}
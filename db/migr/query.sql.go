@@ -68,6 +68,16 @@ func (q *Queries) CreateSource(ctx context.Context, arg CreateSourceParams) erro
 	return err
 }
 
+const deletePipeline = `-- name: DeletePipeline :exec
+DELETE FROM pipelines
+WHERE id = ?
+`
+
+func (q *Queries) DeletePipeline(ctx context.Context, id int64) error {
+	_, err := q.db.ExecContext(ctx, deletePipeline, id)
+	return err
+}
+
 const getAllDestinations = `-- name: GetAllDestinations :many
 SELECT id, destination_name, destination_type, destination_description, config, updated_at FROM destinations
 `
@@ -31,3 +31,6 @@ VALUES (?, ?);
 INSERT INTO destinations (destination_name, destination_type, destination_description, config)
 VALUES (?, ?, ?, ?);
 
+-- name: DeletePipeline :exec
+DELETE FROM pipelines
+WHERE id = ?;
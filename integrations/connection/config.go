@@ -0,0 +1,62 @@
+// Package connection builds the client settings that a source and a
+// destination for the same system share, such as brokers, credentials and
+// TLS, and the config readers the integrations have in common.
+package connection
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// StringsFromConfig accepts either a list of strings or a single comma
+// separated string.
+func StringsFromConfig(config map[string]interface{}, key string) []string {
+	var values []string
+	switch v := config[key].(type) {
+	case string:
+		for _, value := range strings.Split(v, ",") {
+			if value = strings.TrimSpace(value); value != "" {
+				values = append(values, value)
+			}
+		}
+	case []interface{}:
+		for _, value := range v {
+			if s, ok := value.(string); ok && s != "" {
+				values = append(values, s)
+			}
+		}
+	}
+	return values
+}
+
+// TLSConfig builds a client TLS configuration from a tls block:
+//
+//	{"enabled": true, "server_name": "...", "ca_cert": "PEM", "client_cert": "PEM", "client_key": "PEM"}
+//
+// A ca_cert replaces the system roots rather than adding to them.
+func TLSConfig(config map[string]interface{}) (*tls.Config, error) {
+	cfg := &tls.Config{MinVersion: tls.VersionTLS12}
+	cfg.ServerName, _ = config["server_name"].(string)
+
+	if caCert, _ := config["ca_cert"].(string); caCert != "" {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM([]byte(caCert)) {
+			return nil, errors.New("failed to parse ca_cert")
+		}
+		cfg.RootCAs = pool
+	}
+
+	clientCert, _ := config["client_cert"].(string)
+	clientKey, _ := config["client_key"].(string)
+	if clientCert != "" || clientKey != "" {
+		cert, err := tls.X509KeyPair([]byte(clientCert), []byte(clientKey))
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse client certificate: %w", err)
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
@@ -0,0 +1,28 @@
+package connection
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestStringsFromConfig(t *testing.T) {
+	tests := []struct {
+		name  string
+		value interface{}
+		want  []string
+	}{
+		{"list", []interface{}{"a", "", "b", 1}, []string{"a", "b"}},
+		{"comma separated", "a, b,,c ", []string{"a", "b", "c"}},
+		{"single", "a", []string{"a"}},
+		{"empty", "", nil},
+		{"missing", nil, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := StringsFromConfig(map[string]interface{}{"key": tt.value}, "key")
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("StringsFromConfig = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
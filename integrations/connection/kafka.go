@@ -0,0 +1,52 @@
+package connection
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/twmb/franz-go/pkg/kgo"
+	"github.com/twmb/franz-go/pkg/sasl/plain"
+	"github.com/twmb/franz-go/pkg/sasl/scram"
+)
+
+// KafkaOptions builds the client options common to Kafka consumers and
+// producers:
+//
+//	"brokers": ["localhost:9092"],
+//	"sasl": {"mechanism": "SCRAM-SHA-512", "username": "...", "password": "..."},
+//	"tls": {"enabled": true, "ca_cert": "PEM", "client_cert": "PEM", "client_key": "PEM"}
+func KafkaOptions(config map[string]interface{}) ([]kgo.Opt, error) {
+	brokers := StringsFromConfig(config, "brokers")
+	if len(brokers) == 0 {
+		return nil, errors.New("kafka requires at least one broker")
+	}
+	opts := []kgo.Opt{kgo.SeedBrokers(brokers...)}
+
+	if saslConfig, ok := config["sasl"].(map[string]interface{}); ok {
+		mechanism, _ := saslConfig["mechanism"].(string)
+		username, _ := saslConfig["username"].(string)
+		password, _ := saslConfig["password"].(string)
+		switch strings.ToUpper(mechanism) {
+		case "", "PLAIN":
+			opts = append(opts, kgo.SASL(plain.Auth{User: username, Pass: password}.AsMechanism()))
+		case "SCRAM-SHA-256":
+			opts = append(opts, kgo.SASL(scram.Auth{User: username, Pass: password}.AsSha256Mechanism()))
+		case "SCRAM-SHA-512":
+			opts = append(opts, kgo.SASL(scram.Auth{User: username, Pass: password}.AsSha512Mechanism()))
+		default:
+			return nil, fmt.Errorf("unsupported sasl mechanism %q", mechanism)
+		}
+	}
+
+	if tlsConfig, ok := config["tls"].(map[string]interface{}); ok {
+		if enabled, _ := tlsConfig["enabled"].(bool); enabled {
+			cfg, err := TLSConfig(tlsConfig)
+			if err != nil {
+				return nil, err
+			}
+			opts = append(opts, kgo.DialTLSConfig(cfg))
+		}
+	}
+	return opts, nil
+}
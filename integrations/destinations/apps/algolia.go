@@ -47,10 +47,26 @@ func (a *Algolia) Run(r nats.DestinationRecord) error {
 		}
 
 		if _, exists := document["objectID"]; !exists {
-			document["objectID"] = fmt.Sprintf("%s-%d", algoliaID, r.PipelineID)
+			if objectID, ok := nats.PrimaryKeyValue(document, r.PrimaryKey); ok {
+				document["objectID"] = objectID
+			} else {
+				document["objectID"] = fmt.Sprintf("%s-%d", algoliaID, r.PipelineID)
+			}
 		}
 
-		_, err = a.index.SaveObject(document)
+		if r.Operation == nats.OperationDelete {
+			_, err = a.index.DeleteObject(fmt.Sprint(document["objectID"]))
+			if err != nil {
+				return fmt.Errorf("failed to delete document from Algolia: %w", err)
+			}
+			continue
+		}
+
+		if r.Partial {
+			_, err = a.index.PartialUpdateObject(document)
+		} else {
+			_, err = a.index.SaveObject(document)
+		}
 		if err != nil {
 			log.Printf("Failed to index document in Algolia: %s", err)
 			continue
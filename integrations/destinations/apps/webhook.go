@@ -0,0 +1,313 @@
+package apps
+
+import (
+	"bytes"
+	"context"
+	app_sources "dataforge-be/integrations/sources/apps"
+	"dataforge-be/nats"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+const (
+	webhookID = "webhook"
+
+	defaultWebhookBatchSize    = 100
+	defaultWebhookMaxRetries   = 5
+	defaultWebhookTimeout      = 30 * time.Second
+	defaultWebhookMaxRetryWait = 20 * time.Second
+	webhookBaseBackoff         = time.Second
+	webhookMaxBackoffShift     = 16
+	webhookResponseLimit       = 4096
+	// webhookDeliveryBudget bounds the time one OUTPUT message spends in
+	// Run, retries included, so it is acked before the server delivers it
+	// again.
+	webhookDeliveryBudget = nats.OutputAckWait * 2 / 3
+)
+
+var defaultRetryStatuses = []int{
+	http.StatusRequestTimeout,
+	http.StatusTooEarly,
+	http.StatusTooManyRequests,
+	http.StatusInternalServerError,
+	http.StatusBadGateway,
+	http.StatusServiceUnavailable,
+	http.StatusGatewayTimeout,
+}
+
+// Webhook sends records to an HTTP endpoint, batch_size records per request.
+// The body is payload_template rendered over the batch, or a JSON object with
+// the stream, operation and records when no template is set. With an
+// hmac_secret each body is signed as the webhook source verifies it.
+//
+// Responses with a status in retry_statuses are retried with backoff,
+// waiting for Retry-After when the endpoint sends one. Statuses in
+// ignore_statuses count as delivered. Retries only wait in place while the
+// message stays within its ack deadline. A longer wait, or a Retry-After
+// longer than max_retry_wait_seconds, is handed back to the consumer as a
+// RetryAfterError, which delivers the message again once it has passed.
+// Requests already sent are sent again then.
+type Webhook struct {
+	client         *http.Client
+	url            string
+	method         string
+	headers        map[string]string
+	auth           app_sources.Authenticator
+	payload        *template.Template
+	batchSize      int
+	signer         *app_sources.Signer
+	maxRetries     int
+	maxRetryWait   time.Duration
+	retryStatuses  map[int]bool
+	ignoreStatuses map[int]bool
+	deliveryBudget time.Duration
+}
+
+// webhookBatch is what payload_template is rendered over.
+type webhookBatch struct {
+	PipelineID int64                    `json:"pipeline_id"`
+	Stream     string                   `json:"stream,omitempty"`
+	Operation  string                   `json:"operation,omitempty"`
+	Partial    bool                     `json:"partial,omitempty"`
+	Run        string                   `json:"run,omitempty"`
+	Records    []map[string]interface{} `json:"records"`
+}
+
+var webhookFuncs = template.FuncMap{
+	"json": func(value interface{}) (string, error) {
+		encoded, err := json.Marshal(value)
+		return string(encoded), err
+	},
+}
+
+func (wh *Webhook) Initialize(config map[string]interface{}) error {
+	wh.url, _ = config["url"].(string)
+	if wh.url == "" {
+		return errors.New("webhook destination requires url")
+	}
+	wh.method, _ = config["method"].(string)
+	if wh.method == "" {
+		wh.method = http.MethodPost
+	}
+	wh.method = strings.ToUpper(wh.method)
+
+	wh.headers = map[string]string{"Content-Type": "application/json"}
+	if headers, ok := config["headers"].(map[string]interface{}); ok {
+		for key, value := range headers {
+			if s, ok := value.(string); ok {
+				wh.headers[key] = s
+			}
+		}
+	}
+	auth, err := app_sources.AuthenticatorFromConfig(config["auth"])
+	if err != nil {
+		return err
+	}
+	wh.auth = auth
+
+	wh.payload = nil
+	if payload, _ := config["payload_template"].(string); payload != "" {
+		wh.payload, err = template.New("payload").Funcs(webhookFuncs).Option("missingkey=zero").Parse(payload)
+		if err != nil {
+			return fmt.Errorf("invalid payload_template: %w", err)
+		}
+	}
+
+	wh.batchSize = defaultWebhookBatchSize
+	if batchSize, ok := config["batch_size"].(float64); ok && batchSize > 0 {
+		wh.batchSize = int(batchSize)
+	}
+
+	wh.signer, err = app_sources.SignerFromConfig(config)
+	if err != nil {
+		return err
+	}
+
+	wh.maxRetries = defaultWebhookMaxRetries
+	if maxRetries, ok := config["max_retries"].(float64); ok && maxRetries >= 0 {
+		wh.maxRetries = int(maxRetries)
+	}
+	wh.maxRetryWait = defaultWebhookMaxRetryWait
+	if seconds, ok := config["max_retry_wait_seconds"].(float64); ok && seconds > 0 {
+		wh.maxRetryWait = time.Duration(seconds * float64(time.Second))
+	}
+	wh.retryStatuses = statusSet(config["retry_statuses"], defaultRetryStatuses)
+	wh.ignoreStatuses = statusSet(config["ignore_statuses"], nil)
+
+	timeout := defaultWebhookTimeout
+	if seconds, ok := config["timeout_seconds"].(float64); ok && seconds > 0 {
+		timeout = time.Duration(seconds * float64(time.Second))
+	}
+	wh.client = &http.Client{Timeout: timeout}
+	wh.deliveryBudget = webhookDeliveryBudget
+	return nil
+}
+
+func statusSet(value interface{}, defaults []int) map[int]bool {
+	set := make(map[int]bool)
+	statuses, ok := value.([]interface{})
+	if !ok {
+		for _, status := range defaults {
+			set[status] = true
+		}
+		return set
+	}
+	for _, status := range statuses {
+		if code, ok := status.(float64); ok {
+			set[int(code)] = true
+		}
+	}
+	return set
+}
+
+func (wh *Webhook) DestinationID() string {
+	return webhookID
+}
+
+func (wh *Webhook) Run(record nats.DestinationRecord) error {
+	records := make([]map[string]interface{}, 0, len(record.Records))
+	for _, recordBytes := range record.Records {
+		var document map[string]interface{}
+		decoder := json.NewDecoder(bytes.NewReader(recordBytes))
+		decoder.UseNumber()
+		if err := decoder.Decode(&document); err != nil {
+			return fmt.Errorf("error decoding record for pipeline %d: %w", record.PipelineID, err)
+		}
+		records = append(records, document)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), wh.deliveryBudget)
+	defer cancel()
+	for start := 0; start < len(records); start += wh.batchSize {
+		end := start + wh.batchSize
+		if end > len(records) {
+			end = len(records)
+		}
+		body, err := wh.render(webhookBatch{
+			PipelineID: record.PipelineID,
+			Stream:     record.Stream,
+			Operation:  record.Operation,
+			Partial:    record.Partial,
+			Run:        record.Run,
+			Records:    records[start:end],
+		})
+		if err != nil {
+			return fmt.Errorf("pipeline %d: %w", record.PipelineID, err)
+		}
+		if err := wh.send(ctx, body); err != nil {
+			return fmt.Errorf("failed to send %d records to webhook for pipeline %d: %w", end-start, record.PipelineID, err)
+		}
+	}
+	return nil
+}
+
+func (wh *Webhook) render(batch webhookBatch) ([]byte, error) {
+	if wh.payload == nil {
+		return json.Marshal(batch)
+	}
+	var b bytes.Buffer
+	if err := wh.payload.Execute(&b, batch); err != nil {
+		return nil, fmt.Errorf("failed to render payload_template: %w", err)
+	}
+	return b.Bytes(), nil
+}
+
+// send delivers one body, retrying the statuses configured for it.
+func (wh *Webhook) send(ctx context.Context, body []byte) error {
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequestWithContext(ctx, wh.method, wh.url, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		for key, value := range wh.headers {
+			req.Header.Set(key, value)
+		}
+		wh.signer.Sign(req, body)
+		if err := wh.auth.AddAuth(req); err != nil {
+			return fmt.Errorf("authentication error: %w", err)
+		}
+
+		var status int
+		var retryAfter string
+		var response []byte
+		resp, err := wh.client.Do(req)
+		if err == nil {
+			status = resp.StatusCode
+			retryAfter = resp.Header.Get("Retry-After")
+			response, _ = io.ReadAll(io.LimitReader(resp.Body, webhookResponseLimit))
+			resp.Body.Close()
+
+			switch {
+			case status >= 200 && status < 300, wh.ignoreStatuses[status]:
+				return nil
+			case !wh.retryStatuses[status]:
+				return fmt.Errorf("webhook responded with status %d: %s", status, string(response))
+			}
+		}
+		if attempt >= wh.maxRetries {
+			if err != nil {
+				return err
+			}
+			return fmt.Errorf("webhook responded with status %d after %d attempts: %s", status, attempt+1, string(response))
+		}
+
+		wait := backoff(attempt, wh.maxRetryWait)
+		after, hasRetryAfter := parseRetryAfter(retryAfter)
+		if hasRetryAfter {
+			wait = after
+		}
+		// Waits that would outlast the delivery are left to the consumer,
+		// which delivers the message again once they have passed.
+		deadline, hasDeadline := ctx.Deadline()
+		if (hasRetryAfter && after > wh.maxRetryWait) || (hasDeadline && time.Now().Add(wait).After(deadline)) {
+			if err == nil {
+				err = fmt.Errorf("webhook responded with status %d: %s", status, string(response))
+			}
+			return &nats.RetryAfterError{Delay: wait, Err: err}
+		}
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// backoff doubles from webhookBaseBackoff with each attempt, up to limit.
+// The shift is clamped so a large max_retries cannot overflow it.
+func backoff(attempt int, limit time.Duration) time.Duration {
+	if attempt > webhookMaxBackoffShift {
+		attempt = webhookMaxBackoffShift
+	}
+	wait := webhookBaseBackoff << attempt
+	if wait > limit {
+		wait = limit
+	}
+	return wait
+}
+
+// parseRetryAfter reads a Retry-After header in either delay-seconds or
+// HTTP-date form.
+func parseRetryAfter(value string) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if at, err := http.ParseTime(value); err == nil {
+		wait := time.Until(at)
+		if wait < 0 {
+			wait = 0
+		}
+		return wait, true
+	}
+	return 0, false
+}
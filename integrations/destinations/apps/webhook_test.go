@@ -0,0 +1,130 @@
+package apps
+
+import (
+	app_sources "dataforge-be/integrations/sources/apps"
+	"dataforge-be/nats"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newWebhook(t *testing.T, config map[string]interface{}) *Webhook {
+	t.Helper()
+	wh := &Webhook{}
+	if err := wh.Initialize(config); err != nil {
+		t.Fatalf("Initialize: %v", err)
+	}
+	return wh
+}
+
+var webhookRecord = nats.DestinationRecord{PipelineID: 1, Stream: "users", Records: [][]byte{[]byte(`{"id":1}`)}}
+
+func TestWebhookSignsLikeTheSourceVerifies(t *testing.T) {
+	signing := map[string]interface{}{
+		"hmac_secret":        "s3cret",
+		"hmac_algorithm":     "sha512",
+		"signature_encoding": "base64",
+		"signature_header":   "X-Hub-Signature",
+		"signature_prefix":   "v1=",
+	}
+	verifier := &app_sources.Webhook{}
+	if err := verifier.Initialize(signing); err != nil {
+		t.Fatalf("source Initialize: %v", err)
+	}
+
+	var verifyErr error
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		verifyErr = verifier.VerifyRequest(r.Header, body)
+	}))
+	defer server.Close()
+
+	config := map[string]interface{}{"url": server.URL}
+	for key, value := range signing {
+		config[key] = value
+	}
+	if err := newWebhook(t, config).Run(webhookRecord); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if verifyErr != nil {
+		t.Errorf("source rejected the destination's signature: %v", verifyErr)
+	}
+}
+
+func TestWebhookRetryAfter(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch requests.Add(1) {
+		case 1:
+			// Within max_retry_wait: waited for in place.
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusTooManyRequests)
+		case 2:
+			// Past it: handed back to the consumer.
+			w.Header().Set("Retry-After", "120")
+			w.WriteHeader(http.StatusTooManyRequests)
+		}
+	}))
+	defer server.Close()
+
+	err := newWebhook(t, map[string]interface{}{"url": server.URL, "max_retry_wait_seconds": float64(10)}).Run(webhookRecord)
+	var retry *nats.RetryAfterError
+	if !errors.As(err, &retry) {
+		t.Fatalf("Run = %v, want a RetryAfterError", err)
+	}
+	if retry.Delay != 2*time.Minute {
+		t.Errorf("retry delay = %s, want 2m", retry.Delay)
+	}
+	if got := requests.Load(); got != 2 {
+		t.Errorf("sent %d requests, want 2", got)
+	}
+}
+
+func TestWebhookHandsBackWaitsPastTheDeliveryBudget(t *testing.T) {
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	wh := newWebhook(t, map[string]interface{}{"url": server.URL})
+	// Room for the first one second backoff, not the two second one after it.
+	wh.deliveryBudget = 1500 * time.Millisecond
+
+	err := wh.Run(webhookRecord)
+	var retry *nats.RetryAfterError
+	if !errors.As(err, &retry) {
+		t.Fatalf("Run = %v, want a RetryAfterError", err)
+	}
+	if retry.Delay != 2*time.Second {
+		t.Errorf("retry delay = %s, want 2s", retry.Delay)
+	}
+	if got := requests.Load(); got != 2 {
+		t.Errorf("sent %d requests, want 2", got)
+	}
+}
+
+func TestWebhookBackoff(t *testing.T) {
+	limit := time.Hour
+	tests := []struct {
+		attempt int
+		want    time.Duration
+	}{
+		{0, time.Second},
+		{3, 8 * time.Second},
+		{20, limit},
+		// Unclamped, a shift this large wraps to zero or a negative wait.
+		{64, limit},
+		{1000, limit},
+	}
+	for _, tt := range tests {
+		if got := backoff(tt.attempt, limit); got != tt.want {
+			t.Errorf("backoff(%d) = %s, want %s", tt.attempt, got, tt.want)
+		}
+	}
+}
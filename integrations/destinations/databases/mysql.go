@@ -0,0 +1,473 @@
+package databases
+
+import (
+	"context"
+	"database/sql"
+	"dataforge-be/integrations/connection"
+	n "dataforge-be/nats"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+const (
+	mysqlID = "mysql"
+
+	transactionMessage   = "message"
+	transactionStatement = "statement"
+
+	defaultMySQLPort      = "3306"
+	defaultMySQLBatchSize = 500
+	mysqlMaxPlaceholders  = 65535
+	mysqlWriteTimeout     = 5 * time.Minute
+)
+
+// MySQL writes records with batched multi-row INSERTs, upserting through
+// ON DUPLICATE KEY UPDATE when the table has a primary key. Tables are
+// created on first write and gain columns as new fields show up; nested
+// objects and arrays go into JSON columns.
+//
+// With transaction set to "message" (the default) each OUTPUT message is
+// written in one transaction that commits before the message is acked, so a
+// failed batch leaves nothing behind. "statement" commits every INSERT on
+// its own.
+type MySQL struct {
+	config      *mysql.Config
+	table       string
+	mode        string
+	softDelete  bool
+	batchSize   int
+	transaction string
+	primaryKey  []string
+}
+
+func (m *MySQL) Initialize(config map[string]interface{}) error {
+	cfg, err := mysqlConfig(config)
+	if err != nil {
+		return err
+	}
+	m.config = cfg
+
+	m.table, _ = config["table"].(string)
+	if m.table == "" {
+		m.table = defaultTable
+	}
+	m.mode, _ = config["mode"].(string)
+	switch m.mode {
+	case "":
+		m.mode = modeUpsert
+	case modeUpsert, modeAppend:
+	default:
+		return fmt.Errorf("unsupported mysql mode %q", m.mode)
+	}
+	m.transaction, _ = config["transaction"].(string)
+	switch m.transaction {
+	case "":
+		m.transaction = transactionMessage
+	case transactionMessage, transactionStatement:
+	default:
+		return fmt.Errorf("unsupported mysql transaction mode %q", m.transaction)
+	}
+
+	m.batchSize = defaultMySQLBatchSize
+	if batchSize, ok := config["batch_size"].(float64); ok && batchSize > 0 {
+		m.batchSize = int(batchSize)
+	}
+	m.softDelete, _ = config["soft_delete"].(bool)
+	m.primaryKey = connection.StringsFromConfig(config, "primary_key")
+	return nil
+}
+
+// mysqlConfig reads either a dsn or host, port, username, password and db,
+// with tls and the optional ca_cert, server_name and client certificate
+// that connection.TLSConfig reads.
+func mysqlConfig(config map[string]interface{}) (*mysql.Config, error) {
+	if dsn, _ := config["dsn"].(string); dsn != "" {
+		cfg, err := mysql.ParseDSN(dsn)
+		if err != nil {
+			return nil, fmt.Errorf("invalid mysql dsn: %w", err)
+		}
+		return cfg, nil
+	}
+
+	host, _ := config["host"].(string)
+	port, _ := config["port"].(string)
+	if portNumber, ok := config["port"].(float64); ok {
+		port = strconv.Itoa(int(portNumber))
+	}
+	if port == "" {
+		port = defaultMySQLPort
+	}
+	cfg := mysql.NewConfig()
+	cfg.User, _ = config["username"].(string)
+	cfg.Passwd, _ = config["password"].(string)
+	cfg.DBName, _ = config["db"].(string)
+	if host == "" || cfg.User == "" || cfg.DBName == "" {
+		return nil, errors.New("mysql destination requires dsn or host, username and db")
+	}
+	cfg.Net = "tcp"
+	cfg.Addr = net.JoinHostPort(host, port)
+
+	if useTLS, _ := config["tls"].(bool); useTLS {
+		tlsConfig, err := connection.TLSConfig(config)
+		if err != nil {
+			return nil, fmt.Errorf("invalid tls config for mysql destination: %w", err)
+		}
+		if tlsConfig.ServerName == "" {
+			tlsConfig.ServerName = host
+		}
+		cfg.TLS = tlsConfig
+	}
+	return cfg, nil
+}
+
+func (m *MySQL) DestinationID() string {
+	return mysqlID
+}
+
+// mysqlExecer is satisfied by both *sql.DB and *sql.Tx.
+type mysqlExecer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+}
+
+func (m *MySQL) Run(record n.DestinationRecord) error {
+	if len(record.Records) == 0 {
+		return nil
+	}
+
+	primaryKey := m.primaryKey
+	if len(primaryKey) == 0 {
+		primaryKey = record.PrimaryKey
+	}
+	b, err := decodeBatch(record.Records, primaryKey)
+	if err != nil {
+		return fmt.Errorf("pipeline %d: %w", record.PipelineID, err)
+	}
+	isDelete := record.Operation == n.OperationDelete
+	if isDelete && len(primaryKey) == 0 {
+		log.Printf("Skipping %d deletes for pipeline %d: stream %s has no primary key", len(b.rows), record.PipelineID, record.Stream)
+		return nil
+	}
+
+	connector, err := mysql.NewConnector(m.config)
+	if err != nil {
+		return fmt.Errorf("invalid mysql config: %w", err)
+	}
+	db := sql.OpenDB(connector)
+	defer db.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), mysqlWriteTimeout)
+	defer cancel()
+
+	// DDL commits implicitly in MySQL, so the table is settled before the
+	// transaction starts.
+	table := tableFor(m.table, record.Stream)
+	kinds, err := m.ensureTable(ctx, db, table, b, primaryKey)
+	if err != nil {
+		return err
+	}
+
+	var exec mysqlExecer = db
+	var tx *sql.Tx
+	if m.transaction == transactionMessage {
+		tx, err = db.BeginTx(ctx, nil)
+		if err != nil {
+			return fmt.Errorf("failed to begin transaction: %w", err)
+		}
+		defer tx.Rollback()
+		exec = tx
+	}
+
+	switch {
+	case isDelete && m.softDelete && m.mode == modeAppend:
+		err = m.insert(ctx, exec, table, b, kinds, nil, true)
+	case isDelete:
+		err = m.delete(ctx, exec, table, b, kinds, primaryKey)
+	case m.mode == modeUpsert && len(primaryKey) > 0:
+		err = m.insert(ctx, exec, table, b, kinds, primaryKey, false)
+	default:
+		err = m.insert(ctx, exec, table, b, kinds, nil, false)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write %d records to %s for pipeline %d: %w", len(b.rows), table, record.PipelineID, err)
+	}
+
+	if tx != nil {
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("failed to commit %d records to %s: %w", len(b.rows), table, err)
+		}
+	}
+	return nil
+}
+
+// ensureTable creates the table or brings it in line with the batch, and
+// returns the kind every column's values are written as.
+func (m *MySQL) ensureTable(ctx context.Context, db mysqlExecer, table string, b *batch, primaryKey []string) (map[string]string, error) {
+	existing, err := mysqlColumns(ctx, db, table)
+	if err != nil {
+		return nil, err
+	}
+
+	isKey := make(map[string]bool, len(primaryKey))
+	for _, column := range primaryKey {
+		isKey[column] = true
+	}
+
+	kinds := make(map[string]string, len(b.columns))
+	if len(existing) == 0 {
+		definitions := make([]string, 0, len(b.columns)+3)
+		for _, column := range b.columns {
+			kinds[column] = b.kinds[column]
+			definition := quoteMySQL(column) + " " + mysqlType(b.kinds[column], isKey[column])
+			if isKey[column] {
+				definition += " NOT NULL"
+			}
+			definitions = append(definitions, definition)
+		}
+		definitions = append(definitions, quoteMySQL(syncedAtColumn)+" DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6)")
+		if m.softDelete {
+			definitions = append(definitions, quoteMySQL(deletedAtColumn)+" DATETIME(6) NULL")
+		}
+		if m.mode == modeUpsert && len(primaryKey) > 0 {
+			definitions = append(definitions, "PRIMARY KEY ("+quoteMySQLColumns(primaryKey)+")")
+		}
+		query := fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (%s)", quoteMySQL(table), strings.Join(definitions, ", "))
+		if _, err := db.ExecContext(ctx, query); err != nil {
+			return nil, fmt.Errorf("failed to create table %s: %w", table, err)
+		}
+		return kinds, nil
+	}
+
+	var alterations []string
+	for _, column := range b.columns {
+		kind := b.kinds[column]
+		quoted := quoteMySQL(column)
+
+		currentType, ok := existing[strings.ToLower(column)]
+		if !ok {
+			kinds[column] = kind
+			alterations = append(alterations, fmt.Sprintf("ADD COLUMN %s %s NULL", quoted, mysqlType(kind, false)))
+			continue
+		}
+
+		// Columns of types this destination does not manage, such as
+		// DATETIME columns a user created, are left alone and written as
+		// the batch's kind.
+		currentKind := mysqlKind(currentType)
+		widened := widenKind(currentKind, kind)
+		switch {
+		case currentKind == "":
+			kinds[column] = kind
+			continue
+		case widened == currentKind:
+			kinds[column] = currentKind
+			continue
+		case widened == kindJSON && currentKind == kindString:
+			// MySQL cannot convert text that is not JSON in place, and a
+			// text column holds encoded JSON as it is.
+			kinds[column] = kindString
+			continue
+		}
+		kinds[column] = widened
+		nullability := "NULL"
+		if isKey[column] {
+			nullability = "NOT NULL"
+		}
+		alterations = append(alterations, fmt.Sprintf("MODIFY COLUMN %s %s %s", quoted, mysqlType(widened, isKey[column]), nullability))
+	}
+	if _, ok := existing[syncedAtColumn]; !ok {
+		alterations = append(alterations, fmt.Sprintf("ADD COLUMN %s DATETIME(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6)", quoteMySQL(syncedAtColumn)))
+	}
+	if _, ok := existing[deletedAtColumn]; !ok && m.softDelete {
+		alterations = append(alterations, fmt.Sprintf("ADD COLUMN %s DATETIME(6) NULL", quoteMySQL(deletedAtColumn)))
+	}
+	if len(alterations) > 0 {
+		query := fmt.Sprintf("ALTER TABLE %s %s", quoteMySQL(table), strings.Join(alterations, ", "))
+		if _, err := db.ExecContext(ctx, query); err != nil {
+			return nil, fmt.Errorf("failed to evolve table %s: %w", table, err)
+		}
+	}
+	return kinds, nil
+}
+
+// mysqlColumns returns the table's column types keyed by lowercased name,
+// since MySQL compares column names case-insensitively.
+func mysqlColumns(ctx context.Context, db mysqlExecer, table string) (map[string]string, error) {
+	rows, err := db.QueryContext(ctx, `
+		SELECT column_name, column_type FROM information_schema.columns
+		WHERE table_schema = DATABASE() AND table_name = ?`, table)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read columns of %s: %w", table, err)
+	}
+	defer rows.Close()
+
+	columns := make(map[string]string)
+	for rows.Next() {
+		var name, columnType string
+		if err := rows.Scan(&name, &columnType); err != nil {
+			return nil, fmt.Errorf("failed to read columns of %s: %w", table, err)
+		}
+		columns[strings.ToLower(name)] = strings.ToLower(columnType)
+	}
+	return columns, rows.Err()
+}
+
+// mysqlKind maps a column type back onto a kind. Types without one are not
+// evolved.
+func mysqlKind(columnType string) string {
+	base := columnType
+	if i := strings.IndexAny(base, "( "); i >= 0 {
+		base = base[:i]
+	}
+	switch {
+	case columnType == "tinyint(1)" || base == "boolean":
+		return kindBoolean
+	case base == "tinyint" || base == "smallint" || base == "mediumint" || base == "int" || base == "bigint":
+		return kindInteger
+	case base == "float" || base == "double" || base == "decimal":
+		return kindNumber
+	case base == "char" || base == "varchar" || strings.HasSuffix(base, "text"):
+		return kindString
+	case base == "json":
+		return kindJSON
+	default:
+		return ""
+	}
+}
+
+// mysqlType maps a kind onto a column type. Key columns cannot be TEXT, so
+// string keys use VARCHAR.
+func mysqlType(kind string, key bool) string {
+	switch kind {
+	case kindBoolean:
+		return "BOOLEAN"
+	case kindInteger:
+		return "BIGINT"
+	case kindNumber:
+		return "DOUBLE"
+	case kindJSON:
+		if key {
+			return "VARCHAR(255)"
+		}
+		return "JSON"
+	default:
+		if key {
+			return "VARCHAR(255)"
+		}
+		return "LONGTEXT"
+	}
+}
+
+// insert writes the batch in multi-row INSERTs of at most batch_size rows,
+// upserting on primaryKey when one is given.
+func (m *MySQL) insert(ctx context.Context, exec mysqlExecer, table string, b *batch, kinds map[string]string, primaryKey []string, deleted bool) error {
+	isKey := make(map[string]bool, len(primaryKey))
+	for _, column := range primaryKey {
+		isKey[column] = true
+	}
+
+	targets := make([]string, 0, len(b.columns)+2)
+	var updates []string
+	for _, column := range b.columns {
+		targets = append(targets, quoteMySQL(column))
+		if !isKey[column] {
+			updates = append(updates, fmt.Sprintf("%s = VALUES(%s)", quoteMySQL(column), quoteMySQL(column)))
+		}
+	}
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(b.columns)), ", ")
+	targets = append(targets, quoteMySQL(syncedAtColumn))
+	placeholders += ", CURRENT_TIMESTAMP(6)"
+	updates = append(updates, fmt.Sprintf("%s = VALUES(%s)", quoteMySQL(syncedAtColumn), quoteMySQL(syncedAtColumn)))
+	if m.softDelete {
+		targets = append(targets, quoteMySQL(deletedAtColumn))
+		if deleted {
+			placeholders += ", CURRENT_TIMESTAMP(6)"
+		} else {
+			placeholders += ", NULL"
+		}
+		updates = append(updates, fmt.Sprintf("%s = VALUES(%s)", quoteMySQL(deletedAtColumn), quoteMySQL(deletedAtColumn)))
+	}
+
+	prefix := fmt.Sprintf("INSERT INTO %s (%s) VALUES ", quoteMySQL(table), strings.Join(targets, ", "))
+	var suffix string
+	if len(primaryKey) > 0 {
+		suffix = " ON DUPLICATE KEY UPDATE " + strings.Join(updates, ", ")
+	}
+
+	for _, rows := range m.chunks(b.rows, len(b.columns)) {
+		values := make([]string, len(rows))
+		args := make([]interface{}, 0, len(rows)*len(b.columns))
+		for i, row := range rows {
+			values[i] = "(" + placeholders + ")"
+			for _, column := range b.columns {
+				args = append(args, columnValue(row[column], kinds[column]))
+			}
+		}
+		if _, err := exec.ExecContext(ctx, prefix+strings.Join(values, ", ")+suffix, args...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// delete removes rows by primary key, or marks them with soft_delete set.
+func (m *MySQL) delete(ctx context.Context, exec mysqlExecer, table string, b *batch, kinds map[string]string, primaryKey []string) error {
+	tuple := "(" + strings.TrimSuffix(strings.Repeat("?, ", len(primaryKey)), ", ") + ")"
+	prefix := fmt.Sprintf("DELETE FROM %s WHERE (%s) IN (", quoteMySQL(table), quoteMySQLColumns(primaryKey))
+	if m.softDelete {
+		prefix = fmt.Sprintf("UPDATE %s SET %s = CURRENT_TIMESTAMP(6), %s = CURRENT_TIMESTAMP(6) WHERE (%s) IN (",
+			quoteMySQL(table), quoteMySQL(deletedAtColumn), quoteMySQL(syncedAtColumn), quoteMySQLColumns(primaryKey))
+	}
+
+	for _, rows := range m.chunks(b.dedupe(primaryKey), len(primaryKey)) {
+		tuples := make([]string, len(rows))
+		args := make([]interface{}, 0, len(rows)*len(primaryKey))
+		for i, row := range rows {
+			tuples[i] = tuple
+			for _, column := range primaryKey {
+				args = append(args, columnValue(row[column], kinds[column]))
+			}
+		}
+		if _, err := exec.ExecContext(ctx, prefix+strings.Join(tuples, ", ")+")", args...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// chunks splits rows into statements of at most batch_size rows, fewer when
+// the rows would need more placeholders than MySQL allows.
+func (m *MySQL) chunks(rows []map[string]interface{}, columns int) [][]map[string]interface{} {
+	size := m.batchSize
+	if columns > 0 && size*columns > mysqlMaxPlaceholders {
+		size = mysqlMaxPlaceholders / columns
+	}
+	var chunks [][]map[string]interface{}
+	for start := 0; start < len(rows); start += size {
+		end := start + size
+		if end > len(rows) {
+			end = len(rows)
+		}
+		chunks = append(chunks, rows[start:end])
+	}
+	return chunks
+}
+
+func quoteMySQL(identifier string) string {
+	return "`" + strings.ReplaceAll(identifier, "`", "``") + "`"
+}
+
+func quoteMySQLColumns(columns []string) string {
+	quoted := make([]string, len(columns))
+	for i, column := range columns {
+		quoted[i] = quoteMySQL(column)
+	}
+	return strings.Join(quoted, ", ")
+}
@@ -0,0 +1,37 @@
+package databases
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMySQLKind(t *testing.T) {
+	tests := []struct {
+		columnType string
+		want       string
+	}{
+		{"tinyint(1)", kindBoolean},
+		{"tinyint(4)", kindInteger},
+		{"int(11)", kindInteger},
+		{"bigint unsigned", kindInteger},
+		{"bigint", kindInteger},
+		{"double", kindNumber},
+		{"decimal(10,2)", kindNumber},
+		{"varchar(255)", kindString},
+		{"longtext", kindString},
+		{"json", kindJSON},
+		{"datetime(6)", ""},
+		{"blob", ""},
+	}
+	for _, tt := range tests {
+		if got := mysqlKind(tt.columnType); got != tt.want {
+			t.Errorf("mysqlKind(%q) = %q, want %q", tt.columnType, got, tt.want)
+		}
+		// Columns the destination creates map back onto their own kind.
+		if tt.want != "" {
+			if got := mysqlKind(strings.ToLower(mysqlType(tt.want, false))); got != tt.want {
+				t.Errorf("mysqlKind(mysqlType(%q)) = %q", tt.want, got)
+			}
+		}
+	}
+}
@@ -0,0 +1,453 @@
+package databases
+
+import (
+	"context"
+	"dataforge-be/integrations/connection"
+	database_sources "dataforge-be/integrations/sources/databases"
+	n "dataforge-be/nats"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+const (
+	postgresID = "postgres"
+
+	modeUpsert    = "upsert"
+	modeAppend    = "append"
+	modeOverwrite = "overwrite"
+
+	defaultPostgresSchema = "public"
+	defaultTable          = "{stream}"
+	postgresStageTable    = "_dataforge_stage"
+	postgresRunsTable     = "_dataforge_runs"
+	postgresWriteTimeout  = 5 * time.Minute
+)
+
+// Postgres writes each batch in one transaction: the records are COPYed
+// into a temporary stage table and moved into the target from there.
+//
+//   - upsert (the default) inserts with ON CONFLICT on the primary key
+//   - append inserts every record as a new row
+//   - overwrite truncates the table when the first batch of a new pipeline
+//     run arrives, then upserts, or appends when there is no primary key
+//
+// Tables are created on first write and evolve with the records: new fields
+// add columns, and columns widen when values no longer fit. Deletes remove
+// rows by primary key, or with soft_delete set, stamp _dataforge_deleted_at.
+type Postgres struct {
+	connString string
+	schema     string
+	table      string
+	mode       string
+	softDelete bool
+	primaryKey []string
+}
+
+func (p *Postgres) Initialize(config map[string]interface{}) error {
+	connString, err := database_sources.PostgresConnString(config)
+	if err != nil {
+		return err
+	}
+	p.connString = connString
+
+	p.schema, _ = config["schema"].(string)
+	if p.schema == "" {
+		p.schema = defaultPostgresSchema
+	}
+	p.table, _ = config["table"].(string)
+	if p.table == "" {
+		p.table = defaultTable
+	}
+
+	p.mode, _ = config["mode"].(string)
+	switch p.mode {
+	case "":
+		p.mode = modeUpsert
+	case modeUpsert, modeAppend, modeOverwrite:
+	default:
+		return fmt.Errorf("unsupported postgres mode %q", p.mode)
+	}
+	p.softDelete, _ = config["soft_delete"].(bool)
+	p.primaryKey = connection.StringsFromConfig(config, "primary_key")
+	return nil
+}
+
+func (p *Postgres) DestinationID() string {
+	return postgresID
+}
+
+func (p *Postgres) Run(record n.DestinationRecord) error {
+	if len(record.Records) == 0 {
+		return nil
+	}
+
+	primaryKey := p.primaryKey
+	if len(primaryKey) == 0 {
+		primaryKey = record.PrimaryKey
+	}
+	b, err := decodeBatch(record.Records, primaryKey)
+	if err != nil {
+		return fmt.Errorf("pipeline %d: %w", record.PipelineID, err)
+	}
+	isDelete := record.Operation == n.OperationDelete
+	if isDelete && len(primaryKey) == 0 {
+		log.Printf("Skipping %d deletes for pipeline %d: stream %s has no primary key", len(b.rows), record.PipelineID, record.Stream)
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), postgresWriteTimeout)
+	defer cancel()
+
+	conn, err := pgx.Connect(ctx, p.connString)
+	if err != nil {
+		return fmt.Errorf("failed to connect to postgres: %w", err)
+	}
+	defer conn.Close(ctx)
+
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback(ctx)
+
+	table := pgx.Identifier{p.schema, tableFor(p.table, record.Stream)}
+	types, err := p.ensureTable(ctx, tx, table, b, primaryKey)
+	if err != nil {
+		return err
+	}
+
+	if p.mode == modeOverwrite {
+		current, err := p.startRun(ctx, tx, table, record.Run)
+		if err != nil {
+			return err
+		}
+		if !current {
+			log.Printf("Skipping batch from earlier run %s of pipeline %d", record.Run, record.PipelineID)
+			return nil
+		}
+	}
+
+	rows := b.rows
+	upsert := p.mode != modeAppend && len(primaryKey) > 0
+	if upsert || isDelete {
+		rows = b.dedupe(primaryKey)
+	}
+	if err := p.stage(ctx, tx, b, types, rows); err != nil {
+		return err
+	}
+
+	switch {
+	case isDelete && p.softDelete && p.mode == modeAppend:
+		err = p.insert(ctx, tx, table, b.columns, types, nil, true)
+	case isDelete && p.softDelete:
+		err = p.markDeleted(ctx, tx, table, primaryKey, types)
+	case isDelete:
+		err = p.delete(ctx, tx, table, primaryKey, types)
+	case upsert:
+		err = p.insert(ctx, tx, table, b.columns, types, primaryKey, false)
+	default:
+		err = p.insert(ctx, tx, table, b.columns, types, nil, false)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write %d records to %s for pipeline %d: %w", len(rows), table.Sanitize(), record.PipelineID, err)
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return fmt.Errorf("failed to commit %d records to %s: %w", len(rows), table.Sanitize(), err)
+	}
+	return nil
+}
+
+// ensureTable creates the table or brings it in line with the batch, and
+// returns the type of every column the batch writes to.
+func (p *Postgres) ensureTable(ctx context.Context, tx pgx.Tx, table pgx.Identifier, b *batch, primaryKey []string) (map[string]string, error) {
+	existing, err := postgresColumns(ctx, tx, table)
+	if err != nil {
+		return nil, err
+	}
+
+	types := make(map[string]string, len(b.columns))
+	if len(existing) == 0 {
+		definitions := make([]string, 0, len(b.columns)+3)
+		for _, column := range b.columns {
+			types[column] = postgresType(b.kinds[column])
+			definitions = append(definitions, pgx.Identifier{column}.Sanitize()+" "+types[column])
+		}
+		definitions = append(definitions, pgx.Identifier{syncedAtColumn}.Sanitize()+" timestamptz NOT NULL DEFAULT now()")
+		if p.softDelete {
+			definitions = append(definitions, pgx.Identifier{deletedAtColumn}.Sanitize()+" timestamptz")
+		}
+		if p.mode != modeAppend && len(primaryKey) > 0 {
+			definitions = append(definitions, "PRIMARY KEY ("+quotePostgresColumns(primaryKey)+")")
+		}
+		query := fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (%s)", table.Sanitize(), strings.Join(definitions, ", "))
+		if _, err := tx.Exec(ctx, query); err != nil {
+			return nil, fmt.Errorf("failed to create table %s: %w", table.Sanitize(), err)
+		}
+		return types, nil
+	}
+
+	var alterations []string
+	for _, column := range b.columns {
+		kind := b.kinds[column]
+		quoted := pgx.Identifier{column}.Sanitize()
+
+		currentType, ok := existing[column]
+		if !ok {
+			types[column] = postgresType(kind)
+			alterations = append(alterations, fmt.Sprintf("ADD COLUMN IF NOT EXISTS %s %s", quoted, types[column]))
+			continue
+		}
+
+		// Columns of types this destination does not manage, such as
+		// timestamps a user created, are left alone and cast into.
+		currentKind := postgresKind(currentType)
+		widened := widenKind(currentKind, kind)
+		if currentKind == "" || widened == currentKind {
+			types[column] = currentType
+			continue
+		}
+		types[column] = postgresType(widened)
+		using := fmt.Sprintf("%s::%s", quoted, types[column])
+		if widened == kindJSON {
+			using = fmt.Sprintf("to_jsonb(%s)", quoted)
+		}
+		alterations = append(alterations, fmt.Sprintf("ALTER COLUMN %s TYPE %s USING %s", quoted, types[column], using))
+	}
+	if _, ok := existing[syncedAtColumn]; !ok {
+		alterations = append(alterations, fmt.Sprintf("ADD COLUMN IF NOT EXISTS %s timestamptz NOT NULL DEFAULT now()", pgx.Identifier{syncedAtColumn}.Sanitize()))
+	}
+	if _, ok := existing[deletedAtColumn]; !ok && p.softDelete {
+		alterations = append(alterations, fmt.Sprintf("ADD COLUMN IF NOT EXISTS %s timestamptz", pgx.Identifier{deletedAtColumn}.Sanitize()))
+	}
+
+	if len(alterations) > 0 {
+		query := fmt.Sprintf("ALTER TABLE %s %s", table.Sanitize(), strings.Join(alterations, ", "))
+		if _, err := tx.Exec(ctx, query); err != nil {
+			return nil, fmt.Errorf("failed to evolve table %s: %w", table.Sanitize(), err)
+		}
+	}
+	return types, nil
+}
+
+// postgresColumns returns the table's columns and their types, or nothing
+// if the table does not exist.
+func postgresColumns(ctx context.Context, tx pgx.Tx, table pgx.Identifier) (map[string]string, error) {
+	rows, err := tx.Query(ctx, `
+		SELECT a.attname, format_type(a.atttypid, a.atttypmod)
+		FROM pg_attribute a
+		WHERE a.attrelid = to_regclass($1) AND a.attnum > 0 AND NOT a.attisdropped`,
+		table.Sanitize())
+	if err != nil {
+		return nil, fmt.Errorf("failed to read columns of %s: %w", table.Sanitize(), err)
+	}
+	defer rows.Close()
+
+	columns := make(map[string]string)
+	for rows.Next() {
+		var name, columnType string
+		if err := rows.Scan(&name, &columnType); err != nil {
+			return nil, fmt.Errorf("failed to read columns of %s: %w", table.Sanitize(), err)
+		}
+		columns[name] = columnType
+	}
+	return columns, rows.Err()
+}
+
+func postgresType(kind string) string {
+	switch kind {
+	case kindBoolean:
+		return "boolean"
+	case kindInteger:
+		return "bigint"
+	case kindNumber:
+		return "double precision"
+	case kindJSON:
+		return "jsonb"
+	default:
+		return "text"
+	}
+}
+
+// postgresKind maps a column type back onto a kind. Types without one are
+// not evolved.
+func postgresKind(columnType string) string {
+	switch {
+	case columnType == "boolean":
+		return kindBoolean
+	case columnType == "smallint" || columnType == "integer" || columnType == "bigint":
+		return kindInteger
+	case columnType == "real" || columnType == "double precision" || strings.HasPrefix(columnType, "numeric"):
+		return kindNumber
+	case columnType == "text" || strings.HasPrefix(columnType, "character"):
+		return kindString
+	case columnType == "json" || columnType == "jsonb":
+		return kindJSON
+	default:
+		return ""
+	}
+}
+
+// startRun records run as the one the overwrite table belongs to, emptying
+// the table when run is newer than the last one. It returns false for
+// batches of an earlier run, which must not land in the new contents.
+func (p *Postgres) startRun(ctx context.Context, tx pgx.Tx, table pgx.Identifier, run string) (bool, error) {
+	if run == "" {
+		return false, errors.New("postgres overwrite mode needs batches from a pipeline run")
+	}
+
+	runs := pgx.Identifier{p.schema, postgresRunsTable}.Sanitize()
+	_, err := tx.Exec(ctx, fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (table_name text PRIMARY KEY, run text NOT NULL)", runs))
+	if err != nil {
+		return false, fmt.Errorf("failed to create %s: %w", runs, err)
+	}
+
+	var last string
+	err = tx.QueryRow(ctx, fmt.Sprintf("SELECT run FROM %s WHERE table_name = $1 FOR UPDATE", runs), table.Sanitize()).Scan(&last)
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		return false, fmt.Errorf("failed to read last run of %s: %w", table.Sanitize(), err)
+	}
+	switch {
+	case run == last:
+		return true, nil
+	case olderRun(run, last):
+		return false, nil
+	}
+
+	if _, err := tx.Exec(ctx, "TRUNCATE "+table.Sanitize()); err != nil {
+		return false, fmt.Errorf("failed to truncate %s: %w", table.Sanitize(), err)
+	}
+	_, err = tx.Exec(ctx, fmt.Sprintf(`
+		INSERT INTO %s (table_name, run) VALUES ($1, $2)
+		ON CONFLICT (table_name) DO UPDATE SET run = EXCLUDED.run`, runs),
+		table.Sanitize(), run)
+	if err != nil {
+		return false, fmt.Errorf("failed to record run of %s: %w", table.Sanitize(), err)
+	}
+	return true, nil
+}
+
+// olderRun compares run IDs, which are start times in nanoseconds.
+func olderRun(run, last string) bool {
+	if len(run) != len(last) {
+		return len(run) < len(last)
+	}
+	return run < last
+}
+
+// stage COPYs rows into a temporary table typed by the kinds in
+// stageKinds. It is dropped when the transaction ends.
+func (p *Postgres) stage(ctx context.Context, tx pgx.Tx, b *batch, types map[string]string, rows []map[string]interface{}) error {
+	kinds := stageKinds(b, types)
+	definitions := make([]string, len(b.columns))
+	for i, column := range b.columns {
+		definitions[i] = pgx.Identifier{column}.Sanitize() + " " + postgresType(kinds[column])
+	}
+	query := fmt.Sprintf("CREATE TEMPORARY TABLE %s (%s) ON COMMIT DROP", postgresStageTable, strings.Join(definitions, ", "))
+	if _, err := tx.Exec(ctx, query); err != nil {
+		return fmt.Errorf("failed to create stage table: %w", err)
+	}
+
+	values := make([][]interface{}, len(rows))
+	for i, row := range rows {
+		values[i] = make([]interface{}, len(b.columns))
+		for j, column := range b.columns {
+			values[i][j] = columnValue(row[column], kinds[column])
+		}
+	}
+	_, err := tx.CopyFrom(ctx, pgx.Identifier{postgresStageTable}, b.columns, pgx.CopyFromRows(values))
+	if err != nil {
+		return fmt.Errorf("failed to copy %d records: %w", len(rows), err)
+	}
+	return nil
+}
+
+// stageKinds returns the kind each column is staged as: the batch's kind,
+// except for columns the table holds as JSON. Those are staged as JSON so
+// that scalars arrive encoded, since text or numbers do not cast to jsonb.
+func stageKinds(b *batch, types map[string]string) map[string]string {
+	kinds := make(map[string]string, len(b.columns))
+	for _, column := range b.columns {
+		kinds[column] = b.kinds[column]
+		if postgresKind(types[column]) == kindJSON {
+			kinds[column] = kindJSON
+		}
+	}
+	return kinds
+}
+
+// insert moves the stage into the table, upserting on primaryKey when one is
+// given.
+func (p *Postgres) insert(ctx context.Context, tx pgx.Tx, table pgx.Identifier, columns []string, types map[string]string, primaryKey []string, deleted bool) error {
+	isKey := make(map[string]bool, len(primaryKey))
+	for _, column := range primaryKey {
+		isKey[column] = true
+	}
+
+	var targets, selects, updates []string
+	add := func(column, value string) {
+		quoted := pgx.Identifier{column}.Sanitize()
+		targets = append(targets, quoted)
+		selects = append(selects, value)
+		if !isKey[column] {
+			updates = append(updates, fmt.Sprintf("%s = EXCLUDED.%s", quoted, quoted))
+		}
+	}
+	for _, column := range columns {
+		add(column, fmt.Sprintf("CAST(s.%s AS %s)", pgx.Identifier{column}.Sanitize(), types[column]))
+	}
+	add(syncedAtColumn, "now()")
+	if p.softDelete {
+		if deleted {
+			add(deletedAtColumn, "now()")
+		} else {
+			add(deletedAtColumn, "NULL")
+		}
+	}
+
+	query := fmt.Sprintf("INSERT INTO %s (%s) SELECT %s FROM %s s",
+		table.Sanitize(), strings.Join(targets, ", "), strings.Join(selects, ", "), postgresStageTable)
+	if len(primaryKey) > 0 {
+		query += fmt.Sprintf(" ON CONFLICT (%s) DO UPDATE SET %s", quotePostgresColumns(primaryKey), strings.Join(updates, ", "))
+	}
+	_, err := tx.Exec(ctx, query)
+	return err
+}
+
+func (p *Postgres) delete(ctx context.Context, tx pgx.Tx, table pgx.Identifier, primaryKey []string, types map[string]string) error {
+	query := fmt.Sprintf("DELETE FROM %s t USING %s s WHERE %s",
+		table.Sanitize(), postgresStageTable, keyMatch(primaryKey, types))
+	_, err := tx.Exec(ctx, query)
+	return err
+}
+
+func (p *Postgres) markDeleted(ctx context.Context, tx pgx.Tx, table pgx.Identifier, primaryKey []string, types map[string]string) error {
+	query := fmt.Sprintf("UPDATE %s t SET %s = now(), %s = now() FROM %s s WHERE %s",
+		table.Sanitize(), pgx.Identifier{deletedAtColumn}.Sanitize(), pgx.Identifier{syncedAtColumn}.Sanitize(),
+		postgresStageTable, keyMatch(primaryKey, types))
+	_, err := tx.Exec(ctx, query)
+	return err
+}
+
+// keyMatch joins the table t to the stage s on the primary key.
+func keyMatch(primaryKey []string, types map[string]string) string {
+	conditions := make([]string, len(primaryKey))
+	for i, column := range primaryKey {
+		quoted := pgx.Identifier{column}.Sanitize()
+		conditions[i] = fmt.Sprintf("t.%s = CAST(s.%s AS %s)", quoted, quoted, types[column])
+	}
+	return strings.Join(conditions, " AND ")
+}
+
+func quotePostgresColumns(columns []string) string {
+	quoted := make([]string, len(columns))
+	for i, column := range columns {
+		quoted[i] = pgx.Identifier{column}.Sanitize()
+	}
+	return strings.Join(quoted, ", ")
+}
@@ -0,0 +1,45 @@
+package databases
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestPostgresStagesScalarsForJSONColumns(t *testing.T) {
+	b, err := decodeBatch([][]byte{
+		[]byte(`{"id": 1, "doc": "plain", "count": 2, "tags": {"a": 1}, "seen": "2024-01-01T00:00:00Z"}`),
+		[]byte(`{"id": 2, "doc": 12, "count": 3, "tags": true, "seen": null}`),
+	}, []string{"id"})
+	if err != nil {
+		t.Fatalf("decodeBatch: %v", err)
+	}
+	types := map[string]string{
+		"id":    "bigint",
+		"doc":   "jsonb",
+		"count": "json",
+		"tags":  "jsonb",
+		"seen":  "timestamp with time zone",
+	}
+
+	kinds := stageKinds(b, types)
+	wantKinds := map[string]string{"id": kindInteger, "doc": kindJSON, "count": kindJSON, "tags": kindJSON, "seen": kindString}
+	if !reflect.DeepEqual(kinds, wantKinds) {
+		t.Fatalf("stageKinds = %v, want %v", kinds, wantKinds)
+	}
+
+	// Every value staged for a JSON column has to parse as JSON.
+	want := map[string][]interface{}{
+		"doc":   {`"plain"`, `12`},
+		"count": {`2`, `3`},
+		"tags":  {`{"a":1}`, `true`},
+	}
+	for column, values := range want {
+		for i, row := range b.rows {
+			got := columnValue(row[column], kinds[column])
+			if got != values[i] || !json.Valid([]byte(got.(string))) {
+				t.Errorf("staged %s of row %d = %#v, want %#v", column, i, got, values[i])
+			}
+		}
+	}
+}
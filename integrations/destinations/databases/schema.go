@@ -0,0 +1,193 @@
+// Package databases holds destinations that write records into SQL
+// databases, creating and evolving their tables from the records.
+package databases
+
+import (
+	"bytes"
+	n "dataforge-be/nats"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Column kinds inferred from JSON values. Each destination maps them onto
+// its own column types.
+const (
+	kindBoolean = "boolean"
+	kindInteger = "integer"
+	kindNumber  = "number"
+	kindString  = "string"
+	kindJSON    = "json"
+
+	syncedAtColumn  = "_dataforge_synced_at"
+	deletedAtColumn = "_dataforge_deleted_at"
+)
+
+// batch is a DestinationRecord decoded into rows, with the columns the rows
+// use and the kind each column needs to hold all of its values.
+type batch struct {
+	columns []string
+	kinds   map[string]string
+	rows    []map[string]interface{}
+}
+
+// decodeBatch decodes records and infers their columns. Primary key columns
+// come first, in key order, and the rest are sorted by name.
+func decodeBatch(records [][]byte, primaryKey []string) (*batch, error) {
+	b := &batch{
+		kinds: make(map[string]string),
+		rows:  make([]map[string]interface{}, 0, len(records)),
+	}
+	for _, recordBytes := range records {
+		var row map[string]interface{}
+		decoder := json.NewDecoder(bytes.NewReader(recordBytes))
+		decoder.UseNumber()
+		if err := decoder.Decode(&row); err != nil {
+			return nil, fmt.Errorf("error decoding record: %w", err)
+		}
+		for column, value := range row {
+			b.kinds[column] = widenKind(b.kinds[column], kindOf(value))
+		}
+		b.rows = append(b.rows, row)
+	}
+
+	isKey := make(map[string]bool, len(primaryKey))
+	for _, column := range primaryKey {
+		isKey[column] = true
+		if _, ok := b.kinds[column]; !ok {
+			b.kinds[column] = ""
+		}
+		b.columns = append(b.columns, column)
+	}
+	var rest []string
+	for column, kind := range b.kinds {
+		// A column that was only ever null is stored as a string until a
+		// value says otherwise.
+		if kind == "" {
+			b.kinds[column] = kindString
+		}
+		if !isKey[column] {
+			rest = append(rest, column)
+		}
+	}
+	sort.Strings(rest)
+	b.columns = append(b.columns, rest...)
+	return b, nil
+}
+
+func kindOf(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case bool:
+		return kindBoolean
+	case json.Number:
+		if _, err := v.Int64(); err == nil {
+			return kindInteger
+		}
+		return kindNumber
+	case string:
+		return kindString
+	default:
+		return kindJSON
+	}
+}
+
+// widenKind returns a kind that holds values of both kinds. Integers widen
+// to numbers, anything mixed with nested data becomes JSON, and other mixes
+// fall back to strings.
+func widenKind(a, b string) string {
+	switch {
+	case a == "" || a == b:
+		return b
+	case b == "":
+		return a
+	case (a == kindInteger && b == kindNumber) || (a == kindNumber && b == kindInteger):
+		return kindNumber
+	case a == kindJSON || b == kindJSON:
+		return kindJSON
+	default:
+		return kindString
+	}
+}
+
+// dedupe keeps the last row for each primary key, so one statement never
+// touches the same row twice. Rows without a full key are dropped.
+func (b *batch) dedupe(primaryKey []string) []map[string]interface{} {
+	seen := make(map[string]bool, len(b.rows))
+	deduped := make([]map[string]interface{}, 0, len(b.rows))
+	for i := len(b.rows) - 1; i >= 0; i-- {
+		key, ok := n.PrimaryKeyValue(b.rows[i], primaryKey)
+		if !ok || seen[key] {
+			continue
+		}
+		seen[key] = true
+		deduped = append(deduped, b.rows[i])
+	}
+	for i, j := 0, len(deduped)-1; i < j; i, j = i+1, j-1 {
+		deduped[i], deduped[j] = deduped[j], deduped[i]
+	}
+	return deduped
+}
+
+// columnValue converts a decoded JSON value into the Go value written to a
+// column of the given kind. Nested data is written as JSON text.
+func columnValue(value interface{}, kind string) interface{} {
+	if value == nil {
+		return nil
+	}
+	switch kind {
+	case kindInteger:
+		if number, ok := value.(json.Number); ok {
+			i, _ := number.Int64()
+			return i
+		}
+	case kindNumber:
+		if number, ok := value.(json.Number); ok {
+			f, _ := number.Float64()
+			return f
+		}
+	case kindBoolean:
+		return value
+	case kindString:
+		switch v := value.(type) {
+		case string:
+			return v
+		case json.Number:
+			return v.String()
+		case bool:
+			if v {
+				return "true"
+			}
+			return "false"
+		}
+	}
+	encoded, _ := json.Marshal(value)
+	return string(encoded)
+}
+
+// tableFor fills in a "{stream}" placeholder in the configured table name.
+// Stream names such as "db.users" are reduced to a plain identifier.
+func tableFor(table, stream string) string {
+	if stream == "" {
+		stream = "default"
+	}
+	return strings.ReplaceAll(table, "{stream}", identifierFor(stream))
+}
+
+func identifierFor(name string) string {
+	var b strings.Builder
+	for _, r := range strings.ToLower(name) {
+		if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') || r == '_' {
+			b.WriteRune(r)
+		} else {
+			b.WriteByte('_')
+		}
+	}
+	identifier := b.String()
+	if identifier == "" || (identifier[0] >= '0' && identifier[0] <= '9') {
+		identifier = "_" + identifier
+	}
+	return identifier
+}
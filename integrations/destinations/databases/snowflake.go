@@ -0,0 +1,490 @@
+package databases
+
+import (
+	"bufio"
+	"context"
+	"database/sql"
+	"dataforge-be/integrations/connection"
+	warehouse_sources "dataforge-be/integrations/sources/warehouses"
+	n "dataforge-be/nats"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	sf "github.com/snowflakedb/gosnowflake"
+)
+
+const (
+	snowflakeID = "snowflake"
+
+	defaultSnowflakeSchema        = "PUBLIC"
+	defaultSnowflakeCopyThreshold = 1000
+	snowflakeStageTable           = "DATAFORGE_STAGE"
+	snowflakeWriteTimeout         = 15 * time.Minute
+)
+
+// Snowflake loads each batch into a temporary stage table and moves it into
+// the target from there: with MERGE on the primary key in upsert mode (the
+// default), or a plain INSERT in append mode. Deletes remove rows by key.
+//
+// Batches of at least copy_threshold records are written to a file, PUT to
+// the target's table stage and loaded with COPY INTO; smaller ones go in
+// with a single multi-row INSERT. Tables are created from the records, gain
+// columns as new fields show up and widen columns whose values outgrow them,
+// with nested data in VARIANT columns.
+// Names are upper-cased, the way Snowflake stores unquoted identifiers.
+type Snowflake struct {
+	config        *sf.Config
+	table         string
+	mode          string
+	copyThreshold int
+	primaryKey    []string
+}
+
+func (s *Snowflake) Initialize(config map[string]interface{}) error {
+	cfg, err := warehouse_sources.SnowflakeConfig(config)
+	if err != nil {
+		return fmt.Errorf("invalid snowflake config: %w", err)
+	}
+	if cfg.Database == "" {
+		return errors.New("snowflake destination requires db")
+	}
+	cfg.Schema, _ = config["schema"].(string)
+	if cfg.Schema == "" {
+		cfg.Schema = defaultSnowflakeSchema
+	}
+	s.config = cfg
+
+	s.table, _ = config["table"].(string)
+	if s.table == "" {
+		s.table = defaultTable
+	}
+	s.mode, _ = config["mode"].(string)
+	switch s.mode {
+	case "":
+		s.mode = modeUpsert
+	case modeUpsert, modeAppend:
+	default:
+		return fmt.Errorf("unsupported snowflake mode %q", s.mode)
+	}
+
+	s.copyThreshold = defaultSnowflakeCopyThreshold
+	if threshold, ok := config["copy_threshold"].(float64); ok && threshold > 0 {
+		s.copyThreshold = int(threshold)
+	}
+	s.primaryKey = connection.StringsFromConfig(config, "primary_key")
+	return nil
+}
+
+func (s *Snowflake) DestinationID() string {
+	return snowflakeID
+}
+
+func (s *Snowflake) Run(record n.DestinationRecord) error {
+	if len(record.Records) == 0 {
+		return nil
+	}
+
+	primaryKey := s.primaryKey
+	if len(primaryKey) == 0 {
+		primaryKey = record.PrimaryKey
+	}
+	b, err := decodeBatch(record.Records, primaryKey)
+	if err != nil {
+		return fmt.Errorf("pipeline %d: %w", record.PipelineID, err)
+	}
+	isDelete := record.Operation == n.OperationDelete
+	if isDelete && len(primaryKey) == 0 {
+		log.Printf("Skipping %d deletes for pipeline %d: stream %s has no primary key", len(b.rows), record.PipelineID, record.Stream)
+		return nil
+	}
+	upsert := s.mode == modeUpsert && len(primaryKey) > 0
+	rows := b.rows
+	if upsert || isDelete {
+		// MERGE fails when several stage rows match the same target row.
+		rows = b.dedupe(primaryKey)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), snowflakeWriteTimeout)
+	defer cancel()
+
+	db := sql.OpenDB(sf.NewConnector(sf.SnowflakeDriver{}, *s.config))
+	defer db.Close()
+	// The stage table is temporary, so everything runs in one session.
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to connect to snowflake: %w", err)
+	}
+	defer conn.Close()
+
+	table := strings.ToUpper(tableFor(s.table, record.Stream))
+	kinds, err := s.ensureTable(ctx, conn, table, b, primaryKey)
+	if err != nil {
+		return err
+	}
+	if err := s.stage(ctx, conn, table, b, kinds, rows, record.PipelineID); err != nil {
+		return fmt.Errorf("failed to stage %d records for %s: %w", len(rows), table, err)
+	}
+
+	var query string
+	switch {
+	case isDelete:
+		query = fmt.Sprintf("DELETE FROM %s t USING %s s WHERE %s",
+			quoteSnowflake(table), quoteSnowflake(snowflakeStageTable), snowflakeKeyMatch(primaryKey))
+	case upsert:
+		query = s.mergeQuery(table, b.columns, primaryKey)
+	default:
+		columns := quoteSnowflakeColumns(b.columns)
+		query = fmt.Sprintf("INSERT INTO %s (%s, %s) SELECT %s, CURRENT_TIMESTAMP() FROM %s",
+			quoteSnowflake(table), columns, quoteSnowflake(strings.ToUpper(syncedAtColumn)), columns, quoteSnowflake(snowflakeStageTable))
+	}
+	if _, err := conn.ExecContext(ctx, query); err != nil {
+		return fmt.Errorf("failed to write %d records to %s for pipeline %d: %w", len(rows), table, record.PipelineID, err)
+	}
+	return nil
+}
+
+// ensureTable creates the table or brings it in line with the batch, and
+// returns the kind each of the batch's columns is written as.
+func (s *Snowflake) ensureTable(ctx context.Context, conn *sql.Conn, table string, b *batch, primaryKey []string) (map[string]string, error) {
+	existing, err := snowflakeColumns(ctx, conn, table)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(existing) == 0 {
+		definitions := make([]string, 0, len(b.columns)+2)
+		for _, column := range b.columns {
+			definitions = append(definitions, quoteSnowflake(strings.ToUpper(column))+" "+snowflakeType(b.kinds[column]))
+		}
+		definitions = append(definitions, quoteSnowflake(strings.ToUpper(syncedAtColumn))+" TIMESTAMP_TZ DEFAULT CURRENT_TIMESTAMP()")
+		if s.mode == modeUpsert && len(primaryKey) > 0 {
+			definitions = append(definitions, "PRIMARY KEY ("+quoteSnowflakeColumns(primaryKey)+")")
+		}
+		query := fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (%s)", quoteSnowflake(table), strings.Join(definitions, ", "))
+		if _, err := conn.ExecContext(ctx, query); err != nil {
+			return nil, fmt.Errorf("failed to create table %s: %w", table, err)
+		}
+		return b.kinds, nil
+	}
+
+	statements, kinds := snowflakeAlterations(table, existing, b, primaryKey)
+	for _, statement := range statements {
+		if _, err := conn.ExecContext(ctx, statement); err != nil {
+			return nil, fmt.Errorf("failed to evolve table %s: %w", table, err)
+		}
+	}
+	return kinds, nil
+}
+
+// snowflakeColumns returns the kind of each of the table's columns keyed by
+// name, or nothing if the table does not exist. Columns of types without a
+// kind map to "".
+func snowflakeColumns(ctx context.Context, conn *sql.Conn, table string) (map[string]string, error) {
+	rows, err := conn.QueryContext(ctx, `
+		SELECT column_name, data_type, numeric_scale FROM information_schema.columns
+		WHERE table_schema = CURRENT_SCHEMA() AND table_name = ?`, table)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read columns of %s: %w", table, err)
+	}
+	defer rows.Close()
+
+	columns := make(map[string]string)
+	for rows.Next() {
+		var name, dataType string
+		var scale sql.NullInt64
+		if err := rows.Scan(&name, &dataType, &scale); err != nil {
+			return nil, fmt.Errorf("failed to read columns of %s: %w", table, err)
+		}
+		columns[name] = snowflakeKind(dataType, scale.Int64)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read columns of %s: %w", table, err)
+	}
+	return columns, nil
+}
+
+// snowflakeKind maps a data type, as information_schema reports it, back onto
+// a kind. Types without one are not evolved.
+func snowflakeKind(dataType string, scale int64) string {
+	switch strings.ToUpper(dataType) {
+	case "BOOLEAN":
+		return kindBoolean
+	case "NUMBER":
+		if scale == 0 {
+			return kindInteger
+		}
+		return kindNumber
+	case "FLOAT":
+		return kindNumber
+	case "TEXT":
+		return kindString
+	case "VARIANT", "OBJECT", "ARRAY":
+		return kindJSON
+	default:
+		return ""
+	}
+}
+
+// snowflakeWidenSuffix names the column a widened column is rebuilt in.
+const snowflakeWidenSuffix = "__DATAFORGE_WIDEN"
+
+// snowflakeAlterations returns the statements that add the batch's missing
+// columns to table and widen the ones whose kind no longer fits, and the
+// kind each of the batch's columns is written as.
+//
+// Snowflake only changes a column's type in place to a longer VARCHAR or a
+// more precise NUMBER, so a widened column is rebuilt: a column of the new
+// type is added, filled from the old one, and takes its place. A rebuild
+// that was interrupted is finished, or thrown away and redone, first. Key
+// columns are not rebuilt; they keep their type and are cast into.
+func snowflakeAlterations(table string, existing map[string]string, b *batch, primaryKey []string) ([]string, map[string]string) {
+	quotedTable := quoteSnowflake(table)
+	isKey := make(map[string]bool, len(primaryKey))
+	for _, column := range primaryKey {
+		isKey[column] = true
+	}
+
+	var statements []string
+	current := make(map[string]string, len(existing))
+	for name, kind := range existing {
+		if !strings.HasSuffix(name, snowflakeWidenSuffix) {
+			current[name] = kind
+		}
+	}
+	for name, kind := range existing {
+		original, ok := strings.CutSuffix(name, snowflakeWidenSuffix)
+		if !ok {
+			continue
+		}
+		if _, ok := existing[original]; ok {
+			statements = append(statements, fmt.Sprintf("ALTER TABLE %s DROP COLUMN %s", quotedTable, quoteSnowflake(name)))
+			continue
+		}
+		statements = append(statements, fmt.Sprintf("ALTER TABLE %s RENAME COLUMN %s TO %s", quotedTable, quoteSnowflake(name), quoteSnowflake(original)))
+		current[original] = kind
+	}
+	// Map iteration order is random; keep the statements stable.
+	sort.Strings(statements)
+
+	kinds := make(map[string]string, len(b.columns))
+	var additions []string
+	for _, column := range b.columns {
+		kind := b.kinds[column]
+		name := strings.ToUpper(column)
+
+		currentKind, ok := current[name]
+		if !ok {
+			kinds[column] = kind
+			additions = append(additions, quoteSnowflake(name)+" "+snowflakeType(kind))
+			continue
+		}
+
+		// Columns of types this destination does not manage, such as
+		// timestamps a user created, are left alone and cast into.
+		widened := widenKind(currentKind, kind)
+		switch {
+		case currentKind == "":
+			kinds[column] = kind
+			continue
+		case widened == currentKind || isKey[column]:
+			kinds[column] = currentKind
+			continue
+		case widened == kindJSON && currentKind == kindString:
+			// A VARCHAR column holds encoded JSON as it is.
+			kinds[column] = kindString
+			continue
+		}
+		kinds[column] = widened
+
+		quoted := quoteSnowflake(name)
+		rebuilt := quoteSnowflake(name + snowflakeWidenSuffix)
+		statements = append(statements,
+			fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", quotedTable, rebuilt, snowflakeType(widened)),
+			fmt.Sprintf("UPDATE %s SET %s = %s", quotedTable, rebuilt, snowflakeCast(quoted, widened)),
+			fmt.Sprintf("ALTER TABLE %s DROP COLUMN %s", quotedTable, quoted),
+			fmt.Sprintf("ALTER TABLE %s RENAME COLUMN %s TO %s", quotedTable, rebuilt, quoted),
+		)
+	}
+	syncedAt := strings.ToUpper(syncedAtColumn)
+	if _, ok := current[syncedAt]; !ok {
+		additions = append(additions, quoteSnowflake(syncedAt)+" TIMESTAMP_TZ")
+	}
+	if len(additions) > 0 {
+		statements = append(statements, fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s", quotedTable, strings.Join(additions, ", ")))
+	}
+	return statements, kinds
+}
+
+// snowflakeCast converts a column's values to a kind.
+func snowflakeCast(column, kind string) string {
+	switch kind {
+	case kindJSON:
+		return fmt.Sprintf("TO_VARIANT(%s)", column)
+	case kindNumber:
+		return column + "::FLOAT"
+	default:
+		return fmt.Sprintf("TO_VARCHAR(%s)", column)
+	}
+}
+
+func snowflakeType(kind string) string {
+	switch kind {
+	case kindBoolean:
+		return "BOOLEAN"
+	case kindInteger:
+		return "NUMBER(38, 0)"
+	case kindNumber:
+		return "FLOAT"
+	case kindJSON:
+		return "VARIANT"
+	default:
+		return "VARCHAR"
+	}
+}
+
+// stage fills a temporary table, typed like the target's columns, with rows.
+func (s *Snowflake) stage(ctx context.Context, conn *sql.Conn, table string, b *batch, kinds map[string]string, rows []map[string]interface{}, pipelineID int64) error {
+	definitions := make([]string, len(b.columns))
+	for i, column := range b.columns {
+		definitions[i] = quoteSnowflake(strings.ToUpper(column)) + " " + snowflakeType(kinds[column])
+	}
+	query := fmt.Sprintf("CREATE OR REPLACE TEMPORARY TABLE %s (%s)", quoteSnowflake(snowflakeStageTable), strings.Join(definitions, ", "))
+	if _, err := conn.ExecContext(ctx, query); err != nil {
+		return err
+	}
+
+	if len(rows) >= s.copyThreshold {
+		return s.copyRows(ctx, conn, table, rows, pipelineID)
+	}
+	return s.insertRows(ctx, conn, b, kinds, rows)
+}
+
+// insertRows binds the rows as one JSON array and inserts them in a single
+// statement.
+func (s *Snowflake) insertRows(ctx context.Context, conn *sql.Conn, b *batch, kinds map[string]string, rows []map[string]interface{}) error {
+	data, err := json.Marshal(rows)
+	if err != nil {
+		return fmt.Errorf("failed to encode records: %w", err)
+	}
+
+	selects := make([]string, len(b.columns))
+	for i, column := range b.columns {
+		selects[i] = snowflakeExtract("f.value", column, kinds[column])
+	}
+	query := fmt.Sprintf("INSERT INTO %s (%s) SELECT %s FROM TABLE(FLATTEN(INPUT => PARSE_JSON(?))) f",
+		quoteSnowflake(snowflakeStageTable), quoteSnowflakeColumns(b.columns), strings.Join(selects, ", "))
+	_, err = conn.ExecContext(ctx, query, string(data))
+	return err
+}
+
+// snowflakeExtract reads a field out of a VARIANT holding a record.
+func snowflakeExtract(variant, field, kind string) string {
+	path := fmt.Sprintf(`%s['%s']`, variant, strings.ReplaceAll(field, "'", "''"))
+	switch kind {
+	case kindJSON:
+		return path
+	case kindBoolean:
+		return path + "::BOOLEAN"
+	case kindInteger:
+		return path + "::NUMBER(38, 0)"
+	case kindNumber:
+		return path + "::FLOAT"
+	default:
+		return path + "::VARCHAR"
+	}
+}
+
+// copyRows writes the rows to an NDJSON file, PUTs it to the target's table
+// stage and COPYs it into the stage table. PURGE removes the staged file once
+// it has loaded.
+func (s *Snowflake) copyRows(ctx context.Context, conn *sql.Conn, table string, rows []map[string]interface{}, pipelineID int64) error {
+	file, err := os.CreateTemp("", "dataforge-snowflake-*.json")
+	if err != nil {
+		return fmt.Errorf("failed to create load file: %w", err)
+	}
+	defer os.Remove(file.Name())
+
+	writer := bufio.NewWriter(file)
+	encoder := json.NewEncoder(writer)
+	for _, row := range rows {
+		if err := encoder.Encode(row); err != nil {
+			file.Close()
+			return fmt.Errorf("failed to write load file: %w", err)
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to write load file: %w", err)
+	}
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("failed to write load file: %w", err)
+	}
+
+	location := fmt.Sprintf("@%%%s/dataforge/%d/%d", quoteSnowflake(table), pipelineID, time.Now().UnixNano())
+	put := fmt.Sprintf("PUT 'file://%s' '%s' AUTO_COMPRESS = TRUE", filepath.ToSlash(file.Name()), location)
+	if _, err := conn.ExecContext(ctx, put); err != nil {
+		return fmt.Errorf("failed to put load file: %w", err)
+	}
+
+	copyInto := fmt.Sprintf(`COPY INTO %s FROM '%s'
+		FILE_FORMAT = (TYPE = JSON)
+		MATCH_BY_COLUMN_NAME = CASE_INSENSITIVE
+		PURGE = TRUE`, quoteSnowflake(snowflakeStageTable), location)
+	if _, err := conn.ExecContext(ctx, copyInto); err != nil {
+		return fmt.Errorf("failed to copy load file: %w", err)
+	}
+	return nil
+}
+
+func (s *Snowflake) mergeQuery(table string, columns, primaryKey []string) string {
+	isKey := make(map[string]bool, len(primaryKey))
+	for _, column := range primaryKey {
+		isKey[column] = true
+	}
+
+	syncedAt := quoteSnowflake(strings.ToUpper(syncedAtColumn))
+	var updates, values []string
+	for _, column := range columns {
+		quoted := quoteSnowflake(strings.ToUpper(column))
+		values = append(values, "s."+quoted)
+		if !isKey[column] {
+			updates = append(updates, fmt.Sprintf("%s = s.%s", quoted, quoted))
+		}
+	}
+	updates = append(updates, fmt.Sprintf("%s = CURRENT_TIMESTAMP()", syncedAt))
+
+	return fmt.Sprintf(`MERGE INTO %s t USING %s s ON %s
+		WHEN MATCHED THEN UPDATE SET %s
+		WHEN NOT MATCHED THEN INSERT (%s, %s) VALUES (%s, CURRENT_TIMESTAMP())`,
+		quoteSnowflake(table), quoteSnowflake(snowflakeStageTable), snowflakeKeyMatch(primaryKey),
+		strings.Join(updates, ", "),
+		quoteSnowflakeColumns(columns), syncedAt, strings.Join(values, ", "))
+}
+
+func snowflakeKeyMatch(primaryKey []string) string {
+	conditions := make([]string, len(primaryKey))
+	for i, column := range primaryKey {
+		quoted := quoteSnowflake(strings.ToUpper(column))
+		conditions[i] = fmt.Sprintf("t.%s = s.%s", quoted, quoted)
+	}
+	return strings.Join(conditions, " AND ")
+}
+
+func quoteSnowflake(identifier string) string {
+	return `"` + strings.ReplaceAll(identifier, `"`, `""`) + `"`
+}
+
+func quoteSnowflakeColumns(columns []string) string {
+	quoted := make([]string, len(columns))
+	for i, column := range columns {
+		quoted[i] = quoteSnowflake(strings.ToUpper(column))
+	}
+	return strings.Join(quoted, ", ")
+}
@@ -0,0 +1,147 @@
+package databases
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSnowflakeMergeQuery(t *testing.T) {
+	s := &Snowflake{}
+	got := strings.Join(strings.Fields(s.mergeQuery("USERS", []string{"id", "org", "name"}, []string{"id", "org"})), " ")
+	want := `MERGE INTO "USERS" t USING "DATAFORGE_STAGE" s ON t."ID" = s."ID" AND t."ORG" = s."ORG" ` +
+		`WHEN MATCHED THEN UPDATE SET "NAME" = s."NAME", "_DATAFORGE_SYNCED_AT" = CURRENT_TIMESTAMP() ` +
+		`WHEN NOT MATCHED THEN INSERT ("ID", "ORG", "NAME", "_DATAFORGE_SYNCED_AT") VALUES (s."ID", s."ORG", s."NAME", CURRENT_TIMESTAMP())`
+	if got != want {
+		t.Errorf("mergeQuery =\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestSnowflakeExtract(t *testing.T) {
+	tests := []struct {
+		field string
+		kind  string
+		want  string
+	}{
+		{"active", kindBoolean, `f.value['active']::BOOLEAN`},
+		{"id", kindInteger, `f.value['id']::NUMBER(38, 0)`},
+		{"score", kindNumber, `f.value['score']::FLOAT`},
+		{"name", kindString, `f.value['name']::VARCHAR`},
+		{"tags", kindJSON, `f.value['tags']`},
+		{"it's", kindString, `f.value['it''s']::VARCHAR`},
+	}
+	for _, tt := range tests {
+		if got := snowflakeExtract("f.value", tt.field, tt.kind); got != tt.want {
+			t.Errorf("snowflakeExtract(%q, %q) = %s, want %s", tt.field, tt.kind, got, tt.want)
+		}
+	}
+}
+
+func TestSnowflakeKind(t *testing.T) {
+	tests := []struct {
+		dataType string
+		scale    int64
+		want     string
+	}{
+		{"BOOLEAN", 0, kindBoolean},
+		{"NUMBER", 0, kindInteger},
+		{"NUMBER", 2, kindNumber},
+		{"FLOAT", 0, kindNumber},
+		{"TEXT", 0, kindString},
+		{"VARIANT", 0, kindJSON},
+		{"OBJECT", 0, kindJSON},
+		{"TIMESTAMP_TZ", 0, ""},
+	}
+	for _, tt := range tests {
+		if got := snowflakeKind(tt.dataType, tt.scale); got != tt.want {
+			t.Errorf("snowflakeKind(%q, %d) = %q, want %q", tt.dataType, tt.scale, got, tt.want)
+		}
+	}
+}
+
+func TestSnowflakeAlterations(t *testing.T) {
+	b, err := decodeBatch([][]byte{
+		[]byte(`{"id": 1.5, "count": 2.5, "flag": "yes", "doc": {"a": 1}, "note": {"b": 2}, "seen": "2024-01-01", "name": "ada", "extra": 1}`),
+	}, []string{"id"})
+	if err != nil {
+		t.Fatalf("decodeBatch: %v", err)
+	}
+	existing := map[string]string{
+		"ID":                   kindInteger,
+		"COUNT":                kindInteger,
+		"FLAG":                 kindBoolean,
+		"DOC":                  kindString,
+		"NOTE":                 kindInteger,
+		"SEEN":                 "",
+		"NAME":                 kindString,
+		"_DATAFORGE_SYNCED_AT": "",
+	}
+
+	statements, kinds := snowflakeAlterations("USERS", existing, b, []string{"id"})
+	want := []string{
+		`ALTER TABLE "USERS" ADD COLUMN "COUNT__DATAFORGE_WIDEN" FLOAT`,
+		`UPDATE "USERS" SET "COUNT__DATAFORGE_WIDEN" = "COUNT"::FLOAT`,
+		`ALTER TABLE "USERS" DROP COLUMN "COUNT"`,
+		`ALTER TABLE "USERS" RENAME COLUMN "COUNT__DATAFORGE_WIDEN" TO "COUNT"`,
+		`ALTER TABLE "USERS" ADD COLUMN "FLAG__DATAFORGE_WIDEN" VARCHAR`,
+		`UPDATE "USERS" SET "FLAG__DATAFORGE_WIDEN" = TO_VARCHAR("FLAG")`,
+		`ALTER TABLE "USERS" DROP COLUMN "FLAG"`,
+		`ALTER TABLE "USERS" RENAME COLUMN "FLAG__DATAFORGE_WIDEN" TO "FLAG"`,
+		`ALTER TABLE "USERS" ADD COLUMN "NOTE__DATAFORGE_WIDEN" VARIANT`,
+		`UPDATE "USERS" SET "NOTE__DATAFORGE_WIDEN" = TO_VARIANT("NOTE")`,
+		`ALTER TABLE "USERS" DROP COLUMN "NOTE"`,
+		`ALTER TABLE "USERS" RENAME COLUMN "NOTE__DATAFORGE_WIDEN" TO "NOTE"`,
+		`ALTER TABLE "USERS" ADD COLUMN "EXTRA" NUMBER(38, 0)`,
+	}
+	if !reflect.DeepEqual(statements, want) {
+		t.Errorf("statements =\n%s\nwant\n%s", strings.Join(statements, "\n"), strings.Join(want, "\n"))
+	}
+
+	wantKinds := map[string]string{
+		// Key columns keep their type.
+		"id":    kindInteger,
+		"count": kindNumber,
+		"flag":  kindString,
+		// A VARCHAR column holds encoded JSON as it is.
+		"doc":  kindString,
+		"note": kindJSON,
+		// Columns the destination does not manage are written as the batch's kind.
+		"seen":  kindString,
+		"name":  kindString,
+		"extra": kindInteger,
+	}
+	if !reflect.DeepEqual(kinds, wantKinds) {
+		t.Errorf("kinds = %v, want %v", kinds, wantKinds)
+	}
+}
+
+func TestSnowflakeAlterationsFinishInterruptedRebuilds(t *testing.T) {
+	b, err := decodeBatch([][]byte{[]byte(`{"count": 2.5, "score": 1.5}`)}, nil)
+	if err != nil {
+		t.Fatalf("decodeBatch: %v", err)
+	}
+	existing := map[string]string{
+		// Dropped but not yet renamed: the rebuilt column takes its place.
+		"COUNT__DATAFORGE_WIDEN": kindNumber,
+		// Added but perhaps not filled: the rebuild starts over.
+		"SCORE":                  kindInteger,
+		"SCORE__DATAFORGE_WIDEN": kindNumber,
+		"_DATAFORGE_SYNCED_AT":   "",
+	}
+
+	statements, kinds := snowflakeAlterations("USERS", existing, b, nil)
+	want := []string{
+		`ALTER TABLE "USERS" DROP COLUMN "SCORE__DATAFORGE_WIDEN"`,
+		`ALTER TABLE "USERS" RENAME COLUMN "COUNT__DATAFORGE_WIDEN" TO "COUNT"`,
+		`ALTER TABLE "USERS" ADD COLUMN "SCORE__DATAFORGE_WIDEN" FLOAT`,
+		`UPDATE "USERS" SET "SCORE__DATAFORGE_WIDEN" = "SCORE"::FLOAT`,
+		`ALTER TABLE "USERS" DROP COLUMN "SCORE"`,
+		`ALTER TABLE "USERS" RENAME COLUMN "SCORE__DATAFORGE_WIDEN" TO "SCORE"`,
+	}
+	if !reflect.DeepEqual(statements, want) {
+		t.Errorf("statements =\n%s\nwant\n%s", strings.Join(statements, "\n"), strings.Join(want, "\n"))
+	}
+	if want := map[string]string{"count": kindNumber, "score": kindNumber}; !reflect.DeepEqual(kinds, want) {
+		t.Errorf("kinds = %v, want %v", kinds, want)
+	}
+}
@@ -7,47 +7,143 @@ import (
 	"dataforge-be/nats"
 
 	"encoding/json"
+	"errors"
 	"fmt"
+	"log"
 	"strconv"
 
 	"github.com/nats-io/nats.go/jetstream"
 )
 
-func HandleSendingToDestination(recordsToSendToDestination []byte, db *db.DB, kv jetstream.KeyValue) error {
+// HandleSendingToDestination writes one OUTPUT message to its pipeline's
+// destination. delivery tells a failure that will be retried from one that
+// is final, so a snapshot or run is only abandoned once its batch is given
+// up on.
+func HandleSendingToDestination(recordsToSendToDestination []byte, delivery nats.Delivery, db *db.DB, kv jetstream.KeyValue, js jetstream.JetStream) error {
 	var destinationRecord nats.DestinationRecord
 	err := json.Unmarshal(recordsToSendToDestination, &destinationRecord)
 	if err != nil {
 		return err
 	}
-	val, err := kv.Get(context.Background(), fmt.Sprintf("%s-destination", strconv.FormatInt(destinationRecord.PipelineID, 10)))
+
+	if destinationRecord.Commit {
+		return nats.CommitSnapshot(context.Background(), js, destinationRecord.PipelineID, destinationRecord.Snapshot, delivery)
+	}
+
+	if destinationRecord.Abandoned {
+		return nats.ClearRunDelivery(context.Background(), js, destinationRecord.PipelineID, destinationRecord.Run)
+	}
+
+	destinationToRun, destinationID, err := loadDestination(destinationRecord.PipelineID, db, kv)
+	if destinationRecord.Complete {
+		if err != nil {
+			return err
+		}
+		return completeRun(context.Background(), js, destinationRecord, delivery, destinationToRun, destinationID)
+	}
+
+	if err == nil {
+		err = sendToDestination(destinationRecord, destinationToRun, destinationID)
+	}
+	if destinationRecord.Snapshot != "" {
+		run := nats.SnapshotDeliveryRun(destinationRecord.Snapshot)
+		recordErr := nats.RecordDelivery(context.Background(), js, destinationRecord.PipelineID, run, delivery, err)
+		if recordErr != nil {
+			log.Printf("Failed to record delivery for snapshot %s: %v", destinationRecord.Snapshot, recordErr)
+		}
+	}
+	// Runs are only tracked for destinations that act on their completion.
+	if _, ok := destinationToRun.(integrations.RunCompleter); ok && destinationRecord.Run != "" {
+		recordErr := nats.RecordDelivery(context.Background(), js, destinationRecord.PipelineID, destinationRecord.Run, delivery, err)
+		if recordErr != nil {
+			log.Printf("Failed to record delivery for run %s: %v", destinationRecord.Run, recordErr)
+		}
+	}
+	return err
+}
+
+// completeRun hands a finished run to destinations that act on it, such as
+// by swapping in a rebuilt index, once every batch of the run is written.
+// A run with a batch that failed for good is not completed, and one whose
+// batches are awaiting redelivery is retried after them. Whatever was
+// tracked for the run is cleared, whichever the destination.
+func completeRun(ctx context.Context, js jetstream.JetStream, destinationRecord nats.DestinationRecord, delivery nats.Delivery, destinationToRun integrations.Destination, destinationID int64) error {
+	pipelineID, run := destinationRecord.PipelineID, destinationRecord.Run
+	if run == "" {
+		return nil
+	}
+	completer, ok := destinationToRun.(integrations.RunCompleter)
+	if !ok {
+		return nats.ClearRunDelivery(ctx, js, pipelineID, run)
+	}
+
+	err := nats.CheckRunDelivered(ctx, js, pipelineID, run, delivery)
+	switch {
+	case errors.Is(err, nats.ErrRunFailed):
+		log.Printf("Not completing run %s for pipeline %d: %v", run, pipelineID, err)
+		return nats.ClearRunDelivery(ctx, js, pipelineID, run)
+	case err != nil:
+		return err
+	}
+
+	err = completer.CompleteRun(ctx, pipelineID, run)
+	if err != nil {
+		return fmt.Errorf("failed to complete run %s on destination %d: %w", run, destinationID, err)
+	}
+	return nats.ClearRunDelivery(ctx, js, pipelineID, run)
+}
+
+func sendToDestination(destinationRecord nats.DestinationRecord, destinationToRun integrations.Destination, destinationID int64) error {
+	err := destinationToRun.Run(destinationRecord)
 	if err != nil {
-		return fmt.Errorf("failed to get value from KV store: %v", err)
+		return fmt.Errorf("failed to send records to destination %d: %w", destinationID, err)
+	}
+
+	if flusher, ok := destinationToRun.(integrations.Flusher); ok {
+		err = flusher.Flush(context.Background())
+		if err != nil {
+			return fmt.Errorf("failed to flush destination %d: %w", destinationID, err)
+		}
+	}
+
+	return nil
+}
+
+// loadDestination returns the pipeline's destination, initialized from its
+// stored config.
+func loadDestination(pipelineID int64, db *db.DB, kv jetstream.KeyValue) (integrations.Destination, int64, error) {
+	val, err := kv.Get(context.Background(), fmt.Sprintf("%s-destination", strconv.FormatInt(pipelineID, 10)))
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to get value from KV store: %v", err)
 	}
 
 	valueString := string(val.Value())
 
 	intValue, err := strconv.ParseInt(valueString, 10, 64)
 	if err != nil {
-		return fmt.Errorf("failed to parse value from KV store: %v", err)
+		return nil, 0, fmt.Errorf("failed to parse value from KV store: %v", err)
 	}
 
 	destination, err := db.GetDestinationById(context.Background(), intValue)
 	if err != nil {
-		return err
+		return nil, 0, err
 	}
 
 	destinations := integrations.FetchDestinations()
-	destinationToRun := destinations[destination.DestinationType]
+	destinationToRun, ok := destinations[destination.DestinationType]
+	if !ok {
+		return nil, 0, fmt.Errorf("unknown destination type: %s", destination.DestinationType)
+	}
 
 	var destConfig map[string]interface{}
 	err = json.Unmarshal(destination.Config, &destConfig)
 	if err != nil {
-		return err
+		return nil, 0, err
 	}
 
-	destinationToRun.Initialize(destConfig)
-
-	destinationToRun.Run(destinationRecord)
-
-	return nil
+	err = destinationToRun.Initialize(destConfig)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to initialize destination %d: %w", destination.ID, err)
+	}
+	return destinationToRun, destination.ID, nil
 }
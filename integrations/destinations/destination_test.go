@@ -0,0 +1,164 @@
+package destinations
+
+import (
+	"context"
+	"dataforge-be/nats"
+	"dataforge-be/nats/natstest"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// completer records the runs it is asked to complete.
+type completer struct {
+	completed []string
+}
+
+func (c *completer) Initialize(config map[string]interface{}) error { return nil }
+func (c *completer) DestinationID() string                          { return "completer" }
+func (c *completer) Run(d nats.DestinationRecord) error             { return nil }
+
+func (c *completer) CompleteRun(ctx context.Context, pipelineID int64, run string) error {
+	c.completed = append(c.completed, run)
+	return nil
+}
+
+// batchDelivery is the outcome of one attempt at delivering a batch.
+type batchDelivery struct {
+	delivery nats.Delivery
+	err      error
+}
+
+func TestCompleteRunWaitsForBatches(t *testing.T) {
+	const pipelineID = 3
+	failure := errors.New("bulk write failed")
+	marker := nats.DestinationRecord{PipelineID: pipelineID, Run: "42", Complete: true}
+
+	tests := []struct {
+		name string
+		// batches are delivered before the run's Complete marker.
+		batches       []batchDelivery
+		marker        nats.Delivery
+		wantErr       error
+		wantCompleted []string
+	}{
+		{
+			name: "every batch written",
+			batches: []batchDelivery{
+				{nats.Delivery{Sequence: 1, NumDelivered: 1}, nil},
+				{nats.Delivery{Sequence: 2, NumDelivered: 1}, failure},
+				{nats.Delivery{Sequence: 2, NumDelivered: 2}, nil},
+			},
+			marker:        nats.Delivery{Sequence: 3, NumDelivered: 1},
+			wantCompleted: []string{"42"},
+		},
+		{
+			name: "batch awaiting redelivery",
+			batches: []batchDelivery{
+				{nats.Delivery{Sequence: 1, NumDelivered: 1}, failure},
+			},
+			marker:  nats.Delivery{Sequence: 2, NumDelivered: 1},
+			wantErr: nats.ErrRunPending,
+		},
+		{
+			name: "batch still awaiting redelivery on the marker's last attempt",
+			batches: []batchDelivery{
+				{nats.Delivery{Sequence: 1, NumDelivered: 1}, failure},
+			},
+			marker: nats.Delivery{Sequence: 2, NumDelivered: 5, Final: true},
+		},
+		{
+			name: "batch failed for good",
+			batches: []batchDelivery{
+				{nats.Delivery{Sequence: 1, NumDelivered: 5, Final: true}, failure},
+				{nats.Delivery{Sequence: 2, NumDelivered: 1}, nil},
+			},
+			marker: nats.Delivery{Sequence: 3, NumDelivered: 1},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			js := natstest.JetStream(t)
+			for _, batch := range tt.batches {
+				if err := nats.RecordDelivery(ctx, js, pipelineID, marker.Run, batch.delivery, batch.err); err != nil {
+					t.Fatalf("RecordDelivery: %v", err)
+				}
+			}
+
+			destination := &completer{}
+			err := completeRun(ctx, js, marker, tt.marker, destination, 1)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("completeRun = %v, want %v", err, tt.wantErr)
+			}
+			if !reflect.DeepEqual(destination.completed, tt.wantCompleted) {
+				t.Errorf("completed runs = %v, want %v", destination.completed, tt.wantCompleted)
+			}
+
+			// Whatever was recorded is forgotten once the run is settled.
+			if tt.wantErr == nil {
+				if err := nats.CheckRunDelivered(ctx, js, pipelineID, marker.Run, nats.Delivery{}); err != nil {
+					t.Errorf("run delivery state was kept: %v", err)
+				}
+			}
+		})
+	}
+}
+
+// writer is a destination that does nothing on completion.
+type writer struct{}
+
+func (w *writer) Initialize(config map[string]interface{}) error { return nil }
+func (w *writer) DestinationID() string                          { return "writer" }
+func (w *writer) Run(d nats.DestinationRecord) error             { return nil }
+
+func TestRunDeliveryIsClearedWhenTheRunEnds(t *testing.T) {
+	const pipelineID = 3
+	failed := nats.Delivery{Sequence: 1, NumDelivered: 5, Final: true}
+
+	tests := []struct {
+		name string
+		end  func(ctx context.Context, js jetstream.JetStream, record nats.DestinationRecord) error
+	}{
+		{
+			name: "completed on a destination without completion",
+			end: func(ctx context.Context, js jetstream.JetStream, record nats.DestinationRecord) error {
+				record.Complete = true
+				return completeRun(ctx, js, record, nats.Delivery{Sequence: 2, NumDelivered: 1}, &writer{}, 1)
+			},
+		},
+		{
+			name: "abandoned",
+			end: func(ctx context.Context, js jetstream.JetStream, record nats.DestinationRecord) error {
+				record.Abandoned = true
+				data, err := json.Marshal(record)
+				if err != nil {
+					return err
+				}
+				return HandleSendingToDestination(data, nats.Delivery{Sequence: 2, NumDelivered: 1}, nil, nil, js)
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			js := natstest.JetStream(t)
+			record := nats.DestinationRecord{PipelineID: pipelineID, Run: "42"}
+			if err := nats.RecordDelivery(ctx, js, pipelineID, record.Run, failed, errors.New("write failed")); err != nil {
+				t.Fatalf("RecordDelivery: %v", err)
+			}
+
+			if err := tt.end(ctx, js, record); err != nil {
+				t.Fatalf("ending the run: %v", err)
+			}
+			if err := nats.CheckRunDelivered(ctx, js, pipelineID, record.Run, nats.Delivery{}); err != nil {
+				t.Errorf("run delivery state was kept: %v", err)
+			}
+		})
+	}
+}
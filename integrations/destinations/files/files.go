@@ -0,0 +1,509 @@
+// Package files holds the file destination, which archives records as
+// files on local disk or S3-compatible object storage.
+package files
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	n "dataforge-be/nats"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	fileID = "file"
+
+	formatNDJSON  = "ndjson"
+	formatCSV     = "csv"
+	formatParquet = "parquet"
+
+	compressionNone = ""
+	compressionGzip = "gzip"
+	compressionZstd = "zstd"
+
+	operationField = "_dataforge_operation"
+
+	defaultPathTemplate   = "{stream}/{yyyy}/{MM}/{dd}"
+	defaultMaxFileRecords = 100000
+	defaultMaxFileBytes   = 128 << 20
+	manifestDir           = "_manifests"
+	unscheduledRun        = "unscheduled"
+	fileWriteTimeout      = 5 * time.Minute
+	fileCompleteTimeout   = 30 * time.Minute
+)
+
+var placeholderPattern = regexp.MustCompile(`\{([^{}]+)\}`)
+
+// File writes each batch as one or more part files under a partitioned
+// path. path_template places them, using:
+//
+//   - {stream} and {run}
+//   - {yyyy}, {MM}, {dd} and {HH}, taken from time_field when it is set and
+//     from the write time otherwise
+//   - {field:name}, the value of the record's name field
+//
+// The destination handles one OUTPUT message at a time and keeps nothing
+// between them, so every batch is first written to parts of its own, named
+// after a hash of its records so a redelivered batch overwrites them. A
+// manifest of the batch's parts goes to _manifests/<pipeline>/<run>/.
+//
+// Once a run completes, its parts are rolled into files of up to
+// max_file_records records or max_file_bytes bytes (measured on the
+// uncompressed JSON) per partition and stream, the batches' parts and
+// manifests are removed, and _manifests/<pipeline>/<run>.json lists the
+// run's files. Completing a run again finishes any cleanup left over.
+// Records written outside a run, and runs that never complete, keep their
+// batches' parts.
+type File struct {
+	store        objectStore
+	format       string
+	compression  string
+	pathTemplate string
+	timeField    string
+	maxRecords   int
+	maxBytes     int
+}
+
+// manifest lists the parts of one batch, or the files of a completed run.
+type manifest struct {
+	PipelineID int64          `json:"pipeline_id"`
+	Run        string         `json:"run"`
+	Stream     string         `json:"stream,omitempty"`
+	WrittenAt  time.Time      `json:"written_at"`
+	Files      []manifestFile `json:"files"`
+}
+
+type manifestFile struct {
+	Path        string    `json:"path"`
+	Stream      string    `json:"stream"`
+	Format      string    `json:"format"`
+	Compression string    `json:"compression,omitempty"`
+	Records     int       `json:"records"`
+	Bytes       int       `json:"bytes"`
+	WrittenAt   time.Time `json:"written_at"`
+}
+
+func (f *File) Initialize(config map[string]interface{}) error {
+	store, err := newObjectStore(context.Background(), config)
+	if err != nil {
+		return err
+	}
+	f.store = store
+
+	f.format, _ = config["format"].(string)
+	switch f.format {
+	case "":
+		f.format = formatNDJSON
+	case formatNDJSON, formatCSV, formatParquet:
+	default:
+		return fmt.Errorf("unsupported file format %q", f.format)
+	}
+	f.compression, _ = config["compression"].(string)
+	switch f.compression {
+	case compressionNone, compressionGzip, compressionZstd:
+	case "none":
+		f.compression = compressionNone
+	default:
+		return fmt.Errorf("unsupported compression %q", f.compression)
+	}
+
+	f.pathTemplate, _ = config["path_template"].(string)
+	if f.pathTemplate == "" {
+		f.pathTemplate = defaultPathTemplate
+	}
+	f.timeField, _ = config["time_field"].(string)
+
+	f.maxRecords = defaultMaxFileRecords
+	if maxRecords, ok := config["max_file_records"].(float64); ok && maxRecords > 0 {
+		f.maxRecords = int(maxRecords)
+	}
+	f.maxBytes = defaultMaxFileBytes
+	if maxBytes, ok := config["max_file_bytes"].(float64); ok && maxBytes > 0 {
+		f.maxBytes = int(maxBytes)
+	}
+	return nil
+}
+
+func (f *File) DestinationID() string {
+	return fileID
+}
+
+// part is a run of rows bound for one file.
+type part struct {
+	dir  string
+	rows []map[string]interface{}
+	size int
+}
+
+// full reports whether a row of size bytes has to go to a new part.
+func (f *File) full(p *part, size int) bool {
+	return len(p.rows) >= f.maxRecords || (len(p.rows) > 0 && p.size+size > f.maxBytes)
+}
+
+func (f *File) Run(record n.DestinationRecord) error {
+	if len(record.Records) == 0 {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), fileWriteTimeout)
+	defer cancel()
+
+	run := record.Run
+	if run == "" {
+		run = unscheduledRun
+	}
+	now := time.Now().UTC()
+
+	// Rows keep their order within each partition; a partition's current
+	// part rolls over when it is full.
+	var parts []*part
+	open := make(map[string]*part)
+	for _, recordBytes := range record.Records {
+		var row map[string]interface{}
+		decoder := json.NewDecoder(bytes.NewReader(recordBytes))
+		decoder.UseNumber()
+		if err := decoder.Decode(&row); err != nil {
+			return fmt.Errorf("error decoding record for pipeline %d: %w", record.PipelineID, err)
+		}
+		if record.Operation != "" {
+			row[operationField] = record.Operation
+		}
+
+		dir := f.partitionFor(row, record.Stream, run, now)
+		current := open[dir]
+		if current == nil || f.full(current, len(recordBytes)) {
+			current = &part{dir: dir}
+			open[dir] = current
+			parts = append(parts, current)
+		}
+		current.rows = append(current.rows, row)
+		current.size += len(recordBytes)
+	}
+
+	batch := batchName(record)
+	written := make([]manifestFile, 0, len(parts))
+	for i, p := range parts {
+		key := path.Join(p.dir, fmt.Sprintf("part-%s-%04d.%s", batch, i, f.extension()))
+		file, err := f.writePart(ctx, key, record.Stream, p.rows)
+		if err != nil {
+			return fmt.Errorf("pipeline %d: %w", record.PipelineID, err)
+		}
+		written = append(written, file)
+	}
+
+	return f.writeManifest(ctx, path.Join(f.runDir(record.PipelineID, run), batch+".json"), manifest{
+		PipelineID: record.PipelineID,
+		Run:        run,
+		Stream:     record.Stream,
+		WrittenAt:  now,
+		Files:      written,
+	})
+}
+
+// batchName identifies a batch by its contents, the same on every delivery.
+func batchName(record n.DestinationRecord) string {
+	hash := sha256.New()
+	fmt.Fprintf(hash, "%s\x00%s\x00", record.Stream, record.Operation)
+	for _, recordBytes := range record.Records {
+		hash.Write(recordBytes)
+		hash.Write([]byte{'\n'})
+	}
+	return hex.EncodeToString(hash.Sum(nil))[:16]
+}
+
+func (f *File) writePart(ctx context.Context, key, stream string, rows []map[string]interface{}) (manifestFile, error) {
+	data, err := f.encode(rows)
+	if err != nil {
+		return manifestFile{}, fmt.Errorf("failed to encode %d records: %w", len(rows), err)
+	}
+	if err := f.store.Put(ctx, key, data); err != nil {
+		return manifestFile{}, err
+	}
+	return manifestFile{
+		Path:        key,
+		Stream:      stream,
+		Format:      f.format,
+		Compression: f.compression,
+		Records:     len(rows),
+		Bytes:       len(data),
+		WrittenAt:   time.Now().UTC(),
+	}, nil
+}
+
+func (f *File) encode(rows []map[string]interface{}) ([]byte, error) {
+	switch f.format {
+	case formatParquet:
+		return encodeParquet(rows, f.compression)
+	case formatCSV:
+		data, err := encodeCSV(rows)
+		if err != nil {
+			return nil, err
+		}
+		return compressData(data, f.compression)
+	default:
+		data, err := encodeNDJSON(rows)
+		if err != nil {
+			return nil, err
+		}
+		return compressData(data, f.compression)
+	}
+}
+
+func (f *File) extension() string {
+	switch {
+	case f.format == formatParquet:
+		return "parquet"
+	case f.compression == compressionGzip:
+		return f.format + ".gz"
+	case f.compression == compressionZstd:
+		return f.format + ".zst"
+	default:
+		return f.format
+	}
+}
+
+// partitionFor renders path_template for one record.
+func (f *File) partitionFor(row map[string]interface{}, stream, run string, now time.Time) string {
+	if stream == "" {
+		stream = "default"
+	}
+	t := now
+	if f.timeField != "" {
+		if recordTime, ok := timeValue(row[f.timeField]); ok {
+			t = recordTime.UTC()
+		}
+	}
+
+	rendered := placeholderPattern.ReplaceAllStringFunc(f.pathTemplate, func(placeholder string) string {
+		name := placeholder[1 : len(placeholder)-1]
+		switch name {
+		case "stream":
+			return pathSegment(stream)
+		case "run":
+			return pathSegment(run)
+		case "yyyy":
+			return t.Format("2006")
+		case "MM":
+			return t.Format("01")
+		case "dd":
+			return t.Format("02")
+		case "HH":
+			return t.Format("15")
+		}
+		if field, ok := strings.CutPrefix(name, "field:"); ok {
+			value := textValue(row[field])
+			if value == "" {
+				value = "null"
+			}
+			return pathSegment(value)
+		}
+		return placeholder
+	})
+	return strings.Trim(path.Clean("/"+rendered), "/")
+}
+
+// pathSegment keeps a value from adding path levels of its own.
+func pathSegment(value string) string {
+	value = strings.NewReplacer("/", "_", `\`, "_").Replace(value)
+	if value == "." || value == ".." {
+		return "_"
+	}
+	return value
+}
+
+// timeValue accepts RFC 3339 strings and Unix times in seconds or
+// milliseconds.
+func timeValue(value interface{}) (time.Time, bool) {
+	switch v := value.(type) {
+	case string:
+		t, err := time.Parse(time.RFC3339Nano, v)
+		return t, err == nil
+	case json.Number:
+		seconds, err := strconv.ParseFloat(v.String(), 64)
+		if err != nil {
+			return time.Time{}, false
+		}
+		if seconds > 1e12 {
+			seconds /= 1000
+		}
+		return time.Unix(0, int64(seconds*float64(time.Second))), true
+	default:
+		return time.Time{}, false
+	}
+}
+
+func (f *File) runDir(pipelineID int64, run string) string {
+	return path.Join(manifestDir, strconv.FormatInt(pipelineID, 10), pathSegment(run))
+}
+
+func (f *File) writeManifest(ctx context.Context, key string, m manifest) error {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode manifest: %w", err)
+	}
+	if err := f.store.Put(ctx, key, data); err != nil {
+		return fmt.Errorf("failed to write manifest: %w", err)
+	}
+	return nil
+}
+
+func (f *File) readManifest(ctx context.Context, key string) (manifest, error) {
+	var m manifest
+	data, err := f.store.Get(ctx, key)
+	if err != nil {
+		return m, err
+	}
+	if err := json.Unmarshal(data, &m); err != nil {
+		return m, fmt.Errorf("failed to decode manifest %s: %w", f.store.Describe(key), err)
+	}
+	return m, nil
+}
+
+// CompleteRun rolls the run's parts into its final files and lists them in
+// the run's manifest. The manifest is written before anything is removed, so
+// a run that has one is only left to clean up.
+func (f *File) CompleteRun(ctx context.Context, pipelineID int64, run string) error {
+	ctx, cancel := context.WithTimeout(ctx, fileCompleteTimeout)
+	defer cancel()
+
+	dir := f.runDir(pipelineID, run)
+	keys, err := f.store.List(ctx, dir)
+	if err != nil {
+		return err
+	}
+	batches := make([]manifest, 0, len(keys))
+	for _, key := range keys {
+		m, err := f.readManifest(ctx, key)
+		if err != nil {
+			return err
+		}
+		batches = append(batches, m)
+	}
+	// Rows keep the order their batches were written in.
+	sort.SliceStable(batches, func(i, j int) bool {
+		return batches[i].WrittenAt.Before(batches[j].WrittenAt)
+	})
+
+	runKey := dir + ".json"
+	completed, err := f.readManifest(ctx, runKey)
+	if errors.Is(err, errNotFound) {
+		completed, err = f.rollRun(ctx, pipelineID, run, batches)
+		if err == nil {
+			err = f.writeManifest(ctx, runKey, completed)
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	kept := make(map[string]bool, len(completed.Files))
+	for _, file := range completed.Files {
+		kept[file.Path] = true
+	}
+	for _, batch := range batches {
+		for _, file := range batch.Files {
+			if kept[file.Path] {
+				continue
+			}
+			if err := f.store.Delete(ctx, file.Path); err != nil {
+				return err
+			}
+		}
+	}
+	for _, key := range keys {
+		if err := f.store.Delete(ctx, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rollRun writes the rows of the batches' parts to files of up to
+// max_file_records records or max_file_bytes bytes per partition and
+// stream, named after the run so doing it again overwrites them. A
+// partition and stream with a single part keeps it as it is.
+func (f *File) rollRun(ctx context.Context, pipelineID int64, run string, batches []manifest) (manifest, error) {
+	type group struct {
+		dir, stream string
+		files       []manifestFile
+	}
+	var groups []*group
+	byKey := make(map[[2]string]*group)
+	for _, batch := range batches {
+		for _, file := range batch.Files {
+			key := [2]string{path.Dir(file.Path), file.Stream}
+			g := byKey[key]
+			if g == nil {
+				g = &group{dir: key[0], stream: key[1]}
+				byKey[key] = g
+				groups = append(groups, g)
+			}
+			g.files = append(g.files, file)
+		}
+	}
+
+	completed := manifest{PipelineID: pipelineID, Run: run, WrittenAt: time.Now().UTC()}
+	// Each partition numbers its files across the streams written to it.
+	next := make(map[string]int)
+	for _, g := range groups {
+		if len(g.files) == 1 {
+			completed.Files = append(completed.Files, g.files[0])
+			continue
+		}
+
+		current := &part{dir: g.dir}
+		flush := func() error {
+			if len(current.rows) == 0 {
+				return nil
+			}
+			key := path.Join(g.dir, fmt.Sprintf("run-%s-%04d.%s", pathSegment(run), next[g.dir], f.extension()))
+			next[g.dir]++
+			file, err := f.writePart(ctx, key, g.stream, current.rows)
+			if err != nil {
+				return err
+			}
+			completed.Files = append(completed.Files, file)
+			current = &part{dir: g.dir}
+			return nil
+		}
+		for _, file := range g.files {
+			data, err := f.store.Get(ctx, file.Path)
+			if err != nil {
+				return completed, err
+			}
+			rows, err := decodePart(ctx, data, file.Format, file.Compression)
+			if err == nil && len(rows) != file.Records {
+				err = fmt.Errorf("read %d records, manifest lists %d", len(rows), file.Records)
+			}
+			if err != nil {
+				return completed, fmt.Errorf("failed to read %s: %w", f.store.Describe(file.Path), err)
+			}
+			for _, row := range rows {
+				encoded, err := json.Marshal(row)
+				if err != nil {
+					return completed, fmt.Errorf("failed to encode record: %w", err)
+				}
+				if f.full(current, len(encoded)) {
+					if err := flush(); err != nil {
+						return completed, err
+					}
+				}
+				current.rows = append(current.rows, row)
+				current.size += len(encoded)
+			}
+		}
+		if err := flush(); err != nil {
+			return completed, err
+		}
+	}
+	return completed, nil
+}
@@ -0,0 +1,222 @@
+package files
+
+import (
+	"context"
+	n "dataforge-be/nats"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// readManifests decodes the manifests matching pattern, in the order they
+// were written.
+func readManifests(t *testing.T, pattern string) []manifest {
+	t.Helper()
+	names, err := filepath.Glob(pattern)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var manifests []manifest
+	for _, name := range names {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var m manifest
+		if err := json.Unmarshal(data, &m); err != nil {
+			t.Fatalf("failed to decode manifest %s: %v", name, err)
+		}
+		manifests = append(manifests, m)
+	}
+	sort.SliceStable(manifests, func(i, j int) bool { return manifests[i].WrittenAt.Before(manifests[j].WrittenAt) })
+	return manifests
+}
+
+func newFile(t *testing.T, config map[string]interface{}) *File {
+	t.Helper()
+	destination := &File{}
+	if err := destination.Initialize(config); err != nil {
+		t.Fatalf("Initialize: %v", err)
+	}
+	return destination
+}
+
+func TestFileWritesOneManifestPerBatch(t *testing.T) {
+	root := t.TempDir()
+	destination := &File{}
+	err := destination.Initialize(map[string]interface{}{
+		"path":             root,
+		"path_template":    "{stream}",
+		"max_file_records": float64(2),
+	})
+	if err != nil {
+		t.Fatalf("Initialize: %v", err)
+	}
+
+	batches := []n.DestinationRecord{
+		{PipelineID: 4, Run: "run-1", Stream: "users", Records: [][]byte{[]byte(`{"id":1}`), []byte(`{"id":2}`), []byte(`{"id":3}`)}},
+		{PipelineID: 4, Run: "run-1", Stream: "users", Records: [][]byte{[]byte(`{"id":4}`)}},
+	}
+	for _, batch := range batches {
+		if err := destination.Run(batch); err != nil {
+			t.Fatalf("Run: %v", err)
+		}
+	}
+
+	manifests := readManifests(t, filepath.Join(root, manifestDir, "4", "run-1", "*.json"))
+	if len(manifests) != len(batches) {
+		t.Fatalf("found %d manifests, want one per batch", len(manifests))
+	}
+
+	// The first batch splits into parts of two and one records; the second
+	// gets a part of its own.
+	wantRecords := [][]int{{2, 1}, {1}}
+	var listed []string
+	for i, m := range manifests {
+		if m.PipelineID != 4 || m.Run != "run-1" || m.Stream != "users" {
+			t.Errorf("manifest %d = pipeline %d run %q stream %q", i, m.PipelineID, m.Run, m.Stream)
+		}
+		var records []int
+		for _, file := range m.Files {
+			records = append(records, file.Records)
+			listed = append(listed, file.Path)
+			if !strings.HasPrefix(file.Path, "users/") {
+				t.Errorf("part %s is outside the stream's partition", file.Path)
+			}
+		}
+		if !reflect.DeepEqual(records, wantRecords[i]) {
+			t.Errorf("manifest %d lists parts of %v records, want %v", i, records, wantRecords[i])
+		}
+	}
+
+	parts, err := filepath.Glob(filepath.Join(root, "users", "*.ndjson"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(parts) != len(listed) {
+		t.Errorf("wrote %d parts, manifests list %d", len(parts), len(listed))
+	}
+}
+
+func TestFileRedeliveredBatchOverwritesItsParts(t *testing.T) {
+	root := t.TempDir()
+	destination := newFile(t, map[string]interface{}{"path": root, "path_template": "{stream}"})
+
+	batch := n.DestinationRecord{PipelineID: 4, Run: "run-1", Stream: "users", Records: [][]byte{[]byte(`{"id":1}`)}}
+	for i := 0; i < 2; i++ {
+		if err := destination.Run(batch); err != nil {
+			t.Fatalf("Run: %v", err)
+		}
+	}
+
+	if manifests := readManifests(t, filepath.Join(root, manifestDir, "4", "run-1", "*.json")); len(manifests) != 1 {
+		t.Errorf("found %d manifests, want 1", len(manifests))
+	}
+	if parts, _ := filepath.Glob(filepath.Join(root, "users", "*")); len(parts) != 1 {
+		t.Errorf("found parts %v, want 1", parts)
+	}
+}
+
+func TestFileCompleteRunRollsParts(t *testing.T) {
+	tests := []struct {
+		format      string
+		compression string
+	}{
+		{formatNDJSON, ""},
+		{formatCSV, compressionGzip},
+		{formatParquet, compressionZstd},
+	}
+	for _, tt := range tests {
+		t.Run(tt.format, func(t *testing.T) {
+			root := t.TempDir()
+			destination := newFile(t, map[string]interface{}{
+				"path":             root,
+				"path_template":    "{stream}",
+				"format":           tt.format,
+				"compression":      tt.compression,
+				"max_file_records": float64(3),
+			})
+
+			// Four batches of two users, and one batch of orgs.
+			for i := 0; i < 4; i++ {
+				err := destination.Run(n.DestinationRecord{PipelineID: 4, Run: "run-1", Stream: "users", Records: [][]byte{
+					[]byte(fmt.Sprintf(`{"id":%d,"score":%d.5}`, 2*i+1, i)),
+					[]byte(fmt.Sprintf(`{"id":%d,"score":%d.5}`, 2*i+2, i)),
+				}})
+				if err != nil {
+					t.Fatalf("Run: %v", err)
+				}
+			}
+			if err := destination.Run(n.DestinationRecord{PipelineID: 4, Run: "run-1", Stream: "orgs", Records: [][]byte{[]byte(`{"id":1}`)}}); err != nil {
+				t.Fatalf("Run: %v", err)
+			}
+			orgParts, _ := filepath.Glob(filepath.Join(root, "orgs", "*"))
+
+			ctx := context.Background()
+			// Completing the run again only finds it done.
+			for i := 0; i < 2; i++ {
+				if err := destination.CompleteRun(ctx, 4, "run-1"); err != nil {
+					t.Fatalf("CompleteRun: %v", err)
+				}
+			}
+
+			completed := readManifests(t, filepath.Join(root, manifestDir, "4", "run-1.json"))
+			if len(completed) != 1 {
+				t.Fatal("run manifest was not written")
+			}
+			var listed []string
+			var records []int
+			for _, file := range completed[0].Files {
+				listed = append(listed, file.Path)
+				records = append(records, file.Records)
+			}
+			ext := destination.extension()
+			wantListed := []string{"users/run-run-1-0000." + ext, "users/run-run-1-0001." + ext, "users/run-run-1-0002." + ext, "orgs/" + filepath.Base(orgParts[0])}
+			if !reflect.DeepEqual(listed, wantListed) || !reflect.DeepEqual(records, []int{3, 3, 2, 1}) {
+				t.Errorf("run manifest lists %v with %v records, want %v with [3 3 2 1]", listed, records, wantListed)
+			}
+
+			// Only the run's files are left.
+			var files []string
+			filepath.WalkDir(root, func(name string, entry os.DirEntry, err error) error {
+				if err == nil && !entry.IsDir() {
+					rel, _ := filepath.Rel(root, name)
+					files = append(files, filepath.ToSlash(rel))
+				}
+				return nil
+			})
+			sort.Strings(files)
+			want := append([]string{manifestDir + "/4/run-1.json"}, wantListed...)
+			sort.Strings(want)
+			if !reflect.DeepEqual(files, want) {
+				t.Errorf("files = %v, want %v", files, want)
+			}
+
+			var ids []string
+			for _, file := range completed[0].Files[:3] {
+				data, err := os.ReadFile(filepath.Join(root, file.Path))
+				if err != nil {
+					t.Fatal(err)
+				}
+				rows, err := decodePart(ctx, data, tt.format, tt.compression)
+				if err != nil {
+					t.Fatalf("decodePart: %v", err)
+				}
+				for _, row := range rows {
+					ids = append(ids, textValue(row["id"]))
+					if score := textValue(row["score"]); !strings.HasSuffix(score, ".5") {
+						t.Errorf("score = %s, want a fraction", score)
+					}
+				}
+			}
+			if want := []string{"1", "2", "3", "4", "5", "6", "7", "8"}; !reflect.DeepEqual(ids, want) {
+				t.Errorf("ids = %v, want %v", ids, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,158 @@
+package files
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/apache/arrow/go/v16/arrow/array"
+	"github.com/apache/arrow/go/v16/arrow/memory"
+	"github.com/apache/arrow/go/v16/parquet/file"
+	"github.com/apache/arrow/go/v16/parquet/pqarrow"
+	"github.com/klauspost/compress/zstd"
+)
+
+const partReadBatchSize = 1024
+
+// decodePart reads back the rows of a part this destination wrote, with
+// values as the writers take them, so a part can be written again without
+// change.
+func decodePart(ctx context.Context, data []byte, format, compression string) ([]map[string]interface{}, error) {
+	if format == formatParquet {
+		return decodeParquet(ctx, data)
+	}
+	data, err := decompressData(data, compression)
+	if err != nil {
+		return nil, err
+	}
+	if format == formatCSV {
+		return decodeCSV(data)
+	}
+	return decodeNDJSON(data)
+}
+
+func decodeNDJSON(data []byte) ([]map[string]interface{}, error) {
+	var rows []map[string]interface{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	for {
+		var row map[string]interface{}
+		err := decoder.Decode(&row)
+		if errors.Is(err, io.EOF) {
+			return rows, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		rows = append(rows, row)
+	}
+}
+
+// decodeCSV keeps every value as text, which is how it was written.
+func decodeCSV(data []byte) ([]map[string]interface{}, error) {
+	records, err := csv.NewReader(bytes.NewReader(data)).ReadAll()
+	if err != nil || len(records) == 0 {
+		return nil, err
+	}
+	header := records[0]
+	rows := make([]map[string]interface{}, 0, len(records)-1)
+	for _, record := range records[1:] {
+		row := make(map[string]interface{}, len(header))
+		for i, name := range header {
+			row[name] = record[i]
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+// decodeParquet turns numbers back into json.Number, keeping fractional
+// notation for floating point columns so they are not taken for integers.
+func decodeParquet(ctx context.Context, data []byte) ([]map[string]interface{}, error) {
+	parquetReader, err := file.NewParquetReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open parquet file: %w", err)
+	}
+	defer parquetReader.Close()
+
+	fileReader, err := pqarrow.NewFileReader(parquetReader, pqarrow.ArrowReadProperties{BatchSize: partReadBatchSize}, memory.DefaultAllocator)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read parquet schema: %w", err)
+	}
+	recordReader, err := fileReader.GetRecordReader(ctx, nil, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read parquet file: %w", err)
+	}
+	defer recordReader.Release()
+
+	var rows []map[string]interface{}
+	for recordReader.Next() {
+		batch := recordReader.Record()
+		fields := batch.Schema().Fields()
+		for i := 0; i < int(batch.NumRows()); i++ {
+			row := make(map[string]interface{}, len(fields))
+			for j, field := range fields {
+				column := batch.Column(j)
+				if column.IsNull(i) {
+					row[field.Name] = nil
+					continue
+				}
+				switch column := column.(type) {
+				case *array.Boolean:
+					row[field.Name] = column.Value(i)
+				case *array.Int64:
+					row[field.Name] = json.Number(strconv.FormatInt(column.Value(i), 10))
+				case *array.Float64:
+					row[field.Name] = json.Number(floatText(column.Value(i)))
+				case *array.String:
+					row[field.Name] = column.Value(i)
+				default:
+					return nil, fmt.Errorf("unexpected parquet column %s of type %s", field.Name, field.Type)
+				}
+			}
+			rows = append(rows, row)
+		}
+	}
+	if err := recordReader.Err(); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("failed to read parquet file: %w", err)
+	}
+	return rows, nil
+}
+
+func floatText(f float64) string {
+	text := strconv.FormatFloat(f, 'g', -1, 64)
+	if !strings.ContainsAny(text, ".eIN") {
+		text += ".0"
+	}
+	return text
+}
+
+func decompressData(data []byte, compression string) ([]byte, error) {
+	switch compression {
+	case compressionNone:
+		return data, nil
+	case compressionGzip:
+		reader, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		defer reader.Close()
+		return io.ReadAll(reader)
+	case compressionZstd:
+		decoder, err := zstd.NewReader(nil)
+		if err != nil {
+			return nil, err
+		}
+		defer decoder.Close()
+		return decoder.DecodeAll(data, nil)
+	default:
+		return nil, fmt.Errorf("unsupported compression %q", compression)
+	}
+}
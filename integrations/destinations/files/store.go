@@ -0,0 +1,226 @@
+package files
+
+import (
+	"bytes"
+	"context"
+	file_sources "dataforge-be/integrations/sources/files"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
+)
+
+// errNotFound is returned by Get for an object that does not exist.
+var errNotFound = errors.New("object not found")
+
+// objectStore reads and writes whole objects under slash separated keys.
+// Deleting an object that does not exist is not an error.
+type objectStore interface {
+	Put(ctx context.Context, key string, data []byte) error
+	Get(ctx context.Context, key string) ([]byte, error)
+	// List returns the keys of the objects under dir, in no particular
+	// order.
+	List(ctx context.Context, dir string) ([]string, error)
+	Delete(ctx context.Context, key string) error
+	Describe(key string) string
+}
+
+func newObjectStore(ctx context.Context, cfg map[string]interface{}) (objectStore, error) {
+	storage, _ := cfg["storage"].(string)
+	switch storage {
+	case "", "local":
+		root, _ := cfg["path"].(string)
+		if root == "" {
+			return nil, errors.New("local file destination requires path")
+		}
+		return &localStore{root: root}, nil
+	case "s3":
+		bucket, _ := cfg["bucket"].(string)
+		if bucket == "" {
+			return nil, errors.New("s3 file destination requires bucket")
+		}
+		prefix, _ := cfg["prefix"].(string)
+		client, err := file_sources.NewS3Client(ctx, cfg)
+		if err != nil {
+			return nil, err
+		}
+		return &s3Store{client: client, bucket: bucket, prefix: prefix}, nil
+	default:
+		return nil, fmt.Errorf("unsupported storage %q", storage)
+	}
+}
+
+type localStore struct {
+	root string
+}
+
+// Put writes to a temporary file first so readers never see a partial
+// object.
+func (l *localStore) Put(ctx context.Context, key string, data []byte) error {
+	name := filepath.Join(l.root, filepath.FromSlash(key))
+	if err := os.MkdirAll(filepath.Dir(name), 0o755); err != nil {
+		return fmt.Errorf("failed to create directory for %s: %w", name, err)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(name), ".dataforge-*")
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", name, err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write %s: %w", name, err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write %s: %w", name, err)
+	}
+	if err := os.Rename(tmp.Name(), name); err != nil {
+		return fmt.Errorf("failed to write %s: %w", name, err)
+	}
+	return nil
+}
+
+func (l *localStore) Get(ctx context.Context, key string) ([]byte, error) {
+	name := filepath.Join(l.root, filepath.FromSlash(key))
+	data, err := os.ReadFile(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("failed to read %s: %w", name, errNotFound)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", name, err)
+	}
+	return data, nil
+}
+
+// List leaves out the temporary files of writes in progress.
+func (l *localStore) List(ctx context.Context, dir string) ([]string, error) {
+	var keys []string
+	err := filepath.WalkDir(filepath.Join(l.root, filepath.FromSlash(dir)), func(name string, entry fs.DirEntry, err error) error {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() || strings.HasPrefix(entry.Name(), ".dataforge-") {
+			return nil
+		}
+		key, err := filepath.Rel(l.root, name)
+		if err != nil {
+			return err
+		}
+		keys = append(keys, filepath.ToSlash(key))
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list %s: %w", l.Describe(dir), err)
+	}
+	return keys, nil
+}
+
+func (l *localStore) Delete(ctx context.Context, key string) error {
+	name := filepath.Join(l.root, filepath.FromSlash(key))
+	if err := os.Remove(name); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("failed to delete %s: %w", name, err)
+	}
+	return nil
+}
+
+func (l *localStore) Describe(key string) string {
+	return filepath.Join(l.root, filepath.FromSlash(key))
+}
+
+// s3Store writes to an S3 bucket or any S3-compatible service.
+type s3Store struct {
+	client *s3.Client
+	bucket string
+	prefix string
+}
+
+func (s *s3Store) key(key string) string {
+	if s.prefix == "" {
+		return key
+	}
+	return path.Join(s.prefix, key)
+}
+
+func (s *s3Store) Put(ctx context.Context, key string, data []byte) error {
+	_, err := s.client.PutObject(ctx, &s3.PutObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.key(key)),
+		Body:   bytes.NewReader(data),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to put %s: %w", s.Describe(key), err)
+	}
+	return nil
+}
+
+func (s *s3Store) Get(ctx context.Context, key string) ([]byte, error) {
+	object, err := s.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.key(key)),
+	})
+	var noSuchKey *types.NoSuchKey
+	if errors.As(err, &noSuchKey) {
+		return nil, fmt.Errorf("failed to get %s: %w", s.Describe(key), errNotFound)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get %s: %w", s.Describe(key), err)
+	}
+	defer object.Body.Close()
+	data, err := io.ReadAll(object.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get %s: %w", s.Describe(key), err)
+	}
+	return data, nil
+}
+
+func (s *s3Store) List(ctx context.Context, dir string) ([]string, error) {
+	var keys []string
+	prefix := s.key(dir) + "/"
+	paginator := s3.NewListObjectsV2Paginator(s.client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.bucket),
+		Prefix: aws.String(prefix),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list %s: %w", s.Describe(dir), err)
+		}
+		for _, object := range page.Contents {
+			key := aws.ToString(object.Key)
+			if strings.HasSuffix(key, "/") {
+				continue
+			}
+			if s.prefix != "" {
+				key = strings.TrimPrefix(strings.TrimPrefix(key, s.prefix), "/")
+			}
+			keys = append(keys, key)
+		}
+	}
+	return keys, nil
+}
+
+func (s *s3Store) Delete(ctx context.Context, key string) error {
+	_, err := s.client.DeleteObject(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.key(key)),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete %s: %w", s.Describe(key), err)
+	}
+	return nil
+}
+
+func (s *s3Store) Describe(key string) string {
+	return fmt.Sprintf("s3://%s/%s", s.bucket, s.key(key))
+}
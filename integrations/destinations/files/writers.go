@@ -0,0 +1,242 @@
+package files
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/apache/arrow/go/v16/arrow"
+	"github.com/apache/arrow/go/v16/arrow/array"
+	"github.com/apache/arrow/go/v16/arrow/memory"
+	"github.com/apache/arrow/go/v16/parquet"
+	"github.com/apache/arrow/go/v16/parquet/compress"
+	"github.com/apache/arrow/go/v16/parquet/pqarrow"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Column types inferred for CSV headers and Parquet schemas. Nested values
+// are written as JSON text.
+const (
+	typeBoolean = "boolean"
+	typeInteger = "integer"
+	typeNumber  = "number"
+	typeString  = "string"
+)
+
+type column struct {
+	name     string
+	dataType string
+}
+
+// inferColumns returns every field used by rows, sorted by name, with a type
+// that holds all of the field's values.
+func inferColumns(rows []map[string]interface{}) []column {
+	types := make(map[string]string)
+	for _, row := range rows {
+		for name, value := range row {
+			types[name] = widenType(types[name], typeOf(value))
+		}
+	}
+
+	columns := make([]column, 0, len(types))
+	for name, dataType := range types {
+		if dataType == "" {
+			dataType = typeString
+		}
+		columns = append(columns, column{name: name, dataType: dataType})
+	}
+	sort.Slice(columns, func(i, j int) bool { return columns[i].name < columns[j].name })
+	return columns
+}
+
+func typeOf(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case bool:
+		return typeBoolean
+	case json.Number:
+		if _, err := v.Int64(); err == nil {
+			return typeInteger
+		}
+		return typeNumber
+	default:
+		return typeString
+	}
+}
+
+func widenType(a, b string) string {
+	switch {
+	case a == "" || a == b:
+		return b
+	case b == "":
+		return a
+	case (a == typeInteger && b == typeNumber) || (a == typeNumber && b == typeInteger):
+		return typeNumber
+	default:
+		return typeString
+	}
+}
+
+// textValue renders a value for CSV and string columns.
+func textValue(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	case bool:
+		if v {
+			return "true"
+		}
+		return "false"
+	default:
+		encoded, _ := json.Marshal(v)
+		return string(encoded)
+	}
+}
+
+func encodeNDJSON(rows []map[string]interface{}) ([]byte, error) {
+	var b bytes.Buffer
+	encoder := json.NewEncoder(&b)
+	for _, row := range rows {
+		if err := encoder.Encode(row); err != nil {
+			return nil, err
+		}
+	}
+	return b.Bytes(), nil
+}
+
+func encodeCSV(rows []map[string]interface{}) ([]byte, error) {
+	columns := inferColumns(rows)
+	var b bytes.Buffer
+	writer := csv.NewWriter(&b)
+
+	record := make([]string, len(columns))
+	for i, col := range columns {
+		record[i] = col.name
+	}
+	if err := writer.Write(record); err != nil {
+		return nil, err
+	}
+	for _, row := range rows {
+		for i, col := range columns {
+			record[i] = textValue(row[col.name])
+		}
+		if err := writer.Write(record); err != nil {
+			return nil, err
+		}
+	}
+	writer.Flush()
+	return b.Bytes(), writer.Error()
+}
+
+// encodeParquet writes rows as a single row group. Compression is applied by
+// Parquet itself, per column chunk.
+func encodeParquet(rows []map[string]interface{}, compression string) ([]byte, error) {
+	columns := inferColumns(rows)
+	fields := make([]arrow.Field, len(columns))
+	for i, col := range columns {
+		fields[i] = arrow.Field{Name: col.name, Type: arrowType(col.dataType), Nullable: true}
+	}
+	schema := arrow.NewSchema(fields, nil)
+
+	builder := array.NewRecordBuilder(memory.DefaultAllocator, schema)
+	defer builder.Release()
+	for _, row := range rows {
+		for i, col := range columns {
+			appendValue(builder.Field(i), row[col.name], col.dataType)
+		}
+	}
+	record := builder.NewRecord()
+	defer record.Release()
+
+	codec := compress.Codecs.Uncompressed
+	switch compression {
+	case compressionGzip:
+		codec = compress.Codecs.Gzip
+	case compressionZstd:
+		codec = compress.Codecs.Zstd
+	}
+
+	var b bytes.Buffer
+	writer, err := pqarrow.NewFileWriter(schema, &b, parquet.NewWriterProperties(parquet.WithCompression(codec)), pqarrow.DefaultWriterProps())
+	if err != nil {
+		return nil, err
+	}
+	if err := writer.Write(record); err != nil {
+		writer.Close()
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+func arrowType(dataType string) arrow.DataType {
+	switch dataType {
+	case typeBoolean:
+		return arrow.FixedWidthTypes.Boolean
+	case typeInteger:
+		return arrow.PrimitiveTypes.Int64
+	case typeNumber:
+		return arrow.PrimitiveTypes.Float64
+	default:
+		return arrow.BinaryTypes.String
+	}
+}
+
+func appendValue(builder array.Builder, value interface{}, dataType string) {
+	if value == nil {
+		builder.AppendNull()
+		return
+	}
+	switch dataType {
+	case typeBoolean:
+		builder.(*array.BooleanBuilder).Append(value.(bool))
+	case typeInteger:
+		i, _ := value.(json.Number).Int64()
+		builder.(*array.Int64Builder).Append(i)
+	case typeNumber:
+		f, _ := value.(json.Number).Float64()
+		builder.(*array.Float64Builder).Append(f)
+	default:
+		builder.(*array.StringBuilder).Append(textValue(value))
+	}
+}
+
+// compressData wraps NDJSON and CSV output in gzip or zstd.
+func compressData(data []byte, compression string) ([]byte, error) {
+	var b bytes.Buffer
+	var writer io.WriteCloser
+	switch compression {
+	case compressionNone:
+		return data, nil
+	case compressionGzip:
+		writer = gzip.NewWriter(&b)
+	case compressionZstd:
+		encoder, err := zstd.NewWriter(&b)
+		if err != nil {
+			return nil, err
+		}
+		writer = encoder
+	default:
+		return nil, fmt.Errorf("unsupported compression %q", compression)
+	}
+
+	if _, err := writer.Write(data); err != nil {
+		writer.Close()
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
@@ -3,10 +3,15 @@ package warehouses
 import (
 	"bytes"
 	"context"
-	"crypto/tls"
 	"dataforge-be/nats"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/elastic/go-elasticsearch/v8"
 	"github.com/elastic/go-elasticsearch/v8/esutil"
@@ -14,29 +19,95 @@ import (
 
 const (
 	elasticsearchID = "elasticsearch"
+
+	defaultKeepVersions = 1
 )
 
+// ElasticSearch indexes records into index. The index is created on first
+// write with explicit mappings, mappings generated from the first batch
+// (generate_mappings) or none at all, and with index_template put
+// beforehand when one is configured. pipeline names an ingest pipeline run
+// on every document.
+//
+// With reindex set, each run writes to its own index, <index>-<run>, and
+// index becomes an alias that is swapped to the new version when the run
+// completes. keep_versions previous versions are kept for rolling back.
+//
+// With data_stream set, index names an append-only data stream: documents
+// are written with create actions, and a data stream index template is put
+// before the stream is created. Every document gets an @timestamp, copied
+// from timestamp_field or set to the write time. index may hold a date
+// pattern, such as events-{yyyy.MM.dd}, filled in from each document's
+// timestamp. ilm_policy attaches a lifecycle policy to new indices and
+// backing indices, creating it from ilm_policy_body when one is given.
 type ElasticSearch struct {
-	client    *elasticsearch.Client
-	bulkIndex esutil.BulkIndexer
-	index     string
+	client           *elasticsearch.Client
+	bulkIndex        esutil.BulkIndexer
+	index            string
+	pipeline         string
+	mappings         map[string]interface{}
+	generateMappings bool
+	settings         map[string]interface{}
+	template         map[string]interface{}
+	templateName     string
+	reindex          bool
+	keepVersions     int
+	dataStream       bool
+	timestampField   string
+	ilmPolicy        string
+	ilmPolicyBody    map[string]interface{}
+	ensured          map[string]bool
+	templatesPut     bool
+	failed           atomic.Uint64
 }
 
 func (e *ElasticSearch) Initialize(config map[string]interface{}) error {
+	index, _ := config["index"].(string)
+	if index == "" {
+		return errors.New("elasticsearch destination requires index")
+	}
 
-	cloudID := config["cloud_id"].(string)
-	apiKey := config["api_key"].(string)
-	index := config["index"].(string)
-
-	client, bulkIndexer, index, err := initializeES(cloudID, apiKey, index)
+	cfg, flavor, err := esClientConfig(config)
 	if err != nil {
-		return fmt.Errorf("error initializing elasticsearch: %w", err)
+		return err
 	}
 
+	client, err := elasticsearch.NewClient(cfg)
+	if err != nil {
+		return fmt.Errorf("error creating elasticsearch client: %w", err)
+	}
 	e.client = client
-	e.bulkIndex = bulkIndexer
+	e.bulkIndex = nil
 	e.index = index
 
+	e.pipeline, _ = config["pipeline"].(string)
+	e.mappings, _ = config["mappings"].(map[string]interface{})
+	e.generateMappings, _ = config["generate_mappings"].(bool)
+	e.settings, _ = config["settings"].(map[string]interface{})
+	e.template, _ = config["index_template"].(map[string]interface{})
+	e.templateName, _ = config["index_template_name"].(string)
+	if e.templateName == "" {
+		e.templateName = "dataforge-" + strings.Trim(datePattern.ReplaceAllString(index, ""), "-._")
+	}
+
+	e.reindex, _ = config["reindex"].(bool)
+	e.keepVersions = defaultKeepVersions
+	if keep, ok := config["keep_versions"].(float64); ok && keep >= 0 {
+		e.keepVersions = int(keep)
+	}
+
+	e.dataStream, _ = config["data_stream"].(bool)
+	e.timestampField, _ = config["timestamp_field"].(string)
+	e.ilmPolicy, _ = config["ilm_policy"].(string)
+	e.ilmPolicyBody, _ = config["ilm_policy_body"].(map[string]interface{})
+	switch {
+	case e.reindex && (e.dataStream || hasDatePattern(index)):
+		return errors.New("reindex cannot be combined with data_stream or a dated index")
+	case e.ilmPolicy != "" && flavor == flavorOpenSearch:
+		return errors.New("opensearch has no ILM; attach an ISM policy through its ism_template instead")
+	case e.ilmPolicyBody != nil && e.ilmPolicy == "":
+		return errors.New("ilm_policy_body requires ilm_policy")
+	}
 	return nil
 }
 
@@ -45,23 +116,121 @@ func (e *ElasticSearch) DestinationID() string {
 }
 
 func (e *ElasticSearch) Run(record nats.DestinationRecord) error {
+	if len(record.Records) == 0 {
+		return nil
+	}
+	if e.dataStream && record.Operation == nats.OperationDelete {
+		return fmt.Errorf("data stream %s is append-only and cannot delete documents for pipeline %d", e.index, record.PipelineID)
+	}
+
 	ctx := context.Background()
+	index := e.index
+	if e.reindex {
+		if record.Run == "" {
+			return fmt.Errorf("reindex requires a pipeline run for pipeline %d", record.PipelineID)
+		}
+		index = versionedIndex(e.index, record.Run)
+	}
+
+	bulkIndexer, err := esutil.NewBulkIndexer(esutil.BulkIndexerConfig{
+		Client:     e.client,
+		Pipeline:   e.pipeline,
+		NumWorkers: 10,
+		FlushBytes: 5e+6,
+	})
+	if err != nil {
+		return fmt.Errorf("error creating bulk indexer: %w", err)
+	}
+	e.bulkIndex = bulkIndexer
+	e.failed.Store(0)
+	e.ensured = make(map[string]bool)
+	e.templatesPut = false
+
+	now := time.Now().UTC()
 	for _, recordBytes := range record.Records {
+		action := "index"
+		if e.dataStream {
+			action = "create"
+		}
+		documentID := ""
+		target := index
+		var body io.ReadSeeker = bytes.NewReader(recordBytes)
+
+		if len(record.PrimaryKey) > 0 || e.timestamped() {
+			var document map[string]interface{}
+			decoder := json.NewDecoder(bytes.NewReader(recordBytes))
+			decoder.UseNumber()
+			if err := decoder.Decode(&document); err != nil {
+				return fmt.Errorf("error decoding document for pipeline %d: %w", record.PipelineID, err)
+			}
+			documentID, _ = nats.PrimaryKeyValue(document, record.PrimaryKey)
+
+			if e.timestamped() {
+				target = renderIndexName(index, e.stampTimestamp(document, now))
+				encoded, err := json.Marshal(document)
+				if err != nil {
+					return fmt.Errorf("error encoding document for pipeline %d: %w", record.PipelineID, err)
+				}
+				body = bytes.NewReader(encoded)
+			}
+		}
+
+		// A partial record only carries the fields that changed, so it is
+		// merged into the stored document rather than replacing it.
+		if record.Partial && documentID != "" && action == "index" {
+			action = "update"
+			source, err := io.ReadAll(body)
+			if err != nil {
+				return fmt.Errorf("error reading document for pipeline %d: %w", record.PipelineID, err)
+			}
+			update, err := json.Marshal(map[string]interface{}{"doc": json.RawMessage(source), "doc_as_upsert": true})
+			if err != nil {
+				return fmt.Errorf("error encoding update for pipeline %d: %w", record.PipelineID, err)
+			}
+			body = bytes.NewReader(update)
+		}
+
+		if record.Operation == nats.OperationDelete {
+			if documentID == "" {
+				return fmt.Errorf("cannot delete document without a primary key for pipeline %d", record.PipelineID)
+			}
+			action = "delete"
+			body = nil
+		}
+
+		if !e.ensured[target] {
+			if err := e.ensureIndex(ctx, target, record.Records); err != nil {
+				return fmt.Errorf("pipeline %d: %w", record.PipelineID, err)
+			}
+			e.ensured[target] = true
+		}
+
 		err := e.bulkIndex.Add(
 			ctx,
 			esutil.BulkIndexerItem{
-				Action: "index",
-				Body:   bytes.NewReader(recordBytes),
+				Action:     action,
+				DocumentID: documentID,
+				Body:       body,
 				OnSuccess: func(ctx context.Context, item esutil.BulkIndexerItem, res esutil.BulkIndexerResponseItem) {
 				},
 				OnFailure: func(ctx context.Context, item esutil.BulkIndexerItem, res esutil.BulkIndexerResponseItem, err error) {
+					// A create that conflicts was already written, and a
+					// delete that finds nothing already removed, by an
+					// earlier delivery or run.
+					if err == nil && item.Action == "create" && res.Status == http.StatusConflict {
+						return
+					}
+					if err == nil && item.Action == "delete" && res.Status == http.StatusNotFound {
+						return
+					}
+					e.failed.Add(1)
 					if err != nil {
 						fmt.Printf("Error indexing document for pipeline %d: %v\n", record.PipelineID, err)
 					} else {
 						fmt.Printf("Elasticsearch error for pipeline %d: %s\n", record.PipelineID, res.Error.Reason)
 					}
 				},
-				Index: e.index,
+				Index: target,
 			},
 		)
 
@@ -73,37 +242,17 @@ func (e *ElasticSearch) Run(record nats.DestinationRecord) error {
 	return nil
 }
 
-func initializeES(cloudID, apiKey, index string) (*elasticsearch.Client, esutil.BulkIndexer, string, error) {
-	cfg := elasticsearch.Config{
-		CloudID: cloudID,
-		APIKey:  apiKey,
-		Transport: &http.Transport{
-			TLSClientConfig: &tls.Config{
-				InsecureSkipVerify: true,
-			},
-		},
+func (e *ElasticSearch) Flush(ctx context.Context) error {
+	if e.bulkIndex == nil {
+		return nil
 	}
-
-	client, err := elasticsearch.NewClient(cfg)
-	if err != nil {
-		return nil, nil, "", fmt.Errorf("error creating elasticsearch client: %w", err)
-	}
-
-	bi, err := esutil.NewBulkIndexer(esutil.BulkIndexerConfig{
-		Index:      index,
-		Client:     client,
-		NumWorkers: 10,
-		FlushBytes: 5e+6,
-	})
-
+	err := e.bulkIndex.Close(ctx)
 	if err != nil {
-		return nil, nil, "", fmt.Errorf("error creating bulk indexer: %w", err)
+		return fmt.Errorf("error flushing bulk indexer: %w", err)
 	}
 
-	_, err = client.Indices.Create(index)
-	if err != nil {
-		return nil, nil, "", fmt.Errorf("error creating bulk indexer: %w", err)
+	if failed := e.failed.Load(); failed > 0 {
+		return fmt.Errorf("failed to index %d documents", failed)
 	}
-
-	return client, bi, index, nil
+	return nil
 }
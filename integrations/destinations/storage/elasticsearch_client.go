@@ -0,0 +1,94 @@
+package warehouses
+
+import (
+	"dataforge-be/integrations/connection"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/elastic/go-elasticsearch/v8"
+)
+
+const (
+	flavorElasticsearch = "elasticsearch"
+	flavorOpenSearch    = "opensearch"
+)
+
+// esClientConfig reads either an Elastic Cloud cloud_id or a list of node
+// urls, authenticated with an api_key or a username and password. TLS always
+// verifies the server; ca_cert replaces the trusted roots for self-signed
+// clusters, server_name overrides the verified host name, and
+// client_cert/client_key enable mutual TLS.
+//
+// flavor "opensearch" talks to OpenSearch, which the Elasticsearch client
+// otherwise refuses because it lacks the X-Elastic-Product header.
+func esClientConfig(config map[string]interface{}) (elasticsearch.Config, string, error) {
+	cfg := elasticsearch.Config{}
+	cfg.CloudID, _ = config["cloud_id"].(string)
+	cfg.APIKey, _ = config["api_key"].(string)
+	cfg.Username, _ = config["username"].(string)
+	cfg.Password, _ = config["password"].(string)
+
+	switch urls := config["urls"].(type) {
+	case []interface{}:
+		for _, u := range urls {
+			if address, ok := u.(string); ok && address != "" {
+				cfg.Addresses = append(cfg.Addresses, strings.TrimSuffix(address, "/"))
+			}
+		}
+	case string:
+		for _, address := range strings.Split(urls, ",") {
+			if address = strings.TrimSpace(address); address != "" {
+				cfg.Addresses = append(cfg.Addresses, strings.TrimSuffix(address, "/"))
+			}
+		}
+	}
+	if address, _ := config["url"].(string); address != "" {
+		cfg.Addresses = append(cfg.Addresses, strings.TrimSuffix(address, "/"))
+	}
+	if cfg.CloudID == "" && len(cfg.Addresses) == 0 {
+		return cfg, "", errors.New("elasticsearch requires cloud_id or urls")
+	}
+
+	flavor, _ := config["flavor"].(string)
+	switch flavor {
+	case "", flavorElasticsearch:
+		flavor = flavorElasticsearch
+	case flavorOpenSearch:
+		if cfg.CloudID != "" {
+			return cfg, "", errors.New("opensearch flavor requires urls, not cloud_id")
+		}
+		cfg.DisableMetaHeader = true
+	default:
+		return cfg, "", fmt.Errorf("unsupported elasticsearch flavor %q", flavor)
+	}
+
+	tlsConfig, err := connection.TLSConfig(config)
+	if err != nil {
+		return cfg, "", fmt.Errorf("invalid elasticsearch tls config: %w", err)
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	cfg.Transport = transport
+	if flavor == flavorOpenSearch {
+		cfg.Transport = openSearchTransport{next: transport}
+	}
+	return cfg, flavor, nil
+}
+
+// openSearchTransport marks OpenSearch responses as coming from
+// Elasticsearch so the client's product check lets them through. The APIs
+// the destination uses are the same on both.
+type openSearchTransport struct {
+	next http.RoundTripper
+}
+
+func (t openSearchTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	res, err := t.next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	res.Header.Set("X-Elastic-Product", "Elasticsearch")
+	return res, nil
+}
@@ -0,0 +1,536 @@
+package warehouses
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/elastic/go-elasticsearch/v8/esapi"
+)
+
+// ensureIndex creates name unless an index, alias or data stream by that
+// name already exists. The lifecycle policy and index template, when
+// configured, are put first so they apply to the new index; explicit or
+// generated mappings and settings go into the create request itself, or into
+// the template for a data stream.
+func (e *ElasticSearch) ensureIndex(ctx context.Context, name string, records [][]byte) error {
+	res, err := e.client.Indices.Exists([]string{name}, e.client.Indices.Exists.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("failed to check index %s: %w", name, err)
+	}
+	res.Body.Close()
+	switch res.StatusCode {
+	case http.StatusOK:
+		return nil
+	case http.StatusNotFound:
+	default:
+		return fmt.Errorf("failed to check index %s: %s", name, res.Status())
+	}
+
+	if !e.templatesPut {
+		if e.ilmPolicyBody != nil {
+			if err := e.putLifecyclePolicy(ctx); err != nil {
+				return err
+			}
+		}
+		if e.template != nil || e.dataStream {
+			if err := e.putIndexTemplate(ctx, records); err != nil {
+				return err
+			}
+		}
+		e.templatesPut = true
+	}
+	if e.dataStream {
+		return e.createDataStream(ctx, name)
+	}
+
+	body := map[string]interface{}{}
+	if settings := e.indexSettings(); settings != nil {
+		body["settings"] = settings
+	}
+	if mappings := e.indexMappings(records); mappings != nil {
+		body["mappings"] = mappings
+	}
+	encoded, err := json.Marshal(body)
+	if err != nil {
+		return fmt.Errorf("failed to encode index %s: %w", name, err)
+	}
+
+	res, err = e.client.Indices.Create(name,
+		e.client.Indices.Create.WithBody(bytes.NewReader(encoded)),
+		e.client.Indices.Create.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("failed to create index %s: %w", name, err)
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		reason, _ := io.ReadAll(res.Body)
+		// Another writer got there first.
+		if strings.Contains(string(reason), "resource_already_exists_exception") {
+			return nil
+		}
+		return fmt.Errorf("failed to create index %s: %s", name, reason)
+	}
+	return nil
+}
+
+// putIndexTemplate installs index_template as a composable template.
+// Without index_patterns of its own it covers the index and its versions, or
+// every date of a dated index. For a data stream the template is marked as
+// one and carries the settings and mappings of its backing indices.
+func (e *ElasticSearch) putIndexTemplate(ctx context.Context, records [][]byte) error {
+	template := make(map[string]interface{}, len(e.template)+2)
+	for key, value := range e.template {
+		template[key] = value
+	}
+	if _, ok := template["index_patterns"]; !ok {
+		template["index_patterns"] = e.indexPatterns()
+	}
+	if e.dataStream {
+		if _, ok := template["data_stream"]; !ok {
+			template["data_stream"] = map[string]interface{}{}
+		}
+		inner := map[string]interface{}{}
+		if existing, ok := template["template"].(map[string]interface{}); ok {
+			for key, value := range existing {
+				inner[key] = value
+			}
+		}
+		if settings := e.indexSettings(); settings != nil {
+			merged := map[string]interface{}{}
+			if existing, ok := inner["settings"].(map[string]interface{}); ok {
+				for key, value := range existing {
+					merged[key] = value
+				}
+			}
+			for key, value := range settings {
+				merged[key] = value
+			}
+			inner["settings"] = merged
+		}
+		if _, ok := inner["mappings"]; !ok {
+			if mappings := e.indexMappings(records); mappings != nil {
+				inner["mappings"] = mappings
+			}
+		}
+		template["template"] = inner
+	}
+	encoded, err := json.Marshal(template)
+	if err != nil {
+		return fmt.Errorf("failed to encode index template: %w", err)
+	}
+
+	res, err := e.client.Indices.PutIndexTemplate(e.templateName, bytes.NewReader(encoded),
+		e.client.Indices.PutIndexTemplate.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("failed to put index template %s: %w", e.templateName, err)
+	}
+	return esResponseError(res, "put index template "+e.templateName)
+}
+
+func (e *ElasticSearch) indexPatterns() []string {
+	switch {
+	case hasDatePattern(e.index):
+		return []string{datePattern.ReplaceAllString(e.index, "*")}
+	case e.dataStream:
+		return []string{e.index}
+	default:
+		return []string{e.index, e.index + "-*"}
+	}
+}
+
+// indexSettings adds the lifecycle policy to the configured settings.
+func (e *ElasticSearch) indexSettings() map[string]interface{} {
+	if e.ilmPolicy == "" {
+		return e.settings
+	}
+	settings := map[string]interface{}{"index.lifecycle.name": e.ilmPolicy}
+	for key, value := range e.settings {
+		settings[key] = value
+	}
+	return settings
+}
+
+func (e *ElasticSearch) indexMappings(records [][]byte) map[string]interface{} {
+	switch {
+	case e.mappings != nil:
+		return e.mappings
+	case e.generateMappings:
+		mappings := generateMappings(records)
+		if e.dataStream || e.timestampField != "" {
+			mappings["properties"].(map[string]interface{})["@timestamp"] = map[string]interface{}{"type": "date"}
+		}
+		return mappings
+	default:
+		return nil
+	}
+}
+
+func (e *ElasticSearch) putLifecyclePolicy(ctx context.Context) error {
+	encoded, err := json.Marshal(map[string]interface{}{"policy": e.ilmPolicyBody})
+	if err != nil {
+		return fmt.Errorf("failed to encode ilm policy: %w", err)
+	}
+	res, err := e.client.ILM.PutLifecycle(e.ilmPolicy,
+		e.client.ILM.PutLifecycle.WithBody(bytes.NewReader(encoded)),
+		e.client.ILM.PutLifecycle.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("failed to put ilm policy %s: %w", e.ilmPolicy, err)
+	}
+	return esResponseError(res, "put ilm policy "+e.ilmPolicy)
+}
+
+func (e *ElasticSearch) createDataStream(ctx context.Context, name string) error {
+	res, err := e.client.Indices.CreateDataStream(name, e.client.Indices.CreateDataStream.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("failed to create data stream %s: %w", name, err)
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		reason, _ := io.ReadAll(res.Body)
+		if strings.Contains(string(reason), "resource_already_exists_exception") {
+			return nil
+		}
+		return fmt.Errorf("failed to create data stream %s: %s", name, reason)
+	}
+	return nil
+}
+
+// datePattern matches the date placeholders of a dated index name.
+var datePattern = regexp.MustCompile(`\{([^{}]+)\}`)
+
+func hasDatePattern(index string) bool {
+	return datePattern.MatchString(index)
+}
+
+// renderIndexName fills the date placeholders of index, such as {yyyy.MM.dd},
+// with t in UTC.
+func renderIndexName(index string, t time.Time) string {
+	if !hasDatePattern(index) {
+		return index
+	}
+	t = t.UTC()
+	formats := strings.NewReplacer(
+		"yyyy", t.Format("2006"),
+		"yy", t.Format("06"),
+		"MM", t.Format("01"),
+		"dd", t.Format("02"),
+		"HH", t.Format("15"),
+		"mm", t.Format("04"),
+		"ss", t.Format("05"),
+	)
+	return datePattern.ReplaceAllStringFunc(index, func(placeholder string) string {
+		return formats.Replace(placeholder[1 : len(placeholder)-1])
+	})
+}
+
+// timestamped reports whether documents need their time read or stamped.
+func (e *ElasticSearch) timestamped() bool {
+	return e.dataStream || e.timestampField != "" || hasDatePattern(e.index)
+}
+
+// stampTimestamp returns the document's time, from timestamp_field or an
+// existing @timestamp, falling back to now. For data streams and when
+// timestamp_field is set, the time is written to @timestamp.
+func (e *ElasticSearch) stampTimestamp(document map[string]interface{}, now time.Time) time.Time {
+	field := e.timestampField
+	if field == "" {
+		field = "@timestamp"
+	}
+	t := now
+	if value, ok := esTimeValue(document[field]); ok {
+		t = value.UTC()
+	}
+	if e.dataStream || e.timestampField != "" {
+		document["@timestamp"] = t.Format(time.RFC3339Nano)
+	}
+	return t
+}
+
+// esTimeValue accepts RFC 3339 strings and Unix times in seconds or
+// milliseconds.
+func esTimeValue(value interface{}) (time.Time, bool) {
+	switch v := value.(type) {
+	case string:
+		t, err := time.Parse(time.RFC3339Nano, v)
+		return t, err == nil
+	case json.Number:
+		seconds, err := strconv.ParseFloat(v.String(), 64)
+		if err != nil {
+			return time.Time{}, false
+		}
+		if seconds > 1e12 {
+			seconds /= 1000
+		}
+		return time.Unix(0, int64(seconds*float64(time.Second))), true
+	default:
+		return time.Time{}, false
+	}
+}
+
+// versionedIndex names the index a reindex run writes to.
+func versionedIndex(index, run string) string {
+	return index + "-" + run
+}
+
+// CompleteRun points the alias at the index a reindex run has just filled,
+// removing it from the previous versions in the same request so searches
+// never see a gap. Versions beyond keep_versions are then deleted. Runs
+// with a batch that failed to index never get here, so a partial version
+// never replaces the live one.
+func (e *ElasticSearch) CompleteRun(ctx context.Context, pipelineID int64, run string) error {
+	if !e.reindex || run == "" {
+		return nil
+	}
+	target := versionedIndex(e.index, run)
+
+	res, err := e.client.Indices.Exists([]string{target}, e.client.Indices.Exists.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("failed to check index %s: %w", target, err)
+	}
+	res.Body.Close()
+	if res.StatusCode == http.StatusNotFound {
+		log.Printf("Pipeline %d run %s wrote no documents; alias %s is unchanged", pipelineID, run, e.index)
+		return nil
+	}
+
+	current, err := e.aliasIndices(ctx)
+	if err != nil {
+		return err
+	}
+
+	var actions []map[string]interface{}
+	for _, index := range current {
+		if index != target {
+			actions = append(actions, map[string]interface{}{"remove": map[string]string{"index": index, "alias": e.index}})
+		}
+	}
+	actions = append(actions, map[string]interface{}{"add": map[string]string{"index": target, "alias": e.index}})
+	encoded, err := json.Marshal(map[string]interface{}{"actions": actions})
+	if err != nil {
+		return fmt.Errorf("failed to encode alias actions: %w", err)
+	}
+
+	res, err = e.client.Indices.UpdateAliases(bytes.NewReader(encoded), e.client.Indices.UpdateAliases.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("failed to swap alias %s: %w", e.index, err)
+	}
+	if err := esResponseError(res, "swap alias "+e.index); err != nil {
+		return err
+	}
+	log.Printf("Alias %s now points at %s for pipeline %d", e.index, target, pipelineID)
+
+	return e.pruneVersions(ctx, target)
+}
+
+// aliasIndices returns the indices behind the alias. It fails when the
+// alias name is taken by a concrete index, which has to be removed before
+// reindexing can take over the name.
+func (e *ElasticSearch) aliasIndices(ctx context.Context) ([]string, error) {
+	res, err := e.client.Indices.GetAlias(
+		e.client.Indices.GetAlias.WithName(e.index),
+		e.client.Indices.GetAlias.WithContext(ctx))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read alias %s: %w", e.index, err)
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusNotFound {
+		exists, err := e.client.Indices.Exists([]string{e.index}, e.client.Indices.Exists.WithContext(ctx))
+		if err != nil {
+			return nil, fmt.Errorf("failed to check index %s: %w", e.index, err)
+		}
+		exists.Body.Close()
+		if exists.StatusCode == http.StatusOK {
+			return nil, fmt.Errorf("%s is an index, not an alias; delete it so reindexing can manage the name", e.index)
+		}
+		return nil, nil
+	}
+	if res.IsError() {
+		reason, _ := io.ReadAll(res.Body)
+		return nil, fmt.Errorf("failed to read alias %s: %s", e.index, reason)
+	}
+
+	var aliases map[string]json.RawMessage
+	if err := json.NewDecoder(res.Body).Decode(&aliases); err != nil {
+		return nil, fmt.Errorf("failed to decode alias %s: %w", e.index, err)
+	}
+	indices := make([]string, 0, len(aliases))
+	for index := range aliases {
+		indices = append(indices, index)
+	}
+	return indices, nil
+}
+
+// pruneVersions deletes all but the newest keep_versions versions other than
+// current, leaving recent ones around to swap back to.
+func (e *ElasticSearch) pruneVersions(ctx context.Context, current string) error {
+	res, err := e.client.Indices.Get([]string{e.index + "-*"}, e.client.Indices.Get.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("failed to list versions of %s: %w", e.index, err)
+	}
+	defer res.Body.Close()
+	if res.IsError() {
+		reason, _ := io.ReadAll(res.Body)
+		return fmt.Errorf("failed to list versions of %s: %s", e.index, reason)
+	}
+
+	var indices map[string]json.RawMessage
+	if err := json.NewDecoder(res.Body).Decode(&indices); err != nil {
+		return fmt.Errorf("failed to decode versions of %s: %w", e.index, err)
+	}
+	type version struct {
+		name string
+		run  int64
+	}
+	var versions []version
+	for name := range indices {
+		run, err := strconv.ParseInt(strings.TrimPrefix(name, e.index+"-"), 10, 64)
+		if err != nil || name == current {
+			continue
+		}
+		versions = append(versions, version{name: name, run: run})
+	}
+	if len(versions) <= e.keepVersions {
+		return nil
+	}
+	sort.Slice(versions, func(i, j int) bool { return versions[i].run > versions[j].run })
+
+	stale := make([]string, 0, len(versions)-e.keepVersions)
+	for _, v := range versions[e.keepVersions:] {
+		stale = append(stale, v.name)
+	}
+	res, err = e.client.Indices.Delete(stale, e.client.Indices.Delete.WithContext(ctx))
+	if err != nil {
+		return fmt.Errorf("failed to delete old versions of %s: %w", e.index, err)
+	}
+	return esResponseError(res, "delete old versions of "+e.index)
+}
+
+func esResponseError(res *esapi.Response, action string) error {
+	defer res.Body.Close()
+	if res.IsError() {
+		reason, _ := io.ReadAll(res.Body)
+		return fmt.Errorf("failed to %s: %s", action, reason)
+	}
+	return nil
+}
+
+// generateMappings builds explicit mappings from sample records: integers
+// map to long, other numbers to double, RFC 3339 strings to date and other
+// strings to text with a keyword sub-field, the same as dynamic mapping
+// would pick, but fixed before the first document can guess wrong.
+func generateMappings(records [][]byte) map[string]interface{} {
+	properties := map[string]interface{}{}
+	for _, recordBytes := range records {
+		var document map[string]interface{}
+		decoder := json.NewDecoder(bytes.NewReader(recordBytes))
+		decoder.UseNumber()
+		if err := decoder.Decode(&document); err != nil {
+			continue
+		}
+		mergeProperties(properties, document)
+	}
+	return map[string]interface{}{"properties": properties}
+}
+
+func mergeProperties(properties map[string]interface{}, document map[string]interface{}) {
+	for field, value := range document {
+		mapping := fieldMapping(value)
+		if mapping == nil {
+			continue
+		}
+		existing, ok := properties[field].(map[string]interface{})
+		if !ok {
+			properties[field] = mapping
+			continue
+		}
+		properties[field] = mergeMapping(existing, mapping)
+	}
+}
+
+func fieldMapping(value interface{}) map[string]interface{} {
+	switch v := value.(type) {
+	case bool:
+		return map[string]interface{}{"type": "boolean"}
+	case json.Number:
+		if _, err := v.Int64(); err == nil {
+			return map[string]interface{}{"type": "long"}
+		}
+		return map[string]interface{}{"type": "double"}
+	case string:
+		if _, err := time.Parse(time.RFC3339Nano, v); err == nil {
+			return map[string]interface{}{"type": "date"}
+		}
+		return textMapping()
+	case map[string]interface{}:
+		properties := map[string]interface{}{}
+		mergeProperties(properties, v)
+		return map[string]interface{}{"properties": properties}
+	case []interface{}:
+		// Arrays need no mapping of their own; their elements decide.
+		var merged map[string]interface{}
+		for _, element := range v {
+			mapping := fieldMapping(element)
+			if mapping == nil {
+				continue
+			}
+			if merged == nil {
+				merged = mapping
+			} else {
+				merged = mergeMapping(merged, mapping)
+			}
+		}
+		return merged
+	default:
+		return nil
+	}
+}
+
+func textMapping() map[string]interface{} {
+	return map[string]interface{}{
+		"type": "text",
+		"fields": map[string]interface{}{
+			"keyword": map[string]interface{}{"type": "keyword", "ignore_above": 256},
+		},
+	}
+}
+
+// mergeMapping reconciles two mappings of one field: long widens to double,
+// objects merge their properties, and any other mismatch becomes text.
+func mergeMapping(a, b map[string]interface{}) map[string]interface{} {
+	aProperties, aIsObject := a["properties"].(map[string]interface{})
+	bProperties, bIsObject := b["properties"].(map[string]interface{})
+	if aIsObject && bIsObject {
+		for field, mapping := range bProperties {
+			if existing, ok := aProperties[field].(map[string]interface{}); ok {
+				aProperties[field] = mergeMapping(existing, mapping.(map[string]interface{}))
+			} else {
+				aProperties[field] = mapping
+			}
+		}
+		return a
+	}
+
+	aType, _ := a["type"].(string)
+	bType, _ := b["type"].(string)
+	switch {
+	case aIsObject || bIsObject:
+		return textMapping()
+	case aType == bType:
+		return a
+	case (aType == "long" && bType == "double") || (aType == "double" && bType == "long"):
+		return map[string]interface{}{"type": "double"}
+	default:
+		return textMapping()
+	}
+}
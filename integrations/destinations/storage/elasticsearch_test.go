@@ -0,0 +1,517 @@
+package warehouses
+
+import (
+	"bufio"
+	"context"
+	"dataforge-be/nats"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// bulkAction is one action of a bulk request, with the source that followed
+// it for every action but delete.
+type bulkAction struct {
+	Action string
+	Index  string
+	ID     string
+	Source map[string]interface{}
+}
+
+// fakeCluster serves the parts of the Elasticsearch API the destination uses:
+// index checks and creation, bulk writes, aliases and index deletion. Every
+// PUT, whether of an index, index template, lifecycle policy or data stream,
+// is kept with its body.
+type fakeCluster struct {
+	mu      sync.Mutex
+	indices map[string]bool
+	aliases map[string][]string
+	bulk    []bulkAction
+	puts    []putRequest
+	// failIDs are documents the bulk endpoint rejects.
+	failIDs map[string]bool
+}
+
+// putRequest is a PUT the cluster received.
+type putRequest struct {
+	Path string
+	Body map[string]interface{}
+}
+
+func newFakeCluster(t *testing.T) (*fakeCluster, *httptest.Server) {
+	t.Helper()
+	cluster := &fakeCluster{
+		indices: map[string]bool{},
+		aliases: map[string][]string{},
+		failIDs: map[string]bool{},
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Elastic-Product", "Elasticsearch")
+		w.Header().Set("Content-Type", "application/json")
+		cluster.serve(t, w, r)
+	}))
+	t.Cleanup(server.Close)
+	return cluster, server
+}
+
+func (c *fakeCluster) serve(t *testing.T, w http.ResponseWriter, r *http.Request) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	path := strings.TrimPrefix(r.URL.Path, "/")
+	switch {
+	case r.Method == http.MethodPost && path == "_bulk":
+		c.serveBulk(t, w, r)
+	case r.Method == http.MethodPost && path == "_aliases":
+		var body struct {
+			Actions []map[string]map[string]string `json:"actions"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Errorf("failed to decode alias actions: %v", err)
+		}
+		for _, action := range body.Actions {
+			for kind, target := range action {
+				alias := target["alias"]
+				var kept []string
+				for _, index := range c.aliases[alias] {
+					if index != target["index"] {
+						kept = append(kept, index)
+					}
+				}
+				if kind == "add" {
+					kept = append(kept, target["index"])
+				}
+				c.aliases[alias] = kept
+			}
+		}
+		w.Write([]byte(`{"acknowledged":true}`))
+	case r.Method == http.MethodGet && strings.HasPrefix(path, "_alias/"):
+		alias := strings.TrimPrefix(path, "_alias/")
+		if len(c.aliases[alias]) == 0 {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{}`))
+			return
+		}
+		response := map[string]interface{}{}
+		for _, index := range c.aliases[alias] {
+			response[index] = map[string]interface{}{"aliases": map[string]interface{}{alias: map[string]interface{}{}}}
+		}
+		json.NewEncoder(w).Encode(response)
+	case r.Method == http.MethodHead:
+		if !c.indices[path] && len(c.aliases[path]) == 0 {
+			w.WriteHeader(http.StatusNotFound)
+		}
+	case r.Method == http.MethodPut:
+		put := putRequest{Path: path}
+		if err := json.NewDecoder(r.Body).Decode(&put.Body); err != nil && err != io.EOF {
+			t.Errorf("failed to decode body of PUT %s: %v", path, err)
+		}
+		c.puts = append(c.puts, put)
+		switch {
+		case strings.HasPrefix(path, "_data_stream/"):
+			c.indices[strings.TrimPrefix(path, "_data_stream/")] = true
+		case !strings.HasPrefix(path, "_"):
+			c.indices[path] = true
+		}
+		w.Write([]byte(`{"acknowledged":true}`))
+	case r.Method == http.MethodGet && strings.HasSuffix(path, "*"):
+		response := map[string]interface{}{}
+		for index := range c.indices {
+			if strings.HasPrefix(index, strings.TrimSuffix(path, "*")) {
+				response[index] = map[string]interface{}{}
+			}
+		}
+		json.NewEncoder(w).Encode(response)
+	case r.Method == http.MethodDelete:
+		for _, index := range strings.Split(path, ",") {
+			delete(c.indices, index)
+		}
+		w.Write([]byte(`{"acknowledged":true}`))
+	default:
+		t.Errorf("unexpected request %s %s", r.Method, r.URL)
+		w.WriteHeader(http.StatusBadRequest)
+	}
+}
+
+func (c *fakeCluster) serveBulk(t *testing.T, w http.ResponseWriter, r *http.Request) {
+	var items []map[string]interface{}
+	failed := false
+	scanner := bufio.NewScanner(r.Body)
+	for scanner.Scan() {
+		var line map[string]map[string]string
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			t.Errorf("failed to decode bulk action: %v", err)
+			return
+		}
+		for action, meta := range line {
+			entry := bulkAction{Action: action, Index: meta["_index"], ID: meta["_id"]}
+			if action != "delete" && scanner.Scan() {
+				if err := json.Unmarshal(scanner.Bytes(), &entry.Source); err != nil {
+					t.Errorf("failed to decode bulk source: %v", err)
+				}
+			}
+			result := map[string]interface{}{"_index": entry.Index, "_id": entry.ID, "status": http.StatusOK}
+			if c.failIDs[entry.ID] {
+				failed = true
+				result["status"] = http.StatusBadRequest
+				result["error"] = map[string]interface{}{"type": "mapper_parsing_exception", "reason": "failed to parse"}
+			} else {
+				c.bulk = append(c.bulk, entry)
+			}
+			items = append(items, map[string]interface{}{action: result})
+		}
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"errors": failed, "items": items})
+}
+
+func (c *fakeCluster) actions() []bulkAction {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]bulkAction(nil), c.bulk...)
+}
+
+func (c *fakeCluster) putRequests() []putRequest {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]putRequest(nil), c.puts...)
+}
+
+func (c *fakeCluster) indexNames() []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var names []string
+	for index := range c.indices {
+		names = append(names, index)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func newElasticSearch(t *testing.T, config map[string]interface{}) *ElasticSearch {
+	t.Helper()
+	destination := &ElasticSearch{}
+	if err := destination.Initialize(config); err != nil {
+		t.Fatalf("Initialize: %v", err)
+	}
+	return destination
+}
+
+func writeBatch(t *testing.T, destination *ElasticSearch, record nats.DestinationRecord) error {
+	t.Helper()
+	if err := destination.Run(record); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	return destination.Flush(context.Background())
+}
+
+func TestElasticSearchBulkActions(t *testing.T) {
+	cluster, server := newFakeCluster(t)
+	destination := newElasticSearch(t, map[string]interface{}{"url": server.URL, "index": "users"})
+
+	batches := []nats.DestinationRecord{
+		{PrimaryKey: []string{"id"}, Records: [][]byte{[]byte(`{"id":1,"name":"ada"}`), []byte(`{"id":2,"name":"grace"}`)}},
+		{PrimaryKey: []string{"id"}, Operation: nats.OperationUpdate, Partial: true, Records: [][]byte{[]byte(`{"id":1,"name":"lovelace"}`)}},
+		{PrimaryKey: []string{"id"}, Operation: nats.OperationDelete, Records: [][]byte{[]byte(`{"id":2}`)}},
+	}
+	for _, batch := range batches {
+		batch.PipelineID = 1
+		if err := writeBatch(t, destination, batch); err != nil {
+			t.Fatalf("Flush: %v", err)
+		}
+	}
+
+	want := []bulkAction{
+		{Action: "index", Index: "users", ID: "1", Source: map[string]interface{}{"id": 1.0, "name": "ada"}},
+		{Action: "index", Index: "users", ID: "2", Source: map[string]interface{}{"id": 2.0, "name": "grace"}},
+		{Action: "update", Index: "users", ID: "1", Source: map[string]interface{}{
+			"doc":           map[string]interface{}{"id": 1.0, "name": "lovelace"},
+			"doc_as_upsert": true,
+		}},
+		{Action: "delete", Index: "users", ID: "2"},
+	}
+	if got := cluster.actions(); !reflect.DeepEqual(got, want) {
+		t.Errorf("bulk actions = %+v, want %+v", got, want)
+	}
+	if got := cluster.indexNames(); !reflect.DeepEqual(got, []string{"users"}) {
+		t.Errorf("indices = %v, want [users]", got)
+	}
+}
+
+func TestElasticSearchFlushReportsFailedDocuments(t *testing.T) {
+	cluster, server := newFakeCluster(t)
+	cluster.failIDs["2"] = true
+	destination := newElasticSearch(t, map[string]interface{}{"url": server.URL, "index": "users"})
+
+	err := writeBatch(t, destination, nats.DestinationRecord{
+		PipelineID: 1,
+		PrimaryKey: []string{"id"},
+		Records:    [][]byte{[]byte(`{"id":1}`), []byte(`{"id":2}`)},
+	})
+	if err == nil {
+		t.Fatal("expected Flush to fail when a document is rejected")
+	}
+
+	// The next batch starts with a clean count.
+	err = writeBatch(t, destination, nats.DestinationRecord{
+		PipelineID: 1,
+		PrimaryKey: []string{"id"},
+		Records:    [][]byte{[]byte(`{"id":3}`)},
+	})
+	if err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+}
+
+func TestElasticSearchCompleteRun(t *testing.T) {
+	cluster, server := newFakeCluster(t)
+	cluster.indices["users-100"] = true
+	cluster.indices["users-200"] = true
+	cluster.aliases["users"] = []string{"users-200"}
+	destination := newElasticSearch(t, map[string]interface{}{
+		"url":           server.URL,
+		"index":         "users",
+		"reindex":       true,
+		"keep_versions": 1.0,
+	})
+
+	err := writeBatch(t, destination, nats.DestinationRecord{
+		PipelineID: 1,
+		Run:        "300",
+		PrimaryKey: []string{"id"},
+		Records:    [][]byte{[]byte(`{"id":1}`)},
+	})
+	if err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+	if got := cluster.actions(); len(got) != 1 || got[0].Index != "users-300" {
+		t.Fatalf("bulk actions = %+v, want one write to users-300", got)
+	}
+
+	ctx := context.Background()
+	if err := destination.CompleteRun(ctx, 1, "300"); err != nil {
+		t.Fatalf("CompleteRun: %v", err)
+	}
+	if got := cluster.aliases["users"]; !reflect.DeepEqual(got, []string{"users-300"}) {
+		t.Errorf("alias users = %v, want [users-300]", got)
+	}
+	if got := cluster.indexNames(); !reflect.DeepEqual(got, []string{"users-200", "users-300"}) {
+		t.Errorf("indices = %v, want the new version and one previous", got)
+	}
+
+	// A run that wrote nothing leaves the alias where it was.
+	if err := destination.CompleteRun(ctx, 1, "400"); err != nil {
+		t.Fatalf("CompleteRun: %v", err)
+	}
+	if got := cluster.aliases["users"]; !reflect.DeepEqual(got, []string{"users-300"}) {
+		t.Errorf("alias users = %v after an empty run, want [users-300]", got)
+	}
+}
+
+func TestElasticSearchCompleteRunRefusesConcreteIndex(t *testing.T) {
+	cluster, server := newFakeCluster(t)
+	cluster.indices["users"] = true
+	cluster.indices["users-300"] = true
+	destination := newElasticSearch(t, map[string]interface{}{"url": server.URL, "index": "users", "reindex": true})
+
+	if err := destination.CompleteRun(context.Background(), 1, "300"); err == nil {
+		t.Fatal("expected an error when the alias name is taken by an index")
+	}
+	if len(cluster.aliases["users"]) != 0 {
+		t.Errorf("alias users = %v, want none", cluster.aliases["users"])
+	}
+}
+
+func TestElasticSearchDataStream(t *testing.T) {
+	cluster, server := newFakeCluster(t)
+	policy := map[string]interface{}{
+		"phases": map[string]interface{}{
+			"delete": map[string]interface{}{"min_age": "30d", "actions": map[string]interface{}{"delete": map[string]interface{}{}}},
+		},
+	}
+	destination := newElasticSearch(t, map[string]interface{}{
+		"url":               server.URL,
+		"index":             "events",
+		"data_stream":       true,
+		"timestamp_field":   "at",
+		"generate_mappings": true,
+		"ilm_policy":        "events-policy",
+		"ilm_policy_body":   policy,
+	})
+
+	err := writeBatch(t, destination, nats.DestinationRecord{
+		PipelineID: 1,
+		Records:    [][]byte{[]byte(`{"at":"2024-03-05T10:00:00+01:00","name":"signup"}`)},
+	})
+	if err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+
+	// The policy comes before the template that names it, and the template
+	// before the stream it applies to.
+	puts := cluster.putRequests()
+	var paths []string
+	for _, put := range puts {
+		paths = append(paths, put.Path)
+	}
+	wantPaths := []string{"_ilm/policy/events-policy", "_index_template/dataforge-events", "_data_stream/events"}
+	if !reflect.DeepEqual(paths, wantPaths) {
+		t.Fatalf("PUT requests = %v, want %v", paths, wantPaths)
+	}
+	if want := map[string]interface{}{"policy": policy}; !reflect.DeepEqual(puts[0].Body, want) {
+		t.Errorf("ilm policy body = %v, want %v", puts[0].Body, want)
+	}
+
+	template := puts[1].Body
+	if got := template["index_patterns"]; !reflect.DeepEqual(got, []interface{}{"events"}) {
+		t.Errorf("index_patterns = %v, want [events]", got)
+	}
+	if got := template["data_stream"]; !reflect.DeepEqual(got, map[string]interface{}{}) {
+		t.Errorf("data_stream = %v, want {}", got)
+	}
+	inner, _ := template["template"].(map[string]interface{})
+	settings, _ := inner["settings"].(map[string]interface{})
+	if got := settings["index.lifecycle.name"]; got != "events-policy" {
+		t.Errorf("index.lifecycle.name = %v, want events-policy", got)
+	}
+	mappings, _ := inner["mappings"].(map[string]interface{})
+	properties, _ := mappings["properties"].(map[string]interface{})
+	if got := properties["@timestamp"]; !reflect.DeepEqual(got, map[string]interface{}{"type": "date"}) {
+		t.Errorf("@timestamp mapping = %v, want a date", got)
+	}
+
+	want := []bulkAction{{Action: "create", Index: "events", Source: map[string]interface{}{
+		"at":         "2024-03-05T10:00:00+01:00",
+		"name":       "signup",
+		"@timestamp": "2024-03-05T09:00:00Z",
+	}}}
+	if got := cluster.actions(); !reflect.DeepEqual(got, want) {
+		t.Errorf("bulk actions = %+v, want %+v", got, want)
+	}
+}
+
+func TestElasticSearchDatedIndexWithLifecyclePolicy(t *testing.T) {
+	cluster, server := newFakeCluster(t)
+	destination := newElasticSearch(t, map[string]interface{}{
+		"url":             server.URL,
+		"index":           "events-{yyyy.MM.dd}",
+		"timestamp_field": "at",
+		"ilm_policy":      "events-policy",
+	})
+
+	err := writeBatch(t, destination, nats.DestinationRecord{
+		PipelineID: 1,
+		Records: [][]byte{
+			[]byte(`{"at":"2024-03-05T23:30:00-01:00"}`),
+			[]byte(`{"at":1709596800000}`),
+		},
+	})
+	if err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+
+	// Each document goes to the index of its own day, in UTC.
+	var indices []string
+	for _, action := range cluster.actions() {
+		indices = append(indices, action.Index)
+	}
+	sort.Strings(indices)
+	if want := []string{"events-2024.03.05", "events-2024.03.06"}; !reflect.DeepEqual(indices, want) {
+		t.Errorf("documents went to %v, want %v", indices, want)
+	}
+
+	// Without a policy body the policy is left to exist already, and only
+	// named in the settings of each new index.
+	for _, put := range cluster.putRequests() {
+		if !strings.HasPrefix(put.Path, "events-") {
+			t.Errorf("unexpected PUT %s", put.Path)
+			continue
+		}
+		settings, _ := put.Body["settings"].(map[string]interface{})
+		if got := settings["index.lifecycle.name"]; got != "events-policy" {
+			t.Errorf("index %s has index.lifecycle.name %v, want events-policy", put.Path, got)
+		}
+	}
+}
+
+func TestRenderIndexName(t *testing.T) {
+	at := time.Date(2024, 3, 5, 23, 4, 5, 0, time.FixedZone("", -2*3600))
+	tests := []struct {
+		index string
+		want  string
+	}{
+		{"events", "events"},
+		{"events-{yyyy.MM.dd}", "events-2024.03.06"},
+		{"events-{yyyy.MM}", "events-2024.03"},
+		{"logs-{yy}-{HH}", "logs-24-01"},
+		{"logs-{yyyy.MM.dd.HH.mm.ss}", "logs-2024.03.06.01.04.05"},
+	}
+	for _, tt := range tests {
+		if got := renderIndexName(tt.index, at); got != tt.want {
+			t.Errorf("renderIndexName(%q) = %q, want %q", tt.index, got, tt.want)
+		}
+	}
+}
+
+func TestStampTimestamp(t *testing.T) {
+	now := time.Date(2024, 3, 5, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name          string
+		destination   *ElasticSearch
+		document      map[string]interface{}
+		wantTime      time.Time
+		wantTimestamp interface{}
+	}{
+		{
+			name:          "timestamp field as RFC 3339",
+			destination:   &ElasticSearch{timestampField: "at"},
+			document:      map[string]interface{}{"at": "2024-01-02T03:04:05+02:00"},
+			wantTime:      time.Date(2024, 1, 2, 1, 4, 5, 0, time.UTC),
+			wantTimestamp: "2024-01-02T01:04:05Z",
+		},
+		{
+			name:          "timestamp field in milliseconds",
+			destination:   &ElasticSearch{timestampField: "at"},
+			document:      map[string]interface{}{"at": json.Number("1704164645000")},
+			wantTime:      time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+			wantTimestamp: "2024-01-02T03:04:05Z",
+		},
+		{
+			name:          "timestamp field missing",
+			destination:   &ElasticSearch{timestampField: "at"},
+			document:      map[string]interface{}{},
+			wantTime:      now,
+			wantTimestamp: "2024-03-05T12:00:00Z",
+		},
+		{
+			name:          "data stream keeps an existing @timestamp",
+			destination:   &ElasticSearch{dataStream: true},
+			document:      map[string]interface{}{"@timestamp": "2024-01-02T03:04:05Z"},
+			wantTime:      time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+			wantTimestamp: "2024-01-02T03:04:05Z",
+		},
+		{
+			name:        "dated index reads the time without stamping it",
+			destination: &ElasticSearch{index: "events-{yyyy}"},
+			document:    map[string]interface{}{},
+			wantTime:    now,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := tt.destination.stampTimestamp(tt.document, now)
+			if !got.Equal(tt.wantTime) {
+				t.Errorf("stampTimestamp = %v, want %v", got, tt.wantTime)
+			}
+			if timestamp := tt.document["@timestamp"]; timestamp != tt.wantTimestamp {
+				t.Errorf("@timestamp = %v, want %v", timestamp, tt.wantTimestamp)
+			}
+		})
+	}
+}
@@ -0,0 +1,316 @@
+package warehouses
+
+import (
+	"bytes"
+	"context"
+	"dataforge-be/integrations/connection"
+	n "dataforge-be/nats"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"text/template"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Write modes of the destination.
+const (
+	redisID = "redis"
+
+	modeSet  = "set"
+	modeHSet = "hset"
+	modeXAdd = "xadd"
+	modeZAdd = "zadd"
+
+	defaultKeyTemplate       = "{{stream}}:{{key}}"
+	defaultStreamKeyTemplate = "{{stream}}"
+	redisWriteTimeout        = time.Minute
+)
+
+// Redis writes records into Redis, typically to keep app caches fed
+// from the warehouse:
+//
+//   - set stores the record as JSON under key_template, deleting it on delete
+//   - hset stores the record's fields in a hash under key_template
+//   - xadd appends the record as JSON to the stream named by key_template
+//   - zadd upserts the record's key into the sorted set named by
+//     key_template, scored by score_field, and removes it on delete
+//
+// Partial records are merged into the stored JSON or hash rather than
+// replacing it.
+//
+// Key templates are Go templates over the record's fields, with {{stream}}
+// and {{key}} (the joined primary key) also available.
+type Redis struct {
+	options     *redis.Options
+	mode        string
+	keyTemplate *template.Template
+	ttl         time.Duration
+	scoreField  string
+	maxLen      int64
+}
+
+func (d *Redis) Initialize(config map[string]interface{}) error {
+	options, err := connection.RedisOptions(config)
+	if err != nil {
+		return err
+	}
+	d.options = options
+
+	d.mode, _ = config["mode"].(string)
+	if d.mode == "" {
+		d.mode = modeSet
+	}
+
+	keyTemplate, _ := config["key_template"].(string)
+	switch d.mode {
+	case modeSet, modeHSet:
+		if keyTemplate == "" {
+			keyTemplate = defaultKeyTemplate
+		}
+	case modeXAdd:
+		if keyTemplate == "" {
+			keyTemplate = defaultStreamKeyTemplate
+		}
+	case modeZAdd:
+		if keyTemplate == "" {
+			keyTemplate = defaultStreamKeyTemplate
+		}
+		d.scoreField, _ = config["score_field"].(string)
+		if d.scoreField == "" {
+			return errors.New("redis zadd mode requires score_field")
+		}
+	default:
+		return fmt.Errorf("unsupported redis mode %q", d.mode)
+	}
+
+	// The real values are bound per record in keyFor.
+	placeholders := template.FuncMap{
+		"stream": func() string { return "" },
+		"key":    func() (string, error) { return "", nil },
+	}
+	d.keyTemplate, err = template.New("key").Funcs(placeholders).Option("missingkey=error").Parse(keyTemplate)
+	if err != nil {
+		return fmt.Errorf("invalid key_template: %w", err)
+	}
+
+	d.ttl = 0
+	if ttl, ok := config["ttl_seconds"].(float64); ok && ttl > 0 {
+		d.ttl = time.Duration(ttl * float64(time.Second))
+	}
+	d.maxLen = 0
+	if maxLen, ok := config["max_len"].(float64); ok && maxLen > 0 {
+		d.maxLen = int64(maxLen)
+	}
+	return nil
+}
+
+func (d *Redis) DestinationID() string {
+	return redisID
+}
+
+// keyFor renders the key template for a record. A template that uses
+// {{key}} fails for records without a primary key, rather than writing them
+// all to the same key.
+func (d *Redis) keyFor(stream, key string, hasKey bool, document map[string]interface{}) (string, error) {
+	tmpl, err := d.keyTemplate.Clone()
+	if err != nil {
+		return "", err
+	}
+	tmpl.Funcs(template.FuncMap{
+		"stream": func() string { return stream },
+		"key": func() (string, error) {
+			if !hasKey {
+				return "", errors.New("record has no primary key")
+			}
+			return key, nil
+		},
+	})
+
+	var b bytes.Buffer
+	if err := tmpl.Execute(&b, document); err != nil {
+		return "", fmt.Errorf("failed to render key_template: %w", err)
+	}
+	if b.Len() == 0 {
+		return "", errors.New("key_template rendered an empty key")
+	}
+	return b.String(), nil
+}
+
+func (d *Redis) Run(record n.DestinationRecord) error {
+	if len(record.Records) == 0 {
+		return nil
+	}
+
+	client := redis.NewClient(d.options)
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), redisWriteTimeout)
+	defer cancel()
+
+	// MULTI/EXEC keeps readers from seeing a hash between its DEL and HSET.
+	pipe := client.TxPipeline()
+	for _, recordBytes := range record.Records {
+		var document map[string]interface{}
+		decoder := json.NewDecoder(bytes.NewReader(recordBytes))
+		decoder.UseNumber()
+		if err := decoder.Decode(&document); err != nil {
+			return fmt.Errorf("error decoding record for pipeline %d: %w", record.PipelineID, err)
+		}
+
+		primaryKey, hasKey := n.PrimaryKeyValue(document, record.PrimaryKey)
+		if !hasKey && d.mode == modeZAdd {
+			return fmt.Errorf("redis zadd mode needs a primary key for pipeline %d", record.PipelineID)
+		}
+		key, err := d.keyFor(record.Stream, primaryKey, hasKey, document)
+		if err != nil {
+			return fmt.Errorf("pipeline %d: %w", record.PipelineID, err)
+		}
+
+		if record.Partial && d.mode == modeSet {
+			recordBytes, err = mergeStored(ctx, client, key, document)
+			if err != nil {
+				return fmt.Errorf("pipeline %d: %w", record.PipelineID, err)
+			}
+		}
+
+		if err := d.queue(ctx, pipe, key, primaryKey, record.Operation, record.Partial, recordBytes, document); err != nil {
+			return fmt.Errorf("pipeline %d: %w", record.PipelineID, err)
+		}
+	}
+
+	if _, err := pipe.Exec(ctx); err != nil {
+		return fmt.Errorf("failed to write %d records to redis for pipeline %d: %w", len(record.Records), record.PipelineID, err)
+	}
+	return nil
+}
+
+func (d *Redis) queue(ctx context.Context, pipe redis.Pipeliner, key, primaryKey, operation string, partial bool, recordBytes []byte, document map[string]interface{}) error {
+	isDelete := operation == n.OperationDelete
+	switch d.mode {
+	case modeSet:
+		if isDelete {
+			pipe.Del(ctx, key)
+			return nil
+		}
+		pipe.Set(ctx, key, recordBytes, d.ttl)
+	case modeHSet:
+		// HSET only adds fields, so the hash is replaced to drop fields
+		// the record no longer has, unless the record is partial and the
+		// fields it leaves out are meant to stay.
+		if !partial {
+			pipe.Del(ctx, key)
+		}
+		if isDelete {
+			return nil
+		}
+		fields := make([]interface{}, 0, len(document)*2)
+		for field, value := range document {
+			if value == nil {
+				continue
+			}
+			fields = append(fields, field, hashValue(value))
+		}
+		if len(fields) > 0 {
+			pipe.HSet(ctx, key, fields...)
+		}
+		if d.ttl > 0 {
+			pipe.Expire(ctx, key, d.ttl)
+		}
+	case modeXAdd:
+		values := map[string]interface{}{"data": string(recordBytes)}
+		if operation != "" {
+			values["operation"] = operation
+		}
+		if partial {
+			values["partial"] = "true"
+		}
+		pipe.XAdd(ctx, &redis.XAddArgs{
+			Stream: key,
+			MaxLen: d.maxLen,
+			Approx: d.maxLen > 0,
+			Values: values,
+		})
+	case modeZAdd:
+		if isDelete {
+			pipe.ZRem(ctx, key, primaryKey)
+			return nil
+		}
+		value, ok := document[d.scoreField]
+		if !ok && partial {
+			// The score did not change.
+			return nil
+		}
+		score, err := scoreValue(value)
+		if err != nil {
+			return fmt.Errorf("score_field %s: %w", d.scoreField, err)
+		}
+		pipe.ZAdd(ctx, key, redis.Z{Score: score, Member: primaryKey})
+	}
+	return nil
+}
+
+// mergeStored lays a partial record over the JSON stored under key, so the
+// fields it leaves out keep their values.
+func mergeStored(ctx context.Context, client *redis.Client, key string, document map[string]interface{}) ([]byte, error) {
+	stored, err := client.Get(ctx, key).Bytes()
+	if err != nil && !errors.Is(err, redis.Nil) {
+		return nil, fmt.Errorf("failed to read %s to merge into: %w", key, err)
+	}
+
+	merged := make(map[string]interface{})
+	if len(stored) > 0 {
+		decoder := json.NewDecoder(bytes.NewReader(stored))
+		decoder.UseNumber()
+		if err := decoder.Decode(&merged); err != nil {
+			// Anything that is not a JSON object is replaced.
+			merged = make(map[string]interface{})
+		}
+	}
+	for field, value := range document {
+		merged[field] = value
+	}
+	return json.Marshal(merged)
+}
+
+// hashValue stores strings as they are and anything else as JSON.
+func hashValue(value interface{}) string {
+	switch v := value.(type) {
+	case string:
+		return v
+	case json.Number:
+		return v.String()
+	default:
+		encoded, _ := json.Marshal(v)
+		return string(encoded)
+	}
+}
+
+// scoreValue accepts numbers, numeric strings and RFC 3339 timestamps, which
+// score by their Unix time in seconds.
+func scoreValue(value interface{}) (float64, error) {
+	switch v := value.(type) {
+	case json.Number:
+		return v.Float64()
+	case bool:
+		if v {
+			return 1, nil
+		}
+		return 0, nil
+	case string:
+		if score, err := strconv.ParseFloat(v, 64); err == nil {
+			return score, nil
+		}
+		t, err := time.Parse(time.RFC3339Nano, v)
+		if err != nil {
+			return 0, fmt.Errorf("cannot use %q as a score", v)
+		}
+		return float64(t.UnixNano()) / float64(time.Second), nil
+	case nil:
+		return 0, errors.New("missing score")
+	default:
+		return 0, fmt.Errorf("cannot use %v as a score", v)
+	}
+}
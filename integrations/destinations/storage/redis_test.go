@@ -0,0 +1,49 @@
+package warehouses
+
+import (
+	"testing"
+)
+
+func TestRedisKeyFor(t *testing.T) {
+	tests := []struct {
+		name     string
+		template string
+		key      string
+		hasKey   bool
+		want     string
+		wantErr  bool
+	}{
+		{name: "default template", key: "7", hasKey: true, want: "users:7"},
+		{name: "default template without primary key", wantErr: true},
+		{name: "record fields", template: "user:{{.email}}", want: "user:ada@example.com"},
+		{name: "stream only", template: "{{stream}}", want: "users"},
+		{name: "missing field", template: "user:{{.missing}}", wantErr: true},
+		{name: "empty key", template: `{{if false}}x{{end}}`, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			destination := &Redis{}
+			config := map[string]interface{}{"addr": "localhost:6379"}
+			if tt.template != "" {
+				config["key_template"] = tt.template
+			}
+			if err := destination.Initialize(config); err != nil {
+				t.Fatalf("Initialize: %v", err)
+			}
+
+			got, err := destination.keyFor("users", tt.key, tt.hasKey, map[string]interface{}{"email": "ada@example.com"})
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("keyFor = %q, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("keyFor: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("keyFor = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,106 @@
+package streams
+
+import (
+	"context"
+	"dataforge-be/integrations/connection"
+	n "dataforge-be/nats"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+const (
+	kafkaID = "kafka"
+
+	operationHeader = "dataforge-operation"
+	partialHeader   = "dataforge-partial"
+	produceTimeout  = time.Minute
+)
+
+// Kafka produces each record to a topic, keyed by the record's primary
+// key so all versions of a row land in the same partition. Deletes become
+// tombstones unless they are turned off.
+type Kafka struct {
+	opts       []kgo.Opt
+	topic      string
+	tombstones bool
+}
+
+func (d *Kafka) Initialize(config map[string]interface{}) error {
+	opts, err := connection.KafkaOptions(config)
+	if err != nil {
+		return err
+	}
+	d.opts = opts
+
+	d.topic, _ = config["topic"].(string)
+	if d.topic == "" {
+		return errors.New("kafka destination requires topic")
+	}
+	d.tombstones = true
+	if tombstones, ok := config["tombstones"].(bool); ok {
+		d.tombstones = tombstones
+	}
+	return nil
+}
+
+func (d *Kafka) DestinationID() string {
+	return kafkaID
+}
+
+// topicFor fills in a "{stream}" placeholder in the configured topic.
+func (d *Kafka) topicFor(stream string) string {
+	if stream == "" {
+		stream = "default"
+	}
+	return strings.ReplaceAll(d.topic, "{stream}", stream)
+}
+
+func (d *Kafka) Run(record n.DestinationRecord) error {
+	topic := d.topicFor(record.Stream)
+	records := make([]*kgo.Record, 0, len(record.Records))
+	for _, recordBytes := range record.Records {
+		message := &kgo.Record{Topic: topic, Value: recordBytes}
+
+		if len(record.PrimaryKey) > 0 {
+			var document map[string]interface{}
+			if err := json.Unmarshal(recordBytes, &document); err != nil {
+				return fmt.Errorf("error decoding record for pipeline %d: %w", record.PipelineID, err)
+			}
+			if key, ok := n.PrimaryKeyValue(document, record.PrimaryKey); ok {
+				message.Key = []byte(key)
+			}
+		}
+
+		if record.Operation != "" {
+			message.Headers = append(message.Headers, kgo.RecordHeader{Key: operationHeader, Value: []byte(record.Operation)})
+		}
+		if record.Partial {
+			message.Headers = append(message.Headers, kgo.RecordHeader{Key: partialHeader, Value: []byte("true")})
+		}
+		if record.Operation == n.OperationDelete && d.tombstones && message.Key != nil {
+			message.Value = nil
+		}
+		records = append(records, message)
+	}
+	if len(records) == 0 {
+		return nil
+	}
+
+	client, err := kgo.NewClient(d.opts...)
+	if err != nil {
+		return fmt.Errorf("failed to create kafka client: %w", err)
+	}
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), produceTimeout)
+	defer cancel()
+	if err := client.ProduceSync(ctx, records...).FirstErr(); err != nil {
+		return fmt.Errorf("failed to produce to %s for pipeline %d: %w", topic, record.PipelineID, err)
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+package streams
+
+import (
+	"context"
+	n "dataforge-be/nats"
+	"testing"
+	"time"
+
+	"github.com/twmb/franz-go/pkg/kfake"
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+func TestKafkaProducesKeyedRecords(t *testing.T) {
+	cluster, err := kfake.NewCluster(kfake.NumBrokers(1), kfake.SeedTopics(1, "dataforge.users"))
+	if err != nil {
+		t.Fatalf("failed to start kafka cluster: %v", err)
+	}
+	defer cluster.Close()
+
+	destination := &Kafka{}
+	err = destination.Initialize(map[string]interface{}{
+		"brokers": cluster.ListenAddrs()[0],
+		"topic":   "dataforge.{stream}",
+	})
+	if err != nil {
+		t.Fatalf("Initialize: %v", err)
+	}
+
+	batches := []n.DestinationRecord{
+		{PipelineID: 1, Stream: "users", PrimaryKey: []string{"id"}, Operation: n.OperationUpdate, Partial: true,
+			Records: [][]byte{[]byte(`{"id":1,"name":"ada"}`)}},
+		{PipelineID: 1, Stream: "users", PrimaryKey: []string{"id"}, Operation: n.OperationDelete,
+			Records: [][]byte{[]byte(`{"id":2}`)}},
+	}
+	for _, batch := range batches {
+		if err := destination.Run(batch); err != nil {
+			t.Fatalf("Run: %v", err)
+		}
+	}
+
+	client, err := kgo.NewClient(kgo.SeedBrokers(cluster.ListenAddrs()...), kgo.ConsumeTopics("dataforge.users"))
+	if err != nil {
+		t.Fatalf("failed to create consumer: %v", err)
+	}
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	var records []*kgo.Record
+	for len(records) < len(batches) {
+		fetches := client.PollFetches(ctx)
+		if err := fetches.Err(); err != nil {
+			t.Fatalf("failed to consume: %v", err)
+		}
+		records = append(records, fetches.Records()...)
+	}
+
+	headers := func(r *kgo.Record) map[string]string {
+		values := map[string]string{}
+		for _, header := range r.Headers {
+			values[header.Key] = string(header.Value)
+		}
+		return values
+	}
+
+	update := records[0]
+	if string(update.Key) != "1" || string(update.Value) != `{"id":1,"name":"ada"}` {
+		t.Errorf("update = key %q value %q", update.Key, update.Value)
+	}
+	if h := headers(update); h[operationHeader] != n.OperationUpdate || h[partialHeader] != "true" {
+		t.Errorf("update headers = %v", h)
+	}
+
+	tombstone := records[1]
+	if string(tombstone.Key) != "2" || tombstone.Value != nil {
+		t.Errorf("delete = key %q value %q, want a tombstone", tombstone.Key, tombstone.Value)
+	}
+	if h := headers(tombstone); h[operationHeader] != n.OperationDelete {
+		t.Errorf("delete headers = %v", h)
+	}
+}
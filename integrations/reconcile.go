@@ -0,0 +1,62 @@
+package integrations
+
+import (
+	"context"
+	"dataforge-be/db"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// ReconcileWarehouseObjects finds objects created by dataforge in each
+// source's warehouse that no existing pipeline owns. Orphans are keyed by
+// source ID and dropped when drop is set.
+func ReconcileWarehouseObjects(ctx context.Context, db *db.DB, js jetstream.JetStream, drop bool) (map[int64][]string, error) {
+	pipelines, err := db.GetPipelines(ctx)
+	if err != nil {
+		return nil, err
+	}
+	livePipelineIDs := make([]int64, 0, len(pipelines))
+	for _, pipeline := range pipelines {
+		livePipelineIDs = append(livePipelineIDs, pipeline.ID)
+	}
+
+	sources, err := db.GetSources(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	orphans := make(map[int64][]string)
+	for _, source := range sources {
+		reconciler, ok := FetchSources()[source.SourceType].(Reconciler)
+		if !ok {
+			continue
+		}
+
+		var sourceConfig map[string]interface{}
+		err = json.Unmarshal(source.Config, &sourceConfig)
+		if err != nil {
+			return orphans, err
+		}
+
+		err = reconciler.(Source).Initialize(sourceConfig)
+		if err != nil {
+			return orphans, fmt.Errorf("failed to initialize source %d: %w", source.ID, err)
+		}
+
+		found, err := reconciler.Reconcile(ctx, livePipelineIDs, js, drop)
+		if closer, ok := reconciler.(io.Closer); ok {
+			closer.Close()
+		}
+		if err != nil {
+			return orphans, fmt.Errorf("failed to reconcile source %d: %w", source.ID, err)
+		}
+		if len(found) > 0 {
+			orphans[source.ID] = found
+		}
+	}
+
+	return orphans, nil
+}
@@ -1,15 +1,21 @@
 package apps
 
 import (
+	"bufio"
 	"bytes"
+	"compress/gzip"
 	"context"
+	n "dataforge-be/nats"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
+	"hash/fnv"
 	"io"
 	"log"
 	"net/http"
 	"net/url"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -19,92 +25,431 @@ import (
 const (
 	mongoID        = "mongodb"
 	baseURL        = "https://cloud.mongodb.com/api/atlas/v2"
+	tokenPath      = "/api/oauth/token"
 	projEventsPath = "/groups/%s/events"
 	projsPath      = "/groups"
+	orgEventsPath  = "/orgs/%s/events"
+	orgsPath       = "/orgs"
+	alertsPath     = "/groups/%s/alerts"
+	clustersPath   = "/groups/%s/clusters"
+	dbUsersPath    = "/groups/%s/databaseUsers"
+	accessLogsPath = "/groups/%s/dbAccessHistory/clusters/%s"
+	processesPath  = "/groups/%s/processes"
+	auditLogPath   = "/groups/%s/clusters/%s/logs/mongodb-audit-log.gz"
+
+	atlasJSONAccept = "application/vnd.atlas.2024-08-05+json"
+	atlasGzipAccept = "application/vnd.atlas.2023-02-01+gzip"
+	itemsPerPage    = 500
+	initialLookback = 10000 * time.Hour
 )
 
+// Streams the source can sync. Each keeps its own cursor in pipeline state.
+const (
+	ProjectEventsStream = "project_events"
+	OrgEventsStream     = "org_events"
+	AlertsStream        = "alerts"
+	ClustersStream      = "clusters"
+	DatabaseUsersStream = "database_users"
+	AccessLogsStream    = "access_logs"
+	AuditLogsStream     = "audit_logs"
+)
+
+var mongoStreams = []string{
+	ProjectEventsStream,
+	OrgEventsStream,
+	AlertsStream,
+	ClustersStream,
+	DatabaseUsersStream,
+	AccessLogsStream,
+	AuditLogsStream,
+}
+
 type MongoDB struct {
-	client *Client
-	state  *InputState
+	client     *Client
+	streams    []string
+	pipelineID int64
+	js         jetstream.JetStream
 }
 
 func (m *MongoDB) Initialize(config map[string]interface{}) error {
 	clientID, _ := config["client_id"].(string)
 	clientSecret, _ := config["client_secret"].(string)
 
-	authenticator := NewTokenAuthenticator(clientID, clientSecret, &http.Client{
+	apiURL, _ := config["base_url"].(string)
+	if apiURL == "" {
+		apiURL = baseURL
+	}
+	apiURL = strings.TrimRight(apiURL, "/")
+
+	tokenURL, _ := config["token_url"].(string)
+	if tokenURL == "" {
+		parsed, err := url.Parse(apiURL)
+		if err != nil || parsed.Host == "" {
+			return fmt.Errorf("invalid base_url %q", apiURL)
+		}
+		tokenURL = fmt.Sprintf("%s://%s%s", parsed.Scheme, parsed.Host, tokenPath)
+	}
+
+	m.streams = nil
+	streams, _ := config["streams"].([]interface{})
+	for _, stream := range streams {
+		name, _ := stream.(string)
+		if !isMongoStream(name) {
+			return fmt.Errorf("unknown mongodb stream %q", name)
+		}
+		m.streams = append(m.streams, name)
+	}
+	if len(m.streams) == 0 {
+		m.streams = []string{ProjectEventsStream}
+	}
+
+	authenticator := NewTokenAuthenticator(tokenURL, clientID, clientSecret, &http.Client{
 		Timeout: 10 * time.Second,
 	})
 
-	m.client = NewClient(authenticator, &http.Client{
-		Timeout: 10 * time.Second,
+	m.client = NewClient(apiURL, authenticator, &http.Client{
+		Timeout: 30 * time.Second,
 	})
 
 	return nil
 }
 
+func isMongoStream(name string) bool {
+	for _, stream := range mongoStreams {
+		if stream == name {
+			return true
+		}
+	}
+	return false
+}
+
 func (m *MongoDB) SourceID() string {
 	return mongoID
 }
 
 func (m *MongoDB) Run(ctx context.Context, pipelineID int64, js jetstream.JetStream) error {
-	currentSyncTime := time.Now().UTC()
+	m.pipelineID = pipelineID
+	m.js = js
+
+	var projIds []string
+	for _, stream := range m.streams {
+		if stream != OrgEventsStream {
+			var err error
+			projIds, err = m.client.GetProjsIds(ctx)
+			if err != nil {
+				return fmt.Errorf("failed to get project IDs: %w", err)
+			}
+			break
+		}
+	}
 
-	projIds, err := m.client.GetProjsIds(ctx)
+	for _, stream := range m.streams {
+		cursors := make(map[string]string)
+		stateName := fmt.Sprintf("atlas-%s", stream)
+		_, err := n.GetPipelineState(ctx, js, pipelineID, stateName, &cursors)
+		if err != nil {
+			return err
+		}
+		save := func() error {
+			return n.PutPipelineState(ctx, js, pipelineID, stateName, cursors)
+		}
+
+		switch stream {
+		case ProjectEventsStream:
+			err = m.syncProjectEvents(ctx, projIds, cursors, save)
+		case OrgEventsStream:
+			err = m.syncOrgEvents(ctx, cursors, save)
+		case AlertsStream:
+			err = m.syncAlerts(ctx, projIds, cursors, save)
+		case ClustersStream:
+			err = m.syncSnapshots(ctx, stream, projIds, []string{"id"}, m.client.GetClusters, cursors, save)
+		case DatabaseUsersStream:
+			err = m.syncSnapshots(ctx, stream, projIds, []string{"groupId", "databaseName", "username"}, m.client.GetDatabaseUsers, cursors, save)
+		case AccessLogsStream:
+			err = m.syncAccessLogs(ctx, projIds, cursors, save)
+		case AuditLogsStream:
+			err = m.syncAuditLogs(ctx, projIds, cursors, save)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to sync %s: %w", stream, err)
+		}
+	}
+	return nil
+}
+
+func (m *MongoDB) publish(ctx context.Context, stream, operation string, primaryKey []string, records []map[string]interface{}) error {
+	if len(records) == 0 {
+		return nil
+	}
+
+	destinationRecord := n.DestinationRecord{
+		PipelineID: m.pipelineID,
+		Stream:     stream,
+		PrimaryKey: primaryKey,
+		Operation:  operation,
+	}
+	for _, record := range records {
+		recordBytes, err := json.Marshal(record)
+		if err != nil {
+			return fmt.Errorf("failed to marshal record: %w", err)
+		}
+		destinationRecord.Records = append(destinationRecord.Records, recordBytes)
+	}
+
+	err := n.PublishRecords(ctx, m.js, destinationRecord)
 	if err != nil {
-		return fmt.Errorf("failed to get project IDs: %w", err)
+		return err
 	}
+	log.Printf("Published %d %s records to OUTPUT", len(records), stream)
+	return nil
+}
 
-	if m.state == nil {
-		m.state = &InputState{
-			LastSyncTime: currentSyncTime.Add(-10000 * time.Hour),
+// timeCursor returns the saved cursor for key, or the initial lookback window
+// when the stream has not been synced yet.
+func timeCursor(cursors map[string]string, key string) time.Time {
+	if cursor, err := time.Parse(time.RFC3339Nano, cursors[key]); err == nil {
+		return cursor
+	}
+	return time.Now().UTC().Add(-initialLookback)
+}
+
+func recordTime(record map[string]interface{}, field string) (time.Time, bool) {
+	value, _ := record[field].(string)
+	t, err := time.Parse(time.RFC3339Nano, value)
+	return t, err == nil
+}
+
+// syncEvents publishes events created since the cursor. minDate is inclusive,
+// so events at exactly the cursor time may be sent again.
+func (m *MongoDB) syncEvents(ctx context.Context, stream string, ids []string, path string, cursors map[string]string, save func() error) error {
+	for _, id := range ids {
+		cursor := timeCursor(cursors, id)
+		latest := cursor
+
+		err := m.client.ListPages(ctx, fmt.Sprintf(path, id), url.Values{"minDate": {cursor.Format(time.RFC3339)}}, func(results []map[string]interface{}) error {
+			for _, event := range results {
+				if created, ok := recordTime(event, "created"); ok && created.After(latest) {
+					latest = created
+				}
+			}
+			return m.publish(ctx, stream, "", []string{"id"}, results)
+		})
+		if err != nil {
+			return fmt.Errorf("failed to get events for %s: %w", id, err)
 		}
+
+		cursors[id] = latest.Format(time.RFC3339Nano)
+		if err := save(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *MongoDB) syncProjectEvents(ctx context.Context, projIds []string, cursors map[string]string, save func() error) error {
+	return m.syncEvents(ctx, ProjectEventsStream, projIds, projEventsPath, cursors, save)
+}
+
+func (m *MongoDB) syncOrgEvents(ctx context.Context, cursors map[string]string, save func() error) error {
+	orgIds, err := m.client.GetOrgIds(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get organization IDs: %w", err)
 	}
+	return m.syncEvents(ctx, OrgEventsStream, orgIds, orgEventsPath, cursors, save)
+}
 
+// syncAlerts publishes alerts updated since the cursor. The alerts endpoint
+// cannot filter by date, so older alerts are skipped here.
+func (m *MongoDB) syncAlerts(ctx context.Context, projIds []string, cursors map[string]string, save func() error) error {
 	for _, id := range projIds {
-		pageNumber := 1
-		for {
-			events, err := m.client.GetProjEventsByPage(ctx, id, m.state.LastSyncTime, pageNumber)
-			if err != nil {
-				return fmt.Errorf("failed to get events for project %s: %w", id, err)
+		cursor := timeCursor(cursors, id)
+		latest := cursor
+
+		err := m.client.ListPages(ctx, fmt.Sprintf(alertsPath, id), nil, func(results []map[string]interface{}) error {
+			var updated []map[string]interface{}
+			for _, alert := range results {
+				changed, ok := recordTime(alert, "updated")
+				if !ok {
+					changed, ok = recordTime(alert, "created")
+				}
+				if ok && !changed.After(cursor) {
+					continue
+				}
+				if changed.After(latest) {
+					latest = changed
+				}
+				updated = append(updated, alert)
 			}
+			return m.publish(ctx, AlertsStream, "", []string{"id"}, updated)
+		})
+		if err != nil {
+			return fmt.Errorf("failed to get alerts for project %s: %w", id, err)
+		}
+
+		cursors[id] = latest.Format(time.RFC3339Nano)
+		if err := save(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// syncSnapshots handles resources without change timestamps. The cursor is a
+// hash of each record, so only new or changed records are published, and
+// records that disappeared are published as deletes.
+func (m *MongoDB) syncSnapshots(ctx context.Context, stream string, projIds []string, primaryKey []string, list func(context.Context, string) ([]map[string]interface{}, error), cursors map[string]string, save func() error) error {
+	for _, id := range projIds {
+		records, err := list(ctx, id)
+		if err != nil {
+			return fmt.Errorf("failed to list %s for project %s: %w", stream, id, err)
+		}
 
-			if len(events.Results) == 0 {
-				break
+		prefix := id + "/"
+		seen := make(map[string]bool)
+		var changed []map[string]interface{}
+		for _, record := range records {
+			key := prefix + recordKey(record, primaryKey)
+			hash, err := recordHash(record)
+			if err != nil {
+				return err
+			}
+			seen[key] = true
+			if cursors[key] != hash {
+				cursors[key] = hash
+				changed = append(changed, record)
 			}
+		}
 
-			var allEvents [][]byte
-			for _, event := range events.Results {
-				eventBytes, err := json.Marshal(event)
-				if err != nil {
-					return fmt.Errorf("failed to marshal event: %w", err)
+		var deleted []map[string]interface{}
+		for key := range cursors {
+			if !strings.HasPrefix(key, prefix) || seen[key] {
+				continue
+			}
+			var keyValues []string
+			if err := json.Unmarshal([]byte(strings.TrimPrefix(key, prefix)), &keyValues); err == nil && len(keyValues) == len(primaryKey) {
+				record := make(map[string]interface{}, len(primaryKey))
+				for i, column := range primaryKey {
+					record[column] = keyValues[i]
 				}
-				allEvents = append(allEvents, eventBytes)
+				deleted = append(deleted, record)
 			}
+			delete(cursors, key)
+		}
+
+		if err := m.publish(ctx, stream, n.OperationUpdate, primaryKey, changed); err != nil {
+			return err
+		}
+		if err := m.publish(ctx, stream, n.OperationDelete, primaryKey, deleted); err != nil {
+			return err
+		}
+		if err := save(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-			destRecord := map[string]interface{}{
-				"pipeline_id": pipelineID,
-				"records":     allEvents,
+func recordKey(record map[string]interface{}, primaryKey []string) string {
+	values := make([]string, len(primaryKey))
+	for i, column := range primaryKey {
+		values[i] = fmt.Sprint(record[column])
+	}
+	key, _ := json.Marshal(values)
+	return string(key)
+}
+
+func recordHash(record map[string]interface{}) (string, error) {
+	recordBytes, err := json.Marshal(record)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal record: %w", err)
+	}
+	h := fnv.New64a()
+	h.Write(recordBytes)
+	return strconv.FormatUint(h.Sum64(), 16), nil
+}
+
+// syncAccessLogs reads database authentication attempts per cluster. The
+// cursor is the end of the last window that was read.
+func (m *MongoDB) syncAccessLogs(ctx context.Context, projIds []string, cursors map[string]string, save func() error) error {
+	for _, projID := range projIds {
+		clusters, err := m.client.GetClusters(ctx, projID)
+		if err != nil {
+			return fmt.Errorf("failed to list clusters for project %s: %w", projID, err)
+		}
+
+		for _, cluster := range clusters {
+			name, _ := cluster["name"].(string)
+			if name == "" {
+				continue
 			}
-			destRecordBytes, err := json.Marshal(destRecord)
+			key := projID + "/" + name
+			start := timeCursor(cursors, key)
+			end := time.Now().UTC()
+
+			logs, err := m.client.GetAccessLogs(ctx, projID, name, start, end)
 			if err != nil {
-				return fmt.Errorf("failed to marshal event: %w", err)
+				return fmt.Errorf("failed to get access logs for cluster %s: %w", name, err)
 			}
-			ack, err := js.Publish(ctx, "OUTPUT", destRecordBytes)
-			if err != nil {
-				return fmt.Errorf("failed to publish message to OUTPUT subject: %w", err)
+			for _, entry := range logs {
+				entry["groupId"] = projID
+				entry["clusterName"] = name
+			}
+			if err := m.publish(ctx, AccessLogsStream, "", nil, logs); err != nil {
+				return err
 			}
 
-			log.Printf("Message published to OUTPUT subject. Ack: Stream=%s, Seq=%d", ack.Stream, ack.Sequence)
-			pageNumber++
+			cursors[key] = end.Format(time.RFC3339Nano)
+			if err := save(); err != nil {
+				return err
+			}
 		}
 	}
+	return nil
+}
+
+// syncAuditLogs downloads the audit log of every process since the cursor.
+// Audit logging has to be enabled on the project.
+func (m *MongoDB) syncAuditLogs(ctx context.Context, projIds []string, cursors map[string]string, save func() error) error {
+	for _, projID := range projIds {
+		hosts, err := m.client.GetProcessHostnames(ctx, projID)
+		if err != nil {
+			return fmt.Errorf("failed to list processes for project %s: %w", projID, err)
+		}
 
-	m.state.LastSyncTime = currentSyncTime
+		for _, host := range hosts {
+			key := projID + "/" + host
+			start := timeCursor(cursors, key)
+			end := time.Now().UTC()
+
+			entries, err := m.client.GetAuditLog(ctx, projID, host, start, end)
+			if err != nil {
+				return fmt.Errorf("failed to get audit log for %s: %w", host, err)
+			}
+			for _, entry := range entries {
+				entry["groupId"] = projID
+				entry["hostname"] = host
+			}
+			if err := m.publish(ctx, AuditLogsStream, "", nil, entries); err != nil {
+				return err
+			}
+
+			cursors[key] = end.Format(time.RFC3339Nano)
+			if err := save(); err != nil {
+				return err
+			}
+		}
+	}
 	return nil
 }
 
+// Authenticator adds credentials to an outgoing API request.
+type Authenticator interface {
+	AddAuth(req *http.Request) error
+}
+
+// TokenAuthenticator fetches and caches OAuth2 client credentials tokens.
 type TokenAuthenticator struct {
+	tokenURL     string
 	clientID     string
 	clientSecret string
 	client       *http.Client
@@ -117,8 +462,9 @@ type TokenInfo struct {
 	ExpiresAt time.Time
 }
 
-func NewTokenAuthenticator(clientID, clientSecret string, client *http.Client) *TokenAuthenticator {
+func NewTokenAuthenticator(tokenURL, clientID, clientSecret string, client *http.Client) *TokenAuthenticator {
 	return &TokenAuthenticator{
+		tokenURL:     tokenURL,
 		clientID:     clientID,
 		clientSecret: clientSecret,
 		client:       client,
@@ -155,7 +501,7 @@ func (t *TokenAuthenticator) getValidToken() (string, error) {
 	data := url.Values{}
 	data.Set("grant_type", "client_credentials")
 
-	req, err := http.NewRequest("POST", "https://cloud.mongodb.com/api/oauth/token", bytes.NewBufferString(data.Encode()))
+	req, err := http.NewRequest("POST", t.tokenURL, bytes.NewBufferString(data.Encode()))
 	if err != nil {
 		return "", fmt.Errorf("failed to create request: %w", err)
 	}
@@ -192,43 +538,29 @@ func (t *TokenAuthenticator) getValidToken() (string, error) {
 }
 
 type Client struct {
+	baseURL       string
 	client        *http.Client
-	authenticator *TokenAuthenticator
+	authenticator Authenticator
 }
 
-type MongoDBOrgEventResponse struct {
-	Results []map[string]interface{} `json:"results"`
+type mongoDbListResponse struct {
+	Results    []map[string]interface{} `json:"results"`
+	TotalCount int                      `json:"totalCount"`
 }
 
-type mongoDbProjsResponse struct {
-	Results []mongoDbProjResult `json:"results"`
+type mongoDbAccessLogsResponse struct {
+	AccessLogs []map[string]interface{} `json:"accessLogs"`
 }
 
-type mongoDbProjResult struct {
-	ID string `json:"id"`
-}
-
-type MongoDBOrgsResponse struct {
-	Results []struct {
-		ID string `json:"id"`
-	} `json:"results"`
-}
-
-type MongoDBProjsResponse struct {
-	Results []struct {
-		ID string `json:"id"`
-	} `json:"results"`
-}
-
-type InputState struct {
-	LastSyncTime time.Time `json:"last_sync_time"`
-}
-
-func NewClient(authenticator *TokenAuthenticator, client *http.Client) *Client {
+func NewClient(apiURL string, authenticator Authenticator, client *http.Client) *Client {
 	if client == nil {
 		client = &http.Client{Timeout: 10 * time.Second}
 	}
+	if apiURL == "" {
+		apiURL = baseURL
+	}
 	return &Client{
+		baseURL:       strings.TrimRight(apiURL, "/"),
 		client:        client,
 		authenticator: authenticator,
 	}
@@ -257,14 +589,11 @@ func (c *Client) doRequest(req *http.Request) ([]byte, error) {
 	return body, nil
 }
 
-func (c *Client) GetProjEventsByPage(ctx context.Context, projID string, lastRunTime time.Time, pageNumber int) (*MongoDBOrgEventResponse, error) {
-	path := fmt.Sprintf("%s%s", baseURL, fmt.Sprintf(projEventsPath, projID))
-
-	queryParams := url.Values{}
-	queryParams.Add("minDate", lastRunTime.Format(time.RFC3339))
-	queryParams.Add("pageNum", fmt.Sprintf("%d", pageNumber))
-
-	pathWithQuery := fmt.Sprintf("%s?%s", path, queryParams.Encode())
+func (c *Client) get(ctx context.Context, path string, query url.Values, accept string) ([]byte, error) {
+	pathWithQuery := fmt.Sprintf("%s%s", c.baseURL, path)
+	if len(query) > 0 {
+		pathWithQuery = fmt.Sprintf("%s?%s", pathWithQuery, query.Encode())
+	}
 
 	req, err := http.NewRequestWithContext(ctx, "GET", pathWithQuery, nil)
 	if err != nil {
@@ -272,41 +601,156 @@ func (c *Client) GetProjEventsByPage(ctx context.Context, projID string, lastRun
 	}
 
 	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Accept", "application/vnd.atlas.2024-08-05+json")
+	req.Header.Set("Accept", accept)
 
-	resp, err := c.doRequest(req)
-	if err != nil {
-		return nil, err
+	return c.doRequest(req)
+}
+
+// ListPages calls fn with each page of a paginated list endpoint.
+func (c *Client) ListPages(ctx context.Context, path string, query url.Values, fn func(results []map[string]interface{}) error) error {
+	read := 0
+	for pageNumber := 1; ; pageNumber++ {
+		pageQuery := url.Values{}
+		for key, values := range query {
+			pageQuery[key] = values
+		}
+		pageQuery.Set("pageNum", strconv.Itoa(pageNumber))
+		pageQuery.Set("itemsPerPage", strconv.Itoa(itemsPerPage))
+
+		resp, err := c.get(ctx, path, pageQuery, atlasJSONAccept)
+		if err != nil {
+			return err
+		}
+		page := &mongoDbListResponse{}
+		if err := json.Unmarshal(resp, page); err != nil {
+			return err
+		}
+		if len(page.Results) == 0 {
+			return nil
+		}
+		if err := fn(page.Results); err != nil {
+			return err
+		}
+
+		read += len(page.Results)
+		if len(page.Results) < itemsPerPage || (page.TotalCount > 0 && read >= page.TotalCount) {
+			return nil
+		}
 	}
+}
 
-	eventsResponse := &MongoDBOrgEventResponse{}
-	if err := json.Unmarshal(resp, eventsResponse); err != nil {
+func (c *Client) listAll(ctx context.Context, path string) ([]map[string]interface{}, error) {
+	var all []map[string]interface{}
+	err := c.ListPages(ctx, path, nil, func(results []map[string]interface{}) error {
+		all = append(all, results...)
+		return nil
+	})
+	return all, err
+}
+
+func (c *Client) listIds(ctx context.Context, path string) ([]string, error) {
+	results, err := c.listAll(ctx, path)
+	if err != nil {
 		return nil, err
 	}
 
-	return eventsResponse, nil
+	var Ids []string
+	for _, result := range results {
+		if id, ok := result["id"].(string); ok {
+			Ids = append(Ids, id)
+		}
+	}
+	return Ids, nil
 }
 
 func (c *Client) GetProjsIds(ctx context.Context) ([]string, error) {
-	var Ids []string
-	path := fmt.Sprintf("%s%s", baseURL, projsPath)
-	req, err := http.NewRequestWithContext(ctx, "GET", path, nil)
+	return c.listIds(ctx, projsPath)
+}
+
+func (c *Client) GetOrgIds(ctx context.Context) ([]string, error) {
+	return c.listIds(ctx, orgsPath)
+}
+
+func (c *Client) GetClusters(ctx context.Context, projID string) ([]map[string]interface{}, error) {
+	return c.listAll(ctx, fmt.Sprintf(clustersPath, projID))
+}
+
+func (c *Client) GetDatabaseUsers(ctx context.Context, projID string) ([]map[string]interface{}, error) {
+	return c.listAll(ctx, fmt.Sprintf(dbUsersPath, projID))
+}
+
+func (c *Client) GetAccessLogs(ctx context.Context, projID, clusterName string, start, end time.Time) ([]map[string]interface{}, error) {
+	queryParams := url.Values{}
+	queryParams.Add("start", strconv.FormatInt(start.UnixMilli(), 10))
+	queryParams.Add("end", strconv.FormatInt(end.UnixMilli(), 10))
+
+	resp, err := c.get(ctx, fmt.Sprintf(accessLogsPath, projID, url.PathEscape(clusterName)), queryParams, atlasJSONAccept)
 	if err != nil {
 		return nil, err
 	}
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Accept", "application/vnd.atlas.2024-08-05+json")
 
-	resp, err := c.doRequest(req)
+	logsResponse := &mongoDbAccessLogsResponse{}
+	if err := json.Unmarshal(resp, logsResponse); err != nil {
+		return nil, err
+	}
+	return logsResponse.AccessLogs, nil
+}
+
+func (c *Client) GetProcessHostnames(ctx context.Context, projID string) ([]string, error) {
+	processes, err := c.listAll(ctx, fmt.Sprintf(processesPath, projID))
 	if err != nil {
 		return nil, err
 	}
-	projsResponse := &mongoDbProjsResponse{}
-	if err := json.Unmarshal(resp, projsResponse); err != nil {
+
+	seen := make(map[string]bool)
+	var hostnames []string
+	for _, process := range processes {
+		hostname, _ := process["hostname"].(string)
+		if hostname != "" && !seen[hostname] {
+			seen[hostname] = true
+			hostnames = append(hostnames, hostname)
+		}
+	}
+	return hostnames, nil
+}
+
+// GetAuditLog downloads the gzipped audit log of a host and returns one
+// record per log line.
+func (c *Client) GetAuditLog(ctx context.Context, projID, hostname string, start, end time.Time) ([]map[string]interface{}, error) {
+	queryParams := url.Values{}
+	queryParams.Add("startDate", strconv.FormatInt(start.Unix(), 10))
+	queryParams.Add("endDate", strconv.FormatInt(end.Unix(), 10))
+
+	resp, err := c.get(ctx, fmt.Sprintf(auditLogPath, projID, url.PathEscape(hostname)), queryParams, atlasGzipAccept)
+	if err != nil {
 		return nil, err
 	}
-	for _, org := range projsResponse.Results {
-		Ids = append(Ids, org.ID)
+	if len(resp) == 0 {
+		return nil, nil
 	}
-	return Ids, nil
+
+	reader, err := gzip.NewReader(bytes.NewReader(resp))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read audit log: %w", err)
+	}
+	defer reader.Close()
+
+	var entries []map[string]interface{}
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		var entry map[string]interface{}
+		if err := json.Unmarshal(line, &entry); err != nil {
+			return nil, fmt.Errorf("failed to parse audit log entry: %w", err)
+		}
+		entries = append(entries, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read audit log: %w", err)
+	}
+	return entries, nil
 }
@@ -0,0 +1,214 @@
+package apps
+
+import (
+	"compress/gzip"
+	"context"
+	n "dataforge-be/nats"
+	"dataforge-be/nats/natstest"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	atlasTestPipeline = 9
+	atlasTestOrg      = "org1"
+	atlasTestProject  = "proj1"
+	atlasTestCluster  = "main"
+	atlasTestHost     = "main-shard-00-00.example.net"
+)
+
+// fakeAtlas serves one organization and one project with a single cluster,
+// and records the query of every API request by path.
+type fakeAtlas struct {
+	// created and updated fall inside the initial lookback window.
+	created time.Time
+	updated time.Time
+
+	mu      sync.Mutex
+	queries map[string][]url.Values
+}
+
+func (f *fakeAtlas) lastQuery(path string) url.Values {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	queries := f.queries["/api/atlas/v2"+path]
+	if len(queries) == 0 {
+		return nil
+	}
+	return queries[len(queries)-1]
+}
+
+func (f *fakeAtlas) handler(t *testing.T) http.Handler {
+	list := func(results ...map[string]interface{}) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			page := results
+			if r.URL.Query().Get("pageNum") != "1" {
+				page = nil
+			}
+			writeJSON(t, w, map[string]interface{}{"results": page, "totalCount": len(results)})
+		}
+	}
+	api := http.NewServeMux()
+	api.Handle("/api/atlas/v2/orgs", list(map[string]interface{}{"id": atlasTestOrg}))
+	api.Handle("/api/atlas/v2/orgs/org1/events", list(map[string]interface{}{"id": "e1", "created": f.created.Format(time.RFC3339)}))
+	api.Handle("/api/atlas/v2/groups", list(map[string]interface{}{"id": atlasTestProject}))
+	api.Handle("/api/atlas/v2/groups/proj1/alerts", list(map[string]interface{}{"id": "a1", "created": f.created.Format(time.RFC3339), "updated": f.updated.Format(time.RFC3339)}))
+	api.Handle("/api/atlas/v2/groups/proj1/clusters", list(map[string]interface{}{"id": "c1", "name": atlasTestCluster}))
+	api.Handle("/api/atlas/v2/groups/proj1/databaseUsers", list(map[string]interface{}{"groupId": atlasTestProject, "databaseName": "admin", "username": "ada"}))
+	api.Handle("/api/atlas/v2/groups/proj1/processes", list(map[string]interface{}{"hostname": atlasTestHost}))
+	api.HandleFunc("/api/atlas/v2/groups/proj1/dbAccessHistory/clusters/main", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(t, w, map[string]interface{}{"accessLogs": []map[string]interface{}{{"username": "ada", "authResult": true}}})
+	})
+	api.HandleFunc("/api/atlas/v2/groups/proj1/clusters/"+atlasTestHost+"/logs/mongodb-audit-log.gz", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/gzip")
+		writer := gzip.NewWriter(w)
+		writer.Write([]byte(`{"atype": "authenticate", "user": "ada"}` + "\n" + `{"atype": "createCollection", "user": "ada"}` + "\n"))
+		if err := writer.Close(); err != nil {
+			t.Errorf("failed to write audit log: %v", err)
+		}
+	})
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/oauth/token", func(w http.ResponseWriter, r *http.Request) {
+		if user, pass, ok := r.BasicAuth(); !ok || user != "id" || pass != "secret" {
+			http.Error(w, "bad credentials", http.StatusUnauthorized)
+			return
+		}
+		writeJSON(t, w, map[string]interface{}{"access_token": "token", "expires_in": 3600})
+	})
+	mux.HandleFunc("/api/atlas/v2/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token" {
+			http.Error(w, "missing token", http.StatusUnauthorized)
+			return
+		}
+		f.mu.Lock()
+		f.queries[r.URL.Path] = append(f.queries[r.URL.Path], r.URL.Query())
+		f.mu.Unlock()
+		api.ServeHTTP(w, r)
+	})
+	return mux
+}
+
+func TestMongoDBStreams(t *testing.T) {
+	now := time.Now().UTC().Truncate(time.Second)
+	atlas := &fakeAtlas{
+		created: now.Add(-2 * time.Hour),
+		updated: now.Add(-time.Hour),
+		queries: make(map[string][]url.Values),
+	}
+	server := httptest.NewServer(atlas.handler(t))
+	defer server.Close()
+
+	js := natstest.JetStream(t)
+	run := func() {
+		t.Helper()
+		source := &MongoDB{}
+		err := source.Initialize(map[string]interface{}{
+			"client_id":     "id",
+			"client_secret": "secret",
+			"base_url":      server.URL + "/api/atlas/v2",
+			"streams": []interface{}{
+				OrgEventsStream, AlertsStream, ClustersStream,
+				DatabaseUsersStream, AccessLogsStream, AuditLogsStream,
+			},
+		})
+		if err != nil {
+			t.Fatalf("Initialize: %v", err)
+		}
+		if err := source.Run(context.Background(), atlasTestPipeline, js); err != nil {
+			t.Fatalf("Run: %v", err)
+		}
+	}
+	published := func() map[string]int {
+		t.Helper()
+		counts := make(map[string]int)
+		for _, batch := range natstest.Published(t, js) {
+			counts[batch.Stream] += len(batch.Records)
+		}
+		return counts
+	}
+	cursors := func(stream string) map[string]string {
+		t.Helper()
+		state := make(map[string]string)
+		found, err := n.GetPipelineState(context.Background(), js, atlasTestPipeline, "atlas-"+stream, &state)
+		if err != nil {
+			t.Fatalf("GetPipelineState(%s): %v", stream, err)
+		}
+		if !found {
+			t.Fatalf("no state saved for %s", stream)
+		}
+		return state
+	}
+
+	run()
+
+	first := published()
+	want := map[string]int{
+		OrgEventsStream:     1,
+		AlertsStream:        1,
+		ClustersStream:      1,
+		DatabaseUsersStream: 1,
+		AccessLogsStream:    1,
+		AuditLogsStream:     2,
+	}
+	for stream, count := range want {
+		if first[stream] != count {
+			t.Errorf("published %d %s records, want %d", first[stream], stream, count)
+		}
+	}
+
+	// Each stream keeps its cursors under its own state, keyed by the
+	// organization, project, cluster or host it was read from.
+	if got := cursors(OrgEventsStream); len(got) != 1 || got[atlasTestOrg] != atlas.created.Format(time.RFC3339Nano) {
+		t.Errorf("org_events cursors = %v", got)
+	}
+	if got := cursors(AlertsStream); len(got) != 1 || got[atlasTestProject] != atlas.updated.Format(time.RFC3339Nano) {
+		t.Errorf("alerts cursors = %v", got)
+	}
+	if got := cursors(ClustersStream); len(got) != 1 || got[`proj1/["c1"]`] == "" {
+		t.Errorf("clusters cursors = %v", got)
+	}
+	if got := cursors(DatabaseUsersStream); len(got) != 1 || got[`proj1/["proj1","admin","ada"]`] == "" {
+		t.Errorf("database_users cursors = %v", got)
+	}
+	timeCursors := map[string]string{
+		AccessLogsStream: "proj1/" + atlasTestCluster,
+		AuditLogsStream:  "proj1/" + atlasTestHost,
+	}
+	ends := make(map[string]time.Time)
+	for stream, key := range timeCursors {
+		got := cursors(stream)
+		end, err := time.Parse(time.RFC3339Nano, got[key])
+		if len(got) != 1 || err != nil || end.Before(now) {
+			t.Errorf("%s cursors = %v, want the end of the first run's window under %s", stream, got, key)
+		}
+		ends[stream] = end
+	}
+
+	run()
+
+	// The second run reads from the saved cursors, and unchanged alerts,
+	// clusters and users are not published again.
+	if got := atlas.lastQuery("/orgs/org1/events").Get("minDate"); got != atlas.created.Format(time.RFC3339) {
+		t.Errorf("org_events minDate = %q, want the saved cursor", got)
+	}
+	accessStart := strconv.FormatInt(ends[AccessLogsStream].UnixMilli(), 10)
+	if got := atlas.lastQuery("/groups/proj1/dbAccessHistory/clusters/main").Get("start"); got != accessStart {
+		t.Errorf("access_logs start = %q, want %q", got, accessStart)
+	}
+	auditStart := strconv.FormatInt(ends[AuditLogsStream].Unix(), 10)
+	if got := atlas.lastQuery("/groups/proj1/clusters/" + atlasTestHost + "/logs/mongodb-audit-log.gz").Get("startDate"); got != auditStart {
+		t.Errorf("audit_logs startDate = %q, want %q", got, auditStart)
+	}
+	second := published()
+	for _, stream := range []string{AlertsStream, ClustersStream, DatabaseUsersStream} {
+		if second[stream] != first[stream] {
+			t.Errorf("second run published %d more %s records, want none", second[stream]-first[stream], stream)
+		}
+	}
+}
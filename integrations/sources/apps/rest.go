@@ -0,0 +1,622 @@
+package apps
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	n "dataforge-be/nats"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+const (
+	restID = "rest"
+
+	restPageNumber = "page_number"
+	restOffset     = "offset"
+	restCursor     = "cursor"
+	restLinkHeader = "link_header"
+	restNone       = "none"
+
+	defaultRESTPageSize = 100
+	defaultRESTMaxPages = 10000
+	restMaxAttempts     = 3
+	restRetryWait       = 5 * time.Second
+)
+
+// REST syncs records from any JSON HTTP API described entirely by config.
+// Each endpoint becomes a stream; its records are found at records_path in
+// the response and paged through with one of the supported pagination
+// styles.
+type REST struct {
+	baseURL    string
+	headers    map[string]string
+	client     *http.Client
+	auth       Authenticator
+	endpoints  []restEndpoint
+	pipelineID int64
+	js         jetstream.JetStream
+}
+
+type restEndpoint struct {
+	name        string
+	path        string
+	params      map[string]string
+	recordsPath string
+	primaryKey  []string
+	pagination  restPagination
+	incremental *restIncremental
+}
+
+type restPagination struct {
+	style       string
+	pageSize    int
+	maxPages    int
+	sizeParam   string
+	pageParam   string
+	startPage   int
+	offsetParam string
+	cursorParam string
+	cursorPath  string
+}
+
+// restIncremental sends the largest cursor_field value seen so far as param,
+// so each run only asks for records changed since the last one.
+type restIncremental struct {
+	cursorField string
+	param       string
+	startValue  string
+}
+
+type restState struct {
+	Cursor string `json:"cursor"`
+}
+
+// BearerAuthenticator sends a static token in the Authorization header.
+type BearerAuthenticator struct {
+	Token string
+}
+
+func (b *BearerAuthenticator) AddAuth(req *http.Request) error {
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", b.Token))
+	return nil
+}
+
+// BasicAuthenticator sends HTTP basic credentials.
+type BasicAuthenticator struct {
+	Username string
+	Password string
+}
+
+func (b *BasicAuthenticator) AddAuth(req *http.Request) error {
+	auth := base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("%s:%s", b.Username, b.Password)))
+	req.Header.Set("Authorization", fmt.Sprintf("Basic %s", auth))
+	return nil
+}
+
+type noAuthenticator struct{}
+
+func (noAuthenticator) AddAuth(req *http.Request) error {
+	return nil
+}
+
+func (r *REST) Initialize(config map[string]interface{}) error {
+	baseURL, _ := config["base_url"].(string)
+	if baseURL == "" {
+		return errors.New("rest source requires base_url")
+	}
+	r.baseURL = strings.TrimRight(baseURL, "/")
+
+	r.headers = stringMapFromConfig(config["headers"])
+	r.client = &http.Client{Timeout: 30 * time.Second}
+
+	auth, err := AuthenticatorFromConfig(config["auth"])
+	if err != nil {
+		return err
+	}
+	r.auth = auth
+
+	defaults, _ := config["pagination"].(map[string]interface{})
+	defaultRecordsPath, _ := config["records_path"].(string)
+
+	r.endpoints = nil
+	endpoints, _ := config["endpoints"].([]interface{})
+	for _, value := range endpoints {
+		endpointConfig, _ := value.(map[string]interface{})
+		endpoint, err := parseRESTEndpoint(endpointConfig, defaults, defaultRecordsPath)
+		if err != nil {
+			return err
+		}
+		r.endpoints = append(r.endpoints, endpoint)
+	}
+	if len(r.endpoints) == 0 {
+		return errors.New("rest source requires at least one endpoint")
+	}
+	return nil
+}
+
+// AuthenticatorFromConfig reads an auth block of type none, bearer, basic or
+// oauth2. The webhook destination shares it with the REST source.
+func AuthenticatorFromConfig(value interface{}) (Authenticator, error) {
+	config, _ := value.(map[string]interface{})
+	authType, _ := config["type"].(string)
+	switch authType {
+	case "", "none":
+		return noAuthenticator{}, nil
+	case "bearer":
+		token, _ := config["token"].(string)
+		if token == "" {
+			return nil, errors.New("bearer auth requires token")
+		}
+		return &BearerAuthenticator{Token: token}, nil
+	case "basic":
+		username, _ := config["username"].(string)
+		password, _ := config["password"].(string)
+		return &BasicAuthenticator{Username: username, Password: password}, nil
+	case "oauth2":
+		tokenURL, _ := config["token_url"].(string)
+		clientID, _ := config["client_id"].(string)
+		clientSecret, _ := config["client_secret"].(string)
+		if tokenURL == "" || clientID == "" {
+			return nil, errors.New("oauth2 auth requires token_url and client_id")
+		}
+		return NewTokenAuthenticator(tokenURL, clientID, clientSecret, &http.Client{
+			Timeout: 10 * time.Second,
+		}), nil
+	default:
+		return nil, fmt.Errorf("unsupported auth type %q", authType)
+	}
+}
+
+func parseRESTEndpoint(config, defaults map[string]interface{}, defaultRecordsPath string) (restEndpoint, error) {
+	endpoint := restEndpoint{}
+	endpoint.path, _ = config["path"].(string)
+	if endpoint.path == "" {
+		return endpoint, errors.New("rest endpoint requires path")
+	}
+	endpoint.name, _ = config["name"].(string)
+	if endpoint.name == "" {
+		endpoint.name = strings.Trim(endpoint.path, "/")
+	}
+
+	endpoint.params = stringMapFromConfig(config["params"])
+	endpoint.recordsPath = defaultRecordsPath
+	if recordsPath, ok := config["records_path"].(string); ok {
+		endpoint.recordsPath = recordsPath
+	}
+
+	keys, _ := config["primary_key"].([]interface{})
+	for _, key := range keys {
+		if column, ok := key.(string); ok {
+			endpoint.primaryKey = append(endpoint.primaryKey, column)
+		}
+	}
+
+	paginationConfig, ok := config["pagination"].(map[string]interface{})
+	if !ok {
+		paginationConfig = defaults
+	}
+	pagination, err := parseRESTPagination(paginationConfig)
+	if err != nil {
+		return endpoint, fmt.Errorf("endpoint %s: %w", endpoint.name, err)
+	}
+	endpoint.pagination = pagination
+
+	if incrementalConfig, ok := config["incremental"].(map[string]interface{}); ok {
+		incremental := &restIncremental{}
+		incremental.cursorField, _ = incrementalConfig["cursor_field"].(string)
+		incremental.param, _ = incrementalConfig["param"].(string)
+		incremental.startValue, _ = incrementalConfig["start_value"].(string)
+		if incremental.cursorField == "" || incremental.param == "" {
+			return endpoint, fmt.Errorf("endpoint %s: incremental requires cursor_field and param", endpoint.name)
+		}
+		endpoint.incremental = incremental
+	}
+	return endpoint, nil
+}
+
+func parseRESTPagination(config map[string]interface{}) (restPagination, error) {
+	pagination := restPagination{
+		style:       restNone,
+		pageSize:    defaultRESTPageSize,
+		maxPages:    defaultRESTMaxPages,
+		pageParam:   "page",
+		startPage:   1,
+		offsetParam: "offset",
+		cursorParam: "cursor",
+	}
+	if style, ok := config["type"].(string); ok && style != "" {
+		pagination.style = style
+	}
+	if size, ok := config["page_size"].(float64); ok && size > 0 {
+		pagination.pageSize = int(size)
+	}
+	if maxPages, ok := config["max_pages"].(float64); ok && maxPages > 0 {
+		pagination.maxPages = int(maxPages)
+	}
+	if start, ok := config["start_page"].(float64); ok {
+		pagination.startPage = int(start)
+	}
+	setString := func(key string, field *string) {
+		if value, ok := config[key].(string); ok && value != "" {
+			*field = value
+		}
+	}
+	setString("size_param", &pagination.sizeParam)
+	setString("page_param", &pagination.pageParam)
+	setString("offset_param", &pagination.offsetParam)
+	setString("cursor_param", &pagination.cursorParam)
+	setString("cursor_path", &pagination.cursorPath)
+
+	switch pagination.style {
+	case restPageNumber, restLinkHeader, restNone:
+	case restOffset:
+		if pagination.sizeParam == "" {
+			pagination.sizeParam = "limit"
+		}
+	case restCursor:
+		if pagination.cursorPath == "" {
+			return pagination, errors.New("cursor pagination requires cursor_path")
+		}
+	default:
+		return pagination, fmt.Errorf("unsupported pagination type %q", pagination.style)
+	}
+	return pagination, nil
+}
+
+func stringMapFromConfig(value interface{}) map[string]string {
+	values := make(map[string]string)
+	config, _ := value.(map[string]interface{})
+	for key, v := range config {
+		values[key] = fmt.Sprint(v)
+	}
+	return values
+}
+
+func (r *REST) SourceID() string {
+	return restID
+}
+
+func (r *REST) Run(ctx context.Context, pipelineID int64, js jetstream.JetStream) error {
+	r.pipelineID = pipelineID
+	r.js = js
+
+	for _, endpoint := range r.endpoints {
+		if err := r.syncEndpoint(ctx, endpoint); err != nil {
+			return fmt.Errorf("failed to sync %s: %w", endpoint.name, err)
+		}
+	}
+	return nil
+}
+
+// syncEndpoint pages through an endpoint and publishes each page. The
+// incremental cursor is saved only after the last page, since APIs rarely
+// promise to return records in cursor order.
+//
+// A page with the same records as the one before it ends the sync, as from
+// an API that ignores or clamps the page or offset. Paging also stops after
+// max_pages, without saving the cursor, so the next run asks for the same
+// records again rather than skipping the ones not reached.
+func (r *REST) syncEndpoint(ctx context.Context, endpoint restEndpoint) error {
+	stateName := fmt.Sprintf("rest-%s", endpoint.name)
+	state := restState{}
+	if endpoint.incremental != nil {
+		_, err := n.GetPipelineState(ctx, r.js, r.pipelineID, stateName, &state)
+		if err != nil {
+			return err
+		}
+		if state.Cursor == "" {
+			state.Cursor = endpoint.incremental.startValue
+		}
+	}
+	latest := state.Cursor
+
+	query := url.Values{}
+	for key, value := range endpoint.params {
+		query.Set(key, value)
+	}
+	if endpoint.incremental != nil && state.Cursor != "" {
+		query.Set(endpoint.incremental.param, state.Cursor)
+	}
+
+	pagination := endpoint.pagination
+	if pagination.sizeParam != "" {
+		query.Set(pagination.sizeParam, strconv.Itoa(pagination.pageSize))
+	}
+
+	nextURL := r.baseURL + endpoint.path
+	page, offset := pagination.startPage, 0
+	var previousPage [sha256.Size]byte
+	for pages := 0; ; pages++ {
+		if pages >= pagination.maxPages {
+			log.Printf("Stopped paging %s of pipeline %d after max_pages (%d)", endpoint.name, r.pipelineID, pagination.maxPages)
+			return nil
+		}
+
+		pageQuery := url.Values{}
+		for key, values := range query {
+			pageQuery[key] = values
+		}
+		switch pagination.style {
+		case restPageNumber:
+			pageQuery.Set(pagination.pageParam, strconv.Itoa(page))
+		case restOffset:
+			pageQuery.Set(pagination.offsetParam, strconv.Itoa(offset))
+		}
+
+		parsedURL, err := url.Parse(nextURL)
+		if err != nil {
+			return fmt.Errorf("invalid request URL %q: %w", nextURL, err)
+		}
+		urlQuery := parsedURL.Query()
+		for key, values := range pageQuery {
+			urlQuery[key] = values
+		}
+		parsedURL.RawQuery = urlQuery.Encode()
+		requestURL := parsedURL.String()
+
+		body, header, err := r.get(ctx, requestURL)
+		if err != nil {
+			return err
+		}
+
+		var response interface{}
+		decoder := json.NewDecoder(bytes.NewReader(body))
+		decoder.UseNumber()
+		if err := decoder.Decode(&response); err != nil {
+			return fmt.Errorf("failed to decode response: %w", err)
+		}
+
+		records, err := recordsAtPath(response, endpoint.recordsPath)
+		if err != nil {
+			return err
+		}
+		if len(records) > 0 {
+			encoded, err := json.Marshal(records)
+			if err != nil {
+				return fmt.Errorf("failed to encode records: %w", err)
+			}
+			pageHash := sha256.Sum256(encoded)
+			if pages > 0 && pageHash == previousPage {
+				return r.saveCursor(ctx, endpoint, stateName, latest)
+			}
+			previousPage = pageHash
+		}
+		if endpoint.incremental != nil {
+			for _, record := range records {
+				if value, ok := record[endpoint.incremental.cursorField]; ok && value != nil {
+					if cursor := fmt.Sprint(value); cursorAfter(cursor, latest) {
+						latest = cursor
+					}
+				}
+			}
+		}
+		if err := r.publish(ctx, endpoint, records); err != nil {
+			return err
+		}
+
+		// A short page is not the last one: many APIs cap the page size
+		// below what was asked for. Only an empty page ends the sync.
+		switch pagination.style {
+		case restPageNumber:
+			if len(records) == 0 {
+				return r.saveCursor(ctx, endpoint, stateName, latest)
+			}
+			page++
+		case restOffset:
+			if len(records) == 0 {
+				return r.saveCursor(ctx, endpoint, stateName, latest)
+			}
+			offset += len(records)
+		case restCursor:
+			next, _ := lookupJSONPath(response, pagination.cursorPath)
+			cursor := ""
+			if next != nil {
+				cursor = fmt.Sprint(next)
+			}
+			if cursor == "" || len(records) == 0 {
+				return r.saveCursor(ctx, endpoint, stateName, latest)
+			}
+			if strings.HasPrefix(cursor, "http://") || strings.HasPrefix(cursor, "https://") {
+				nextURL = cursor
+				query = url.Values{}
+			} else {
+				query.Set(pagination.cursorParam, cursor)
+			}
+		case restLinkHeader:
+			next := nextLink(header, requestURL)
+			if next == "" || len(records) == 0 {
+				return r.saveCursor(ctx, endpoint, stateName, latest)
+			}
+			// The next link carries every query parameter already.
+			nextURL = next
+			query = url.Values{}
+		default:
+			return r.saveCursor(ctx, endpoint, stateName, latest)
+		}
+	}
+}
+
+func (r *REST) saveCursor(ctx context.Context, endpoint restEndpoint, stateName, cursor string) error {
+	if endpoint.incremental == nil || cursor == "" {
+		return nil
+	}
+	return n.PutPipelineState(ctx, r.js, r.pipelineID, stateName, restState{Cursor: cursor})
+}
+
+// get fetches a URL, waiting out rate limits and retrying server errors a
+// few times before giving up.
+func (r *REST) get(ctx context.Context, requestURL string) ([]byte, http.Header, error) {
+	for attempt := 1; ; attempt++ {
+		req, err := http.NewRequestWithContext(ctx, "GET", requestURL, nil)
+		if err != nil {
+			return nil, nil, err
+		}
+		req.Header.Set("Accept", "application/json")
+		for key, value := range r.headers {
+			req.Header.Set(key, value)
+		}
+		if err := r.auth.AddAuth(req); err != nil {
+			return nil, nil, fmt.Errorf("authentication error: %w", err)
+		}
+
+		resp, err := r.client.Do(req)
+		if err != nil {
+			return nil, nil, err
+		}
+		body, err := io.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return nil, nil, err
+		}
+
+		retryable := resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500
+		if retryable && attempt < restMaxAttempts {
+			wait := restRetryWait
+			if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+				wait = time.Duration(seconds) * time.Second
+			}
+			select {
+			case <-time.After(wait):
+				continue
+			case <-ctx.Done():
+				return nil, nil, ctx.Err()
+			}
+		}
+		if resp.StatusCode >= 400 {
+			return nil, nil, fmt.Errorf("request failed with status %d: %s", resp.StatusCode, string(body))
+		}
+		return body, resp.Header, nil
+	}
+}
+
+func (r *REST) publish(ctx context.Context, endpoint restEndpoint, records []map[string]interface{}) error {
+	if len(records) == 0 {
+		return nil
+	}
+
+	destinationRecord := n.DestinationRecord{
+		PipelineID: r.pipelineID,
+		Stream:     endpoint.name,
+		PrimaryKey: endpoint.primaryKey,
+	}
+	for _, record := range records {
+		recordBytes, err := json.Marshal(record)
+		if err != nil {
+			return fmt.Errorf("failed to marshal record: %w", err)
+		}
+		destinationRecord.Records = append(destinationRecord.Records, recordBytes)
+	}
+
+	err := n.PublishRecords(ctx, r.js, destinationRecord)
+	if err != nil {
+		return err
+	}
+	log.Printf("Published %d %s records to OUTPUT", len(records), endpoint.name)
+	return nil
+}
+
+// lookupJSONPath follows a dot separated path such as "data.items" or
+// "results.0.rows" through decoded JSON. An empty path is the value itself.
+func lookupJSONPath(value interface{}, path string) (interface{}, bool) {
+	path = strings.TrimPrefix(strings.TrimPrefix(path, "$"), ".")
+	if path == "" {
+		return value, true
+	}
+	for _, part := range strings.Split(path, ".") {
+		switch v := value.(type) {
+		case map[string]interface{}:
+			next, ok := v[part]
+			if !ok {
+				return nil, false
+			}
+			value = next
+		case []interface{}:
+			index, err := strconv.Atoi(part)
+			if err != nil || index < 0 || index >= len(v) {
+				return nil, false
+			}
+			value = v[index]
+		default:
+			return nil, false
+		}
+	}
+	return value, true
+}
+
+// recordsAtPath returns the objects found at path. A missing path or null
+// means an empty page; a single object is treated as one record.
+func recordsAtPath(response interface{}, path string) ([]map[string]interface{}, error) {
+	value, ok := lookupJSONPath(response, path)
+	if !ok || value == nil {
+		return nil, nil
+	}
+
+	switch v := value.(type) {
+	case []interface{}:
+		records := make([]map[string]interface{}, 0, len(v))
+		for _, element := range v {
+			record, ok := element.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("records at %q must be JSON objects", path)
+			}
+			records = append(records, record)
+		}
+		return records, nil
+	case map[string]interface{}:
+		return []map[string]interface{}{v}, nil
+	default:
+		return nil, fmt.Errorf("records at %q must be an array of objects", path)
+	}
+}
+
+// cursorAfter compares cursor values numerically when both are numbers and
+// as strings otherwise, which orders ISO 8601 timestamps correctly.
+func cursorAfter(cursor, latest string) bool {
+	if latest == "" {
+		return true
+	}
+	a, errA := strconv.ParseFloat(cursor, 64)
+	b, errB := strconv.ParseFloat(latest, 64)
+	if errA == nil && errB == nil {
+		return a > b
+	}
+	return cursor > latest
+}
+
+// nextLink returns the rel="next" target of an RFC 8288 Link header,
+// resolved against the request URL.
+func nextLink(header http.Header, requestURL string) string {
+	for _, link := range header.Values("Link") {
+		for _, part := range strings.Split(link, ",") {
+			segments := strings.Split(part, ";")
+			target := strings.Trim(strings.TrimSpace(segments[0]), "<>")
+			for _, param := range segments[1:] {
+				key, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+				if strings.EqualFold(key, "rel") && strings.Contains(" "+strings.Trim(value, `"`)+" ", " next ") {
+					base, err := url.Parse(requestURL)
+					if err != nil {
+						return target
+					}
+					next, err := base.Parse(target)
+					if err != nil {
+						return target
+					}
+					return next.String()
+				}
+			}
+		}
+	}
+	return ""
+}
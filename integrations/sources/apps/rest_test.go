@@ -0,0 +1,403 @@
+package apps
+
+import (
+	"context"
+	n "dataforge-be/nats"
+	"dataforge-be/nats/natstest"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+const (
+	restTestPipeline = 7
+	// serverPageSize is smaller than the page_size the tests ask for, as
+	// with APIs that cap their pages.
+	serverPageSize = 3
+	restTestItems  = 10
+)
+
+// restItems returns the records the test APIs serve from start on, one page
+// at a time.
+func restItems(start int) []map[string]interface{} {
+	items := []map[string]interface{}{}
+	for i := start; i < restTestItems && i < start+serverPageSize; i++ {
+		items = append(items, map[string]interface{}{
+			"id":         i + 1,
+			"updated_at": fmt.Sprintf("2024-01-%02dT00:00:00Z", i+1),
+		})
+	}
+	return items
+}
+
+func allIDs() []int {
+	ids := make([]int, restTestItems)
+	for i := range ids {
+		ids[i] = i + 1
+	}
+	return ids
+}
+
+func writeJSON(t *testing.T, w http.ResponseWriter, value interface{}) {
+	t.Helper()
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(value); err != nil {
+		t.Errorf("failed to write response: %v", err)
+	}
+}
+
+// requestLog records the query of every request a test API serves.
+type requestLog struct {
+	mu      sync.Mutex
+	queries []string
+}
+
+func (l *requestLog) add(r *http.Request) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.queries = append(l.queries, r.URL.RawQuery)
+}
+
+func (l *requestLog) all() []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]string(nil), l.queries...)
+}
+
+func runREST(t *testing.T, js jetstream.JetStream, config string) {
+	t.Helper()
+	var parsed map[string]interface{}
+	if err := json.Unmarshal([]byte(config), &parsed); err != nil {
+		t.Fatalf("invalid config: %v", err)
+	}
+	source := &REST{}
+	if err := source.Initialize(parsed); err != nil {
+		t.Fatalf("Initialize: %v", err)
+	}
+	if err := source.Run(context.Background(), restTestPipeline, js); err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+}
+
+func publishedIDs(t *testing.T, records []n.DestinationRecord) []int {
+	t.Helper()
+	var ids []int
+	for _, record := range records {
+		for _, recordBytes := range record.Records {
+			var document struct {
+				ID int `json:"id"`
+			}
+			if err := json.Unmarshal(recordBytes, &document); err != nil {
+				t.Fatalf("failed to decode record: %v", err)
+			}
+			ids = append(ids, document.ID)
+		}
+	}
+	return ids
+}
+
+func TestRESTPagination(t *testing.T) {
+	tests := []struct {
+		name       string
+		pagination string
+		handler    func(t *testing.T, server *httptest.Server) http.HandlerFunc
+		want       []string
+	}{
+		{
+			name:       "page_number",
+			pagination: `{"type": "page_number", "page_size": 5, "size_param": "per_page"}`,
+			handler: func(t *testing.T, _ *httptest.Server) http.HandlerFunc {
+				return func(w http.ResponseWriter, r *http.Request) {
+					page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+					writeJSON(t, w, map[string]interface{}{"items": restItems((page - 1) * serverPageSize)})
+				}
+			},
+			want: []string{"page=1&per_page=5", "page=2&per_page=5", "page=3&per_page=5", "page=4&per_page=5", "page=5&per_page=5"},
+		},
+		{
+			name:       "offset",
+			pagination: `{"type": "offset", "page_size": 5}`,
+			handler: func(t *testing.T, _ *httptest.Server) http.HandlerFunc {
+				return func(w http.ResponseWriter, r *http.Request) {
+					offset, _ := strconv.Atoi(r.URL.Query().Get("offset"))
+					writeJSON(t, w, map[string]interface{}{"items": restItems(offset)})
+				}
+			},
+			want: []string{"limit=5&offset=0", "limit=5&offset=3", "limit=5&offset=6", "limit=5&offset=9", "limit=5&offset=10"},
+		},
+		{
+			name:       "cursor",
+			pagination: `{"type": "cursor", "cursor_param": "after", "cursor_path": "meta.next"}`,
+			handler: func(t *testing.T, _ *httptest.Server) http.HandlerFunc {
+				return func(w http.ResponseWriter, r *http.Request) {
+					start, _ := strconv.Atoi(r.URL.Query().Get("after"))
+					response := map[string]interface{}{"items": restItems(start), "meta": map[string]interface{}{}}
+					if next := start + serverPageSize; next < restTestItems {
+						response["meta"] = map[string]interface{}{"next": strconv.Itoa(next)}
+					}
+					writeJSON(t, w, response)
+				}
+			},
+			want: []string{"", "after=3", "after=6", "after=9"},
+		},
+		{
+			name:       "cursor with next URL",
+			pagination: `{"type": "cursor", "cursor_path": "meta.next"}`,
+			handler: func(t *testing.T, server *httptest.Server) http.HandlerFunc {
+				return func(w http.ResponseWriter, r *http.Request) {
+					start, _ := strconv.Atoi(r.URL.Query().Get("from"))
+					response := map[string]interface{}{"items": restItems(start), "meta": map[string]interface{}{}}
+					if next := start + serverPageSize; next < restTestItems {
+						response["meta"] = map[string]interface{}{"next": fmt.Sprintf("%s/items?from=%d", server.URL, next)}
+					}
+					writeJSON(t, w, response)
+				}
+			},
+			want: []string{"", "from=3", "from=6", "from=9"},
+		},
+		{
+			name:       "link_header",
+			pagination: `{"type": "link_header"}`,
+			handler: func(t *testing.T, _ *httptest.Server) http.HandlerFunc {
+				return func(w http.ResponseWriter, r *http.Request) {
+					page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+					if page == 0 {
+						page = 1
+					}
+					if page*serverPageSize < restTestItems {
+						w.Header().Add("Link", fmt.Sprintf(`</items?page=1>; rel="first", </items?page=%d>; rel="next"`, page+1))
+					}
+					writeJSON(t, w, map[string]interface{}{"items": restItems((page - 1) * serverPageSize)})
+				}
+			},
+			want: []string{"", "page=2", "page=3", "page=4"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			requests := &requestLog{}
+			var handler http.HandlerFunc
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				requests.add(r)
+				handler(w, r)
+			}))
+			defer server.Close()
+			handler = tt.handler(t, server)
+
+			js := natstest.JetStream(t)
+			runREST(t, js, fmt.Sprintf(`{
+				"base_url": %q,
+				"records_path": "items",
+				"endpoints": [{"path": "/items", "pagination": %s}]
+			}`, server.URL, tt.pagination))
+
+			if ids := publishedIDs(t, natstest.Published(t, js)); !reflect.DeepEqual(ids, allIDs()) {
+				t.Errorf("published ids = %v, want %v", ids, allIDs())
+			}
+			if got := requests.all(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("requests = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRESTStopsOnRepeatedPage(t *testing.T) {
+	tests := []struct {
+		name       string
+		pagination string
+		response   string
+		want       []int
+	}{
+		{"page param ignored", `{"type": "page_number"}`, `{"items": [{"id": 1}, {"id": 2}]}`, []int{1, 2}},
+		{"offset param ignored", `{"type": "offset"}`, `{"items": [{"id": 1}, {"id": 2}]}`, []int{1, 2}},
+		{"single object", `{"type": "page_number"}`, `{"items": {"id": 3}}`, []int{3}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			requests := &requestLog{}
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				requests.add(r)
+				w.Write([]byte(tt.response))
+			}))
+			defer server.Close()
+
+			js := natstest.JetStream(t)
+			runREST(t, js, fmt.Sprintf(`{
+				"base_url": %q,
+				"records_path": "items",
+				"endpoints": [{"path": "/items", "pagination": %s}]
+			}`, server.URL, tt.pagination))
+
+			if ids := publishedIDs(t, natstest.Published(t, js)); !reflect.DeepEqual(ids, tt.want) {
+				t.Errorf("published ids = %v, want %v", ids, tt.want)
+			}
+			if got := len(requests.all()); got != 2 {
+				t.Errorf("sent %d requests, want 2", got)
+			}
+		})
+	}
+}
+
+func TestRESTMaxPages(t *testing.T) {
+	requests := &requestLog{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.add(r)
+		page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+		// Never runs out of records.
+		writeJSON(t, w, map[string]interface{}{"items": []map[string]interface{}{
+			{"id": page, "updated_at": fmt.Sprintf("2024-01-%02dT00:00:00Z", page)},
+		}})
+	}))
+	defer server.Close()
+
+	js := natstest.JetStream(t)
+	runREST(t, js, fmt.Sprintf(`{
+		"base_url": %q,
+		"records_path": "items",
+		"endpoints": [{
+			"name": "events",
+			"path": "/events",
+			"pagination": {"type": "page_number", "max_pages": 3},
+			"incremental": {"cursor_field": "updated_at", "param": "since"}
+		}]
+	}`, server.URL))
+
+	if ids := publishedIDs(t, natstest.Published(t, js)); !reflect.DeepEqual(ids, []int{1, 2, 3}) {
+		t.Errorf("published ids = %v, want [1 2 3]", ids)
+	}
+	if got := len(requests.all()); got != 3 {
+		t.Errorf("sent %d requests, want 3", got)
+	}
+	var state restState
+	found, err := n.GetPipelineState(context.Background(), js, restTestPipeline, "rest-events", &state)
+	if err != nil {
+		t.Fatalf("GetPipelineState: %v", err)
+	}
+	if found {
+		t.Errorf("saved cursor %q after stopping at max_pages, want none", state.Cursor)
+	}
+}
+
+func TestRESTRecordsPath(t *testing.T) {
+	tests := []struct {
+		name        string
+		recordsPath string
+		response    string
+		want        []int
+	}{
+		{"top-level array", "", `[{"id": 1}, {"id": 2}]`, []int{1, 2}},
+		{"nested path", "data.items", `{"data": {"items": [{"id": 1}, {"id": 2}]}}`, []int{1, 2}},
+		{"array index", "$.results.0.rows", `{"results": [{"rows": [{"id": 3}]}]}`, []int{3}},
+		{"single object", "data", `{"data": {"id": 4}}`, []int{4}},
+		{"missing path", "data.items", `{"data": {}}`, nil},
+		{"null", "data", `{"data": null}`, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Write([]byte(tt.response))
+			}))
+			defer server.Close()
+
+			js := natstest.JetStream(t)
+			runREST(t, js, fmt.Sprintf(`{
+				"base_url": %q,
+				"endpoints": [{"name": "things", "path": "/things", "records_path": %q, "primary_key": ["id"]}]
+			}`, server.URL, tt.recordsPath))
+
+			published := natstest.Published(t, js)
+			if ids := publishedIDs(t, published); !reflect.DeepEqual(ids, tt.want) {
+				t.Errorf("published ids = %v, want %v", ids, tt.want)
+			}
+			for _, record := range published {
+				if record.Stream != "things" || !reflect.DeepEqual(record.PrimaryKey, []string{"id"}) {
+					t.Errorf("published stream %q with primary key %v", record.Stream, record.PrimaryKey)
+				}
+			}
+		})
+	}
+}
+
+func TestRESTRecordsPathRejectsScalars(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"data": [1, 2]}`))
+	}))
+	defer server.Close()
+
+	source := &REST{}
+	err := source.Initialize(map[string]interface{}{
+		"base_url":  server.URL,
+		"endpoints": []interface{}{map[string]interface{}{"path": "/things", "records_path": "data"}},
+	})
+	if err != nil {
+		t.Fatalf("Initialize: %v", err)
+	}
+	if err := source.Run(context.Background(), restTestPipeline, natstest.JetStream(t)); err == nil {
+		t.Fatal("expected an error for records that are not objects")
+	}
+}
+
+func TestRESTIncrementalCursor(t *testing.T) {
+	requests := &requestLog{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.add(r)
+		since := r.URL.Query().Get("since")
+		var items []map[string]interface{}
+		for start := 0; start < restTestItems; start += serverPageSize {
+			for _, item := range restItems(start) {
+				if item["updated_at"].(string) > since {
+					items = append(items, item)
+				}
+			}
+		}
+		// Out of cursor order, so the saved cursor has to be the largest
+		// value rather than the last one seen.
+		for i, j := 0, len(items)-1; i < j; i, j = i+1, j-1 {
+			items[i], items[j] = items[j], items[i]
+		}
+		writeJSON(t, w, map[string]interface{}{"items": items})
+	}))
+	defer server.Close()
+
+	config := fmt.Sprintf(`{
+		"base_url": %q,
+		"records_path": "items",
+		"endpoints": [{
+			"name": "events",
+			"path": "/events",
+			"incremental": {"cursor_field": "updated_at", "param": "since", "start_value": "2024-01-05T00:00:00Z"}
+		}]
+	}`, server.URL)
+
+	js := natstest.JetStream(t)
+	runREST(t, js, config)
+
+	var state restState
+	found, err := n.GetPipelineState(context.Background(), js, restTestPipeline, "rest-events", &state)
+	if err != nil {
+		t.Fatalf("GetPipelineState: %v", err)
+	}
+	if !found || state.Cursor != "2024-01-10T00:00:00Z" {
+		t.Fatalf("saved cursor = %q (found %v), want 2024-01-10T00:00:00Z", state.Cursor, found)
+	}
+	if ids := publishedIDs(t, natstest.Published(t, js)); !reflect.DeepEqual(ids, []int{10, 9, 8, 7, 6}) {
+		t.Errorf("first run published %v, want [10 9 8 7 6]", ids)
+	}
+
+	// The next run asks only for what changed since the saved cursor.
+	runREST(t, js, config)
+	want := []string{"since=2024-01-05T00%3A00%3A00Z", "since=2024-01-10T00%3A00%3A00Z"}
+	if got := requests.all(); !reflect.DeepEqual(got, want) {
+		t.Errorf("requests = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,133 @@
+package apps
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"net/http"
+	"strings"
+)
+
+const (
+	defaultSignatureHeader = "X-Signature-256"
+	defaultSignatureAlgo   = "sha256"
+	defaultSignatureEncode = "hex"
+)
+
+var ErrInvalidSignature = errors.New("invalid webhook signature")
+
+// Signer signs and verifies request bodies with an HMAC, as configured by
+// hmac_secret, hmac_algorithm (sha1, sha256 or sha512), signature_encoding
+// (hex or base64), signature_header and signature_prefix. Without a secret
+// nothing is signed and every request verifies.
+type Signer struct {
+	secret   []byte
+	newHash  func() hash.Hash
+	encoding string
+	header   string
+	prefix   string
+}
+
+func SignerFromConfig(config map[string]interface{}) (*Signer, error) {
+	s := &Signer{header: defaultSignatureHeader}
+	secret, _ := config["hmac_secret"].(string)
+	s.secret = []byte(secret)
+	if header, ok := config["signature_header"].(string); ok && header != "" {
+		s.header = header
+	}
+	s.prefix, _ = config["signature_prefix"].(string)
+
+	algorithm := defaultSignatureAlgo
+	if value, ok := config["hmac_algorithm"].(string); ok && value != "" {
+		algorithm = strings.ToLower(value)
+	}
+	switch algorithm {
+	case "sha1":
+		s.newHash = sha1.New
+	case "sha256":
+		s.newHash = sha256.New
+	case "sha512":
+		s.newHash = sha512.New
+	default:
+		return nil, fmt.Errorf("unsupported hmac_algorithm %q", algorithm)
+	}
+
+	s.encoding = defaultSignatureEncode
+	if value, ok := config["signature_encoding"].(string); ok && value != "" {
+		s.encoding = strings.ToLower(value)
+	}
+	if s.encoding != "hex" && s.encoding != "base64" {
+		return nil, fmt.Errorf("unsupported signature_encoding %q", s.encoding)
+	}
+	return s, nil
+}
+
+// Sign sets the signature header of req to the signature of body.
+func (s *Signer) Sign(req *http.Request, body []byte) {
+	if len(s.secret) == 0 {
+		return
+	}
+	sum := s.sum(body)
+	if s.encoding == "base64" {
+		req.Header.Set(s.header, s.prefix+base64.StdEncoding.EncodeToString(sum))
+		return
+	}
+	req.Header.Set(s.header, s.prefix+hex.EncodeToString(sum))
+}
+
+// Verify checks the body's HMAC against the signature header. A leading
+// "sha256=" style algorithm tag is stripped when no explicit prefix is
+// configured, as GitHub and similar senders use.
+func (s *Signer) Verify(header http.Header, body []byte) error {
+	if len(s.secret) == 0 {
+		return nil
+	}
+
+	signature := strings.TrimSpace(header.Get(s.header))
+	if signature == "" {
+		return fmt.Errorf("%w: missing %s header", ErrInvalidSignature, s.header)
+	}
+	if s.prefix != "" {
+		if !strings.HasPrefix(signature, s.prefix) {
+			return fmt.Errorf("%w: expected %q prefix", ErrInvalidSignature, s.prefix)
+		}
+		signature = strings.TrimPrefix(signature, s.prefix)
+	} else if tag, value, ok := strings.Cut(signature, "="); ok && isHashTag(tag) {
+		signature = value
+	}
+
+	var provided []byte
+	var err error
+	if s.encoding == "base64" {
+		provided, err = base64.StdEncoding.DecodeString(signature)
+	} else {
+		provided, err = hex.DecodeString(signature)
+	}
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidSignature, err)
+	}
+	if !hmac.Equal(s.sum(body), provided) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+func (s *Signer) sum(body []byte) []byte {
+	mac := hmac.New(s.newHash, s.secret)
+	mac.Write(body)
+	return mac.Sum(nil)
+}
+
+func isHashTag(tag string) bool {
+	switch strings.ToLower(tag) {
+	case "sha1", "sha256", "sha512":
+		return true
+	}
+	return false
+}
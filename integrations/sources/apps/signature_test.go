@@ -0,0 +1,73 @@
+package apps
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSignerVerify(t *testing.T) {
+	body := []byte(`{"id":1}`)
+	signer, err := SignerFromConfig(map[string]interface{}{"hmac_secret": "s3cret"})
+	if err != nil {
+		t.Fatalf("SignerFromConfig: %v", err)
+	}
+	req := httptest.NewRequest(http.MethodPost, "/", nil)
+	signer.Sign(req, body)
+	signature := req.Header.Get(defaultSignatureHeader)
+
+	tests := []struct {
+		name      string
+		signature string
+		body      string
+		wantErr   bool
+	}{
+		{"signed", signature, string(body), false},
+		{"algorithm tag", "sha256=" + signature, string(body), false},
+		{"changed body", signature, `{"id":2}`, true},
+		{"missing", "", string(body), true},
+		{"not hex", "zz", string(body), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := http.Header{}
+			if tt.signature != "" {
+				header.Set(defaultSignatureHeader, tt.signature)
+			}
+			err := signer.Verify(header, []byte(tt.body))
+			if tt.wantErr && !errors.Is(err, ErrInvalidSignature) {
+				t.Errorf("Verify = %v, want ErrInvalidSignature", err)
+			}
+			if !tt.wantErr && err != nil {
+				t.Errorf("Verify: %v", err)
+			}
+		})
+	}
+}
+
+func TestSignerWithoutSecret(t *testing.T) {
+	signer, err := SignerFromConfig(map[string]interface{}{})
+	if err != nil {
+		t.Fatalf("SignerFromConfig: %v", err)
+	}
+	req := httptest.NewRequest(http.MethodPost, "/", nil)
+	signer.Sign(req, []byte("body"))
+	if len(req.Header) != 0 {
+		t.Errorf("signed without a secret: %v", req.Header)
+	}
+	if err := signer.Verify(http.Header{}, []byte("body")); err != nil {
+		t.Errorf("Verify without a secret: %v", err)
+	}
+}
+
+func TestSignerRejectsUnknownSettings(t *testing.T) {
+	for _, config := range []map[string]interface{}{
+		{"hmac_algorithm": "md5"},
+		{"signature_encoding": "base32"},
+	} {
+		if _, err := SignerFromConfig(config); err == nil {
+			t.Errorf("SignerFromConfig(%v) accepted an unsupported setting", config)
+		}
+	}
+}
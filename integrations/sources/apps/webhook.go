@@ -0,0 +1,87 @@
+package apps
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+const (
+	webhookID = "webhook"
+
+	defaultWebhookStream = "webhook"
+	defaultMaxBodyBytes  = 10 << 20
+)
+
+// Webhook is a push source: records arrive through the ingest endpoint rather
+// than being pulled, so Run only holds the pipeline open. The config decides
+// which stream the records land in and how request signatures are checked.
+type Webhook struct {
+	stream       string
+	primaryKey   []string
+	maxBodyBytes int64
+	queryToken   bool
+	signer       *Signer
+}
+
+func (wh *Webhook) Initialize(config map[string]interface{}) error {
+	wh.stream = defaultWebhookStream
+	if stream, ok := config["stream"].(string); ok && stream != "" {
+		wh.stream = stream
+	}
+
+	wh.primaryKey = nil
+	if keys, ok := config["primary_key"].([]interface{}); ok {
+		for _, key := range keys {
+			if column, ok := key.(string); ok && column != "" {
+				wh.primaryKey = append(wh.primaryKey, column)
+			}
+		}
+	}
+
+	wh.maxBodyBytes = defaultMaxBodyBytes
+	if limit, ok := config["max_body_bytes"].(float64); ok && limit > 0 {
+		wh.maxBodyBytes = int64(limit)
+	}
+
+	wh.queryToken, _ = config["allow_query_token"].(bool)
+
+	signer, err := SignerFromConfig(config)
+	if err != nil {
+		return err
+	}
+	wh.signer = signer
+	return nil
+}
+
+func (wh *Webhook) SourceID() string {
+	return webhookID
+}
+
+func (wh *Webhook) Run(ctx context.Context, pipelineID int64, js jetstream.JetStream) error {
+	<-ctx.Done()
+	return nil
+}
+
+func (wh *Webhook) Stream() string {
+	return wh.stream
+}
+
+func (wh *Webhook) PrimaryKey() []string {
+	return wh.primaryKey
+}
+
+func (wh *Webhook) MaxBodyBytes() int64 {
+	return wh.maxBodyBytes
+}
+
+func (wh *Webhook) AllowsQueryToken() bool {
+	return wh.queryToken
+}
+
+// VerifyRequest checks the request's signature. Without a configured
+// secret every request is accepted.
+func (wh *Webhook) VerifyRequest(header http.Header, body []byte) error {
+	return wh.signer.Verify(header, body)
+}
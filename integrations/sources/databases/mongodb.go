@@ -0,0 +1,335 @@
+package databases
+
+import (
+	"context"
+	"dataforge-be/integrations/connection"
+	n "dataforge-be/nats"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go/jetstream"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.mongodb.org/mongo-driver/v2/mongo"
+	"go.mongodb.org/mongo-driver/v2/mongo/options"
+)
+
+const (
+	mongoChangeStreamID = "mongodb_cdc"
+
+	mongoState        = "mongodb"
+	mongoMaxAwaitTime = 5 * time.Second
+)
+
+// MongoDB reads collection data from a replica set or sharded cluster: an
+// initial snapshot of each selected collection, then change stream events.
+type MongoDB struct {
+	uri      string
+	database string
+	includes []string
+	excludes []string
+	snapshot bool
+	client   *mongo.Client
+	js       jetstream.JetStream
+}
+
+type mongoSourceState struct {
+	ResumeToken   string `json:"resume_token,omitempty"`
+	OperationTime uint32 `json:"operation_time,omitempty"`
+	OperationInc  uint32 `json:"operation_increment,omitempty"`
+	SnapshotDone  bool   `json:"snapshot_done"`
+}
+
+func (m *MongoDB) Initialize(config map[string]interface{}) error {
+	m.uri, _ = config["uri"].(string)
+	m.database, _ = config["db"].(string)
+	if m.uri == "" || m.database == "" {
+		return errors.New("mongodb source requires uri and db")
+	}
+
+	m.includes = connection.StringsFromConfig(config, "collections")
+	m.excludes = connection.StringsFromConfig(config, "exclude")
+	m.snapshot = true
+	if snapshot, ok := config["snapshot"].(bool); ok {
+		m.snapshot = snapshot
+	}
+
+	client, err := mongo.Connect(options.Client().ApplyURI(m.uri))
+	if err != nil {
+		return fmt.Errorf("failed to create mongodb client: %w", err)
+	}
+	m.client = client
+	return nil
+}
+
+func (m *MongoDB) SourceID() string {
+	return mongoChangeStreamID
+}
+
+func (m *MongoDB) isCollectionSelected(collection string) bool {
+	if strings.HasPrefix(collection, "system.") {
+		return false
+	}
+	qualified := m.database + "." + collection
+	if len(m.includes) > 0 && !matchesAnyPattern(m.includes, qualified, collection) {
+		return false
+	}
+	return !matchesAnyPattern(m.excludes, qualified, collection)
+}
+
+func (m *MongoDB) Run(ctx context.Context, pipelineID int64, js jetstream.JetStream) error {
+	m.js = js
+	defer m.client.Disconnect(context.Background())
+
+	state := mongoSourceState{}
+	_, err := n.GetPipelineState(ctx, js, pipelineID, mongoState, &state)
+	if err != nil {
+		return err
+	}
+
+	db := m.client.Database(m.database)
+	if state.ResumeToken == "" && state.OperationTime == 0 {
+		// Changes made while the snapshot runs are replayed from this point,
+		// so nothing between the snapshot and the stream is lost.
+		operationTime, err := m.operationTime(ctx, db)
+		if err != nil {
+			return err
+		}
+		state.OperationTime, state.OperationInc = operationTime.T, operationTime.I
+		state.SnapshotDone = false
+	}
+
+	if m.snapshot && !state.SnapshotDone {
+		if err := m.snapshotCollections(ctx, pipelineID, db); err != nil {
+			return err
+		}
+	}
+	state.SnapshotDone = true
+	if err := n.PutPipelineState(ctx, js, pipelineID, mongoState, state); err != nil {
+		return err
+	}
+
+	opts := options.ChangeStream().
+		SetFullDocument(options.UpdateLookup).
+		SetMaxAwaitTime(mongoMaxAwaitTime)
+	if state.ResumeToken != "" {
+		opts.SetStartAfter(bson.D{{Key: "_data", Value: state.ResumeToken}})
+	} else {
+		opts.SetStartAtOperationTime(&bson.Timestamp{T: state.OperationTime, I: state.OperationInc})
+	}
+
+	stream, err := db.Watch(ctx, mongo.Pipeline{}, opts)
+	if err != nil {
+		return fmt.Errorf("failed to open change stream: %w", err)
+	}
+	defer stream.Close(context.Background())
+	log.Printf("Pipeline %d streaming changes from mongodb database %s", pipelineID, m.database)
+
+	err = m.stream(ctx, pipelineID, stream, &state)
+	if ctx.Err() != nil {
+		return nil
+	}
+	return err
+}
+
+func (m *MongoDB) operationTime(ctx context.Context, db *mongo.Database) (bson.Timestamp, error) {
+	var reply struct {
+		OperationTime bson.Timestamp `bson:"operationTime"`
+	}
+	err := db.RunCommand(ctx, bson.D{{Key: "ping", Value: 1}}).Decode(&reply)
+	if err != nil {
+		return bson.Timestamp{}, fmt.Errorf("failed to read mongodb operation time: %w", err)
+	}
+	if reply.OperationTime.IsZero() {
+		return bson.Timestamp{}, errors.New("mongodb change streams require a replica set or sharded cluster")
+	}
+	return reply.OperationTime, nil
+}
+
+func (m *MongoDB) snapshotCollections(ctx context.Context, pipelineID int64, db *mongo.Database) error {
+	collections, err := db.ListCollectionNames(ctx, bson.D{{Key: "type", Value: "collection"}})
+	if err != nil {
+		return fmt.Errorf("failed to list collections: %w", err)
+	}
+
+	for _, collection := range collections {
+		if !m.isCollectionSelected(collection) {
+			continue
+		}
+		if err := m.snapshotCollection(ctx, pipelineID, db.Collection(collection)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *MongoDB) snapshotCollection(ctx context.Context, pipelineID int64, collection *mongo.Collection) error {
+	stream := m.database + "." + collection.Name()
+	cursor, err := collection.Find(ctx, bson.D{})
+	if err != nil {
+		return fmt.Errorf("failed to snapshot %s: %w", stream, err)
+	}
+	defer cursor.Close(context.Background())
+
+	batch := &changeBatch{pipelineID: pipelineID, js: m.js}
+	for cursor.Next(ctx) {
+		var document bson.D
+		if err := cursor.Decode(&document); err != nil {
+			return fmt.Errorf("failed to decode document in %s: %w", stream, err)
+		}
+		record, _ := mongoValue(document).(map[string]interface{})
+		if err := batch.add(ctx, stream, n.OperationInsert, []string{"_id"}, record); err != nil {
+			return err
+		}
+	}
+	if err := cursor.Err(); err != nil {
+		return fmt.Errorf("failed to snapshot %s: %w", stream, err)
+	}
+	return batch.flush(ctx)
+}
+
+type changeEvent struct {
+	OperationType string `bson:"operationType"`
+	Namespace     struct {
+		Database   string `bson:"db"`
+		Collection string `bson:"coll"`
+	} `bson:"ns"`
+	DocumentKey  bson.D `bson:"documentKey"`
+	FullDocument bson.D `bson:"fullDocument"`
+}
+
+func (m *MongoDB) stream(ctx context.Context, pipelineID int64, stream *mongo.ChangeStream, state *mongoSourceState) error {
+	batch := &changeBatch{pipelineID: pipelineID, js: m.js}
+
+	// The resume token is saved once the server's batch has been published,
+	// including after empty batches, so idle streams keep a fresh token.
+	checkpoint := func() error {
+		if err := batch.flush(ctx); err != nil {
+			return err
+		}
+		token, ok := stream.ResumeToken().Lookup("_data").StringValueOK()
+		if !ok || token == state.ResumeToken {
+			return nil
+		}
+		state.ResumeToken = token
+		return n.PutPipelineState(ctx, m.js, pipelineID, mongoState, state)
+	}
+
+	for {
+		if !stream.TryNext(ctx) {
+			if err := stream.Err(); err != nil {
+				return fmt.Errorf("change stream failed: %w", err)
+			}
+			if ctx.Err() != nil {
+				return nil
+			}
+			if err := checkpoint(); err != nil {
+				return err
+			}
+			continue
+		}
+
+		var event changeEvent
+		if err := stream.Decode(&event); err != nil {
+			return fmt.Errorf("failed to decode change event: %w", err)
+		}
+		if err := m.handleEvent(ctx, batch, event); err != nil {
+			return err
+		}
+
+		if stream.RemainingBatchLength() == 0 {
+			if err := checkpoint(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (m *MongoDB) handleEvent(ctx context.Context, batch *changeBatch, event changeEvent) error {
+	collection := event.Namespace.Collection
+	stream := m.database + "." + collection
+
+	switch event.OperationType {
+	case "insert", "update", "replace":
+		if !m.isCollectionSelected(collection) {
+			return nil
+		}
+		if event.FullDocument == nil {
+			// The document was deleted before the update could be looked
+			// up; its delete event follows.
+			return nil
+		}
+		operation := n.OperationUpdate
+		if event.OperationType == "insert" {
+			operation = n.OperationInsert
+		}
+		record, _ := mongoValue(event.FullDocument).(map[string]interface{})
+		return batch.add(ctx, stream, operation, []string{"_id"}, record)
+	case "delete":
+		if !m.isCollectionSelected(collection) {
+			return nil
+		}
+		record, _ := mongoValue(event.DocumentKey).(map[string]interface{})
+		return batch.add(ctx, stream, n.OperationDelete, []string{"_id"}, record)
+	case "invalidate":
+		return errors.New("change stream was invalidated; the database was dropped or renamed")
+	case "drop", "rename", "dropDatabase":
+		log.Printf("Ignoring %s of %s", event.OperationType, stream)
+	}
+	return nil
+}
+
+// mongoValue converts decoded BSON into plain JSON values. ObjectIDs become
+// their hex string so they can be used as primary keys downstream.
+func mongoValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case bson.D:
+		record := make(map[string]interface{}, len(v))
+		for _, element := range v {
+			record[element.Key] = mongoValue(element.Value)
+		}
+		return record
+	case bson.M:
+		record := make(map[string]interface{}, len(v))
+		for key, element := range v {
+			record[key] = mongoValue(element)
+		}
+		return record
+	case bson.A:
+		values := make([]interface{}, len(v))
+		for i, element := range v {
+			values[i] = mongoValue(element)
+		}
+		return values
+	case bson.ObjectID:
+		return v.Hex()
+	case bson.DateTime:
+		return v.Time().UTC().Format(time.RFC3339Nano)
+	case bson.Timestamp:
+		return time.Unix(int64(v.T), 0).UTC().Format(time.RFC3339)
+	case bson.Decimal128:
+		return json.Number(v.String())
+	case bson.Binary:
+		return base64.StdEncoding.EncodeToString(v.Data)
+	case bson.Regex:
+		return fmt.Sprintf("/%s/%s", v.Pattern, v.Options)
+	case bson.JavaScript:
+		return string(v)
+	case bson.Symbol:
+		return string(v)
+	case bson.Null, bson.Undefined, bson.MinKey, bson.MaxKey:
+		return nil
+	case float64:
+		if math.IsInf(v, 0) || math.IsNaN(v) {
+			return fmt.Sprint(v)
+		}
+		return v
+	default:
+		return v
+	}
+}
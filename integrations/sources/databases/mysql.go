@@ -0,0 +1,738 @@
+package databases
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"database/sql"
+	"dataforge-be/integrations/connection"
+	n "dataforge-be/nats"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	gomysql "github.com/go-mysql-org/go-mysql/mysql"
+	"github.com/go-mysql-org/go-mysql/replication"
+	"github.com/go-sql-driver/mysql"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+const (
+	mysqlID = "mysql"
+
+	mysqlState            = "mysql"
+	defaultMySQLPort      = "3306"
+	mysqlHeartbeat        = 30 * time.Second
+	mysqlServerIDBase     = 1000000
+	mysqlCheckpointGTID   = "gtid"
+	mysqlCheckpointFile   = "file"
+	mysqlFirstEventOffset = 4
+)
+
+var mysqlSystemSchemas = []string{"mysql", "information_schema", "performance_schema", "sys"}
+
+type MySQL struct {
+	host       string
+	port       string
+	user       string
+	password   string
+	database   string
+	tlsConfig  *tls.Config
+	serverID   uint32
+	checkpoint string
+	includes   []string
+	excludes   []string
+	snapshot   bool
+	db         *sql.DB
+	columns    map[string][]mysqlColumn
+	js         jetstream.JetStream
+}
+
+type mysqlSourceState struct {
+	File         string `json:"file,omitempty"`
+	Position     uint32 `json:"position,omitempty"`
+	GTIDSet      string `json:"gtid_set,omitempty"`
+	SnapshotDone bool   `json:"snapshot_done"`
+}
+
+type databaseTable struct {
+	Schema string
+	Name   string
+}
+
+func (t databaseTable) String() string {
+	return t.Schema + "." + t.Name
+}
+
+func (m *MySQL) Initialize(config map[string]interface{}) error {
+	m.host, _ = config["host"].(string)
+	m.port, _ = config["port"].(string)
+	if portNumber, ok := config["port"].(float64); ok {
+		m.port = strconv.Itoa(int(portNumber))
+	}
+	if m.port == "" {
+		m.port = defaultMySQLPort
+	}
+	m.user, _ = config["username"].(string)
+	m.password, _ = config["password"].(string)
+	m.database, _ = config["db"].(string)
+	if m.host == "" || m.user == "" {
+		return errors.New("mysql source requires host and username")
+	}
+
+	m.tlsConfig = nil
+	if useTLS, _ := config["tls"].(bool); useTLS {
+		m.tlsConfig = &tls.Config{ServerName: m.host, MinVersion: tls.VersionTLS12}
+		if caCert, _ := config["ca_cert"].(string); caCert != "" {
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM([]byte(caCert)) {
+				return errors.New("invalid ca_cert for mysql source")
+			}
+			m.tlsConfig.RootCAs = pool
+		}
+	}
+
+	m.serverID = 0
+	if serverID, ok := config["server_id"].(float64); ok && serverID > 0 {
+		m.serverID = uint32(serverID)
+	}
+
+	m.checkpoint, _ = config["checkpoint"].(string)
+	switch m.checkpoint {
+	case "", mysqlCheckpointGTID, mysqlCheckpointFile:
+	default:
+		return fmt.Errorf("unsupported mysql checkpoint mode %s", m.checkpoint)
+	}
+
+	m.includes = connection.StringsFromConfig(config, "include")
+	m.excludes = connection.StringsFromConfig(config, "exclude")
+	if len(m.includes) == 0 && m.database != "" {
+		m.includes = []string{m.database + ".*"}
+	}
+
+	m.snapshot = true
+	if snapshot, ok := config["snapshot"].(bool); ok {
+		m.snapshot = snapshot
+	}
+
+	cfg := mysql.NewConfig()
+	cfg.User = m.user
+	cfg.Passwd = m.password
+	cfg.Net = "tcp"
+	cfg.Addr = net.JoinHostPort(m.host, m.port)
+	cfg.DBName = m.database
+	cfg.TLS = m.tlsConfig
+	connector, err := mysql.NewConnector(cfg)
+	if err != nil {
+		return fmt.Errorf("invalid mysql config: %w", err)
+	}
+	m.db = sql.OpenDB(connector)
+	m.columns = make(map[string][]mysqlColumn)
+	return nil
+}
+
+func (m *MySQL) SourceID() string {
+	return mysqlID
+}
+
+func (m *MySQL) Run(ctx context.Context, pipelineID int64, js jetstream.JetStream) error {
+	m.js = js
+	defer m.db.Close()
+
+	state := mysqlSourceState{}
+	_, err := n.GetPipelineState(ctx, js, pipelineID, mysqlState, &state)
+	if err != nil {
+		return err
+	}
+
+	if err := m.checkBinlogSettings(ctx); err != nil {
+		return err
+	}
+	useGTID, err := m.useGTID(ctx, state)
+	if err != nil {
+		return err
+	}
+
+	if m.snapshot && !state.SnapshotDone {
+		state, err = m.snapshotTables(ctx, pipelineID)
+		if err != nil {
+			return err
+		}
+		state.SnapshotDone = true
+		if !useGTID {
+			state.GTIDSet = ""
+		}
+		if err := n.PutPipelineState(ctx, js, pipelineID, mysqlState, state); err != nil {
+			return err
+		}
+	} else if state.File == "" && state.GTIDSet == "" {
+		state, err = m.currentPosition(ctx, m.db)
+		if err != nil {
+			return err
+		}
+		state.SnapshotDone = !m.snapshot
+		if !useGTID {
+			state.GTIDSet = ""
+		}
+		if err := n.PutPipelineState(ctx, js, pipelineID, mysqlState, state); err != nil {
+			return err
+		}
+	}
+
+	port, err := strconv.ParseUint(m.port, 10, 16)
+	if err != nil {
+		return fmt.Errorf("invalid mysql port %s", m.port)
+	}
+	serverID := m.serverID
+	if serverID == 0 {
+		serverID = uint32(mysqlServerIDBase + pipelineID)
+	}
+
+	syncer := replication.NewBinlogSyncer(replication.BinlogSyncerConfig{
+		ServerID:        serverID,
+		Flavor:          gomysql.MySQLFlavor,
+		Host:            m.host,
+		Port:            uint16(port),
+		User:            m.user,
+		Password:        m.password,
+		TLSConfig:       m.tlsConfig,
+		HeartbeatPeriod: mysqlHeartbeat,
+		ReadTimeout:     3 * mysqlHeartbeat,
+		// TIMESTAMP values are rendered in UTC, as in the snapshot.
+		TimestampStringLocation: time.UTC,
+	})
+	defer syncer.Close()
+
+	var streamer *replication.BinlogStreamer
+	if useGTID {
+		executed, err := gomysql.ParseMysqlGTIDSet(state.GTIDSet)
+		if err != nil {
+			return fmt.Errorf("failed to parse GTID set %s: %w", state.GTIDSet, err)
+		}
+		streamer, err = syncer.StartSyncGTID(executed)
+		log.Printf("Pipeline %d streaming mysql binlog after GTID set %s", pipelineID, executed)
+	} else {
+		if state.Position < mysqlFirstEventOffset {
+			state.Position = mysqlFirstEventOffset
+		}
+		streamer, err = syncer.StartSync(gomysql.Position{Name: state.File, Pos: state.Position})
+		log.Printf("Pipeline %d streaming mysql binlog from %s:%d", pipelineID, state.File, state.Position)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to request binlog dump: %w", err)
+	}
+
+	err = m.stream(ctx, pipelineID, streamer, useGTID, &state)
+	if ctx.Err() != nil {
+		return nil
+	}
+	return err
+}
+
+func (m *MySQL) checkBinlogSettings(ctx context.Context) error {
+	var format, rowImage string
+	err := m.db.QueryRowContext(ctx, "SELECT @@GLOBAL.binlog_format, @@GLOBAL.binlog_row_image").Scan(&format, &rowImage)
+	if err != nil {
+		return fmt.Errorf("failed to read binlog settings: %w", err)
+	}
+	if !strings.EqualFold(format, "ROW") {
+		return fmt.Errorf("mysql source requires binlog_format=ROW, server has %s", format)
+	}
+	if !strings.EqualFold(rowImage, "FULL") {
+		log.Printf("mysql binlog_row_image is %s; updates will be sent as partial records of the columns the server logs", rowImage)
+	}
+	return nil
+}
+
+// useGTID decides how the stream position is tracked. An existing checkpoint
+// keeps its mode, otherwise GTIDs are used when the server has them enabled.
+func (m *MySQL) useGTID(ctx context.Context, state mysqlSourceState) (bool, error) {
+	var gtidMode string
+	err := m.db.QueryRowContext(ctx, "SELECT @@GLOBAL.gtid_mode").Scan(&gtidMode)
+	if err != nil {
+		return false, fmt.Errorf("failed to read gtid_mode: %w", err)
+	}
+	gtidEnabled := strings.EqualFold(gtidMode, "ON")
+
+	switch {
+	case state.GTIDSet != "":
+		if !gtidEnabled {
+			return false, errors.New("pipeline was checkpointed with GTIDs but gtid_mode is no longer ON")
+		}
+		return true, nil
+	case state.File != "":
+		return false, nil
+	case m.checkpoint == mysqlCheckpointGTID:
+		if !gtidEnabled {
+			return false, errors.New("gtid checkpointing requires gtid_mode=ON")
+		}
+		return true, nil
+	case m.checkpoint == mysqlCheckpointFile:
+		return false, nil
+	}
+	return gtidEnabled, nil
+}
+
+type queryRower interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// currentPosition reads the binlog file, position and executed GTID set.
+func (m *MySQL) currentPosition(ctx context.Context, q queryRower) (mysqlSourceState, error) {
+	rows, err := q.QueryContext(ctx, "SHOW BINARY LOG STATUS")
+	if err != nil {
+		// Servers before 8.2 only know the old statement.
+		rows, err = q.QueryContext(ctx, "SHOW MASTER STATUS")
+	}
+	if err != nil {
+		return mysqlSourceState{}, fmt.Errorf("failed to read binlog position: %w", err)
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return mysqlSourceState{}, err
+	}
+	if !rows.Next() {
+		if err := rows.Err(); err != nil {
+			return mysqlSourceState{}, err
+		}
+		return mysqlSourceState{}, errors.New("binary logging is not enabled on the mysql server")
+	}
+
+	values := make([]sql.RawBytes, len(columns))
+	scanArgs := make([]interface{}, len(columns))
+	for i := range values {
+		scanArgs[i] = &values[i]
+	}
+	if err := rows.Scan(scanArgs...); err != nil {
+		return mysqlSourceState{}, err
+	}
+
+	state := mysqlSourceState{}
+	for i, column := range columns {
+		switch column {
+		case "File":
+			state.File = string(values[i])
+		case "Position":
+			position, err := strconv.ParseUint(string(values[i]), 10, 32)
+			if err != nil {
+				return mysqlSourceState{}, fmt.Errorf("invalid binlog position %s", values[i])
+			}
+			state.Position = uint32(position)
+		case "Executed_Gtid_Set":
+			gtids, err := gomysql.ParseMysqlGTIDSet(string(values[i]))
+			if err != nil {
+				return mysqlSourceState{}, fmt.Errorf("failed to parse GTID set %s: %w", values[i], err)
+			}
+			state.GTIDSet = gtids.String()
+		}
+	}
+	return state, rows.Err()
+}
+
+func (m *MySQL) isTableSelected(schema, table string) bool {
+	for _, system := range mysqlSystemSchemas {
+		if strings.EqualFold(schema, system) {
+			return false
+		}
+	}
+	qualified := schema + "." + table
+	if len(m.includes) > 0 && !matchesAnyPattern(m.includes, qualified, table) {
+		return false
+	}
+	return !matchesAnyPattern(m.excludes, qualified, table)
+}
+
+func matchesAnyPattern(patterns []string, qualified, name string) bool {
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, qualified); ok {
+			return true
+		}
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *MySQL) selectedTables(ctx context.Context, q queryRower) ([]databaseTable, error) {
+	rows, err := q.QueryContext(ctx, `SELECT TABLE_SCHEMA, TABLE_NAME FROM information_schema.TABLES
+	WHERE TABLE_TYPE = 'BASE TABLE' ORDER BY TABLE_SCHEMA, TABLE_NAME`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list tables: %w", err)
+	}
+	defer rows.Close()
+
+	var tables []databaseTable
+	for rows.Next() {
+		var table databaseTable
+		if err := rows.Scan(&table.Schema, &table.Name); err != nil {
+			return nil, err
+		}
+		if m.isTableSelected(table.Schema, table.Name) {
+			tables = append(tables, table)
+		}
+	}
+	return tables, rows.Err()
+}
+
+// tableColumns returns the columns of a table in ordinal order, which is the
+// order rows events use. Results are cached until the next DDL statement.
+func (m *MySQL) tableColumns(ctx context.Context, q queryRower, table databaseTable) ([]mysqlColumn, error) {
+	if columns, ok := m.columns[table.String()]; ok {
+		return columns, nil
+	}
+
+	rows, err := q.QueryContext(ctx, `SELECT COLUMN_NAME, DATA_TYPE, COLUMN_TYPE, COLUMN_KEY FROM information_schema.COLUMNS
+	WHERE TABLE_SCHEMA = ? AND TABLE_NAME = ? ORDER BY ORDINAL_POSITION`, table.Schema, table.Name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up columns for %s: %w", table, err)
+	}
+	defer rows.Close()
+
+	var columns []mysqlColumn
+	for rows.Next() {
+		var column mysqlColumn
+		var key string
+		if err := rows.Scan(&column.Name, &column.DataType, &column.ColumnType, &key); err != nil {
+			return nil, err
+		}
+		column.DataType = strings.ToLower(column.DataType)
+		column.Unsigned = strings.Contains(strings.ToLower(column.ColumnType), "unsigned")
+		column.Key = key == "PRI"
+		if column.DataType == "enum" || column.DataType == "set" {
+			column.Values = parseEnumValues(column.ColumnType)
+		}
+		columns = append(columns, column)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	m.columns[table.String()] = columns
+	return columns, nil
+}
+
+// parseEnumValues extracts the members of an enum('a','b') or set('a','b')
+// column type.
+func parseEnumValues(columnType string) []string {
+	start, end := strings.Index(columnType, "("), strings.LastIndex(columnType, ")")
+	if start < 0 || end <= start {
+		return nil
+	}
+
+	var values []string
+	var current strings.Builder
+	inQuote := false
+	body := columnType[start+1 : end]
+	for i := 0; i < len(body); i++ {
+		c := body[i]
+		switch {
+		case c == '\'' && inQuote && i+1 < len(body) && body[i+1] == '\'':
+			current.WriteByte('\'')
+			i++
+		case c == '\'':
+			if inQuote {
+				values = append(values, current.String())
+				current.Reset()
+			}
+			inQuote = !inQuote
+		case inQuote:
+			current.WriteByte(c)
+		}
+	}
+	return values
+}
+
+func primaryKeyColumns(columns []mysqlColumn) []string {
+	var primaryKey []string
+	for _, column := range columns {
+		if column.Key {
+			primaryKey = append(primaryKey, column.Name)
+		}
+	}
+	return primaryKey
+}
+
+func quoteMySQLIdentifier(name string) string {
+	return "`" + strings.ReplaceAll(name, "`", "``") + "`"
+}
+
+// snapshotTables copies every selected table inside one consistent-snapshot
+// transaction. The binlog position is read before the snapshot starts, so
+// changes made in between are replayed rather than lost.
+func (m *MySQL) snapshotTables(ctx context.Context, pipelineID int64) (mysqlSourceState, error) {
+	conn, err := m.db.Conn(ctx)
+	if err != nil {
+		return mysqlSourceState{}, fmt.Errorf("failed to connect to mysql for snapshot: %w", err)
+	}
+	defer conn.Close()
+
+	state, err := m.currentPosition(ctx, conn)
+	if err != nil {
+		return mysqlSourceState{}, err
+	}
+
+	// TIMESTAMP values are rendered in the session time zone, while the
+	// binlog stores them in UTC.
+	_, err = conn.ExecContext(ctx, "SET SESSION time_zone = '+00:00', SESSION TRANSACTION ISOLATION LEVEL REPEATABLE READ")
+	if err != nil {
+		return mysqlSourceState{}, fmt.Errorf("failed to prepare snapshot session: %w", err)
+	}
+	_, err = conn.ExecContext(ctx, "START TRANSACTION WITH CONSISTENT SNAPSHOT, READ ONLY")
+	if err != nil {
+		return mysqlSourceState{}, fmt.Errorf("failed to begin snapshot transaction: %w", err)
+	}
+	defer conn.ExecContext(context.Background(), "ROLLBACK")
+
+	tables, err := m.selectedTables(ctx, conn)
+	if err != nil {
+		return mysqlSourceState{}, err
+	}
+	for _, table := range tables {
+		if err := m.snapshotTable(ctx, conn, pipelineID, table); err != nil {
+			return mysqlSourceState{}, err
+		}
+	}
+	return state, nil
+}
+
+func (m *MySQL) snapshotTable(ctx context.Context, conn *sql.Conn, pipelineID int64, table databaseTable) error {
+	columns, err := m.tableColumns(ctx, conn, table)
+	if err != nil {
+		return err
+	}
+	byName := make(map[string]mysqlColumn, len(columns))
+	for _, column := range columns {
+		byName[column.Name] = column
+	}
+
+	rows, err := conn.QueryContext(ctx, fmt.Sprintf("SELECT * FROM %s.%s", quoteMySQLIdentifier(table.Schema), quoteMySQLIdentifier(table.Name)))
+	if err != nil {
+		return fmt.Errorf("failed to snapshot %s: %w", table, err)
+	}
+	defer rows.Close()
+
+	names, err := rows.Columns()
+	if err != nil {
+		return err
+	}
+	values := make([]interface{}, len(names))
+	scanArgs := make([]interface{}, len(names))
+	for i := range values {
+		scanArgs[i] = &values[i]
+	}
+
+	batch := &changeBatch{pipelineID: pipelineID, js: m.js}
+	primaryKey := primaryKeyColumns(columns)
+	for rows.Next() {
+		if err := rows.Scan(scanArgs...); err != nil {
+			return fmt.Errorf("failed to scan row of %s: %w", table, err)
+		}
+
+		record := make(map[string]interface{}, len(names))
+		for i, name := range names {
+			record[name] = decodeMySQLText(byName[name], values[i])
+		}
+		if err := batch.add(ctx, table.String(), n.OperationInsert, primaryKey, record); err != nil {
+			return err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to snapshot %s: %w", table, err)
+	}
+	return batch.flush(ctx)
+}
+
+// decodeMySQLText converts a snapshot value into the same JSON type the
+// binlog decoder produces for the column.
+func decodeMySQLText(column mysqlColumn, value interface{}) interface{} {
+	data, ok := value.([]byte)
+	if !ok {
+		if t, ok := value.(time.Time); ok {
+			return t.UTC().Format("2006-01-02 15:04:05.999999")
+		}
+		return value
+	}
+
+	text := string(data)
+	switch column.DataType {
+	case "tinyint", "smallint", "mediumint", "int", "integer", "bigint", "year":
+		if column.Unsigned {
+			if v, err := strconv.ParseUint(text, 10, 64); err == nil {
+				return v
+			}
+		} else if v, err := strconv.ParseInt(text, 10, 64); err == nil {
+			return v
+		}
+	case "float", "double", "real":
+		if v, err := strconv.ParseFloat(text, 64); err == nil {
+			return jsonFloat(v)
+		}
+	case "decimal", "numeric":
+		if json.Valid(data) {
+			return json.Number(text)
+		}
+	case "json":
+		if json.Valid(data) {
+			return json.RawMessage(text)
+		}
+	case "bit":
+		return bigEndian(data)
+	case "tinyblob", "blob", "mediumblob", "longblob", "geometry", "point", "linestring", "polygon",
+		"multipoint", "multilinestring", "multipolygon", "geometrycollection":
+		return base64.StdEncoding.EncodeToString(data)
+	}
+	return text
+}
+
+func (m *MySQL) stream(ctx context.Context, pipelineID int64, streamer *replication.BinlogStreamer, useGTID bool, state *mysqlSourceState) error {
+	batch := &changeBatch{pipelineID: pipelineID, js: m.js}
+	file := state.File
+
+	checkpoint := func(position uint32, executed gomysql.GTIDSet) error {
+		if err := batch.flush(ctx); err != nil {
+			return err
+		}
+		state.File = file
+		state.Position = position
+		if useGTID && executed != nil {
+			state.GTIDSet = executed.String()
+		}
+		return n.PutPipelineState(ctx, m.js, pipelineID, mysqlState, state)
+	}
+
+	for {
+		event, err := streamer.GetEvent(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to read binlog event: %w", err)
+		}
+
+		switch e := event.Event.(type) {
+		case *replication.RotateEvent:
+			file = string(e.NextLogName)
+		case *replication.QueryEvent:
+			statement := strings.ToUpper(strings.TrimSpace(string(e.Query)))
+			if statement == "BEGIN" {
+				continue
+			}
+			if statement != "COMMIT" {
+				// DDL commits on its own and may change column layouts.
+				m.columns = make(map[string][]mysqlColumn)
+			}
+			if err := checkpoint(event.Header.LogPos, e.GSet); err != nil {
+				return err
+			}
+		case *replication.XIDEvent:
+			if err := checkpoint(event.Header.LogPos, e.GSet); err != nil {
+				return err
+			}
+		case *replication.RowsEvent:
+			if event.Header.EventType == replication.PARTIAL_UPDATE_ROWS_EVENT {
+				return errors.New("partial JSON updates are not supported; set binlog_row_value_options to an empty value")
+			}
+			if e.Table == nil || !m.isTableSelected(string(e.Table.Schema), string(e.Table.Table)) {
+				continue
+			}
+			if err := m.emit(ctx, batch, e); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (m *MySQL) emit(ctx context.Context, batch *changeBatch, e *replication.RowsEvent) error {
+	table := databaseTable{Schema: string(e.Table.Schema), Name: string(e.Table.Table)}
+	columns, err := m.tableColumns(ctx, m.db, table)
+	if err != nil {
+		return err
+	}
+	if len(columns) != int(e.ColumnCount) {
+		delete(m.columns, table.String())
+		columns, err = m.tableColumns(ctx, m.db, table)
+		if err != nil {
+			return err
+		}
+		if len(columns) != int(e.ColumnCount) {
+			log.Printf("Columns of %s changed since the binlog event was written; unmatched columns are named by position", table)
+		}
+	}
+
+	var operation string
+	switch e.Type() {
+	case replication.EnumRowsEventTypeInsert:
+		operation = n.OperationInsert
+	case replication.EnumRowsEventTypeUpdate:
+		operation = n.OperationUpdate
+	case replication.EnumRowsEventTypeDelete:
+		operation = n.OperationDelete
+	default:
+		return fmt.Errorf("unknown rows event for %s", table)
+	}
+
+	// Updates carry the row before and after the change, one after the
+	// other; only the image after is sent.
+	step, first := 1, 0
+	if operation == n.OperationUpdate {
+		step, first = 2, 1
+	}
+
+	primaryKey := primaryKeyColumns(columns)
+	for i := first; i < len(e.Rows); i += step {
+		record, skipped, err := mysqlRecord(columns, e.Rows[i], e.SkippedColumns, i)
+		if err != nil {
+			return fmt.Errorf("failed to decode row of %s: %w", table, err)
+		}
+
+		// A row image other than FULL leaves out columns that did not
+		// change, which destinations have to merge around.
+		if operation != n.OperationUpdate {
+			skipped = nil
+		}
+		if err := batch.addPartial(ctx, table.String(), operation, primaryKey, skipped, record); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mysqlRecord names the values of a row image by column and returns the
+// columns the image leaves out.
+func mysqlRecord(columns []mysqlColumn, row []interface{}, skippedColumns [][]int, index int) (map[string]interface{}, []string, error) {
+	column := func(i int) mysqlColumn {
+		if i < len(columns) {
+			return columns[i]
+		}
+		return mysqlColumn{Name: fmt.Sprintf("column_%d", i+1)}
+	}
+
+	isSkipped := make(map[int]bool)
+	var skipped []string
+	if index < len(skippedColumns) {
+		for _, i := range skippedColumns[index] {
+			isSkipped[i] = true
+			skipped = append(skipped, column(i).Name)
+		}
+	}
+
+	record := make(map[string]interface{}, len(row))
+	for i, value := range row {
+		if isSkipped[i] {
+			continue
+		}
+		decoded, err := mysqlValue(column(i), value)
+		if err != nil {
+			return nil, nil, err
+		}
+		record[column(i).Name] = decoded
+	}
+	return record, skipped, nil
+}
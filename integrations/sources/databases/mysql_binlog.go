@@ -0,0 +1,123 @@
+package databases
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/go-mysql-org/go-mysql/replication"
+)
+
+// mysqlColumn describes a table column as reported by information_schema.
+// The binlog carries neither column names nor signedness.
+type mysqlColumn struct {
+	Name       string
+	DataType   string
+	ColumnType string
+	Unsigned   bool
+	Key        bool
+	Values     []string
+}
+
+// mysqlValue converts a value decoded from a rows event into the same JSON
+// type the snapshot produces for the column. Integers come out of the
+// binlog signed, enums as their index and sets as a bitmap, so the column
+// is needed to read them.
+func mysqlValue(column mysqlColumn, value interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case nil:
+		return nil, nil
+	case int8:
+		if column.Unsigned {
+			return uint64(uint8(v)), nil
+		}
+		return int64(v), nil
+	case int16:
+		if column.Unsigned {
+			return uint64(uint16(v)), nil
+		}
+		return int64(v), nil
+	case int32:
+		if column.Unsigned && column.DataType == "mediumint" {
+			return uint64(uint32(v) & 0xffffff), nil
+		}
+		if column.Unsigned {
+			return uint64(uint32(v)), nil
+		}
+		return int64(v), nil
+	case int64:
+		switch {
+		case column.DataType == "enum":
+			if v > 0 && int(v) <= len(column.Values) {
+				return column.Values[v-1], nil
+			}
+			if v == 0 {
+				return "", nil
+			}
+			return v, nil
+		case column.DataType == "set":
+			var members []string
+			for i, member := range column.Values {
+				if v&(1<<uint(i)) != 0 {
+					members = append(members, member)
+				}
+			}
+			return strings.Join(members, ","), nil
+		case column.DataType == "bit" || column.Unsigned:
+			return uint64(v), nil
+		}
+		return v, nil
+	case int:
+		return int64(v), nil
+	case float32:
+		return jsonFloat(float64(v)), nil
+	case float64:
+		return jsonFloat(v), nil
+	case string:
+		switch column.DataType {
+		case "decimal", "numeric":
+			if json.Valid([]byte(v)) {
+				return json.Number(v), nil
+			}
+		case "json":
+			if json.Valid([]byte(v)) {
+				return json.RawMessage(v), nil
+			}
+		}
+		return v, nil
+	case []byte:
+		switch {
+		case column.DataType == "json":
+			// An empty document is what MySQL stores for a NULL inserted
+			// into a NOT NULL column in non-strict mode.
+			if len(v) == 0 {
+				return nil, nil
+			}
+			return json.RawMessage(v), nil
+		case strings.HasSuffix(column.DataType, "text"):
+			return string(v), nil
+		}
+		return base64.StdEncoding.EncodeToString(v), nil
+	case *replication.JsonDiff:
+		return nil, fmt.Errorf("partial JSON update of column %s is not supported; set binlog_row_value_options to an empty value", column.Name)
+	}
+	return value, nil
+}
+
+func bigEndian(b []byte) uint64 {
+	var v uint64
+	for _, c := range b {
+		v = v<<8 | uint64(c)
+	}
+	return v
+}
+
+func jsonFloat(v float64) interface{} {
+	if math.IsInf(v, 0) || math.IsNaN(v) {
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	return v
+}
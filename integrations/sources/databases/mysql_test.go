@@ -0,0 +1,106 @@
+package databases
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/go-mysql-org/go-mysql/replication"
+)
+
+func TestMySQLValue(t *testing.T) {
+	tests := []struct {
+		name   string
+		column mysqlColumn
+		value  interface{}
+		want   interface{}
+	}{
+		{"null", mysqlColumn{DataType: "int"}, nil, nil},
+		{"signed tinyint", mysqlColumn{DataType: "tinyint"}, int8(-1), int64(-1)},
+		{"unsigned tinyint", mysqlColumn{DataType: "tinyint", Unsigned: true}, int8(-1), uint64(255)},
+		{"unsigned smallint", mysqlColumn{DataType: "smallint", Unsigned: true}, int16(-1), uint64(65535)},
+		{"unsigned mediumint", mysqlColumn{DataType: "mediumint", Unsigned: true}, int32(-1), uint64(16777215)},
+		{"unsigned int", mysqlColumn{DataType: "int", Unsigned: true}, int32(-1), uint64(4294967295)},
+		{"unsigned bigint", mysqlColumn{DataType: "bigint", Unsigned: true}, int64(-1), uint64(18446744073709551615)},
+		{"year", mysqlColumn{DataType: "year"}, 2024, int64(2024)},
+		{"double", mysqlColumn{DataType: "double"}, 1.5, 1.5},
+		{"float", mysqlColumn{DataType: "float"}, float32(0.5), 0.5},
+		{"decimal", mysqlColumn{DataType: "decimal"}, "12.50", json.Number("12.50")},
+		{"json", mysqlColumn{DataType: "json"}, `{"a":[1,2]}`, json.RawMessage(`{"a":[1,2]}`)},
+		{"empty json", mysqlColumn{DataType: "json"}, []byte{}, nil},
+		{"enum", mysqlColumn{DataType: "enum", Values: []string{"small", "large"}}, int64(2), "large"},
+		{"empty enum", mysqlColumn{DataType: "enum", Values: []string{"small"}}, int64(0), ""},
+		{"set", mysqlColumn{DataType: "set", Values: []string{"a", "b", "c"}}, int64(5), "a,c"},
+		{"bit", mysqlColumn{DataType: "bit"}, int64(5), uint64(5)},
+		{"text", mysqlColumn{DataType: "mediumtext"}, []byte("hello"), "hello"},
+		{"blob", mysqlColumn{DataType: "blob"}, []byte{0, 1, 2}, "AAEC"},
+		{"varchar", mysqlColumn{DataType: "varchar"}, "hi", "hi"},
+		{"datetime", mysqlColumn{DataType: "datetime"}, "2024-01-02 03:04:05.123", "2024-01-02 03:04:05.123"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := mysqlValue(tt.column, tt.value)
+			if err != nil {
+				t.Fatalf("mysqlValue: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("mysqlValue = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMySQLValueRejectsPartialJSON(t *testing.T) {
+	_, err := mysqlValue(mysqlColumn{Name: "doc", DataType: "json"}, &replication.JsonDiff{})
+	if err == nil {
+		t.Fatal("expected an error for a partial JSON update")
+	}
+}
+
+func TestMySQLRecord(t *testing.T) {
+	columns := []mysqlColumn{
+		{Name: "id", DataType: "int", Key: true},
+		{Name: "name", DataType: "varchar"},
+		{Name: "body", DataType: "text"},
+	}
+
+	tests := []struct {
+		name        string
+		row         []interface{}
+		skipped     [][]int
+		wantRecord  map[string]interface{}
+		wantSkipped []string
+	}{
+		{
+			name:       "full image",
+			row:        []interface{}{int32(1), "ada", []byte("notes")},
+			wantRecord: map[string]interface{}{"id": int64(1), "name": "ada", "body": "notes"},
+		},
+		{
+			name:        "minimal image leaves columns out",
+			row:         []interface{}{int32(1), "ada", nil},
+			skipped:     [][]int{{2}},
+			wantRecord:  map[string]interface{}{"id": int64(1), "name": "ada"},
+			wantSkipped: []string{"body"},
+		},
+		{
+			name:       "columns beyond the known layout are named by position",
+			row:        []interface{}{int32(1), "ada", nil, "extra"},
+			wantRecord: map[string]interface{}{"id": int64(1), "name": "ada", "body": nil, "column_4": "extra"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			record, skipped, err := mysqlRecord(columns, tt.row, tt.skipped, 0)
+			if err != nil {
+				t.Fatalf("mysqlRecord: %v", err)
+			}
+			if !reflect.DeepEqual(record, tt.wantRecord) {
+				t.Errorf("record = %#v, want %#v", record, tt.wantRecord)
+			}
+			if !reflect.DeepEqual(skipped, tt.wantSkipped) {
+				t.Errorf("skipped = %v, want %v", skipped, tt.wantSkipped)
+			}
+		})
+	}
+}
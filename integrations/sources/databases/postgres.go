@@ -0,0 +1,603 @@
+package databases
+
+import (
+	"context"
+	n "dataforge-be/nats"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pglogrepl"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgproto3"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+const (
+	postgresID = "postgres"
+
+	postgresState          = "postgres"
+	changeBatchSize        = 100
+	standbyStatusInterval  = 10 * time.Second
+	defaultPostgresPort    = "5432"
+	defaultPostgresSSLMode = "prefer"
+)
+
+type Postgres struct {
+	connString  string
+	slotName    string
+	publication string
+	tables      []string
+	snapshot    bool
+	js          jetstream.JetStream
+}
+
+type postgresSourceState struct {
+	LSN                string `json:"lsn"`
+	SnapshotDone       bool   `json:"snapshot_done"`
+	CreatedPublication bool   `json:"created_publication"`
+}
+
+func (p *Postgres) Initialize(config map[string]interface{}) error {
+	connString, err := PostgresConnString(config)
+	if err != nil {
+		return err
+	}
+	p.connString = connString
+	p.slotName, _ = config["slot"].(string)
+	p.publication, _ = config["publication"].(string)
+	p.snapshot = true
+	if snapshot, ok := config["snapshot"].(bool); ok {
+		p.snapshot = snapshot
+	}
+
+	tables, _ := config["tables"].([]interface{})
+	p.tables = nil
+	for _, table := range tables {
+		if name, ok := table.(string); ok && name != "" {
+			p.tables = append(p.tables, name)
+		}
+	}
+	return nil
+}
+
+// PostgresConnString reads either a dsn or host, port, username, password,
+// db and sslmode. The postgres destination shares it with the source.
+func PostgresConnString(config map[string]interface{}) (string, error) {
+	connString, _ := config["dsn"].(string)
+	if connString == "" {
+		host, _ := config["host"].(string)
+		port, _ := config["port"].(string)
+		if portNumber, ok := config["port"].(float64); ok {
+			port = strconv.Itoa(int(portNumber))
+		}
+		if port == "" {
+			port = defaultPostgresPort
+		}
+		user, _ := config["username"].(string)
+		password, _ := config["password"].(string)
+		database, _ := config["db"].(string)
+		sslMode, _ := config["sslmode"].(string)
+		if sslMode == "" {
+			sslMode = defaultPostgresSSLMode
+		}
+		if host == "" || user == "" || database == "" {
+			return "", errors.New("postgres requires dsn or host, username and db")
+		}
+
+		dsn := url.URL{
+			Scheme:   "postgres",
+			User:     url.UserPassword(user, password),
+			Host:     net.JoinHostPort(host, port),
+			Path:     "/" + database,
+			RawQuery: url.Values{"sslmode": []string{sslMode}}.Encode(),
+		}
+		connString = dsn.String()
+	}
+	return connString, nil
+}
+
+func (p *Postgres) SourceID() string {
+	return postgresID
+}
+
+func (p *Postgres) names(pipelineID int64) (string, string) {
+	slotName, publication := p.slotName, p.publication
+	if slotName == "" {
+		slotName = fmt.Sprintf("dataforge_%d", pipelineID)
+	}
+	if publication == "" {
+		publication = fmt.Sprintf("dataforge_%d", pipelineID)
+	}
+	return slotName, publication
+}
+
+func (p *Postgres) replicationConnString() (string, error) {
+	if _, err := pgconn.ParseConfig(p.connString); err != nil {
+		return "", fmt.Errorf("invalid postgres connection string: %w", err)
+	}
+	if strings.Contains(p.connString, "://") {
+		separator := "?"
+		if strings.Contains(p.connString, "?") {
+			separator = "&"
+		}
+		return p.connString + separator + "replication=database", nil
+	}
+	return p.connString + " replication=database", nil
+}
+
+func (p *Postgres) Run(ctx context.Context, pipelineID int64, js jetstream.JetStream) error {
+	p.js = js
+	slotName, publication := p.names(pipelineID)
+
+	state := postgresSourceState{}
+	_, err := n.GetPipelineState(ctx, js, pipelineID, postgresState, &state)
+	if err != nil {
+		return err
+	}
+
+	conn, err := pgx.Connect(ctx, p.connString)
+	if err != nil {
+		return fmt.Errorf("failed to connect to postgres: %w", err)
+	}
+	defer conn.Close(context.Background())
+
+	created, err := p.ensurePublication(ctx, conn, publication)
+	if err != nil {
+		return err
+	}
+	if created {
+		state.CreatedPublication = true
+		if err := n.PutPipelineState(ctx, js, pipelineID, postgresState, state); err != nil {
+			return err
+		}
+	}
+
+	replicationConnString, err := p.replicationConnString()
+	if err != nil {
+		return err
+	}
+	replConn, err := pgconn.Connect(ctx, replicationConnString)
+	if err != nil {
+		return fmt.Errorf("failed to open replication connection: %w", err)
+	}
+	defer replConn.Close(context.Background())
+
+	var slotExists bool
+	err = conn.QueryRow(ctx, "SELECT EXISTS (SELECT 1 FROM pg_replication_slots WHERE slot_name = $1)", slotName).Scan(&slotExists)
+	if err != nil {
+		return fmt.Errorf("failed to look up replication slot: %w", err)
+	}
+
+	needsSnapshot := p.snapshot && !state.SnapshotDone
+	if slotExists && needsSnapshot {
+		// A snapshot that did not finish has to be redone from a fresh slot so
+		// the stream starts exactly where the snapshot ends.
+		_, err = conn.Exec(ctx, "SELECT pg_drop_replication_slot($1)", slotName)
+		if err != nil {
+			return fmt.Errorf("failed to drop replication slot %s: %w", slotName, err)
+		}
+		slotExists = false
+	}
+
+	if !slotExists {
+		consistentPoint, snapshotName, err := createReplicationSlot(ctx, replConn, slotName, needsSnapshot)
+		if err != nil {
+			return err
+		}
+		state.LSN = consistentPoint.String()
+
+		if needsSnapshot {
+			err = p.snapshotTables(ctx, pipelineID, publication, snapshotName)
+			if err != nil {
+				return err
+			}
+			state.SnapshotDone = true
+		}
+
+		err = n.PutPipelineState(ctx, js, pipelineID, postgresState, state)
+		if err != nil {
+			return err
+		}
+	}
+
+	var start pglogrepl.LSN
+	if state.LSN != "" {
+		start, err = pglogrepl.ParseLSN(state.LSN)
+		if err != nil {
+			return fmt.Errorf("failed to parse LSN %s: %w", state.LSN, err)
+		}
+	}
+
+	err = startReplication(ctx, replConn, slotName, start, publication)
+	if err != nil {
+		return err
+	}
+	log.Printf("Pipeline %d streaming from replication slot %s at %s", pipelineID, slotName, start)
+
+	return p.stream(ctx, pipelineID, replConn, start, &state)
+}
+
+func (p *Postgres) ensurePublication(ctx context.Context, conn *pgx.Conn, publication string) (bool, error) {
+	var exists bool
+	err := conn.QueryRow(ctx, "SELECT EXISTS (SELECT 1 FROM pg_publication WHERE pubname = $1)", publication).Scan(&exists)
+	if err != nil {
+		return false, fmt.Errorf("failed to look up publication: %w", err)
+	}
+	if exists {
+		return false, nil
+	}
+
+	query := fmt.Sprintf("CREATE PUBLICATION %s FOR ALL TABLES", pgx.Identifier{publication}.Sanitize())
+	if len(p.tables) > 0 {
+		tables := make([]string, len(p.tables))
+		for i, table := range p.tables {
+			tables[i] = pgx.Identifier(strings.SplitN(table, ".", 2)).Sanitize()
+		}
+		query = fmt.Sprintf("CREATE PUBLICATION %s FOR TABLE %s", pgx.Identifier{publication}.Sanitize(), strings.Join(tables, ", "))
+	}
+
+	_, err = conn.Exec(ctx, query)
+	if err != nil {
+		return false, fmt.Errorf("failed to create publication %s: %w", publication, err)
+	}
+	return true, nil
+}
+
+// snapshotTables copies every published table as of the slot's exported
+// snapshot, so replication picks up exactly where the copy ends.
+func (p *Postgres) snapshotTables(ctx context.Context, pipelineID int64, publication, snapshotName string) error {
+	conn, err := pgx.Connect(ctx, p.connString)
+	if err != nil {
+		return fmt.Errorf("failed to connect to postgres for snapshot: %w", err)
+	}
+	defer conn.Close(context.Background())
+
+	tx, err := conn.BeginTx(ctx, pgx.TxOptions{IsoLevel: pgx.RepeatableRead, AccessMode: pgx.ReadOnly})
+	if err != nil {
+		return fmt.Errorf("failed to begin snapshot transaction: %w", err)
+	}
+	defer tx.Rollback(context.Background())
+
+	_, err = tx.Exec(ctx, fmt.Sprintf("SET TRANSACTION SNAPSHOT '%s'", strings.ReplaceAll(snapshotName, "'", "''")))
+	if err != nil {
+		return fmt.Errorf("failed to use exported snapshot: %w", err)
+	}
+
+	rows, err := tx.Query(ctx, "SELECT schemaname, tablename FROM pg_publication_tables WHERE pubname = $1 ORDER BY schemaname, tablename", publication)
+	if err != nil {
+		return fmt.Errorf("failed to list published tables: %w", err)
+	}
+	var tables []pgx.Identifier
+	for rows.Next() {
+		var schema, table string
+		if err := rows.Scan(&schema, &table); err != nil {
+			rows.Close()
+			return err
+		}
+		tables = append(tables, pgx.Identifier{schema, table})
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, table := range tables {
+		if err := p.snapshotTable(ctx, tx.Conn().PgConn(), pipelineID, table); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *Postgres) snapshotTable(ctx context.Context, conn *pgconn.PgConn, pipelineID int64, table pgx.Identifier) error {
+	primaryKey, err := p.primaryKey(ctx, conn, table)
+	if err != nil {
+		return err
+	}
+
+	batch := &changeBatch{pipelineID: pipelineID, js: p.js}
+	stream := strings.Join(table, ".")
+
+	// The simple protocol returns every column as text, which decodes the
+	// same way as the values sent over logical replication.
+	result := conn.Exec(ctx, fmt.Sprintf("SELECT * FROM %s", table.Sanitize()))
+	for result.NextResult() {
+		reader := result.ResultReader()
+		fields := reader.FieldDescriptions()
+		for reader.NextRow() {
+			record := make(map[string]interface{}, len(fields))
+			for i, field := range fields {
+				value := reader.Values()[i]
+				if value == nil {
+					record[field.Name] = nil
+					continue
+				}
+				record[field.Name] = decodeText(field.DataTypeOID, value)
+			}
+
+			if err := batch.add(ctx, stream, n.OperationInsert, primaryKey, record); err != nil {
+				return err
+			}
+		}
+		if _, err := reader.Close(); err != nil {
+			return fmt.Errorf("failed to snapshot %s: %w", stream, err)
+		}
+	}
+	if err := result.Close(); err != nil {
+		return fmt.Errorf("failed to snapshot %s: %w", stream, err)
+	}
+
+	return batch.flush(ctx)
+}
+
+func (p *Postgres) primaryKey(ctx context.Context, conn *pgconn.PgConn, table pgx.Identifier) ([]string, error) {
+	query := fmt.Sprintf(`SELECT a.attname
+	FROM pg_index i
+	JOIN pg_attribute a ON a.attrelid = i.indrelid AND a.attnum = ANY(i.indkey)
+	WHERE i.indrelid = '%s'::regclass AND i.indisprimary
+	ORDER BY array_position(i.indkey, a.attnum)`, strings.ReplaceAll(table.Sanitize(), "'", "''"))
+
+	results, err := conn.Exec(ctx, query).ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up primary key for %s: %w", strings.Join(table, "."), err)
+	}
+
+	var primaryKey []string
+	for _, result := range results {
+		for _, row := range result.Rows {
+			primaryKey = append(primaryKey, string(row[0]))
+		}
+	}
+	return primaryKey, nil
+}
+
+func (p *Postgres) stream(ctx context.Context, pipelineID int64, conn *pgconn.PgConn, start pglogrepl.LSN, state *postgresSourceState) error {
+	relations := make(map[uint32]*pglogrepl.RelationMessage)
+	batch := &changeBatch{pipelineID: pipelineID, js: p.js}
+	committed := start
+	nextStatus := time.Now().Add(standbyStatusInterval)
+
+	checkpoint := func(position pglogrepl.LSN) error {
+		if position <= committed {
+			return nil
+		}
+		if err := batch.flush(ctx); err != nil {
+			return err
+		}
+		state.LSN = position.String()
+		if err := n.PutPipelineState(ctx, p.js, pipelineID, postgresState, state); err != nil {
+			return err
+		}
+		committed = position
+		return nil
+	}
+
+	for {
+		if time.Now().After(nextStatus) {
+			if err := sendStandbyStatus(ctx, conn, committed); err != nil {
+				return err
+			}
+			nextStatus = time.Now().Add(standbyStatusInterval)
+		}
+
+		receiveCtx, cancel := context.WithDeadline(ctx, nextStatus)
+		rawMsg, err := conn.ReceiveMessage(receiveCtx)
+		cancel()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			if pgconn.Timeout(err) {
+				continue
+			}
+			return fmt.Errorf("failed to receive replication message: %w", err)
+		}
+
+		switch msg := rawMsg.(type) {
+		case *pgproto3.ErrorResponse:
+			return pgconn.ErrorResponseToPgError(msg)
+		case *pgproto3.CopyData:
+			if len(msg.Data) == 0 {
+				continue
+			}
+			switch msg.Data[0] {
+			case pglogrepl.PrimaryKeepaliveMessageByteID:
+				keepalive, err := pglogrepl.ParsePrimaryKeepaliveMessage(msg.Data[1:])
+				if err != nil {
+					return fmt.Errorf("failed to parse primary keepalive: %w", err)
+				}
+				if keepalive.ReplyRequested {
+					nextStatus = time.Time{}
+				}
+			case pglogrepl.XLogDataByteID:
+				xld, err := pglogrepl.ParseXLogData(msg.Data[1:])
+				if err != nil {
+					return fmt.Errorf("failed to parse XLogData: %w", err)
+				}
+				logical, err := pglogrepl.Parse(xld.WALData)
+				if err != nil {
+					return fmt.Errorf("failed to parse logical replication message: %w", err)
+				}
+				err = p.handleMessage(ctx, relations, batch, logical, checkpoint)
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+}
+
+func (p *Postgres) handleMessage(ctx context.Context, relations map[uint32]*pglogrepl.RelationMessage, batch *changeBatch, msg pglogrepl.Message, checkpoint func(pglogrepl.LSN) error) error {
+	switch msg := msg.(type) {
+	case *pglogrepl.RelationMessage:
+		relations[msg.RelationID] = msg
+	case *pglogrepl.InsertMessage:
+		return p.emit(ctx, relations, batch, msg.RelationID, n.OperationInsert, msg.Tuple, nil)
+	case *pglogrepl.UpdateMessage:
+		return p.emit(ctx, relations, batch, msg.RelationID, n.OperationUpdate, msg.NewTuple, msg.OldTuple)
+	case *pglogrepl.DeleteMessage:
+		return p.emit(ctx, relations, batch, msg.RelationID, n.OperationDelete, msg.OldTuple, nil)
+	case *pglogrepl.TruncateMessage:
+		for _, relationID := range msg.RelationIDs {
+			if relation, ok := relations[relationID]; ok {
+				log.Printf("Ignoring truncate of %s.%s", relation.Namespace, relation.RelationName)
+			}
+		}
+	case *pglogrepl.CommitMessage:
+		return checkpoint(msg.TransactionEndLSN)
+	}
+	return nil
+}
+
+func (p *Postgres) emit(ctx context.Context, relations map[uint32]*pglogrepl.RelationMessage, batch *changeBatch, relationID uint32, operation string, tuple, oldTuple *pglogrepl.TupleData) error {
+	relation, ok := relations[relationID]
+	if !ok {
+		return fmt.Errorf("received change for unknown relation %d", relationID)
+	}
+
+	record, primaryKey, unchanged := changeRecord(relation, operation, tuple, oldTuple)
+	stream := fmt.Sprintf("%s.%s", relation.Namespace, relation.RelationName)
+	// An update that changed the row's key leaves the old key behind in
+	// destinations that upsert on it, so it is deleted first.
+	if operation == n.OperationUpdate {
+		if key := previousKey(relation, record, oldTuple); key != nil {
+			if err := batch.add(ctx, stream, n.OperationDelete, primaryKey, key); err != nil {
+				return err
+			}
+		}
+	}
+	return batch.addPartial(ctx, stream, operation, primaryKey, unchanged, record)
+}
+
+// changeBatch groups consecutive changes to the same table with the same
+// operation, so batches keep the order the changes were made in. Updates
+// that leave out unchanged columns are only grouped with updates leaving
+// out the same ones, so each partial batch has a single set of columns.
+type changeBatch struct {
+	pipelineID int64
+	js         jetstream.JetStream
+	record     n.DestinationRecord
+	unchanged  string
+}
+
+func (b *changeBatch) add(ctx context.Context, stream, operation string, primaryKey []string, record map[string]interface{}) error {
+	return b.addPartial(ctx, stream, operation, primaryKey, nil, record)
+}
+
+// addPartial adds a record that leaves out the unchanged columns.
+func (b *changeBatch) addPartial(ctx context.Context, stream, operation string, primaryKey, unchanged []string, record map[string]interface{}) error {
+	unchangedKey := strings.Join(unchanged, "\x00")
+	if len(b.record.Records) > 0 && (b.record.Stream != stream || b.record.Operation != operation || b.unchanged != unchangedKey) {
+		if err := b.flush(ctx); err != nil {
+			return err
+		}
+	}
+
+	recordBytes, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("failed to marshal record: %w", err)
+	}
+
+	b.record.PipelineID = b.pipelineID
+	b.record.Stream = stream
+	b.record.Operation = operation
+	b.record.PrimaryKey = primaryKey
+	b.record.Partial = len(unchanged) > 0
+	b.unchanged = unchangedKey
+	b.record.Records = append(b.record.Records, recordBytes)
+
+	if len(b.record.Records) >= changeBatchSize {
+		return b.flush(ctx)
+	}
+	return nil
+}
+
+func (b *changeBatch) flush(ctx context.Context) error {
+	if len(b.record.Records) == 0 {
+		return nil
+	}
+	err := n.PublishRecords(ctx, b.js, b.record)
+	b.record.Records = nil
+	return err
+}
+
+// Teardown drops the replication slot so the server stops retaining WAL for
+// the pipeline, and the publication if the source created it.
+func (p *Postgres) Teardown(ctx context.Context, pipelineID int64, js jetstream.JetStream) error {
+	slotName, publication := p.names(pipelineID)
+
+	state := postgresSourceState{}
+	_, err := n.GetPipelineState(ctx, js, pipelineID, postgresState, &state)
+	if err != nil {
+		return err
+	}
+
+	conn, err := pgx.Connect(ctx, p.connString)
+	if err != nil {
+		return fmt.Errorf("failed to connect to postgres: %w", err)
+	}
+	defer conn.Close(context.Background())
+
+	_, err = conn.Exec(ctx, "SELECT pg_drop_replication_slot(slot_name) FROM pg_replication_slots WHERE slot_name = $1", slotName)
+	if err != nil {
+		return fmt.Errorf("failed to drop replication slot %s: %w", slotName, err)
+	}
+
+	if state.CreatedPublication {
+		_, err = conn.Exec(ctx, fmt.Sprintf("DROP PUBLICATION IF EXISTS %s", pgx.Identifier{publication}.Sanitize()))
+		if err != nil {
+			return fmt.Errorf("failed to drop publication %s: %w", publication, err)
+		}
+	}
+
+	return n.DeletePipelineState(ctx, js, pipelineID, postgresState)
+}
+
+const (
+	boolOID    = 16
+	int8OID    = 20
+	int2OID    = 21
+	int4OID    = 23
+	oidOID     = 26
+	jsonOID    = 114
+	float4OID  = 700
+	float8OID  = 701
+	numericOID = 1700
+	jsonbOID   = 3802
+)
+
+// decodeText converts a value in Postgres text format into the matching JSON
+// type. Types without a natural JSON form are kept as their text.
+func decodeText(typeOID uint32, data []byte) interface{} {
+	text := string(data)
+	switch typeOID {
+	case boolOID:
+		return text == "t"
+	case int2OID, int4OID, int8OID, oidOID:
+		if v, err := strconv.ParseInt(text, 10, 64); err == nil {
+			return v
+		}
+	case float4OID, float8OID:
+		if v, err := strconv.ParseFloat(text, 64); err == nil && !math.IsInf(v, 0) && !math.IsNaN(v) {
+			return v
+		}
+	case numericOID:
+		if json.Valid(data) {
+			return json.Number(text)
+		}
+	case jsonOID, jsonbOID:
+		if json.Valid(data) {
+			return json.RawMessage(text)
+		}
+	}
+	return text
+}
@@ -0,0 +1,128 @@
+package databases
+
+import (
+	"context"
+	n "dataforge-be/nats"
+	"fmt"
+	"reflect"
+	"strings"
+
+	"github.com/jackc/pglogrepl"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+// The replication commands take the slot name as an identifier and the
+// publication names as a string holding a list of identifiers, so both are
+// quoted the same way as in ordinary SQL.
+
+func createReplicationSlot(ctx context.Context, conn *pgconn.PgConn, slotName string, exportSnapshot bool) (pglogrepl.LSN, string, error) {
+	snapshotAction := "NOEXPORT_SNAPSHOT"
+	if exportSnapshot {
+		snapshotAction = "EXPORT_SNAPSHOT"
+	}
+
+	slot, err := pglogrepl.CreateReplicationSlot(ctx, conn, pgx.Identifier{slotName}.Sanitize(), "pgoutput", pglogrepl.CreateReplicationSlotOptions{
+		Mode:           pglogrepl.LogicalReplication,
+		SnapshotAction: snapshotAction,
+	})
+	if err != nil {
+		return 0, "", fmt.Errorf("failed to create replication slot %s: %w", slotName, err)
+	}
+	consistentPoint, err := pglogrepl.ParseLSN(slot.ConsistentPoint)
+	if err != nil {
+		return 0, "", fmt.Errorf("failed to parse consistent point of replication slot %s: %w", slotName, err)
+	}
+	return consistentPoint, slot.SnapshotName, nil
+}
+
+func startReplication(ctx context.Context, conn *pgconn.PgConn, slotName string, start pglogrepl.LSN, publication string) error {
+	err := pglogrepl.StartReplication(ctx, conn, pgx.Identifier{slotName}.Sanitize(), start, pglogrepl.StartReplicationOptions{
+		Mode:       pglogrepl.LogicalReplication,
+		PluginArgs: pluginArgs(publication),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to start replication from slot %s: %w", slotName, err)
+	}
+	return nil
+}
+
+func pluginArgs(publication string) []string {
+	publicationNames := strings.ReplaceAll(pgx.Identifier{publication}.Sanitize(), "'", "''")
+	return []string{"proto_version '1'", "publication_names '" + publicationNames + "'"}
+}
+
+// sendStandbyStatus tells the server everything up to position has been
+// processed so the slot can release the WAL behind it.
+func sendStandbyStatus(ctx context.Context, conn *pgconn.PgConn, position pglogrepl.LSN) error {
+	err := pglogrepl.SendStandbyStatusUpdate(ctx, conn, pglogrepl.StandbyStatusUpdate{WALWritePosition: position})
+	if err != nil {
+		return fmt.Errorf("failed to send standby status update: %w", err)
+	}
+	return nil
+}
+
+// changeRecord turns a row sent over replication into a record along with
+// the relation's key columns. Columns whose TOASTed value did not change
+// are not sent again: they are carried over from the old row when the
+// update has one, and otherwise left out and returned as unchanged so the
+// record can be merged into the stored one.
+func changeRecord(relation *pglogrepl.RelationMessage, operation string, tuple, oldTuple *pglogrepl.TupleData) (record map[string]interface{}, primaryKey, unchanged []string) {
+	record = make(map[string]interface{}, len(relation.Columns))
+	for i, column := range relation.Columns {
+		isKey := column.Flags&1 != 0
+		if isKey {
+			primaryKey = append(primaryKey, column.Name)
+		}
+		if tuple == nil || i >= len(tuple.Columns) {
+			continue
+		}
+
+		value := tuple.Columns[i]
+		// An old row sent as a key only has nulls outside the key, which
+		// say nothing about the value.
+		if value.DataType == pglogrepl.TupleDataTypeToast && oldTuple != nil && i < len(oldTuple.Columns) &&
+			oldTuple.Columns[i].DataType == pglogrepl.TupleDataTypeText {
+			value = oldTuple.Columns[i]
+		}
+		switch value.DataType {
+		case pglogrepl.TupleDataTypeNull:
+			if operation != n.OperationDelete || isKey {
+				record[column.Name] = nil
+			}
+		case pglogrepl.TupleDataTypeText:
+			record[column.Name] = decodeText(column.DataType, value.Data)
+		case pglogrepl.TupleDataTypeToast:
+			if operation == n.OperationDelete {
+				continue
+			}
+			unchanged = append(unchanged, column.Name)
+		}
+	}
+	return record, primaryKey, unchanged
+}
+
+// previousKey returns the key an update moved its row away from, or nil if
+// the row kept its key. Postgres sends an update's old row when its key
+// changed, as the key alone, or always under REPLICA IDENTITY FULL.
+func previousKey(relation *pglogrepl.RelationMessage, record map[string]interface{}, oldTuple *pglogrepl.TupleData) map[string]interface{} {
+	if oldTuple == nil {
+		return nil
+	}
+	old, primaryKey, _ := changeRecord(relation, n.OperationDelete, oldTuple, nil)
+	if len(primaryKey) == 0 {
+		return nil
+	}
+	key := make(map[string]interface{}, len(primaryKey))
+	moved := false
+	for _, column := range primaryKey {
+		key[column] = old[column]
+		if !reflect.DeepEqual(old[column], record[column]) {
+			moved = true
+		}
+	}
+	if !moved {
+		return nil
+	}
+	return key
+}
@@ -0,0 +1,239 @@
+package databases
+
+import (
+	n "dataforge-be/nats"
+	"encoding/binary"
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"github.com/jackc/pglogrepl"
+)
+
+// pgoutput builds pgoutput protocol version 1 messages.
+type pgoutput []byte
+
+func (b pgoutput) byte(v byte) pgoutput     { return append(b, v) }
+func (b pgoutput) uint16(v uint16) pgoutput { return binary.BigEndian.AppendUint16(b, v) }
+func (b pgoutput) uint32(v uint32) pgoutput { return binary.BigEndian.AppendUint32(b, v) }
+func (b pgoutput) string(v string) pgoutput { return append(append(b, v...), 0) }
+
+type testColumn struct {
+	key  bool
+	name string
+	oid  uint32
+}
+
+func relationBytes(id uint32, namespace, name string, columns []testColumn) []byte {
+	b := pgoutput{}.byte('R').uint32(id).string(namespace).string(name).byte('d').uint16(uint16(len(columns)))
+	for _, column := range columns {
+		flags := byte(0)
+		if column.key {
+			flags = 1
+		}
+		b = b.byte(flags).string(column.name).uint32(column.oid).uint32(0xffffffff)
+	}
+	return b
+}
+
+// tuple encodes values as text, with nil as null and toast as an unchanged
+// TOASTed value.
+func (b pgoutput) tuple(values ...interface{}) pgoutput {
+	b = b.uint16(uint16(len(values)))
+	for _, value := range values {
+		switch value := value.(type) {
+		case nil:
+			b = b.byte('n')
+		case toast:
+			b = b.byte('u')
+		case string:
+			b = b.byte('t').uint32(uint32(len(value)))
+			b = append(b, value...)
+		}
+	}
+	return b
+}
+
+type toast struct{}
+
+var testColumns = []testColumn{
+	{key: true, name: "id", oid: int8OID},
+	{name: "name", oid: 25},
+	{name: "doc", oid: jsonbOID},
+}
+
+func TestChangeRecord(t *testing.T) {
+	tests := []struct {
+		name          string
+		operation     string
+		message       []byte
+		wantRecord    map[string]interface{}
+		wantUnchanged []string
+	}{
+		{
+			name:       "insert",
+			operation:  n.OperationInsert,
+			message:    pgoutput{}.byte('I').uint32(1).byte('N').tuple("7", "ada", `{"a":1}`),
+			wantRecord: map[string]interface{}{"id": int64(7), "name": "ada", "doc": json.RawMessage(`{"a":1}`)},
+		},
+		{
+			name:       "update with null",
+			operation:  n.OperationUpdate,
+			message:    pgoutput{}.byte('U').uint32(1).byte('N').tuple("7", nil, `[]`),
+			wantRecord: map[string]interface{}{"id": int64(7), "name": nil, "doc": json.RawMessage(`[]`)},
+		},
+		{
+			name:          "update leaves out unchanged TOASTed column",
+			operation:     n.OperationUpdate,
+			message:       pgoutput{}.byte('U').uint32(1).byte('N').tuple("7", "grace", toast{}),
+			wantRecord:    map[string]interface{}{"id": int64(7), "name": "grace"},
+			wantUnchanged: []string{"doc"},
+		},
+		{
+			name:      "update carries TOASTed column over from old row",
+			operation: n.OperationUpdate,
+			message: pgoutput{}.byte('U').uint32(1).
+				byte('O').tuple("7", "ada", `{"a":1}`).
+				byte('N').tuple("7", "grace", toast{}),
+			wantRecord: map[string]interface{}{"id": int64(7), "name": "grace", "doc": json.RawMessage(`{"a":1}`)},
+		},
+		{
+			name:      "update does not take nulls from old key",
+			operation: n.OperationUpdate,
+			message: pgoutput{}.byte('U').uint32(1).
+				byte('K').tuple("6", nil, nil).
+				byte('N').tuple("7", "grace", toast{}),
+			wantRecord:    map[string]interface{}{"id": int64(7), "name": "grace"},
+			wantUnchanged: []string{"doc"},
+		},
+		{
+			name:       "delete keeps only the key",
+			operation:  n.OperationDelete,
+			message:    pgoutput{}.byte('D').uint32(1).byte('K').tuple("7", nil, nil),
+			wantRecord: map[string]interface{}{"id": int64(7)},
+		},
+	}
+
+	relationMsg, err := pglogrepl.Parse(relationBytes(1, "public", "users", testColumns))
+	if err != nil {
+		t.Fatalf("failed to parse relation: %v", err)
+	}
+	relation := relationMsg.(*pglogrepl.RelationMessage)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg, err := pglogrepl.Parse(tt.message)
+			if err != nil {
+				t.Fatalf("failed to parse message: %v", err)
+			}
+
+			var tuple, oldTuple *pglogrepl.TupleData
+			switch msg := msg.(type) {
+			case *pglogrepl.InsertMessage:
+				tuple = msg.Tuple
+			case *pglogrepl.UpdateMessage:
+				tuple, oldTuple = msg.NewTuple, msg.OldTuple
+			case *pglogrepl.DeleteMessage:
+				tuple = msg.OldTuple
+			default:
+				t.Fatalf("unexpected message %T", msg)
+			}
+
+			record, primaryKey, unchanged := changeRecord(relation, tt.operation, tuple, oldTuple)
+			if !reflect.DeepEqual(record, tt.wantRecord) {
+				t.Errorf("record = %#v, want %#v", record, tt.wantRecord)
+			}
+			if !reflect.DeepEqual(primaryKey, []string{"id"}) {
+				t.Errorf("primary key = %v, want [id]", primaryKey)
+			}
+			if !reflect.DeepEqual(unchanged, tt.wantUnchanged) {
+				t.Errorf("unchanged = %v, want %v", unchanged, tt.wantUnchanged)
+			}
+		})
+	}
+}
+
+func TestPreviousKey(t *testing.T) {
+	tests := []struct {
+		name    string
+		message []byte
+		want    map[string]interface{}
+	}{
+		{
+			name:    "update without old row",
+			message: pgoutput{}.byte('U').uint32(1).byte('N').tuple("7", "grace", `{}`),
+		},
+		{
+			name: "update that changed the key",
+			message: pgoutput{}.byte('U').uint32(1).
+				byte('K').tuple("6", nil, nil).
+				byte('N').tuple("7", "grace", toast{}),
+			want: map[string]interface{}{"id": int64(6)},
+		},
+		{
+			name: "full old row with the same key",
+			message: pgoutput{}.byte('U').uint32(1).
+				byte('O').tuple("7", "ada", `{"a":1}`).
+				byte('N').tuple("7", "grace", `{"a":1}`),
+		},
+		{
+			name: "full old row with another key",
+			message: pgoutput{}.byte('U').uint32(1).
+				byte('O').tuple("6", "ada", `{"a":1}`).
+				byte('N').tuple("7", "ada", `{"a":1}`),
+			want: map[string]interface{}{"id": int64(6)},
+		},
+	}
+
+	relationMsg, err := pglogrepl.Parse(relationBytes(1, "public", "users", testColumns))
+	if err != nil {
+		t.Fatalf("failed to parse relation: %v", err)
+	}
+	relation := relationMsg.(*pglogrepl.RelationMessage)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg, err := pglogrepl.Parse(tt.message)
+			if err != nil {
+				t.Fatalf("failed to parse message: %v", err)
+			}
+			update := msg.(*pglogrepl.UpdateMessage)
+			record, _, _ := changeRecord(relation, n.OperationUpdate, update.NewTuple, update.OldTuple)
+			if got := previousKey(relation, record, update.OldTuple); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("previousKey = %#v, want %#v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecodeText(t *testing.T) {
+	tests := []struct {
+		oid  uint32
+		text string
+		want interface{}
+	}{
+		{boolOID, "t", true},
+		{boolOID, "f", false},
+		{int4OID, "-12", int64(-12)},
+		{float8OID, "1.5", 1.5},
+		{float8OID, "NaN", "NaN"},
+		{numericOID, "12345678901234567890.5", json.Number("12345678901234567890.5")},
+		{numericOID, "NaN", "NaN"},
+		{jsonOID, `{"a":[1]}`, json.RawMessage(`{"a":[1]}`)},
+		{25, "plain", "plain"},
+	}
+	for _, tt := range tests {
+		got := decodeText(tt.oid, []byte(tt.text))
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("decodeText(%d, %q) = %#v, want %#v", tt.oid, tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestPluginArgsQuotesPublication(t *testing.T) {
+	got := pluginArgs(`it's "pub"`)
+	want := []string{"proto_version '1'", `publication_names '"it''s ""pub"""'`}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("pluginArgs = %v, want %v", got, want)
+	}
+}
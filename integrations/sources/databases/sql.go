@@ -0,0 +1,491 @@
+package databases
+
+import (
+	"context"
+	"database/sql"
+	"dataforge-be/integrations/connection"
+	"dataforge-be/integrations/sources/models"
+	n "dataforge-be/nats"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	_ "github.com/jackc/pgx/v5/stdlib"
+	"github.com/nats-io/nats.go/jetstream"
+	_ "modernc.org/sqlite"
+)
+
+const (
+	sqlID = "sql"
+
+	defaultSQLPageSize     = 1000
+	defaultSQLPollInterval = time.Minute
+)
+
+// sqlDriver describes how the generic SQL source talks to one kind of
+// database.
+type sqlDriver struct {
+	driverName    string
+	dialect       models.Dialect
+	tablesQuery   string
+	primaryKeySQL string
+	defaultSchema string
+	// timeLayout formats time keys so the database reads them back as the
+	// values they were scanned from. localTime keeps them in the location
+	// the driver scanned them in rather than converting to UTC.
+	timeLayout string
+	localTime  bool
+}
+
+const informationSchemaPrimaryKey = `SELECT kcu.column_name
+	FROM information_schema.table_constraints tc
+	JOIN information_schema.key_column_usage kcu
+	ON kcu.constraint_name = tc.constraint_name AND kcu.table_schema = tc.table_schema AND kcu.table_name = tc.table_name
+	WHERE tc.constraint_type = 'PRIMARY KEY' AND tc.table_schema = %s AND tc.table_name = %s
+	ORDER BY kcu.ordinal_position`
+
+var sqlDrivers = map[string]sqlDriver{
+	"mysql": {
+		driverName: "mysql",
+		dialect:    models.MySQLDialect,
+		tablesQuery: `SELECT table_schema, table_name FROM information_schema.tables
+	WHERE table_type = 'BASE TABLE' AND table_schema NOT IN ('mysql', 'information_schema', 'performance_schema', 'sys')
+	ORDER BY table_schema, table_name`,
+		primaryKeySQL: fmt.Sprintf(informationSchemaPrimaryKey, "?", "?"),
+		// DATETIME columns hold wall-clock times with no zone, and the driver
+		// scans them in its configured location.
+		timeLayout: "2006-01-02 15:04:05.999999",
+		localTime:  true,
+	},
+	"postgres": {
+		driverName: "pgx",
+		dialect:    models.PostgresDialect,
+		tablesQuery: `SELECT table_schema, table_name FROM information_schema.tables
+	WHERE table_type = 'BASE TABLE' AND table_schema NOT IN ('pg_catalog', 'information_schema')
+	ORDER BY table_schema, table_name`,
+		primaryKeySQL: fmt.Sprintf(informationSchemaPrimaryKey, "$1", "$2"),
+		defaultSchema: "public",
+		timeLayout:    time.RFC3339Nano,
+	},
+	// SQLite has no information_schema; its catalog is read from sqlite_master
+	// and table_info instead.
+	"sqlite": {
+		driverName: "sqlite",
+		dialect:    models.QuestionMarkDialect,
+		tablesQuery: `SELECT 'main', name FROM sqlite_master
+	WHERE type = 'table' AND name NOT LIKE 'sqlite_%' ORDER BY name`,
+		primaryKeySQL: `SELECT name FROM pragma_table_info(?) WHERE pk > 0 ORDER BY pk`,
+		defaultSchema: "main",
+		// SQLite compares dates as text in the form they were stored.
+		timeLayout: "2006-01-02 15:04:05.999999999",
+	},
+}
+
+var sqlDriverAliases = map[string]string{
+	"pgx":        "postgres",
+	"postgresql": "postgres",
+	"sqlite3":    "sqlite",
+}
+
+// sqlTableConfig overrides how a single table is synced. Tables without an
+// entry are copied in full on every run.
+type sqlTableConfig struct {
+	Name       string   `json:"name"`
+	SyncMode   string   `json:"sync_mode"`
+	Cursor     string   `json:"cursor"`
+	PrimaryKey []string `json:"primary_key"`
+}
+
+type SQL struct {
+	driver       sqlDriver
+	db           *sql.DB
+	includes     []string
+	excludes     []string
+	tables       map[string]sqlTableConfig
+	pageSize     int
+	isContinuous bool
+	pollInterval time.Duration
+	models       []models.Model
+	js           jetstream.JetStream
+}
+
+func (s *SQL) Initialize(config map[string]interface{}) error {
+	driverName, _ := config["driver"].(string)
+	driverName = strings.ToLower(driverName)
+	if alias, ok := sqlDriverAliases[driverName]; ok {
+		driverName = alias
+	}
+	driver, ok := sqlDrivers[driverName]
+	if !ok {
+		return fmt.Errorf("unsupported sql driver %q", driverName)
+	}
+	dsn, _ := config["dsn"].(string)
+	if dsn == "" {
+		return errors.New("sql source requires a dsn")
+	}
+
+	s.driver = driver
+	s.includes = connection.StringsFromConfig(config, "include")
+	s.excludes = connection.StringsFromConfig(config, "exclude")
+	s.isContinuous, _ = config["continuous"].(bool)
+	s.pollInterval = durationFromConfig(config, "poll_interval_seconds", defaultSQLPollInterval)
+	s.pageSize = defaultSQLPageSize
+	if pageSize, ok := config["page_size"].(float64); ok && pageSize > 0 {
+		s.pageSize = int(pageSize)
+	}
+
+	var err error
+	s.tables, err = sqlTablesFromConfig(config)
+	if err != nil {
+		return err
+	}
+	s.models, err = models.ModelsFromConfig(config)
+	if err != nil {
+		return err
+	}
+
+	s.db, err = sql.Open(driver.driverName, dsn)
+	if err != nil {
+		return fmt.Errorf("failed to open %s database: %w", driverName, err)
+	}
+	return nil
+}
+
+func durationFromConfig(config map[string]interface{}, key string, fallback time.Duration) time.Duration {
+	seconds, ok := config[key].(float64)
+	if !ok || seconds <= 0 {
+		return fallback
+	}
+	return time.Duration(seconds * float64(time.Second))
+}
+
+func sqlTablesFromConfig(config map[string]interface{}) (map[string]sqlTableConfig, error) {
+	tables := make(map[string]sqlTableConfig)
+	raw, ok := config["tables"]
+	if !ok || raw == nil {
+		return tables, nil
+	}
+
+	rawBytes, err := json.Marshal(raw)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode tables: %w", err)
+	}
+	var entries []sqlTableConfig
+	if err := json.Unmarshal(rawBytes, &entries); err != nil {
+		return nil, fmt.Errorf("invalid tables config: %w", err)
+	}
+
+	for _, entry := range entries {
+		if entry.Name == "" {
+			return nil, errors.New("table name is required")
+		}
+		if entry.SyncMode == "" {
+			entry.SyncMode = models.SyncModeFullRefresh
+			if entry.Cursor != "" {
+				entry.SyncMode = models.SyncModeIncremental
+			}
+		}
+		switch entry.SyncMode {
+		case models.SyncModeFullRefresh:
+		case models.SyncModeIncremental:
+			if entry.Cursor == "" {
+				return nil, fmt.Errorf("table %s: incremental sync requires a cursor", entry.Name)
+			}
+		default:
+			return nil, fmt.Errorf("table %s: unsupported sync mode %s", entry.Name, entry.SyncMode)
+		}
+		tables[entry.Name] = entry
+	}
+	return tables, nil
+}
+
+func (s *SQL) SourceID() string {
+	return sqlID
+}
+
+// Close releases the connection pool opened by Initialize.
+func (s *SQL) Close() error {
+	if s.db == nil {
+		return nil
+	}
+	return s.db.Close()
+}
+
+func (s *SQL) Run(ctx context.Context, pipelineID int64, js jetstream.JetStream) error {
+	s.js = js
+	defer s.Close()
+
+	for {
+		tables, err := s.selectedTables(ctx)
+		if err != nil {
+			return err
+		}
+		for _, table := range tables {
+			if err := s.syncTable(ctx, pipelineID, table); err != nil {
+				return fmt.Errorf("failed to sync %s: %w", table, err)
+			}
+		}
+
+		if len(s.models) > 0 {
+			err = models.SyncModels(ctx, s.db, s.driver.dialect, js, pipelineID, s.models)
+			if err != nil {
+				return err
+			}
+		}
+
+		if !s.isContinuous {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(s.pollInterval):
+		}
+	}
+}
+
+func (s *SQL) Preview(ctx context.Context, query string, limit int) (*models.Preview, error) {
+	return models.RunPreview(ctx, s.db, query, limit)
+}
+
+func (s *SQL) selectedTables(ctx context.Context) ([]databaseTable, error) {
+	rows, err := s.db.QueryContext(ctx, s.driver.tablesQuery)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list tables: %w", err)
+	}
+	defer rows.Close()
+
+	var tables []databaseTable
+	for rows.Next() {
+		var table databaseTable
+		if err := rows.Scan(&table.Schema, &table.Name); err != nil {
+			return nil, err
+		}
+		if s.isTableSelected(table) {
+			tables = append(tables, table)
+		}
+	}
+	return tables, rows.Err()
+}
+
+func (s *SQL) isTableSelected(table databaseTable) bool {
+	qualified := table.String()
+	includes := s.includes
+	if len(includes) == 0 && s.driver.defaultSchema != "" {
+		includes = []string{s.driver.defaultSchema + ".*"}
+	}
+	if len(includes) > 0 && !matchesAnyPattern(includes, qualified, table.Name) {
+		return false
+	}
+	return !matchesAnyPattern(s.excludes, qualified, table.Name)
+}
+
+func (s *SQL) tableConfig(table databaseTable) sqlTableConfig {
+	if config, ok := s.tables[table.String()]; ok {
+		return config
+	}
+	if config, ok := s.tables[table.Name]; ok {
+		return config
+	}
+	return sqlTableConfig{SyncMode: models.SyncModeFullRefresh}
+}
+
+func (s *SQL) primaryKey(ctx context.Context, table databaseTable) ([]string, error) {
+	args := []interface{}{table.Schema, table.Name}
+	if s.driver.driverName == "sqlite" {
+		args = []interface{}{table.Name}
+	}
+
+	rows, err := s.db.QueryContext(ctx, s.driver.primaryKeySQL, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to look up primary key: %w", err)
+	}
+	defer rows.Close()
+
+	var primaryKey []string
+	for rows.Next() {
+		var column string
+		if err := rows.Scan(&column); err != nil {
+			return nil, err
+		}
+		primaryKey = append(primaryKey, column)
+	}
+	return primaryKey, rows.Err()
+}
+
+func tableCursorState(table databaseTable) string {
+	return fmt.Sprintf("table-%s-cursor", table)
+}
+
+// syncTable reads a table one page at a time, ordered by the cursor (for
+// incremental tables) and primary key. Each page starts after the last key of
+// the previous one, so large tables are read without OFFSET scans.
+func (s *SQL) syncTable(ctx context.Context, pipelineID int64, table databaseTable) error {
+	config := s.tableConfig(table)
+	primaryKey := config.PrimaryKey
+	if len(primaryKey) == 0 {
+		var err error
+		primaryKey, err = s.primaryKey(ctx, table)
+		if err != nil {
+			return err
+		}
+	}
+
+	incremental := config.SyncMode == models.SyncModeIncremental
+	var keyColumns []string
+	if incremental {
+		keyColumns = append(keyColumns, config.Cursor)
+	}
+	for _, column := range primaryKey {
+		if column != config.Cursor {
+			keyColumns = append(keyColumns, column)
+		}
+	}
+
+	var lastKey []interface{}
+	if incremental {
+		var state json.RawMessage
+		found, err := n.GetPipelineState(ctx, s.js, pipelineID, tableCursorState(table), &state)
+		if err != nil {
+			return err
+		}
+		if found {
+			value, err := models.DecodeStateValue(state)
+			if err != nil {
+				return fmt.Errorf("failed to decode cursor of %s: %w", table, err)
+			}
+			lastKey, _ = value.([]interface{})
+		}
+		if len(lastKey) != len(keyColumns) {
+			lastKey = nil
+		}
+	}
+
+	batch := &changeBatch{pipelineID: pipelineID, js: s.js}
+	for {
+		query, args := s.pageQuery(table, keyColumns, lastKey)
+		count, key, err := s.readPage(ctx, query, args, table, keyColumns, primaryKey, batch)
+		if err != nil {
+			return err
+		}
+		if err := batch.flush(ctx); err != nil {
+			return err
+		}
+		if count > 0 {
+			lastKey = key
+			if incremental {
+				err = n.PutPipelineState(ctx, s.js, pipelineID, tableCursorState(table), lastKey)
+				if err != nil {
+					return err
+				}
+			}
+		}
+		if len(keyColumns) == 0 || count < s.pageSize {
+			return nil
+		}
+	}
+}
+
+func (s *SQL) pageQuery(table databaseTable, keyColumns []string, lastKey []interface{}) (string, []interface{}) {
+	d := s.driver.dialect
+	query := fmt.Sprintf("SELECT * FROM %s.%s", d.QuoteIdentifier(table.Schema), d.QuoteIdentifier(table.Name))
+	if len(keyColumns) == 0 {
+		return query, nil
+	}
+
+	quoted := make([]string, len(keyColumns))
+	for i, column := range keyColumns {
+		quoted[i] = d.QuoteIdentifier(column)
+	}
+
+	var args []interface{}
+	if lastKey != nil {
+		placeholders := make([]string, len(lastKey))
+		for i := range lastKey {
+			placeholders[i] = d.Placeholder(i + 1)
+		}
+		if len(keyColumns) == 1 {
+			query += fmt.Sprintf(" WHERE %s > %s", quoted[0], placeholders[0])
+		} else {
+			query += fmt.Sprintf(" WHERE (%s) > (%s)", strings.Join(quoted, ", "), strings.Join(placeholders, ", "))
+		}
+		args = lastKey
+	}
+	query += fmt.Sprintf(" ORDER BY %s LIMIT %d", strings.Join(quoted, ", "), s.pageSize)
+	return query, args
+}
+
+func (s *SQL) readPage(ctx context.Context, query string, args []interface{}, table databaseTable, keyColumns, primaryKey []string, batch *changeBatch) (int, []interface{}, error) {
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to query table: %w", err)
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return 0, nil, err
+	}
+	keyIndexes := make([]int, len(keyColumns))
+	for i, keyColumn := range keyColumns {
+		keyIndexes[i] = -1
+		for j, column := range columns {
+			if column == keyColumn {
+				keyIndexes[i] = j
+			}
+		}
+		if keyIndexes[i] < 0 {
+			return 0, nil, fmt.Errorf("column %s not found", keyColumn)
+		}
+	}
+
+	values := make([]interface{}, len(columns))
+	scanArgs := make([]interface{}, len(columns))
+	for i := range values {
+		scanArgs[i] = &values[i]
+	}
+
+	count := 0
+	var key []interface{}
+	for rows.Next() {
+		if err := rows.Scan(scanArgs...); err != nil {
+			return 0, nil, fmt.Errorf("failed to scan row: %w", err)
+		}
+
+		record := make(map[string]interface{}, len(columns))
+		for i, column := range columns {
+			record[column] = models.RecordValue(values[i])
+		}
+		if err := batch.add(ctx, table.String(), "", primaryKey, record); err != nil {
+			return 0, nil, err
+		}
+
+		key = make([]interface{}, len(keyIndexes))
+		for i, index := range keyIndexes {
+			key[i] = s.keyValue(values[index])
+		}
+		count++
+	}
+	if err := rows.Err(); err != nil {
+		return 0, nil, fmt.Errorf("error during row iteration: %w", err)
+	}
+	return count, key, nil
+}
+
+// keyValue converts a scanned key into a value that compares the same way
+// when it is bound as a parameter on the next page or run.
+func (s *SQL) keyValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case []byte:
+		return string(v)
+	case time.Time:
+		if s.driver.localTime {
+			return v.Format(s.driver.timeLayout)
+		}
+		return v.UTC().Format(s.driver.timeLayout)
+	default:
+		return v
+	}
+}
@@ -0,0 +1,69 @@
+package databases
+
+import (
+	"context"
+	"dataforge-be/nats/natstest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSQLIncrementalCursorKeepsLargeIntegers(t *testing.T) {
+	dsn := filepath.Join(t.TempDir(), "source.db")
+	config := map[string]interface{}{
+		"driver": "sqlite",
+		"dsn":    dsn,
+		"tables": []interface{}{
+			map[string]interface{}{"name": "items", "cursor": "id"},
+		},
+	}
+	source := &SQL{}
+	if err := source.Initialize(config); err != nil {
+		t.Fatalf("Initialize: %v", err)
+	}
+	defer source.Close()
+	// The last id is past 2^53, where a float64 rounds it down.
+	_, err := source.db.Exec(`CREATE TABLE items (id INTEGER PRIMARY KEY, name TEXT);
+		INSERT INTO items VALUES (1, 'a'), (9007199254740993, 'b')`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	js := natstest.JetStream(t)
+	for run := 0; run < 2; run++ {
+		source := &SQL{}
+		if err := source.Initialize(config); err != nil {
+			t.Fatalf("Initialize: %v", err)
+		}
+		if err := source.Run(context.Background(), 1, js); err != nil {
+			t.Fatalf("Run: %v", err)
+		}
+	}
+
+	// The second run starts after the last id and finds nothing new.
+	var records int
+	for _, batch := range natstest.Published(t, js) {
+		records += len(batch.Records)
+	}
+	if records != 2 {
+		t.Errorf("published %d records over two runs, want 2", records)
+	}
+}
+
+func TestSQLKeyValueFormatsTimesPerDriver(t *testing.T) {
+	at := time.Date(2024, 1, 2, 3, 4, 5, 123456000, time.FixedZone("CET", 3600))
+	tests := []struct {
+		driver string
+		want   string
+	}{
+		{"mysql", "2024-01-02 03:04:05.123456"},
+		{"postgres", "2024-01-02T02:04:05.123456Z"},
+		{"sqlite", "2024-01-02 02:04:05.123456"},
+	}
+	for _, tt := range tests {
+		s := &SQL{driver: sqlDrivers[tt.driver]}
+		if got := s.keyValue(at); got != tt.want {
+			t.Errorf("%s keyValue = %v, want %v", tt.driver, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,366 @@
+package files
+
+import (
+	"compress/gzip"
+	"context"
+	n "dataforge-be/nats"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+const (
+	fileID = "file"
+
+	formatCSV     = "csv"
+	formatNDJSON  = "ndjson"
+	formatParquet = "parquet"
+
+	fileBatchSize           = 500
+	defaultFilePollInterval = time.Minute
+)
+
+// File reads data drops from a local directory or an S3-compatible bucket.
+// Each configured stream picks files by glob, and files already read are
+// remembered in pipeline state so only new or changed files are synced.
+type File struct {
+	config       map[string]interface{}
+	streams      []fileStream
+	isContinuous bool
+	pollInterval time.Duration
+	pipelineID   int64
+	js           jetstream.JetStream
+}
+
+type fileStream struct {
+	name       string
+	patterns   []*regexp.Regexp
+	format     string
+	primaryKey []string
+	delimiter  rune
+	header     bool
+}
+
+type fileState struct {
+	Files  map[string]processedFile `json:"files"`
+	Schema map[string]string        `json:"schema,omitempty"`
+}
+
+type processedFile struct {
+	Size     int64     `json:"size"`
+	Modified time.Time `json:"modified"`
+	ETag     string    `json:"etag,omitempty"`
+}
+
+func (f *File) Initialize(config map[string]interface{}) error {
+	storage, _ := config["storage"].(string)
+	if storage != "" && storage != "local" && storage != "s3" {
+		return fmt.Errorf("unsupported storage %q", storage)
+	}
+	f.config = config
+
+	f.isContinuous, _ = config["continuous"].(bool)
+	f.pollInterval = defaultFilePollInterval
+	if seconds, ok := config["poll_interval_seconds"].(float64); ok && seconds > 0 {
+		f.pollInterval = time.Duration(seconds * float64(time.Second))
+	}
+
+	f.streams = nil
+	streams, ok := config["streams"].([]interface{})
+	if !ok {
+		// A single stream may be configured at the top level.
+		streams = []interface{}{config}
+	}
+	for _, value := range streams {
+		streamConfig, _ := value.(map[string]interface{})
+		stream, err := parseFileStream(streamConfig)
+		if err != nil {
+			return err
+		}
+		f.streams = append(f.streams, stream)
+	}
+	return nil
+}
+
+func parseFileStream(config map[string]interface{}) (fileStream, error) {
+	stream := fileStream{header: true}
+	stream.name, _ = config["stream"].(string)
+	if name, ok := config["name"].(string); ok && name != "" {
+		stream.name = name
+	}
+	if stream.name == "" {
+		stream.name = "files"
+	}
+
+	patterns, _ := config["patterns"].([]interface{})
+	if len(patterns) == 0 {
+		patterns = []interface{}{"**"}
+	}
+	for _, value := range patterns {
+		pattern, _ := value.(string)
+		re, err := compileGlob(pattern)
+		if err != nil {
+			return stream, fmt.Errorf("stream %s: %w", stream.name, err)
+		}
+		stream.patterns = append(stream.patterns, re)
+	}
+
+	stream.format, _ = config["format"].(string)
+	switch stream.format {
+	case "", formatCSV, formatNDJSON, formatParquet:
+	default:
+		return stream, fmt.Errorf("stream %s: unsupported format %q", stream.name, stream.format)
+	}
+
+	keys, _ := config["primary_key"].([]interface{})
+	for _, key := range keys {
+		if column, ok := key.(string); ok {
+			stream.primaryKey = append(stream.primaryKey, column)
+		}
+	}
+
+	if delimiter, ok := config["delimiter"].(string); ok && delimiter != "" {
+		r, size := utf8.DecodeRuneInString(delimiter)
+		if size != len(delimiter) {
+			return stream, fmt.Errorf("stream %s: delimiter must be a single character", stream.name)
+		}
+		stream.delimiter = r
+	}
+	if header, ok := config["header"].(bool); ok {
+		stream.header = header
+	}
+	return stream, nil
+}
+
+func (f *File) SourceID() string {
+	return fileID
+}
+
+func (f *File) Run(ctx context.Context, pipelineID int64, js jetstream.JetStream) error {
+	f.pipelineID = pipelineID
+	f.js = js
+
+	store, err := newFileStore(ctx, f.config)
+	if err != nil {
+		return err
+	}
+
+	for {
+		files, err := store.List(ctx)
+		if err != nil {
+			return err
+		}
+		sort.Slice(files, func(i, j int) bool {
+			if !files[i].Modified.Equal(files[j].Modified) {
+				return files[i].Modified.Before(files[j].Modified)
+			}
+			return files[i].Name < files[j].Name
+		})
+
+		for _, stream := range f.streams {
+			if err := f.syncStream(ctx, store, stream, files); err != nil {
+				return fmt.Errorf("failed to sync %s: %w", stream.name, err)
+			}
+		}
+
+		if !f.isContinuous {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(f.pollInterval):
+		}
+	}
+}
+
+func (s fileStream) matches(name string) bool {
+	for _, pattern := range s.patterns {
+		if pattern.MatchString(name) {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *File) syncStream(ctx context.Context, store fileStore, stream fileStream, files []fileInfo) error {
+	stateName := fmt.Sprintf("files-%s", stream.name)
+	state := fileState{}
+	_, err := n.GetPipelineState(ctx, f.js, f.pipelineID, stateName, &state)
+	if err != nil {
+		return err
+	}
+	if state.Files == nil {
+		state.Files = make(map[string]processedFile)
+	}
+	if state.Schema == nil {
+		state.Schema = make(map[string]string)
+	}
+
+	for _, info := range files {
+		if !stream.matches(info.Name) {
+			continue
+		}
+		processed := processedFile{Size: info.Size, Modified: info.Modified, ETag: info.ETag}
+		if previous, ok := state.Files[info.Name]; ok && previous.Size == processed.Size &&
+			previous.Modified.Equal(processed.Modified) && previous.ETag == processed.ETag {
+			continue
+		}
+
+		format := stream.format
+		if format == "" {
+			format = formatFromName(info.Name)
+		}
+		if format == "" {
+			log.Printf("Skipping %s: unknown file format", info.Name)
+			continue
+		}
+
+		count, err := f.syncFile(ctx, store, stream, format, info, state.Schema)
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", info.Name, err)
+		}
+		log.Printf("Pipeline %d read %d records from %s", f.pipelineID, count, info.Name)
+
+		// The file is marked done only once all of its records are out, so a
+		// failure part way through reads the whole file again.
+		state.Files[info.Name] = processed
+		if err := n.PutPipelineState(ctx, f.js, f.pipelineID, stateName, state); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// formatFromName picks the format from the file extension, looking past a
+// trailing .gz.
+func formatFromName(name string) string {
+	ext := strings.ToLower(path.Ext(strings.TrimSuffix(strings.ToLower(name), ".gz")))
+	switch ext {
+	case ".csv", ".tsv":
+		return formatCSV
+	case ".ndjson", ".jsonl", ".json":
+		return formatNDJSON
+	case ".parquet", ".pq":
+		return formatParquet
+	default:
+		return ""
+	}
+}
+
+func (f *File) syncFile(ctx context.Context, store fileStore, stream fileStream, format string, info fileInfo, schema map[string]string) (int, error) {
+	body, err := store.Open(ctx, info.Key)
+	if err != nil {
+		return 0, err
+	}
+	defer body.Close()
+
+	batch := &recordBatch{pipelineID: f.pipelineID, js: f.js, stream: stream.name, primaryKey: stream.primaryKey}
+	emit := func(record map[string]interface{}) error {
+		return batch.add(ctx, record)
+	}
+
+	if format == formatParquet {
+		err = f.readParquetFile(ctx, body, schema, emit)
+	} else {
+		var r io.Reader = body
+		if strings.HasSuffix(strings.ToLower(info.Name), ".gz") {
+			gz, err := gzip.NewReader(body)
+			if err != nil {
+				return 0, fmt.Errorf("failed to open gzip stream: %w", err)
+			}
+			defer gz.Close()
+			r = gz
+		}
+		if format == formatCSV {
+			if stream.delimiter == 0 {
+				stream.delimiter = ','
+				if strings.HasSuffix(strings.TrimSuffix(strings.ToLower(info.Name), ".gz"), ".tsv") {
+					stream.delimiter = '\t'
+				}
+			}
+			err = readCSV(r, stream, schema, emit)
+		} else {
+			err = readJSON(r, schema, emit)
+		}
+	}
+	if err != nil {
+		return 0, err
+	}
+	if err := batch.flush(ctx); err != nil {
+		return 0, err
+	}
+	return batch.count, nil
+}
+
+// readParquetFile needs random access, so objects that are not already local
+// files are spooled to a temporary file first.
+func (f *File) readParquetFile(ctx context.Context, body io.ReadCloser, schema map[string]string, emit emitFunc) error {
+	if local, ok := body.(*os.File); ok {
+		return readParquet(ctx, local, schema, emit)
+	}
+
+	spool, err := os.CreateTemp("", "dataforge-*.parquet")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+
+	if _, err := io.Copy(spool, body); err != nil {
+		return fmt.Errorf("failed to download parquet file: %w", err)
+	}
+	if _, err := spool.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	return readParquet(ctx, spool, schema, emit)
+}
+
+type recordBatch struct {
+	pipelineID int64
+	js         jetstream.JetStream
+	stream     string
+	primaryKey []string
+	records    [][]byte
+	count      int
+}
+
+func (b *recordBatch) add(ctx context.Context, record map[string]interface{}) error {
+	recordBytes, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("failed to marshal record: %w", err)
+	}
+	b.records = append(b.records, recordBytes)
+	b.count++
+	if len(b.records) >= fileBatchSize {
+		return b.flush(ctx)
+	}
+	return nil
+}
+
+func (b *recordBatch) flush(ctx context.Context) error {
+	if len(b.records) == 0 {
+		return nil
+	}
+	err := n.PublishRecords(ctx, b.js, n.DestinationRecord{
+		PipelineID: b.pipelineID,
+		Records:    b.records,
+		Stream:     b.stream,
+		PrimaryKey: b.primaryKey,
+	})
+	if err != nil {
+		return err
+	}
+	b.records = nil
+	return nil
+}
@@ -0,0 +1,312 @@
+package files
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/apache/arrow/go/v16/arrow"
+	"github.com/apache/arrow/go/v16/arrow/memory"
+	"github.com/apache/arrow/go/v16/parquet"
+	"github.com/apache/arrow/go/v16/parquet/file"
+	"github.com/apache/arrow/go/v16/parquet/pqarrow"
+)
+
+// Inferred column types. A column holding values of two different types
+// widens to number (integer and number) or string (anything else).
+const (
+	typeBoolean = "boolean"
+	typeInteger = "integer"
+	typeNumber  = "number"
+	typeString  = "string"
+	typeObject  = "object"
+	typeArray   = "array"
+
+	inferenceSampleRows = 1000
+)
+
+type emitFunc func(record map[string]interface{}) error
+
+func widenType(a, b string) string {
+	switch {
+	case a == "":
+		return b
+	case b == "" || a == b:
+		return a
+	case (a == typeInteger && b == typeNumber) || (a == typeNumber && b == typeInteger):
+		return typeNumber
+	default:
+		return typeString
+	}
+}
+
+// inferTextType returns the narrowest type a CSV value parses as.
+func inferTextType(value string) string {
+	if value == "" {
+		return ""
+	}
+	if _, err := strconv.ParseBool(value); err == nil && !isDigits(value) {
+		return typeBoolean
+	}
+	if _, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return typeInteger
+	}
+	if f, err := strconv.ParseFloat(value, 64); err == nil && !math.IsInf(f, 0) && !math.IsNaN(f) {
+		return typeNumber
+	}
+	return typeString
+}
+
+// isDigits keeps "0" and "1" integers rather than booleans.
+func isDigits(value string) bool {
+	return strings.Trim(value, "0123456789") == ""
+}
+
+func convertText(value, columnType string) (interface{}, bool) {
+	if value == "" {
+		return nil, true
+	}
+	switch columnType {
+	case typeBoolean:
+		b, err := strconv.ParseBool(value)
+		return b, err == nil
+	case typeInteger:
+		i, err := strconv.ParseInt(value, 10, 64)
+		return i, err == nil
+	case typeNumber:
+		f, err := strconv.ParseFloat(value, 64)
+		return f, err == nil && !math.IsInf(f, 0) && !math.IsNaN(f)
+	default:
+		return value, true
+	}
+}
+
+func jsonType(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case bool:
+		return typeBoolean
+	case json.Number:
+		if _, err := v.Int64(); err == nil {
+			return typeInteger
+		}
+		return typeNumber
+	case string:
+		return typeString
+	case map[string]interface{}:
+		return typeObject
+	case []interface{}:
+		return typeArray
+	default:
+		return typeString
+	}
+}
+
+// readCSV infers column types from the first rows of the file, merged with
+// what earlier files of the stream produced, and converts every value to
+// its column's type. The types are settled once the sample is read, so
+// every record of the file is typed the same way; a later value that does
+// not fit its column is emitted as the string it was read as.
+func readCSV(r io.Reader, stream fileStream, schema map[string]string, emit emitFunc) error {
+	reader := csv.NewReader(r)
+	reader.Comma = stream.delimiter
+	reader.FieldsPerRecord = -1
+
+	var columns []string
+	if stream.header {
+		header, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read csv header: %w", err)
+		}
+		columns = header
+	}
+	columnName := func(i int) string {
+		if i < len(columns) && strings.TrimSpace(columns[i]) != "" {
+			return strings.TrimSpace(columns[i])
+		}
+		return fmt.Sprintf("column_%d", i+1)
+	}
+
+	var sample [][]string
+	for len(sample) < inferenceSampleRows {
+		row, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read csv: %w", err)
+		}
+		sample = append(sample, row)
+	}
+	for _, row := range sample {
+		for i, value := range row {
+			name := columnName(i)
+			schema[name] = widenType(schema[name], inferTextType(value))
+		}
+	}
+
+	toRecord := func(row []string) map[string]interface{} {
+		record := make(map[string]interface{}, len(row))
+		for i, value := range row {
+			name := columnName(i)
+			converted, ok := convertText(value, schema[name])
+			if !ok {
+				converted = value
+			}
+			record[name] = converted
+		}
+		return record
+	}
+
+	for _, row := range sample {
+		if err := emit(toRecord(row)); err != nil {
+			return err
+		}
+	}
+	for {
+		row, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read csv: %w", err)
+		}
+		if err := emit(toRecord(row)); err != nil {
+			return err
+		}
+	}
+}
+
+// readJSON reads newline-delimited objects, or a single JSON array of
+// objects, recording the type of each field in schema.
+func readJSON(r io.Reader, schema map[string]string, emit emitFunc) error {
+	buffered := bufio.NewReader(r)
+	decoder := json.NewDecoder(buffered)
+	decoder.UseNumber()
+
+	emitValue := func() error {
+		var record map[string]interface{}
+		if err := decoder.Decode(&record); err != nil {
+			return fmt.Errorf("failed to decode json record: %w", err)
+		}
+		for name, value := range record {
+			schema[name] = widenType(schema[name], jsonType(value))
+		}
+		return emit(record)
+	}
+
+	first, err := firstNonSpace(buffered)
+	if errors.Is(err, io.EOF) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if first == '[' {
+		if _, err := decoder.Token(); err != nil {
+			return fmt.Errorf("failed to decode json array: %w", err)
+		}
+		for decoder.More() {
+			if err := emitValue(); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	for decoder.More() {
+		if err := emitValue(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func firstNonSpace(r *bufio.Reader) (byte, error) {
+	for i := 1; ; i++ {
+		peeked, err := r.Peek(i)
+		if err != nil {
+			return 0, err
+		}
+		c := peeked[i-1]
+		if c != ' ' && c != '\t' && c != '\r' && c != '\n' {
+			return c, nil
+		}
+	}
+}
+
+// readParquet reads a Parquet file batch by batch. Column types come from the
+// file's schema rather than from the values.
+func readParquet(ctx context.Context, r parquet.ReaderAtSeeker, schema map[string]string, emit emitFunc) error {
+	parquetReader, err := file.NewParquetReader(r)
+	if err != nil {
+		return fmt.Errorf("failed to open parquet file: %w", err)
+	}
+	defer parquetReader.Close()
+
+	fileReader, err := pqarrow.NewFileReader(parquetReader, pqarrow.ArrowReadProperties{BatchSize: fileBatchSize}, memory.DefaultAllocator)
+	if err != nil {
+		return fmt.Errorf("failed to read parquet schema: %w", err)
+	}
+	recordReader, err := fileReader.GetRecordReader(ctx, nil, nil)
+	if err != nil {
+		return fmt.Errorf("failed to read parquet file: %w", err)
+	}
+	defer recordReader.Release()
+
+	for _, field := range recordReader.Schema().Fields() {
+		schema[field.Name] = widenType(schema[field.Name], arrowType(field.Type))
+	}
+
+	for recordReader.Next() {
+		batch := recordReader.Record()
+		fields := batch.Schema().Fields()
+		for row := 0; row < int(batch.NumRows()); row++ {
+			record := make(map[string]interface{}, len(fields))
+			for i, field := range fields {
+				column := batch.Column(i)
+				if column.IsNull(row) {
+					record[field.Name] = nil
+					continue
+				}
+				record[field.Name] = column.GetOneForMarshal(row)
+			}
+			if err := emit(record); err != nil {
+				return err
+			}
+		}
+	}
+	if err := recordReader.Err(); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("failed to read parquet file: %w", err)
+	}
+	return nil
+}
+
+func arrowType(dataType arrow.DataType) string {
+	switch dataType.ID() {
+	case arrow.BOOL:
+		return typeBoolean
+	case arrow.INT8, arrow.INT16, arrow.INT32, arrow.INT64,
+		arrow.UINT8, arrow.UINT16, arrow.UINT32, arrow.UINT64:
+		return typeInteger
+	case arrow.FLOAT16, arrow.FLOAT32, arrow.FLOAT64, arrow.DECIMAL128, arrow.DECIMAL256:
+		return typeNumber
+	case arrow.STRUCT, arrow.MAP:
+		return typeObject
+	case arrow.LIST, arrow.LARGE_LIST, arrow.FIXED_SIZE_LIST:
+		return typeArray
+	default:
+		return typeString
+	}
+}
@@ -0,0 +1,41 @@
+package files
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReadCSVTypesFromSample(t *testing.T) {
+	var input strings.Builder
+	input.WriteString("id,score,active\n")
+	for i := 1; i <= inferenceSampleRows; i++ {
+		fmt.Fprintf(&input, "%d,%d.5,true\n", i, i)
+	}
+	input.WriteString("n/a,high,\n")
+
+	schema := map[string]string{}
+	var records []map[string]interface{}
+	err := readCSV(strings.NewReader(input.String()), fileStream{delimiter: ',', header: true}, schema, func(record map[string]interface{}) error {
+		records = append(records, record)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("readCSV: %v", err)
+	}
+
+	wantSchema := map[string]string{"id": typeInteger, "score": typeNumber, "active": typeBoolean}
+	if !reflect.DeepEqual(schema, wantSchema) {
+		t.Errorf("schema = %v, want %v", schema, wantSchema)
+	}
+	if len(records) != inferenceSampleRows+1 {
+		t.Fatalf("read %d records, want %d", len(records), inferenceSampleRows+1)
+	}
+	if want := (map[string]interface{}{"id": int64(1), "score": 1.5, "active": true}); !reflect.DeepEqual(records[0], want) {
+		t.Errorf("first record = %#v, want %#v", records[0], want)
+	}
+	if want := (map[string]interface{}{"id": "n/a", "score": "high", "active": nil}); !reflect.DeepEqual(records[inferenceSampleRows], want) {
+		t.Errorf("last record = %#v, want %#v", records[inferenceSampleRows], want)
+	}
+}
@@ -0,0 +1,227 @@
+package files
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+)
+
+// fileInfo describes one file in a store. Name is relative to the store's
+// root and is what patterns and state refer to; Key is what Open takes.
+type fileInfo struct {
+	Key      string
+	Name     string
+	Size     int64
+	Modified time.Time
+	ETag     string
+}
+
+type fileStore interface {
+	List(ctx context.Context) ([]fileInfo, error)
+	Open(ctx context.Context, key string) (io.ReadCloser, error)
+}
+
+func newFileStore(ctx context.Context, cfg map[string]interface{}) (fileStore, error) {
+	storage, _ := cfg["storage"].(string)
+	switch storage {
+	case "", "local":
+		root, _ := cfg["path"].(string)
+		if root == "" {
+			return nil, errors.New("local file source requires path")
+		}
+		return &localStore{root: root}, nil
+	case "s3":
+		return newS3Store(ctx, cfg)
+	default:
+		return nil, fmt.Errorf("unsupported storage %q", storage)
+	}
+}
+
+type localStore struct {
+	root string
+}
+
+func (l *localStore) List(ctx context.Context) ([]fileInfo, error) {
+	var files []fileInfo
+	err := filepath.WalkDir(l.root, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if entry.IsDir() {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		name, err := filepath.Rel(l.root, path)
+		if err != nil {
+			return err
+		}
+		name = filepath.ToSlash(name)
+		files = append(files, fileInfo{
+			Key:      name,
+			Name:     name,
+			Size:     info.Size(),
+			Modified: info.ModTime().UTC(),
+		})
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list %s: %w", l.root, err)
+	}
+	return files, nil
+}
+
+func (l *localStore) Open(ctx context.Context, key string) (io.ReadCloser, error) {
+	return os.Open(filepath.Join(l.root, filepath.FromSlash(key)))
+}
+
+// s3Store reads from an S3 bucket. Setting endpoint points it at any
+// S3-compatible service such as MinIO.
+type s3Store struct {
+	client *s3.Client
+	bucket string
+	prefix string
+}
+
+func newS3Store(ctx context.Context, cfg map[string]interface{}) (*s3Store, error) {
+	bucket, _ := cfg["bucket"].(string)
+	if bucket == "" {
+		return nil, errors.New("s3 file source requires bucket")
+	}
+	prefix, _ := cfg["prefix"].(string)
+	client, err := NewS3Client(ctx, cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &s3Store{client: client, bucket: bucket, prefix: prefix}, nil
+}
+
+// NewS3Client reads region, endpoint, static credentials and
+// force_path_style, falling back to the default AWS credential chain. The
+// file destination shares it with the source.
+func NewS3Client(ctx context.Context, cfg map[string]interface{}) (*s3.Client, error) {
+	region, _ := cfg["region"].(string)
+	if region == "" {
+		region = "us-east-1"
+	}
+	endpoint, _ := cfg["endpoint"].(string)
+	accessKeyID, _ := cfg["access_key_id"].(string)
+	secretAccessKey, _ := cfg["secret_access_key"].(string)
+	sessionToken, _ := cfg["session_token"].(string)
+	pathStyle, ok := cfg["force_path_style"].(bool)
+	if !ok {
+		pathStyle = endpoint != ""
+	}
+
+	opts := []func(*config.LoadOptions) error{config.WithRegion(region)}
+	if accessKeyID != "" {
+		opts = append(opts, config.WithCredentialsProvider(
+			credentials.NewStaticCredentialsProvider(accessKeyID, secretAccessKey, sessionToken),
+		))
+	}
+	awsConfig, err := config.LoadDefaultConfig(ctx, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load s3 config: %w", err)
+	}
+
+	return s3.NewFromConfig(awsConfig, func(o *s3.Options) {
+		if endpoint != "" {
+			o.BaseEndpoint = aws.String(endpoint)
+		}
+		o.UsePathStyle = pathStyle
+	}), nil
+}
+
+func (s *s3Store) List(ctx context.Context) ([]fileInfo, error) {
+	var files []fileInfo
+	paginator := s3.NewListObjectsV2Paginator(s.client, &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.bucket),
+		Prefix: aws.String(s.prefix),
+	})
+	for paginator.HasMorePages() {
+		page, err := paginator.NextPage(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to list s3://%s/%s: %w", s.bucket, s.prefix, err)
+		}
+		for _, object := range page.Contents {
+			key := aws.ToString(object.Key)
+			if strings.HasSuffix(key, "/") {
+				continue
+			}
+			files = append(files, fileInfo{
+				Key:      key,
+				Name:     strings.TrimPrefix(strings.TrimPrefix(key, s.prefix), "/"),
+				Size:     aws.ToInt64(object.Size),
+				Modified: aws.ToTime(object.LastModified).UTC(),
+				ETag:     strings.Trim(aws.ToString(object.ETag), `"`),
+			})
+		}
+	}
+	return files, nil
+}
+
+func (s *s3Store) Open(ctx context.Context, key string) (io.ReadCloser, error) {
+	object, err := s.client.GetObject(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get s3://%s/%s: %w", s.bucket, key, err)
+	}
+	return object.Body, nil
+}
+
+// compileGlob turns a glob into a regexp over slash separated names. "*" and
+// "?" stay within one path segment, "**" crosses segments, and [...]
+// classes work as in path.Match.
+func compileGlob(pattern string) (*regexp.Regexp, error) {
+	var b strings.Builder
+	b.WriteString("^")
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; c {
+		case '*':
+			if i+1 < len(pattern) && pattern[i+1] == '*' {
+				i++
+				if i+1 < len(pattern) && pattern[i+1] == '/' {
+					i++
+					b.WriteString("(?:.*/)?")
+				} else {
+					b.WriteString(".*")
+				}
+			} else {
+				b.WriteString("[^/]*")
+			}
+		case '?':
+			b.WriteString("[^/]")
+		case '[':
+			end := strings.IndexByte(pattern[i:], ']')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated character class in %q", pattern)
+			}
+			class := pattern[i+1 : i+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			b.WriteString("[" + class + "]")
+			i += end
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	b.WriteString("$")
+	return regexp.Compile(b.String())
+}
@@ -0,0 +1,100 @@
+package models
+
+import (
+	n "dataforge-be/nats"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"strings"
+)
+
+// Differ compares rows against the snapshot of the last committed run and
+// builds the snapshot for the current one.
+type Differ struct {
+	primaryKey []string
+	previous   n.Snapshot
+	current    n.Snapshot
+}
+
+func NewDiffer(primaryKey []string, previous n.Snapshot) *Differ {
+	return &Differ{
+		primaryKey: primaryKey,
+		previous:   previous,
+		current:    n.Snapshot{},
+	}
+}
+
+// Diff returns the operation needed to bring the destination in line with
+// record, or an empty string if the row is unchanged.
+func (d *Differ) Diff(record map[string]interface{}) (string, error) {
+	keyValues := make([]interface{}, len(d.primaryKey))
+	for i, column := range d.primaryKey {
+		value, ok := record[column]
+		if !ok {
+			return "", fmt.Errorf("primary key column %s missing from row", column)
+		}
+		keyValues[i] = value
+	}
+
+	keyBytes, err := json.Marshal(keyValues)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode primary key: %w", err)
+	}
+	key := string(keyBytes)
+
+	recordBytes, err := json.Marshal(record)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode row: %w", err)
+	}
+	hasher := fnv.New64a()
+	hasher.Write(recordBytes)
+	hash := hasher.Sum64()
+
+	if _, seen := d.current[key]; seen {
+		return "", fmt.Errorf("duplicate primary key %s", key)
+	}
+	d.current[key] = hash
+
+	previousHash, existed := d.previous[key]
+	switch {
+	case !existed:
+		return n.OperationInsert, nil
+	case previousHash != hash:
+		return n.OperationUpdate, nil
+	default:
+		return "", nil
+	}
+}
+
+// Deleted returns the primary key columns of every row in the previous
+// snapshot that was not passed to Diff.
+func (d *Differ) Deleted() ([]map[string]interface{}, error) {
+	var deleted []map[string]interface{}
+	for key := range d.previous {
+		if _, ok := d.current[key]; ok {
+			continue
+		}
+
+		// Numbers are kept as written so large integer keys stay exact.
+		var keyValues []interface{}
+		decoder := json.NewDecoder(strings.NewReader(key))
+		decoder.UseNumber()
+		if err := decoder.Decode(&keyValues); err != nil {
+			return nil, fmt.Errorf("failed to decode primary key %s: %w", key, err)
+		}
+		if len(keyValues) != len(d.primaryKey) {
+			return nil, fmt.Errorf("primary key %s does not match columns %v", key, d.primaryKey)
+		}
+
+		record := make(map[string]interface{}, len(d.primaryKey))
+		for i, column := range d.primaryKey {
+			record[column] = keyValues[i]
+		}
+		deleted = append(deleted, record)
+	}
+	return deleted, nil
+}
+
+func (d *Differ) Snapshot() n.Snapshot {
+	return d.current
+}
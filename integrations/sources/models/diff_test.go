@@ -0,0 +1,27 @@
+package models
+
+import (
+	n "dataforge-be/nats"
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestDifferDeletedKeepsLargeIntegerKeys(t *testing.T) {
+	differ := NewDiffer([]string{"id", "org"}, n.Snapshot{
+		`[9007199254740993,"acme"]`: 1,
+		`[1,"acme"]`:                2,
+	})
+	if _, err := differ.Diff(map[string]interface{}{"id": int64(1), "org": "acme"}); err != nil {
+		t.Fatalf("Diff: %v", err)
+	}
+
+	deleted, err := differ.Deleted()
+	if err != nil {
+		t.Fatalf("Deleted: %v", err)
+	}
+	want := []map[string]interface{}{{"id": json.Number("9007199254740993"), "org": "acme"}}
+	if !reflect.DeepEqual(deleted, want) {
+		t.Errorf("Deleted = %v, want %v", deleted, want)
+	}
+}
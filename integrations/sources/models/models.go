@@ -0,0 +1,292 @@
+package models
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultPreviewLimit = 20
+	maxPreviewLimit     = 1000
+
+	SyncModeFullRefresh = "full_refresh"
+	SyncModeIncremental = "incremental"
+	SyncModeDiff        = "diff"
+)
+
+var selectStatement = regexp.MustCompile(`(?is)^\s*(select|with)\s`)
+
+// Model is a user-defined SELECT statement synced as if it were a table.
+type Model struct {
+	Name       string   `json:"name"`
+	Query      string   `json:"query"`
+	PrimaryKey []string `json:"primary_key"`
+	Cursor     string   `json:"cursor"`
+	SyncMode   string   `json:"sync_mode"`
+}
+
+type Column struct {
+	Name     string `json:"name"`
+	Type     string `json:"type"`
+	Nullable *bool  `json:"nullable,omitempty"`
+}
+
+type Preview struct {
+	Columns []Column                 `json:"columns"`
+	Rows    []map[string]interface{} `json:"rows"`
+}
+
+// Dialect holds the SQL differences between sources that run models.
+type Dialect struct {
+	QuoteIdentifier func(name string) string
+	Placeholder     func(position int) string
+}
+
+func doubleQuote(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+func questionMark(int) string {
+	return "?"
+}
+
+var QuestionMarkDialect = Dialect{
+	QuoteIdentifier: doubleQuote,
+	Placeholder:     questionMark,
+}
+
+var PostgresDialect = Dialect{
+	QuoteIdentifier: doubleQuote,
+	Placeholder: func(position int) string {
+		return "$" + strconv.Itoa(position)
+	},
+}
+
+var MySQLDialect = Dialect{
+	QuoteIdentifier: func(name string) string {
+		return "`" + strings.ReplaceAll(name, "`", "``") + "`"
+	},
+	Placeholder: questionMark,
+}
+
+func ModelsFromConfig(config map[string]interface{}) ([]Model, error) {
+	raw, ok := config["models"]
+	if !ok || raw == nil {
+		return nil, nil
+	}
+
+	rawBytes, err := json.Marshal(raw)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode models: %w", err)
+	}
+
+	var models []Model
+	if err := json.Unmarshal(rawBytes, &models); err != nil {
+		return nil, fmt.Errorf("invalid models config: %w", err)
+	}
+
+	names := make(map[string]bool)
+	for i := range models {
+		if err := models[i].Validate(); err != nil {
+			return nil, err
+		}
+		if names[models[i].Name] {
+			return nil, fmt.Errorf("duplicate model name: %s", models[i].Name)
+		}
+		names[models[i].Name] = true
+	}
+	return models, nil
+}
+
+func (m *Model) Validate() error {
+	if m.Name == "" {
+		return errors.New("model name is required")
+	}
+	query, err := CleanQuery(m.Query)
+	if err != nil {
+		return fmt.Errorf("model %s: %w", m.Name, err)
+	}
+	m.Query = query
+	if len(m.PrimaryKey) == 0 {
+		return fmt.Errorf("model %s: primary key is required", m.Name)
+	}
+
+	if m.SyncMode == "" {
+		m.SyncMode = SyncModeFullRefresh
+		if m.Cursor != "" {
+			m.SyncMode = SyncModeIncremental
+		}
+	}
+	switch m.SyncMode {
+	case SyncModeFullRefresh:
+	case SyncModeIncremental:
+		if m.Cursor == "" {
+			return fmt.Errorf("model %s: incremental sync requires a cursor", m.Name)
+		}
+	case SyncModeDiff:
+		if m.Cursor != "" {
+			return fmt.Errorf("model %s: diff sync compares every row and cannot use a cursor", m.Name)
+		}
+	default:
+		return fmt.Errorf("model %s: unsupported sync mode %s", m.Name, m.SyncMode)
+	}
+	return nil
+}
+
+// CleanQuery trims trailing semicolons and checks that query is a single
+// SELECT statement so it can be wrapped in a subquery.
+func CleanQuery(query string) (string, error) {
+	query = strings.TrimRight(strings.TrimSpace(query), "; \t\r\n")
+	if query == "" {
+		return "", errors.New("query is required")
+	}
+	if !selectStatement.MatchString(query) {
+		return "", errors.New("query must be a SELECT statement")
+	}
+	if strings.Contains(query, ";") {
+		return "", errors.New("query must be a single statement")
+	}
+	return query, nil
+}
+
+// SyncQuery returns the statement that reads the model. With a cursor and a
+// previous cursor value only newer rows are selected, ordered by the cursor.
+func (m Model) SyncQuery(d Dialect, lastCursor interface{}) (string, []interface{}) {
+	if m.SyncMode != SyncModeIncremental {
+		return m.Query, nil
+	}
+
+	cursor := d.QuoteIdentifier(m.Cursor)
+	if lastCursor == nil {
+		return fmt.Sprintf("SELECT * FROM (%s) dataforge_model ORDER BY %s", m.Query, cursor), nil
+	}
+	return fmt.Sprintf("SELECT * FROM (%s) dataforge_model WHERE %s > %s ORDER BY %s", m.Query, cursor, d.Placeholder(1), cursor), []interface{}{lastCursor}
+}
+
+func RunPreview(ctx context.Context, db *sql.DB, query string, limit int) (*Preview, error) {
+	query, err := CleanQuery(query)
+	if err != nil {
+		return nil, err
+	}
+	if limit <= 0 {
+		limit = defaultPreviewLimit
+	}
+	if limit > maxPreviewLimit {
+		limit = maxPreviewLimit
+	}
+
+	rows, err := db.QueryContext(ctx, fmt.Sprintf("SELECT * FROM (%s) dataforge_preview LIMIT %d", query, limit))
+	if err != nil {
+		return nil, fmt.Errorf("failed to run preview query: %w", err)
+	}
+	defer rows.Close()
+
+	columnTypes, err := rows.ColumnTypes()
+	if err != nil {
+		return nil, err
+	}
+
+	preview := &Preview{Rows: []map[string]interface{}{}}
+	for _, columnType := range columnTypes {
+		column := Column{Name: columnType.Name(), Type: columnType.DatabaseTypeName()}
+		if nullable, ok := columnType.Nullable(); ok {
+			column.Nullable = &nullable
+		}
+		preview.Columns = append(preview.Columns, column)
+	}
+
+	err = ScanRows(rows, func(record map[string]interface{}) error {
+		preview.Rows = append(preview.Rows, record)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return preview, nil
+}
+
+// ScanRows calls fn with each row keyed by column name. Byte slices are
+// converted to strings so the records encode as readable JSON.
+func ScanRows(rows *sql.Rows, fn func(record map[string]interface{}) error) error {
+	columns, err := rows.Columns()
+	if err != nil {
+		return fmt.Errorf("failed to get columns: %w", err)
+	}
+
+	values := make([]interface{}, len(columns))
+	scanArgs := make([]interface{}, len(columns))
+	for i := range values {
+		scanArgs[i] = &values[i]
+	}
+
+	for rows.Next() {
+		if err := rows.Scan(scanArgs...); err != nil {
+			return fmt.Errorf("failed to scan row: %w", err)
+		}
+
+		record := make(map[string]interface{}, len(columns))
+		for i, col := range columns {
+			record[col] = RecordValue(values[i])
+		}
+
+		if err := fn(record); err != nil {
+			return err
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("error during row iteration: %w", err)
+	}
+	return nil
+}
+
+// RecordValue converts a scanned value into the form it is published in.
+func RecordValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case []byte:
+		return string(v)
+	case time.Time:
+		return v.UTC().Format(time.RFC3339Nano)
+	default:
+		return v
+	}
+}
+
+// DecodeStateValue decodes a value kept in pipeline state that is bound back
+// as a query parameter. Integers come back as int64 rather than float64,
+// which would lose precision past 2^53 and bind as a different type.
+func DecodeStateValue(data []byte) (interface{}, error) {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return nil, err
+	}
+	return stateValue(value), nil
+}
+
+func stateValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i
+		}
+		f, _ := v.Float64()
+		return f
+	case []interface{}:
+		for i := range v {
+			v[i] = stateValue(v[i])
+		}
+		return v
+	default:
+		return v
+	}
+}
@@ -0,0 +1,192 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	n "dataforge-be/nats"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+const syncBatchSize = 100
+
+func cursorState(model Model) string {
+	return fmt.Sprintf("model-%s-cursor", model.Name)
+}
+
+// SyncModels reads every model and publishes its rows to OUTPUT. Diff models
+// share one snapshot run that is committed once destinations have written it.
+func SyncModels(ctx context.Context, db *sql.DB, d Dialect, js jetstream.JetStream, pipelineID int64, models []Model) error {
+	runID := ""
+	for _, model := range models {
+		if model.SyncMode == SyncModeDiff {
+			runID = strconv.FormatInt(time.Now().UnixNano(), 10)
+			break
+		}
+	}
+
+	for _, model := range models {
+		var err error
+		if model.SyncMode == SyncModeDiff {
+			err = syncDiff(ctx, db, js, pipelineID, model, runID)
+		} else {
+			err = syncRows(ctx, db, d, js, pipelineID, model)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to sync model %s: %w", model.Name, err)
+		}
+	}
+
+	if runID == "" {
+		return nil
+	}
+	return n.PublishRecords(ctx, js, n.DestinationRecord{
+		PipelineID: pipelineID,
+		Snapshot:   runID,
+		Commit:     true,
+	})
+}
+
+type batcher struct {
+	ctx    context.Context
+	js     jetstream.JetStream
+	record n.DestinationRecord
+}
+
+func newBatcher(ctx context.Context, js jetstream.JetStream, pipelineID int64, model Model, operation, runID string) *batcher {
+	return &batcher{
+		ctx: ctx,
+		js:  js,
+		record: n.DestinationRecord{
+			PipelineID: pipelineID,
+			Stream:     model.Name,
+			PrimaryKey: model.PrimaryKey,
+			Operation:  operation,
+			Snapshot:   runID,
+		},
+	}
+}
+
+func (b *batcher) add(record map[string]interface{}) error {
+	recordBytes, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("failed to marshal record: %w", err)
+	}
+	b.record.Records = append(b.record.Records, recordBytes)
+	if len(b.record.Records) >= syncBatchSize {
+		return b.flush()
+	}
+	return nil
+}
+
+func (b *batcher) flush() error {
+	if len(b.record.Records) == 0 {
+		return nil
+	}
+	err := n.PublishRecords(b.ctx, b.js, b.record)
+	b.record.Records = nil
+	return err
+}
+
+func syncRows(ctx context.Context, db *sql.DB, d Dialect, js jetstream.JetStream, pipelineID int64, model Model) error {
+	var lastCursor interface{}
+	if model.SyncMode == SyncModeIncremental {
+		var state json.RawMessage
+		found, err := n.GetPipelineState(ctx, js, pipelineID, cursorState(model), &state)
+		if err != nil {
+			return err
+		}
+		if found {
+			lastCursor, err = DecodeStateValue(state)
+			if err != nil {
+				return fmt.Errorf("failed to decode cursor of model %s: %w", model.Name, err)
+			}
+		}
+	}
+
+	query, args := model.SyncQuery(d, lastCursor)
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return fmt.Errorf("failed to query model: %w", err)
+	}
+	defer rows.Close()
+
+	batch := newBatcher(ctx, js, pipelineID, model, "", "")
+	var cursor interface{}
+	err = ScanRows(rows, func(record map[string]interface{}) error {
+		if model.SyncMode == SyncModeIncremental {
+			cursor = record[model.Cursor]
+		}
+		return batch.add(record)
+	})
+	if err != nil {
+		return err
+	}
+	if err := batch.flush(); err != nil {
+		return err
+	}
+
+	if cursor != nil {
+		return n.PutPipelineState(ctx, js, pipelineID, cursorState(model), cursor)
+	}
+	return nil
+}
+
+func syncDiff(ctx context.Context, db *sql.DB, js jetstream.JetStream, pipelineID int64, model Model, runID string) error {
+	previous, err := n.LoadCommittedSnapshot(ctx, js, pipelineID, model.Name)
+	if err != nil {
+		return err
+	}
+	differ := NewDiffer(model.PrimaryKey, previous)
+
+	rows, err := db.QueryContext(ctx, model.Query)
+	if err != nil {
+		return fmt.Errorf("failed to query model: %w", err)
+	}
+	defer rows.Close()
+
+	inserts := newBatcher(ctx, js, pipelineID, model, n.OperationInsert, runID)
+	updates := newBatcher(ctx, js, pipelineID, model, n.OperationUpdate, runID)
+	err = ScanRows(rows, func(record map[string]interface{}) error {
+		operation, err := differ.Diff(record)
+		if err != nil {
+			return err
+		}
+		switch operation {
+		case n.OperationInsert:
+			return inserts.add(record)
+		case n.OperationUpdate:
+			return updates.add(record)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if err := inserts.flush(); err != nil {
+		return err
+	}
+	if err := updates.flush(); err != nil {
+		return err
+	}
+
+	deleted, err := differ.Deleted()
+	if err != nil {
+		return err
+	}
+	deletes := newBatcher(ctx, js, pipelineID, model, n.OperationDelete, runID)
+	for _, record := range deleted {
+		if err := deletes.add(record); err != nil {
+			return err
+		}
+	}
+	if err := deletes.flush(); err != nil {
+		return err
+	}
+
+	return n.SavePendingSnapshot(ctx, js, pipelineID, runID, model.Name, differ.Snapshot())
+}
@@ -0,0 +1,42 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"dataforge-be/nats/natstest"
+	"path/filepath"
+	"testing"
+
+	_ "modernc.org/sqlite"
+)
+
+func TestIncrementalModelCursorKeepsLargeIntegers(t *testing.T) {
+	db, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "source.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	// The last id is past 2^53, where a float64 rounds it down.
+	_, err = db.Exec(`CREATE TABLE items (id INTEGER PRIMARY KEY, name TEXT);
+		INSERT INTO items VALUES (1, 'a'), (9007199254740993, 'b')`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	js := natstest.JetStream(t)
+	model := Model{Name: "items", Query: "SELECT * FROM items", Cursor: "id", SyncMode: SyncModeIncremental}
+	for run := 0; run < 2; run++ {
+		if err := SyncModels(context.Background(), db, QuestionMarkDialect, js, 1, []Model{model}); err != nil {
+			t.Fatalf("SyncModels: %v", err)
+		}
+	}
+
+	// The second run starts after the last id and finds nothing new.
+	var records int
+	for _, batch := range natstest.Published(t, js) {
+		records += len(batch.Records)
+	}
+	if records != 2 {
+		t.Errorf("published %d records over two runs, want 2", records)
+	}
+}
@@ -0,0 +1,228 @@
+package streams
+
+import (
+	"bytes"
+	"context"
+	"dataforge-be/integrations/connection"
+	n "dataforge-be/nats"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/twmb/franz-go/pkg/kgo"
+)
+
+const (
+	kafkaID = "kafka"
+
+	defaultPollRecords = 1000
+	kafkaBatchSize     = 500
+)
+
+// Kafka consumes topics as part of a consumer group. Offsets are committed
+// only after the polled records have been published to OUTPUT, so a crash
+// replays records rather than losing them.
+type Kafka struct {
+	opts            []kgo.Opt
+	topics          []string
+	topicRegex      bool
+	groupID         string
+	resetOffset     kgo.Offset
+	primaryKey      []string
+	rawValues       bool
+	includeMetadata bool
+	pollRecords     int
+}
+
+func (s *Kafka) Initialize(config map[string]interface{}) error {
+	opts, err := connection.KafkaOptions(config)
+	if err != nil {
+		return err
+	}
+	s.opts = opts
+
+	s.topics = connection.StringsFromConfig(config, "topics")
+	if len(s.topics) == 0 {
+		return errors.New("kafka source requires topics")
+	}
+	s.topicRegex, _ = config["topic_regex"].(bool)
+	s.groupID, _ = config["group_id"].(string)
+	s.primaryKey = connection.StringsFromConfig(config, "primary_key")
+	s.includeMetadata, _ = config["include_metadata"].(bool)
+
+	startOffset, _ := config["start_offset"].(string)
+	switch startOffset {
+	case "", "earliest":
+		s.resetOffset = kgo.NewOffset().AtStart()
+	case "latest":
+		s.resetOffset = kgo.NewOffset().AtEnd()
+	default:
+		return fmt.Errorf("unsupported start_offset %q", startOffset)
+	}
+
+	valueFormat, _ := config["value_format"].(string)
+	switch valueFormat {
+	case "", "json":
+		s.rawValues = false
+	case "raw":
+		s.rawValues = true
+	default:
+		return fmt.Errorf("unsupported value_format %q", valueFormat)
+	}
+
+	s.pollRecords = defaultPollRecords
+	if pollRecords, ok := config["poll_records"].(float64); ok && pollRecords > 0 {
+		s.pollRecords = int(pollRecords)
+	}
+	return nil
+}
+
+func (s *Kafka) SourceID() string {
+	return kafkaID
+}
+
+func (s *Kafka) Run(ctx context.Context, pipelineID int64, js jetstream.JetStream) error {
+	groupID := s.groupID
+	if groupID == "" {
+		groupID = fmt.Sprintf("dataforge-%d", pipelineID)
+	}
+
+	opts := append([]kgo.Opt{}, s.opts...)
+	opts = append(opts,
+		kgo.ConsumerGroup(groupID),
+		kgo.ConsumeTopics(s.topics...),
+		kgo.ConsumeResetOffset(s.resetOffset),
+		kgo.DisableAutoCommit(),
+		// Partitions are not revoked while a polled batch is in flight, so
+		// its offsets can still be committed once it is published.
+		kgo.BlockRebalanceOnPoll(),
+	)
+	if s.topicRegex {
+		opts = append(opts, kgo.ConsumeRegex())
+	}
+
+	client, err := kgo.NewClient(opts...)
+	if err != nil {
+		return fmt.Errorf("failed to create kafka client: %w", err)
+	}
+	defer client.Close()
+	log.Printf("Pipeline %d consuming %v as group %s", pipelineID, s.topics, groupID)
+
+	for {
+		fetches := client.PollRecords(ctx, s.pollRecords)
+		if ctx.Err() != nil || fetches.IsClientClosed() {
+			return nil
+		}
+
+		var fetchErr error
+		fetches.EachError(func(topic string, partition int32, err error) {
+			if fetchErr == nil {
+				fetchErr = fmt.Errorf("failed to fetch %s[%d]: %w", topic, partition, err)
+			}
+		})
+		if fetchErr != nil {
+			client.AllowRebalance()
+			return fetchErr
+		}
+
+		err := s.publish(ctx, pipelineID, js, fetches)
+		if err == nil {
+			err = client.CommitUncommittedOffsets(ctx)
+		}
+		client.AllowRebalance()
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (s *Kafka) publish(ctx context.Context, pipelineID int64, js jetstream.JetStream, fetches kgo.Fetches) error {
+	var publishErr error
+	fetches.EachTopic(func(topic kgo.FetchTopic) {
+		if publishErr != nil {
+			return
+		}
+
+		var records [][]byte
+		flush := func() error {
+			if len(records) == 0 {
+				return nil
+			}
+			err := n.PublishRecords(ctx, js, n.DestinationRecord{
+				PipelineID: pipelineID,
+				Records:    records,
+				Stream:     topic.Topic,
+				PrimaryKey: s.primaryKey,
+			})
+			records = nil
+			return err
+		}
+
+		topic.EachRecord(func(r *kgo.Record) {
+			if publishErr != nil {
+				return
+			}
+			if r.Value == nil {
+				// Tombstones carry no row to forward.
+				return
+			}
+			record, err := s.record(r)
+			if err == nil {
+				var recordBytes []byte
+				recordBytes, err = json.Marshal(record)
+				records = append(records, recordBytes)
+			}
+			if err == nil && len(records) >= kafkaBatchSize {
+				err = flush()
+			}
+			publishErr = err
+		})
+		if publishErr == nil {
+			publishErr = flush()
+		}
+	})
+	return publishErr
+}
+
+// record decodes a message value into a record. JSON values that are not
+// objects, and raw values, are kept under "value".
+func (s *Kafka) record(r *kgo.Record) (map[string]interface{}, error) {
+	record := map[string]interface{}{}
+	if s.rawValues {
+		record["value"] = string(r.Value)
+	} else {
+		var value interface{}
+		decoder := json.NewDecoder(bytes.NewReader(r.Value))
+		decoder.UseNumber()
+		if err := decoder.Decode(&value); err != nil {
+			return nil, fmt.Errorf("failed to decode %s[%d] offset %d as json: %w", r.Topic, r.Partition, r.Offset, err)
+		}
+		if object, ok := value.(map[string]interface{}); ok {
+			record = object
+		} else {
+			record["value"] = value
+		}
+	}
+
+	if s.includeMetadata {
+		headers := make(map[string]string, len(r.Headers))
+		for _, header := range r.Headers {
+			headers[header.Key] = string(header.Value)
+		}
+		record["_kafka"] = map[string]interface{}{
+			"topic":     r.Topic,
+			"partition": r.Partition,
+			"offset":    r.Offset,
+			"key":       string(r.Key),
+			"timestamp": r.Timestamp.UTC().Format(time.RFC3339Nano),
+			"headers":   headers,
+		}
+	}
+	return record, nil
+}
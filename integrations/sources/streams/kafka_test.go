@@ -0,0 +1,197 @@
+package streams
+
+import (
+	"context"
+	"dataforge-be/nats/natstest"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/twmb/franz-go/pkg/kfake"
+	"github.com/twmb/franz-go/pkg/kgo"
+	"github.com/twmb/franz-go/pkg/kmsg"
+)
+
+const (
+	kafkaTestPipeline = 3
+	kafkaTestTopic    = "events"
+	kafkaTestGroup    = "dataforge-test"
+	kafkaTestRecords  = 5
+)
+
+func kafkaCluster(t *testing.T) *kfake.Cluster {
+	t.Helper()
+	cluster, err := kfake.NewCluster(kfake.NumBrokers(1), kfake.SeedTopics(1, kafkaTestTopic))
+	if err != nil {
+		t.Fatalf("failed to start kafka cluster: %v", err)
+	}
+	t.Cleanup(cluster.Close)
+
+	client, err := kgo.NewClient(kgo.SeedBrokers(cluster.ListenAddrs()...))
+	if err != nil {
+		t.Fatalf("failed to create producer: %v", err)
+	}
+	defer client.Close()
+	var records []*kgo.Record
+	for i := 0; i < kafkaTestRecords; i++ {
+		records = append(records, &kgo.Record{Topic: kafkaTestTopic, Value: []byte(fmt.Sprintf(`{"id": %d}`, i+1))})
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := client.ProduceSync(ctx, records...).FirstErr(); err != nil {
+		t.Fatalf("failed to produce: %v", err)
+	}
+	return cluster
+}
+
+func kafkaSource(t *testing.T, cluster *kfake.Cluster) *Kafka {
+	t.Helper()
+	brokers := []interface{}{}
+	for _, addr := range cluster.ListenAddrs() {
+		brokers = append(brokers, addr)
+	}
+	source := &Kafka{}
+	err := source.Initialize(map[string]interface{}{
+		"brokers":  brokers,
+		"topics":   kafkaTestTopic,
+		"group_id": kafkaTestGroup,
+	})
+	if err != nil {
+		t.Fatalf("Initialize: %v", err)
+	}
+	return source
+}
+
+// committedOffset returns the group's committed offset for partition 0, or
+// -1 if nothing was committed.
+func committedOffset(t *testing.T, cluster *kfake.Cluster) int64 {
+	t.Helper()
+	client, err := kgo.NewClient(kgo.SeedBrokers(cluster.ListenAddrs()...))
+	if err != nil {
+		t.Fatalf("failed to create client: %v", err)
+	}
+	defer client.Close()
+
+	req := kmsg.NewPtrOffsetFetchRequest()
+	req.Group = kafkaTestGroup
+	topic := kmsg.NewOffsetFetchRequestTopic()
+	topic.Topic = kafkaTestTopic
+	topic.Partitions = []int32{0}
+	req.Topics = append(req.Topics, topic)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	resp, err := req.RequestWith(ctx, client)
+	if err != nil {
+		t.Fatalf("failed to fetch offsets: %v", err)
+	}
+	for _, topic := range resp.Topics {
+		for _, partition := range topic.Partitions {
+			return partition.Offset
+		}
+	}
+	return -1
+}
+
+// outputCount reads the number of batches in OUTPUT without a testing.T, so
+// it can run on the cluster's goroutine.
+func outputCount(js jetstream.JetStream) (uint64, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	stream, err := js.Stream(ctx, "OUTPUTS")
+	if err != nil {
+		return 0, err
+	}
+	info, err := stream.Info(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return info.State.Msgs, nil
+}
+
+func TestKafkaCommitsAfterPublish(t *testing.T) {
+	cluster := kafkaCluster(t)
+	js := natstest.JetStream(t)
+
+	// Record how much had been published each time the source commits.
+	var mu sync.Mutex
+	var publishedAtCommit []uint64
+	cluster.ControlKey(int16(kmsg.OffsetCommit), func(kmsg.Request) (kmsg.Response, error, bool) {
+		cluster.KeepControl()
+		count, err := outputCount(js)
+		if err != nil {
+			t.Errorf("failed to count output: %v", err)
+		}
+		mu.Lock()
+		publishedAtCommit = append(publishedAtCommit, count)
+		mu.Unlock()
+		return nil, nil, false
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- kafkaSource(t, cluster).Run(ctx, kafkaTestPipeline, js)
+	}()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for committedOffset(t, cluster) < kafkaTestRecords {
+		if time.Now().After(deadline) {
+			t.Fatal("offsets were not committed")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+
+	var ids []int
+	for _, record := range natstest.Published(t, js) {
+		if record.Stream != kafkaTestTopic {
+			t.Errorf("published stream %q, want %q", record.Stream, kafkaTestTopic)
+		}
+		for _, recordBytes := range record.Records {
+			var document struct {
+				ID int `json:"id"`
+			}
+			if err := json.Unmarshal(recordBytes, &document); err != nil {
+				t.Fatalf("failed to decode record: %v", err)
+			}
+			ids = append(ids, document.ID)
+		}
+	}
+	if len(ids) != kafkaTestRecords {
+		t.Errorf("published %v, want %d records", ids, kafkaTestRecords)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(publishedAtCommit) == 0 {
+		t.Fatal("no offset commit was seen")
+	}
+	if publishedAtCommit[0] == 0 {
+		t.Errorf("offsets were committed before anything was published")
+	}
+}
+
+func TestKafkaDoesNotCommitUnpublished(t *testing.T) {
+	cluster := kafkaCluster(t)
+	js := natstest.JetStream(t)
+
+	// Without the OUTPUTS stream nothing can be published.
+	if err := js.DeleteStream(context.Background(), "OUTPUTS"); err != nil {
+		t.Fatalf("failed to delete output stream: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
+	defer cancel()
+	if err := kafkaSource(t, cluster).Run(ctx, kafkaTestPipeline, js); err == nil {
+		t.Fatal("expected Run to fail when publishing fails")
+	}
+	if offset := committedOffset(t, cluster); offset >= 0 {
+		t.Errorf("committed offset %d for records that were never published", offset)
+	}
+}
@@ -0,0 +1,364 @@
+package streams
+
+import (
+	"bytes"
+	"context"
+	"dataforge-be/integrations/connection"
+	n "dataforge-be/nats"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/nats-io/nkeys"
+)
+
+const (
+	natsID = "nats"
+
+	defaultNATSBatchSize = 100
+	natsFetchWait        = 5 * time.Second
+	natsFlushInterval    = time.Second
+)
+
+// NATS forwards messages that other services publish on a NATS server into
+// the pipeline. With a stream configured it reads through a durable
+// JetStream consumer and acks each message only after it has been published
+// to OUTPUT. Plain subjects have no redelivery, so those messages are
+// forwarded at most once; publishers that use request-reply get their reply
+// after the forward.
+type NATS struct {
+	url             string
+	options         []nats.Option
+	subject         string
+	stream          string
+	durable         string
+	deliverNew      bool
+	batchSize       int
+	primaryKey      []string
+	includeMetadata bool
+	pipelineID      int64
+	js              jetstream.JetStream
+}
+
+func (s *NATS) Initialize(config map[string]interface{}) error {
+	s.url, _ = config["url"].(string)
+	if s.url == "" {
+		s.url = nats.DefaultURL
+	}
+	s.subject, _ = config["subject"].(string)
+	s.stream, _ = config["stream"].(string)
+	if s.subject == "" && s.stream == "" {
+		return errors.New("nats source requires subject or stream")
+	}
+	s.durable, _ = config["durable"].(string)
+
+	deliver, _ := config["deliver"].(string)
+	switch deliver {
+	case "", "all":
+		s.deliverNew = false
+	case "new":
+		s.deliverNew = true
+	default:
+		return fmt.Errorf("unsupported deliver policy %q", deliver)
+	}
+
+	s.batchSize = defaultNATSBatchSize
+	if batchSize, ok := config["batch_size"].(float64); ok && batchSize > 0 {
+		s.batchSize = int(batchSize)
+	}
+	s.includeMetadata, _ = config["include_metadata"].(bool)
+
+	s.primaryKey = nil
+	keys, _ := config["primary_key"].([]interface{})
+	for _, key := range keys {
+		if column, ok := key.(string); ok {
+			s.primaryKey = append(s.primaryKey, column)
+		}
+	}
+
+	options, err := natsOptions(config)
+	if err != nil {
+		return err
+	}
+	s.options = options
+	return nil
+}
+
+// natsOptions reads one of the supported credential styles: a creds file,
+// an inline creds document, an nkey seed, a token, or a username and
+// password. A ca_cert or client certificate enables TLS, read by
+// connection.TLSConfig.
+func natsOptions(config map[string]interface{}) ([]nats.Option, error) {
+	options := []nats.Option{nats.Name("dataforge")}
+
+	if credsFile, _ := config["credentials_file"].(string); credsFile != "" {
+		options = append(options, nats.UserCredentials(credsFile))
+	}
+	if creds, _ := config["credentials"].(string); creds != "" {
+		jwt, err := nkeys.ParseDecoratedJWT([]byte(creds))
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse nats credentials: %w", err)
+		}
+		seed, err := nkeys.ParseDecoratedNKey([]byte(creds))
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse nats credentials: %w", err)
+		}
+		options = append(options, nats.UserJWT(
+			func() (string, error) { return jwt, nil },
+			func(nonce []byte) ([]byte, error) { return seed.Sign(nonce) },
+		))
+	}
+	if seed, _ := config["nkey_seed"].(string); seed != "" {
+		option, err := nkeyOptionFromSeed(seed)
+		if err != nil {
+			return nil, err
+		}
+		options = append(options, option)
+	}
+	if token, _ := config["token"].(string); token != "" {
+		options = append(options, nats.Token(token))
+	}
+	if username, _ := config["username"].(string); username != "" {
+		password, _ := config["password"].(string)
+		options = append(options, nats.UserInfo(username, password))
+	}
+
+	caCert, _ := config["ca_cert"].(string)
+	clientCert, _ := config["client_cert"].(string)
+	if caCert != "" || clientCert != "" {
+		tlsConfig, err := connection.TLSConfig(config)
+		if err != nil {
+			return nil, fmt.Errorf("invalid nats tls config: %w", err)
+		}
+		options = append(options, nats.Secure(tlsConfig))
+	}
+	return options, nil
+}
+
+func nkeyOptionFromSeed(seed string) (nats.Option, error) {
+	keyPair, err := nkeys.ParseDecoratedNKey([]byte(seed))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse nats nkey seed: %w", err)
+	}
+	publicKey, err := keyPair.PublicKey()
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse nats nkey seed: %w", err)
+	}
+	return nats.Nkey(publicKey, keyPair.Sign), nil
+}
+
+func (s *NATS) SourceID() string {
+	return natsID
+}
+
+func (s *NATS) Run(ctx context.Context, pipelineID int64, js jetstream.JetStream) error {
+	s.pipelineID = pipelineID
+	s.js = js
+
+	conn, err := nats.Connect(s.url, s.options...)
+	if err != nil {
+		return fmt.Errorf("failed to connect to nats at %s: %w", s.url, err)
+	}
+	defer conn.Close()
+
+	durable := s.durable
+	if durable == "" {
+		durable = fmt.Sprintf("dataforge-%d", pipelineID)
+	}
+
+	if s.stream != "" {
+		err = s.consumeStream(ctx, conn, durable)
+	} else {
+		err = s.consumeSubject(ctx, conn, durable)
+	}
+	if ctx.Err() != nil {
+		return nil
+	}
+	return err
+}
+
+func (s *NATS) consumeStream(ctx context.Context, conn *nats.Conn, durable string) error {
+	remote, err := jetstream.New(conn)
+	if err != nil {
+		return fmt.Errorf("failed to open jetstream: %w", err)
+	}
+
+	consumerConfig := jetstream.ConsumerConfig{
+		Durable:       durable,
+		FilterSubject: s.subject,
+		AckPolicy:     jetstream.AckExplicitPolicy,
+		DeliverPolicy: jetstream.DeliverAllPolicy,
+	}
+	if s.deliverNew {
+		consumerConfig.DeliverPolicy = jetstream.DeliverNewPolicy
+	}
+	consumer, err := remote.CreateOrUpdateConsumer(ctx, s.stream, consumerConfig)
+	if err != nil {
+		return fmt.Errorf("failed to create consumer %s on stream %s: %w", durable, s.stream, err)
+	}
+	log.Printf("Pipeline %d consuming nats stream %s as %s", s.pipelineID, s.stream, durable)
+
+	for {
+		batch, err := consumer.Fetch(s.batchSize, jetstream.FetchMaxWait(natsFetchWait))
+		if err != nil {
+			return fmt.Errorf("failed to fetch from stream %s: %w", s.stream, err)
+		}
+
+		var messages []jetstream.Msg
+		for msg := range batch.Messages() {
+			messages = append(messages, msg)
+		}
+		if err := batch.Error(); err != nil && !errors.Is(err, nats.ErrTimeout) {
+			return fmt.Errorf("failed to fetch from stream %s: %w", s.stream, err)
+		}
+
+		records := make([]forwardedMessage, 0, len(messages))
+		for _, msg := range messages {
+			record := s.record(msg.Subject(), msg.Headers(), msg.Data())
+			if s.includeMetadata {
+				if metadata, err := msg.Metadata(); err == nil {
+					record["_nats"].(map[string]interface{})["sequence"] = metadata.Sequence.Stream
+				}
+			}
+			records = append(records, forwardedMessage{subject: msg.Subject(), record: record})
+		}
+
+		if err := s.forward(ctx, records); err != nil {
+			for _, msg := range messages {
+				msg.Nak()
+			}
+			return err
+		}
+		for _, msg := range messages {
+			if err := msg.Ack(); err != nil {
+				log.Printf("Failed to ack message on %s: %v", msg.Subject(), err)
+			}
+		}
+
+		if ctx.Err() != nil {
+			return nil
+		}
+	}
+}
+
+// consumeSubject joins a queue group named after the durable, so several
+// pipelines sharing a durable split the subject's messages between them.
+func (s *NATS) consumeSubject(ctx context.Context, conn *nats.Conn, durable string) error {
+	messages := make(chan *nats.Msg, s.batchSize*4)
+	sub, err := conn.ChanQueueSubscribe(s.subject, durable, messages)
+	if err != nil {
+		return fmt.Errorf("failed to subscribe to %s: %w", s.subject, err)
+	}
+	defer sub.Unsubscribe()
+	log.Printf("Pipeline %d consuming nats subject %s in queue group %s", s.pipelineID, s.subject, durable)
+
+	ticker := time.NewTicker(natsFlushInterval)
+	defer ticker.Stop()
+
+	var pending []*nats.Msg
+	flush := func() error {
+		if len(pending) == 0 {
+			return nil
+		}
+		records := make([]forwardedMessage, 0, len(pending))
+		for _, msg := range pending {
+			record := s.record(msg.Subject, msg.Header, msg.Data)
+			records = append(records, forwardedMessage{subject: msg.Subject, record: record})
+		}
+		if err := s.forward(ctx, records); err != nil {
+			return err
+		}
+		for _, msg := range pending {
+			if msg.Reply != "" {
+				msg.Respond(nil)
+			}
+		}
+		pending = nil
+		return nil
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case msg := <-messages:
+			pending = append(pending, msg)
+			if len(pending) >= s.batchSize {
+				if err := flush(); err != nil {
+					return err
+				}
+			}
+		case <-ticker.C:
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+type forwardedMessage struct {
+	subject string
+	record  map[string]interface{}
+}
+
+// forward publishes records to OUTPUT, one batch per subject in the order
+// the subjects were first seen.
+func (s *NATS) forward(ctx context.Context, messages []forwardedMessage) error {
+	var subjects []string
+	bySubject := make(map[string][][]byte)
+	for _, message := range messages {
+		recordBytes, err := json.Marshal(message.record)
+		if err != nil {
+			return fmt.Errorf("failed to marshal record: %w", err)
+		}
+		if _, ok := bySubject[message.subject]; !ok {
+			subjects = append(subjects, message.subject)
+		}
+		bySubject[message.subject] = append(bySubject[message.subject], recordBytes)
+	}
+
+	for _, subject := range subjects {
+		err := n.PublishRecords(ctx, s.js, n.DestinationRecord{
+			PipelineID: s.pipelineID,
+			Records:    bySubject[subject],
+			Stream:     subject,
+			PrimaryKey: s.primaryKey,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// record decodes a message body. JSON objects are used as they are; any
+// other payload is kept under "value".
+func (s *NATS) record(subject string, header nats.Header, data []byte) map[string]interface{} {
+	record := map[string]interface{}{}
+	var value interface{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(&value); err != nil {
+		record["value"] = string(data)
+	} else if object, ok := value.(map[string]interface{}); ok {
+		record = object
+	} else {
+		record["value"] = value
+	}
+
+	if s.includeMetadata {
+		headers := make(map[string]string, len(header))
+		for key := range header {
+			headers[key] = header.Get(key)
+		}
+		record["_nats"] = map[string]interface{}{
+			"subject": subject,
+			"headers": headers,
+		}
+	}
+	return record
+}
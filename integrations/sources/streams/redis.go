@@ -0,0 +1,204 @@
+package streams
+
+import (
+	"bytes"
+	"context"
+	"dataforge-be/integrations/connection"
+	n "dataforge-be/nats"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/nats-io/nats.go/jetstream"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	redisID = "redis"
+
+	defaultRedisBatchSize = 500
+	redisBlock            = 5 * time.Second
+)
+
+// Redis reads Redis Streams through a consumer group. Entries are acked
+// with XACK only after they have been published to OUTPUT; entries left
+// pending by an earlier run are read again first.
+type Redis struct {
+	options         *redis.Options
+	streams         []string
+	group           string
+	consumer        string
+	startID         string
+	valueField      string
+	batchSize       int64
+	primaryKey      []string
+	includeMetadata bool
+}
+
+func (s *Redis) Initialize(config map[string]interface{}) error {
+	options, err := connection.RedisOptions(config)
+	if err != nil {
+		return err
+	}
+	s.options = options
+
+	s.streams = connection.StringsFromConfig(config, "streams")
+	if len(s.streams) == 0 {
+		return errors.New("redis source requires streams")
+	}
+	s.group, _ = config["group"].(string)
+	s.consumer, _ = config["consumer"].(string)
+	s.valueField, _ = config["value_field"].(string)
+	s.primaryKey = connection.StringsFromConfig(config, "primary_key")
+	s.includeMetadata, _ = config["include_metadata"].(bool)
+
+	startID, _ := config["start_id"].(string)
+	switch startID {
+	case "", "earliest":
+		s.startID = "0"
+	case "latest":
+		s.startID = "$"
+	default:
+		s.startID = startID
+	}
+
+	s.batchSize = defaultRedisBatchSize
+	if batchSize, ok := config["batch_size"].(float64); ok && batchSize > 0 {
+		s.batchSize = int64(batchSize)
+	}
+	return nil
+}
+
+func (s *Redis) SourceID() string {
+	return redisID
+}
+
+func (s *Redis) Run(ctx context.Context, pipelineID int64, js jetstream.JetStream) error {
+	client := redis.NewClient(s.options)
+	defer client.Close()
+
+	group := s.group
+	if group == "" {
+		group = fmt.Sprintf("dataforge-%d", pipelineID)
+	}
+	consumer := s.consumer
+	if consumer == "" {
+		consumer = group
+	}
+
+	for _, stream := range s.streams {
+		err := client.XGroupCreateMkStream(ctx, stream, group, s.startID).Err()
+		if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+			return fmt.Errorf("failed to create consumer group %s on %s: %w", group, stream, err)
+		}
+	}
+	log.Printf("Pipeline %d reading redis streams %v as %s/%s", pipelineID, s.streams, group, consumer)
+
+	// "0" replays this consumer's pending entries; once they are drained,
+	// ">" asks for entries never delivered to the group.
+	id := "0"
+	for {
+		args := &redis.XReadGroupArgs{
+			Group:    group,
+			Consumer: consumer,
+			Streams:  make([]string, 0, len(s.streams)*2),
+			Count:    s.batchSize,
+			Block:    redisBlock,
+		}
+		args.Streams = append(args.Streams, s.streams...)
+		for range s.streams {
+			args.Streams = append(args.Streams, id)
+		}
+		if id == "0" {
+			args.Block = -1
+		}
+
+		results, err := client.XReadGroup(ctx, args).Result()
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err != nil && !errors.Is(err, redis.Nil) {
+			return fmt.Errorf("failed to read redis streams: %w", err)
+		}
+
+		read := 0
+		for _, result := range results {
+			read += len(result.Messages)
+			if err := s.forward(ctx, pipelineID, js, client, group, result); err != nil {
+				if ctx.Err() != nil {
+					return nil
+				}
+				return err
+			}
+		}
+		if id == "0" && read == 0 {
+			id = ">"
+		}
+	}
+}
+
+func (s *Redis) forward(ctx context.Context, pipelineID int64, js jetstream.JetStream, client *redis.Client, group string, result redis.XStream) error {
+	if len(result.Messages) == 0 {
+		return nil
+	}
+
+	records := make([][]byte, 0, len(result.Messages))
+	ids := make([]string, 0, len(result.Messages))
+	for _, message := range result.Messages {
+		recordBytes, err := json.Marshal(s.record(result.Stream, message))
+		if err != nil {
+			return fmt.Errorf("failed to marshal record: %w", err)
+		}
+		records = append(records, recordBytes)
+		ids = append(ids, message.ID)
+	}
+
+	err := n.PublishRecords(ctx, js, n.DestinationRecord{
+		PipelineID: pipelineID,
+		Records:    records,
+		Stream:     result.Stream,
+		PrimaryKey: s.primaryKey,
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := client.XAck(ctx, result.Stream, group, ids...).Err(); err != nil {
+		return fmt.Errorf("failed to ack %d entries on %s: %w", len(ids), result.Stream, err)
+	}
+	return nil
+}
+
+// record turns a stream entry into a record. Entry fields become record
+// fields, unless value_field names a field holding a JSON object.
+func (s *Redis) record(stream string, message redis.XMessage) map[string]interface{} {
+	var record map[string]interface{}
+	if s.valueField != "" {
+		raw, _ := message.Values[s.valueField].(string)
+		decoder := json.NewDecoder(bytes.NewReader([]byte(raw)))
+		decoder.UseNumber()
+		if err := decoder.Decode(&record); err != nil {
+			// Keeping the raw fields lets a malformed entry through instead
+			// of blocking the stream behind it.
+			log.Printf("Entry %s on %s has no JSON object in %s: %v", message.ID, stream, s.valueField, err)
+			record = nil
+		}
+	}
+	if record == nil {
+		record = make(map[string]interface{}, len(message.Values))
+		for field, value := range message.Values {
+			record[field] = value
+		}
+	}
+
+	if s.includeMetadata {
+		record["_redis"] = map[string]interface{}{
+			"stream": stream,
+			"id":     message.ID,
+		}
+	}
+	return record
+}
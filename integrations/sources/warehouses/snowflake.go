@@ -3,260 +3,456 @@ package sources
 import (
 	"context"
 	"database/sql"
-	"encoding/json"
-	"errors"
+	"dataforge-be/integrations/connection"
+	"dataforge-be/integrations/sources/models"
+	n "dataforge-be/nats"
 	"fmt"
 	"log"
+	"path"
 	"strings"
 	"time"
 
 	"github.com/nats-io/nats.go/jetstream"
-	_ "github.com/snowflakedb/gosnowflake"
+	sf "github.com/snowflakedb/gosnowflake"
 )
 
 const (
 	snowflakeID = "snowflake"
+
+	defaultReadyTimeout    = 5 * time.Minute
+	defaultPollInterval    = time.Minute
+	defaultSchema          = "PUBLIC"
+	defaultDataforgeSchema = "DATAFORGE"
+	defaultTargetLag       = "1 minutes"
+	defaultObjectPrefix    = "DF_"
 )
 
 type Snowflake struct {
-	conn        *sql.DB
-	isStreaming bool
-	DbName      string
-	WHName      string
-	js          jetstream.JetStream
+	conn            *sql.DB
+	isStreaming     bool
+	isContinuous    bool
+	readyTimeout    time.Duration
+	pollInterval    time.Duration
+	DbName          string
+	WHName          string
+	schemas         []string
+	includes        []string
+	excludes        []string
+	dataforgeSchema string
+	objectPrefix    string
+	targetLag       string
+	pipelineID      int64
+	models          []models.Model
+	js              jetstream.JetStream
+}
+
+type snowflakeTable struct {
+	Schema string
+	Name   string
 }
 
 func (s *Snowflake) Initialize(config map[string]interface{}) error {
-	snowflakeUsername := config["username"].(string)
-	snowflakePassword := config["password"].(string)
-	snowflakeAcc := config["acc"].(string)
-	snowflakeOrg := config["org"].(string)
 	snowflakeDB := config["db"].(string)
 	snowflakeWH := config["wh"].(string)
-	snowflakeIsStream := config["stream"].(bool)
-	snowflakeURL := fmt.Sprintf("%s:%s@%s-%s/%s?warehouse=%s", snowflakeUsername, snowflakePassword, snowflakeAcc, snowflakeOrg, snowflakeDB, snowflakeWH)
-	db, err := sql.Open("snowflake", snowflakeURL)
+	snowflakeIsStream, _ := config["stream"].(bool)
+	snowflakeIsContinuous, _ := config["continuous"].(bool)
+
+	cfg, err := SnowflakeConfig(config)
 	if err != nil {
-		panic(err)
+		return fmt.Errorf("invalid snowflake config: %w", err)
 	}
+	db := sql.OpenDB(sf.NewConnector(sf.SnowflakeDriver{}, *cfg))
 	s.conn = db
 	s.isStreaming = snowflakeIsStream
+	s.isContinuous = snowflakeIsContinuous
+	s.readyTimeout = durationFromConfig(config, "ready_timeout_seconds", defaultReadyTimeout)
+	s.pollInterval = durationFromConfig(config, "poll_interval_seconds", defaultPollInterval)
 	s.DbName = snowflakeDB
 	s.WHName = snowflakeWH
+
+	s.schemas = connection.StringsFromConfig(config, "schemas")
+	if len(s.schemas) == 0 {
+		s.schemas = []string{defaultSchema}
+	}
+	s.includes = connection.StringsFromConfig(config, "include")
+	s.excludes = connection.StringsFromConfig(config, "exclude")
+
+	s.dataforgeSchema, _ = config["dataforge_schema"].(string)
+	if s.dataforgeSchema == "" {
+		s.dataforgeSchema = defaultDataforgeSchema
+	}
+	s.objectPrefix, _ = config["object_prefix"].(string)
+	if s.objectPrefix == "" {
+		s.objectPrefix = defaultObjectPrefix
+	}
+	s.targetLag, _ = config["target_lag"].(string)
+	if s.targetLag == "" {
+		s.targetLag = defaultTargetLag
+	}
+
+	s.models, err = models.ModelsFromConfig(config)
+	if err != nil {
+		return err
+	}
 	return nil
 }
 
+func durationFromConfig(config map[string]interface{}, key string, fallback time.Duration) time.Duration {
+	seconds, ok := config[key].(float64)
+	if !ok || seconds <= 0 {
+		return fallback
+	}
+	return time.Duration(seconds * float64(time.Second))
+}
+
+// Close releases the connection pool opened by Initialize.
+func (s *Snowflake) Close() error {
+	if s.conn == nil {
+		return nil
+	}
+	return s.conn.Close()
+}
+
 func (s *Snowflake) SourceID() string {
 	return snowflakeID
 }
 
 func (s *Snowflake) Run(ctx context.Context, pipelineID int64, js jetstream.JetStream) error {
 	s.js = js
+	s.pipelineID = pipelineID
+
+	// since is taken once the dynamic tables and their streams exist: the
+	// refresh that initializes a table on creation lands before its stream
+	// does, so only later refreshes put changes in the stream.
+	var since time.Time
 	var err error
 	if s.isStreaming {
-		err = s.HandleInWarehouseDiffing()
+		err = s.HandleInWarehouseDiffing(ctx)
 		if err != nil {
 			return err
 		}
-		time.Sleep(time.Minute * 2)
-		err = s.HandleStreaming(ctx, pipelineID)
+		since, err = s.currentTimestamp(ctx)
 		if err != nil {
 			return err
 		}
 	}
-	return err
+
+	for {
+		if s.isStreaming {
+			ready, err := s.waitForStreams(ctx, since)
+			if err != nil {
+				return err
+			}
+			if !ready && !s.isContinuous {
+				return fmt.Errorf("dynamic tables were not refreshed within %s", s.readyTimeout)
+			}
+
+			if ready {
+				since, err = s.currentTimestamp(ctx)
+				if err != nil {
+					return err
+				}
+				err = s.HandleStreaming(ctx, pipelineID)
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		err = s.syncModels(ctx, pipelineID)
+		if err != nil {
+			return err
+		}
+
+		if !s.isContinuous {
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(s.pollInterval):
+		}
+	}
 }
 
-func sendBatch(pipelineID int64, batch [][]byte, js jetstream.JetStream, ctx context.Context) error {
-	requestBody := map[string]interface{}{
-		"pipeline_id": pipelineID,
-		"records":     batch,
+func (s *Snowflake) currentTimestamp(ctx context.Context) (time.Time, error) {
+	var now time.Time
+	err := s.conn.QueryRowContext(ctx, "SELECT CURRENT_TIMESTAMP()").Scan(&now)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("failed to fetch current timestamp: %w", err)
 	}
+	return now, nil
+}
 
-	destRecordBytes, err := json.Marshal(requestBody)
+// waitForStreams polls until every dynamic table has completed a refresh after
+// since, or its stream already has data. It returns false if readyTimeout
+// elapses first.
+func (s *Snowflake) waitForStreams(ctx context.Context, since time.Time) (bool, error) {
+	tables, err := s.fetchTablesInDB()
 	if err != nil {
-		return fmt.Errorf("failed to marshal request body: %v", err)
+		return false, err
+	}
+
+	pending := make(map[snowflakeTable]bool)
+	for _, table := range tables {
+		pending[table] = true
 	}
-	ack, err := js.Publish(ctx, "OUTPUT", destRecordBytes)
+
+	deadline := time.Now().Add(s.readyTimeout)
+	for {
+		for table := range pending {
+			ready, err := s.isStreamReady(ctx, table, since)
+			if err != nil {
+				return false, err
+			}
+			if ready {
+				delete(pending, table)
+			}
+		}
+
+		if len(pending) == 0 {
+			return true, nil
+		}
+
+		wait := s.pollInterval
+		if remaining := time.Until(deadline); remaining <= 0 {
+			log.Printf("Timed out waiting for dynamic tables to refresh: %d pending", len(pending))
+			return false, nil
+		} else if remaining < wait {
+			wait = remaining
+		}
+
+		select {
+		case <-ctx.Done():
+			return false, ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
+func (s *Snowflake) isStreamReady(ctx context.Context, table snowflakeTable, since time.Time) (bool, error) {
+	streamName := s.streamName(table)
+	var hasData bool
+	err := s.conn.QueryRowContext(ctx, "SELECT SYSTEM$STREAM_HAS_DATA(?)", streamName).Scan(&hasData)
 	if err != nil {
-		return fmt.Errorf("failed to publish message to OUTPUT subject: %w", err)
+		return false, fmt.Errorf("failed to check stream %s for data: %w", streamName, err)
 	}
-	log.Printf("Message published to OUTPUT subject. Ack: Stream=%s, Seq=%d", ack.Stream, ack.Sequence)
-	return nil
+	if hasData {
+		return true, nil
+	}
+
+	dynamicTableName := s.dynamicTableName(table)
+	refreshHistoryQuery := fmt.Sprintf(`SELECT COUNT(*)
+	FROM TABLE(%s.INFORMATION_SCHEMA.DYNAMIC_TABLE_REFRESH_HISTORY(NAME => ?))
+	WHERE STATE = 'SUCCEEDED' AND REFRESH_END_TIME > ?`, s.DbName)
+	var refreshes int
+	err = s.conn.QueryRowContext(ctx, refreshHistoryQuery, dynamicTableName, since).Scan(&refreshes)
+	if err != nil {
+		return false, fmt.Errorf("failed to fetch refresh history for %s: %w", dynamicTableName, err)
+	}
+	return refreshes > 0, nil
 }
 
+func sendBatch(pipelineID int64, batch [][]byte, js jetstream.JetStream, ctx context.Context) error {
+	return n.PublishRecords(ctx, js, n.DestinationRecord{
+		PipelineID: pipelineID,
+		Records:    batch,
+	})
+}
+
+// HandleStreaming publishes the changes waiting in every table's stream.
+// Selecting from a stream does not move its offset; only a DML statement in
+// a committed transaction does. So each stream is copied into a temporary
+// table inside a transaction that commits once its records are published,
+// and a failed publish leaves the changes in the stream for the next pass.
 func (s *Snowflake) HandleStreaming(ctx context.Context, pipelineID int64) error {
 	tables, err := s.fetchTablesInDB()
 	if err != nil {
 		return fmt.Errorf("failed to fetch tables: %v", err)
 	}
 
-	for _, tableName := range tables {
-		if s.isDynamicTable(tableName) {
-			fmt.Printf("Skipping dynamic table: %s\n", tableName)
-			continue
-		}
-		streamName := fmt.Sprintf("%s.PUBLIC.%s_STREAM", s.DbName, tableName)
-		query := fmt.Sprintf("SELECT * FROM %s", streamName)
-		rows, err := s.conn.QueryContext(ctx, query)
-		if err != nil {
-			return fmt.Errorf("failed to query stream %s: %v", streamName, err)
-		}
-		defer rows.Close()
+	// Temporary tables belong to the session, so every statement runs on
+	// one connection.
+	conn, err := s.conn.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get connection: %w", err)
+	}
+	defer conn.Close()
 
-		columns, err := rows.Columns()
-		if err != nil {
-			return fmt.Errorf("failed to get columns for stream %s: %v", streamName, err)
-		}
+	changesTable := fmt.Sprintf("%s.%s.%s", s.DbName, quoteIdentifier(strings.ToUpper(s.dataforgeSchema)),
+		quoteIdentifier(strings.ToUpper(fmt.Sprintf("%s%d_CHANGES", s.objectPrefix, pipelineID))))
+	_, err = conn.ExecContext(ctx, fmt.Sprintf("CREATE TEMPORARY TABLE IF NOT EXISTS %s (RECORD VARIANT)", changesTable))
+	if err != nil {
+		return fmt.Errorf("failed to create changes table: %w", err)
+	}
 
-		values := make([]interface{}, len(columns))
-		scanArgs := make([]interface{}, len(columns))
-		for i := range values {
-			scanArgs[i] = &values[i]
+	for _, table := range tables {
+		if err := s.consumeStream(ctx, conn, pipelineID, s.streamName(table), changesTable); err != nil {
+			return err
 		}
+	}
+	return nil
+}
 
-		var batchSize = 100
-		var batch [][]byte
-
-		for rows.Next() {
-			if err := rows.Scan(scanArgs...); err != nil {
-				return fmt.Errorf("failed to scan row: %v", err)
-			}
+func (s *Snowflake) consumeStream(ctx context.Context, conn *sql.Conn, pipelineID int64, streamName, changesTable string) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction for stream %s: %w", streamName, err)
+	}
+	defer tx.Rollback()
 
-			record := make(map[string]interface{})
-			for i, col := range columns {
-				val := values[i]
-				record[col] = val
-			}
+	_, err = tx.ExecContext(ctx, fmt.Sprintf("DELETE FROM %s", changesTable))
+	if err != nil {
+		return fmt.Errorf("failed to clear changes table: %w", err)
+	}
+	_, err = tx.ExecContext(ctx, fmt.Sprintf("INSERT INTO %s SELECT OBJECT_CONSTRUCT_KEEP_NULL(*) FROM %s", changesTable, streamName))
+	if err != nil {
+		return fmt.Errorf("failed to consume stream %s: %w", streamName, err)
+	}
 
-			jsonData, err := json.Marshal(record)
-			if err != nil {
-				return fmt.Errorf("failed to marshal record: %v", err)
-			}
+	rows, err := tx.QueryContext(ctx, fmt.Sprintf("SELECT RECORD FROM %s", changesTable))
+	if err != nil {
+		return fmt.Errorf("failed to query changes of stream %s: %w", streamName, err)
+	}
+	defer rows.Close()
 
-			batch = append(batch, jsonData)
+	var batchSize = 100
+	var batch [][]byte
 
-			if len(batch) >= batchSize {
-				if err := sendBatch(pipelineID, batch, s.js, ctx); err != nil {
-					return err
-				}
-				batch = nil
-			}
+	for rows.Next() {
+		var record string
+		if err := rows.Scan(&record); err != nil {
+			return fmt.Errorf("failed to scan row: %v", err)
 		}
+		batch = append(batch, []byte(record))
 
-		if len(batch) > 0 {
+		if len(batch) >= batchSize {
 			if err := sendBatch(pipelineID, batch, s.js, ctx); err != nil {
 				return err
 			}
+			batch = nil
 		}
+	}
+	if err = rows.Err(); err != nil {
+		return fmt.Errorf("error during row iteration: %v", err)
+	}
+	rows.Close()
 
-		if err = rows.Err(); err != nil {
-			return fmt.Errorf("error during row iteration: %v", err)
-		}
-
-		err = s.handleStreamDeletionAndRecreation()
-		if err != nil {
+	if len(batch) > 0 {
+		if err := sendBatch(pipelineID, batch, s.js, ctx); err != nil {
 			return err
 		}
 	}
 
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit stream %s: %w", streamName, err)
+	}
 	return nil
 }
 
-func (s *Snowflake) handleStreamDeletionAndRecreation() error {
-	tables, err := s.fetchTablesInDB()
-	if err != nil {
-		return err
-	}
+func quoteIdentifier(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
 
-	deleteStreamQuery := `DROP STREAM %s;`
-	streamOnDynamicTableQuery := `CREATE OR REPLACE STREAM %s ON DYNAMIC TABLE %s;`
+func (s *Snowflake) tableName(table snowflakeTable) string {
+	return fmt.Sprintf("%s.%s.%s", s.DbName, quoteIdentifier(table.Schema), quoteIdentifier(table.Name))
+}
 
-	fmt.Println("Fetched Tables:", tables)
+func (s *Snowflake) object(objectType string, table snowflakeTable, suffix string) warehouseObject {
+	return warehouseObject{
+		Type:     objectType,
+		Database: strings.ToUpper(s.DbName),
+		Schema:   strings.ToUpper(s.dataforgeSchema),
+		Name:     strings.ToUpper(fmt.Sprintf("%s%d_%s_%s_%s", s.objectPrefix, s.pipelineID, table.Schema, table.Name, suffix)),
+	}
+}
 
-	for _, tableName := range tables {
-		if s.isDynamicTable(tableName) {
-			fmt.Printf("Skipping dynamic table: %s\n", tableName)
-			continue
-		}
+func (s *Snowflake) dynamicTableName(table snowflakeTable) string {
+	return s.object(objectDynamicTable, table, "DYNAMIC").String()
+}
 
-		deleteQuery := fmt.Sprintf(deleteStreamQuery, fmt.Sprintf("%s.PUBLIC.%s_STREAM", s.DbName, tableName))
-		fmt.Println("Executing:", deleteQuery)
-		_, err := s.conn.Exec(deleteQuery)
-		if err != nil {
-			return fmt.Errorf("failed to delete stream: %v", err)
-		}
+func (s *Snowflake) streamName(table snowflakeTable) string {
+	return s.object(objectStream, table, "STREAM").String()
+}
 
-		streamQuery := fmt.Sprintf(streamOnDynamicTableQuery, fmt.Sprintf("%s.PUBLIC.%s", s.DbName, fmt.Sprintf("%s_STREAM", tableName)), fmt.Sprintf("%s.PUBLIC.%s", s.DbName, fmt.Sprintf("%s_DYNAMIC", tableName)))
-		fmt.Println("Executing:", streamQuery)
-		_, err = s.conn.Exec(streamQuery)
-		if err != nil {
-			return fmt.Errorf("failed to create stream: %v", err)
-		}
+func (s *Snowflake) isTableSelected(table snowflakeTable) bool {
+	if strings.EqualFold(table.Schema, s.dataforgeSchema) {
+		return false
 	}
-
-	return nil
+	if len(s.includes) > 0 && !matchesAny(s.includes, table) {
+		return false
+	}
+	return !matchesAny(s.excludes, table)
 }
 
-func (s *Snowflake) isDynamicTable(tableName string) bool {
-	return strings.Contains(tableName, "_DYNAMIC")
+// matchesAny reports whether table matches one of the glob patterns, either as
+// TABLE or SCHEMA.TABLE. Matching is case-insensitive.
+func matchesAny(patterns []string, table snowflakeTable) bool {
+	qualified := strings.ToUpper(fmt.Sprintf("%s.%s", table.Schema, table.Name))
+	name := strings.ToUpper(table.Name)
+	for _, pattern := range patterns {
+		pattern = strings.ToUpper(pattern)
+		if ok, _ := path.Match(pattern, qualified); ok {
+			return true
+		}
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
 }
 
-func (s *Snowflake) fetchTablesInDB() ([]string, error) {
-	_, err := s.conn.Exec("USE INITDB")
-	if err != nil {
-		return nil, err
+func (s *Snowflake) fetchTablesInDB() ([]snowflakeTable, error) {
+	schemas := make([]string, len(s.schemas))
+	args := make([]interface{}, len(s.schemas))
+	for i, schema := range s.schemas {
+		schemas[i] = "?"
+		args[i] = strings.ToUpper(schema)
 	}
-	rows, err := s.conn.Query("SHOW TABLES")
+
+	query := fmt.Sprintf(`SELECT TABLE_SCHEMA, TABLE_NAME
+	FROM %s.INFORMATION_SCHEMA.TABLES
+	WHERE TABLE_TYPE = 'BASE TABLE' AND UPPER(TABLE_SCHEMA) IN (%s)
+	ORDER BY TABLE_SCHEMA, TABLE_NAME`, s.DbName, strings.Join(schemas, ", "))
+	rows, err := s.conn.Query(query, args...)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	columns, err := rows.Columns()
-	if err != nil {
-		log.Fatal("Error getting columns:", err)
-	}
-	var tableNames []string
-
+	var tables []snowflakeTable
 	for rows.Next() {
-		columnsData := make([]interface{}, len(columns))
-		for i := range columnsData {
-			columnsData[i] = new(interface{})
-		}
-
-		err := rows.Scan(columnsData...)
-		if err != nil {
+		var table snowflakeTable
+		if err := rows.Scan(&table.Schema, &table.Name); err != nil {
 			return nil, err
 		}
-
-		for i, col := range columnsData {
-			if columns[i] == "name" {
-				tableName, ok := (*(col.(*interface{}))).(string)
-				if ok {
-					tableNames = append(tableNames, tableName)
-				} else {
-					return nil, errors.New("error type assertion to string")
-				}
-			}
+		if s.isTableSelected(table) {
+			tables = append(tables, table)
 		}
 	}
 
 	if err := rows.Err(); err != nil {
-		log.Fatal("Error with row iteration:", err)
+		return nil, err
 	}
 
-	return tableNames, nil
+	return tables, nil
 }
 
-func (s *Snowflake) HandleInWarehouseDiffing() error {
+func (s *Snowflake) HandleInWarehouseDiffing(ctx context.Context) error {
 	tables, err := s.fetchTablesInDB()
 	if err != nil {
 		return err
 	}
 
+	schemaCreationQuery := `CREATE SCHEMA IF NOT EXISTS %s.%s;`
+	_, err = s.conn.ExecContext(ctx, fmt.Sprintf(schemaCreationQuery, s.DbName, quoteIdentifier(strings.ToUpper(s.dataforgeSchema))))
+	if err != nil {
+		return fmt.Errorf("failed to create dataforge schema: %w", err)
+	}
+
 	dynamicTableCreationQuery := `CREATE OR REPLACE DYNAMIC TABLE %s
-	TARGET_LAG = '1 minutes'
+	TARGET_LAG = '%s'
 	WAREHOUSE = %s
 	REFRESH_MODE = auto
 	INITIALIZE = on_create
@@ -264,14 +460,19 @@ func (s *Snowflake) HandleInWarehouseDiffing() error {
 	  SELECT * FROM %s;`
 
 	streamOnDynamicTableQuery := `CREATE OR REPLACE STREAM %s ON DYNAMIC TABLE %s;`
-	for _, i := range tables {
-		query := fmt.Sprintf(dynamicTableCreationQuery, fmt.Sprintf("%s_DYNAMIC", i), s.WHName, fmt.Sprintf("%s.PUBLIC.%s", s.DbName, i))
+	for _, table := range tables {
+		err = s.trackObjects(ctx, s.object(objectDynamicTable, table, "DYNAMIC"), s.object(objectStream, table, "STREAM"))
+		if err != nil {
+			return err
+		}
+
+		query := fmt.Sprintf(dynamicTableCreationQuery, s.dynamicTableName(table), strings.ReplaceAll(s.targetLag, "'", ""), s.WHName, s.tableName(table))
 		_, err := s.conn.Exec(query)
 		if err != nil {
 			return err
 		}
 
-		streamQuery := fmt.Sprintf(streamOnDynamicTableQuery, fmt.Sprintf("%s.PUBLIC.%s", s.DbName, fmt.Sprintf("%s_STREAM", i)), fmt.Sprintf("%s.PUBLIC.%s", s.DbName, fmt.Sprintf("%s_DYNAMIC", i)))
+		streamQuery := fmt.Sprintf(streamOnDynamicTableQuery, s.streamName(table), s.dynamicTableName(table))
 		_, err = s.conn.Exec(streamQuery)
 		if err != nil {
 			return err
@@ -0,0 +1,137 @@
+package sources
+
+import (
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	sf "github.com/snowflakedb/gosnowflake"
+	"github.com/youmark/pkcs8"
+)
+
+const (
+	authPassword = "password"
+	authKeyPair  = "key_pair"
+	authOAuth    = "oauth"
+)
+
+// SnowflakeConfig builds the connection settings shared by the Snowflake
+// source and destination.
+func SnowflakeConfig(config map[string]interface{}) (*sf.Config, error) {
+	user, _ := config["username"].(string)
+	database, _ := config["db"].(string)
+	warehouse, _ := config["wh"].(string)
+	role, _ := config["role"].(string)
+	region, _ := config["region"].(string)
+	host, _ := config["host"].(string)
+
+	account, err := snowflakeAccount(config)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg := &sf.Config{
+		Account:   account,
+		User:      user,
+		Database:  database,
+		Warehouse: warehouse,
+		Role:      role,
+		Region:    region,
+		Host:      host,
+	}
+
+	authType, _ := config["auth_type"].(string)
+	switch strings.ToLower(authType) {
+	case "", authPassword:
+		password, _ := config["password"].(string)
+		if user == "" || password == "" {
+			return nil, errors.New("password auth requires username and password")
+		}
+		cfg.Authenticator = sf.AuthTypeSnowflake
+		cfg.Password = password
+	case authKeyPair:
+		if user == "" {
+			return nil, errors.New("key pair auth requires username")
+		}
+		privateKey, err := snowflakePrivateKey(config)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Authenticator = sf.AuthTypeJwt
+		cfg.PrivateKey = privateKey
+	case authOAuth:
+		token, _ := config["token"].(string)
+		if token == "" {
+			return nil, errors.New("oauth auth requires token")
+		}
+		cfg.Authenticator = sf.AuthTypeOAuth
+		cfg.Token = token
+	default:
+		return nil, fmt.Errorf("unsupported snowflake auth type: %s", authType)
+	}
+
+	return cfg, nil
+}
+
+// snowflakeAccount accepts either a full account identifier (orgname-account,
+// or an account locator such as xy12345 / xy12345.us-east-2.aws) or the
+// legacy acc and org pair.
+func snowflakeAccount(config map[string]interface{}) (string, error) {
+	if account, _ := config["account"].(string); account != "" {
+		return account, nil
+	}
+
+	acc, _ := config["acc"].(string)
+	org, _ := config["org"].(string)
+	if acc == "" || org == "" {
+		return "", errors.New("snowflake account is required")
+	}
+	return fmt.Sprintf("%s-%s", acc, org), nil
+}
+
+func snowflakePrivateKey(config map[string]interface{}) (*rsa.PrivateKey, error) {
+	keyPEM, _ := config["private_key"].(string)
+	if keyPath, _ := config["private_key_path"].(string); keyPEM == "" && keyPath != "" {
+		keyBytes, err := os.ReadFile(keyPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read private key: %w", err)
+		}
+		keyPEM = string(keyBytes)
+	}
+	if keyPEM == "" {
+		return nil, errors.New("key pair auth requires private_key or private_key_path")
+	}
+
+	block, _ := pem.Decode([]byte(keyPEM))
+	if block == nil {
+		return nil, errors.New("failed to decode private key PEM")
+	}
+
+	passphrase, _ := config["private_key_passphrase"].(string)
+	var key interface{}
+	var err error
+	switch block.Type {
+	case "ENCRYPTED PRIVATE KEY":
+		if passphrase == "" {
+			return nil, errors.New("private key is encrypted but no passphrase was given")
+		}
+		key, err = pkcs8.ParsePKCS8PrivateKey(block.Bytes, []byte(passphrase))
+	case "RSA PRIVATE KEY":
+		key, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	default:
+		key, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse private key: %w", err)
+	}
+
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("private key is not an RSA key")
+	}
+	return rsaKey, nil
+}
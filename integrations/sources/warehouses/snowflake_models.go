@@ -0,0 +1,14 @@
+package sources
+
+import (
+	"context"
+	"dataforge-be/integrations/sources/models"
+)
+
+func (s *Snowflake) syncModels(ctx context.Context, pipelineID int64) error {
+	return models.SyncModels(ctx, s.conn, models.QuestionMarkDialect, s.js, pipelineID, s.models)
+}
+
+func (s *Snowflake) Preview(ctx context.Context, query string, limit int) (*models.Preview, error) {
+	return models.RunPreview(ctx, s.conn, query, limit)
+}
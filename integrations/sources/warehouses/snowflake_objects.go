@@ -0,0 +1,187 @@
+package sources
+
+import (
+	"context"
+	n "dataforge-be/nats"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+const (
+	objectDynamicTable = "DYNAMIC TABLE"
+	objectStream       = "STREAM"
+
+	warehouseObjectsState = "objects"
+)
+
+type warehouseObject struct {
+	Type     string `json:"type"`
+	Database string `json:"database"`
+	Schema   string `json:"schema"`
+	Name     string `json:"name"`
+}
+
+func (o warehouseObject) String() string {
+	return fmt.Sprintf("%s.%s.%s", quoteIdentifier(o.Database), quoteIdentifier(o.Schema), quoteIdentifier(o.Name))
+}
+
+func (o warehouseObject) key() string {
+	return strings.ToUpper(fmt.Sprintf("%s|%s.%s.%s", o.Type, o.Database, o.Schema, o.Name))
+}
+
+func (s *Snowflake) trackedObjects(ctx context.Context, pipelineID int64) ([]warehouseObject, error) {
+	var objects []warehouseObject
+	_, err := n.GetPipelineState(ctx, s.js, pipelineID, warehouseObjectsState, &objects)
+	if err != nil {
+		return nil, err
+	}
+	return objects, nil
+}
+
+func (s *Snowflake) trackObjects(ctx context.Context, created ...warehouseObject) error {
+	objects, err := s.trackedObjects(ctx, s.pipelineID)
+	if err != nil {
+		return err
+	}
+
+	known := make(map[string]bool)
+	for _, object := range objects {
+		known[object.key()] = true
+	}
+
+	changed := false
+	for _, object := range created {
+		if !known[object.key()] {
+			objects = append(objects, object)
+			known[object.key()] = true
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+
+	return n.PutPipelineState(ctx, s.js, s.pipelineID, warehouseObjectsState, objects)
+}
+
+// Teardown drops every warehouse object recorded for the pipeline. Streams are
+// dropped before the dynamic tables they read from.
+func (s *Snowflake) Teardown(ctx context.Context, pipelineID int64, js jetstream.JetStream) error {
+	s.js = js
+	objects, err := s.trackedObjects(ctx, pipelineID)
+	if err != nil {
+		return err
+	}
+
+	for _, objectType := range []string{objectStream, objectDynamicTable} {
+		for _, object := range objects {
+			if object.Type != objectType {
+				continue
+			}
+			if err := s.dropObject(ctx, object); err != nil {
+				return err
+			}
+		}
+	}
+
+	return n.DeletePipelineState(ctx, js, pipelineID, warehouseObjectsState)
+}
+
+// Reconcile lists objects in the dataforge schema that no live pipeline has
+// recorded, dropping them when drop is set.
+func (s *Snowflake) Reconcile(ctx context.Context, livePipelineIDs []int64, js jetstream.JetStream, drop bool) ([]string, error) {
+	s.js = js
+	tracked := make(map[string]bool)
+	for _, pipelineID := range livePipelineIDs {
+		objects, err := s.trackedObjects(ctx, pipelineID)
+		if err != nil {
+			return nil, err
+		}
+		for _, object := range objects {
+			tracked[object.key()] = true
+		}
+	}
+
+	var orphans []string
+	for _, objectType := range []string{objectStream, objectDynamicTable} {
+		objects, err := s.listObjects(ctx, objectType)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, object := range objects {
+			if tracked[object.key()] || !strings.HasPrefix(object.Name, strings.ToUpper(s.objectPrefix)) {
+				continue
+			}
+			orphans = append(orphans, object.String())
+			if drop {
+				if err := s.dropObject(ctx, object); err != nil {
+					return orphans, err
+				}
+			}
+		}
+	}
+
+	return orphans, nil
+}
+
+func (s *Snowflake) dropObject(ctx context.Context, object warehouseObject) error {
+	query := fmt.Sprintf("DROP %s IF EXISTS %s;", object.Type, object.String())
+	log.Println("Executing:", query)
+	_, err := s.conn.ExecContext(ctx, query)
+	if err != nil {
+		return fmt.Errorf("failed to drop %s %s: %w", strings.ToLower(object.Type), object, err)
+	}
+	return nil
+}
+
+func (s *Snowflake) listObjects(ctx context.Context, objectType string) ([]warehouseObject, error) {
+	query := fmt.Sprintf("SHOW %sS IN SCHEMA %s.%s", objectType, s.DbName, quoteIdentifier(strings.ToUpper(s.dataforgeSchema)))
+	rows, err := s.conn.QueryContext(ctx, query)
+	if err != nil {
+		if strings.Contains(err.Error(), "does not exist") {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to list %ss: %w", strings.ToLower(objectType), err)
+	}
+	defer rows.Close()
+
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+
+	var objects []warehouseObject
+	for rows.Next() {
+		columnsData := make([]interface{}, len(columns))
+		for i := range columnsData {
+			columnsData[i] = new(interface{})
+		}
+
+		if err := rows.Scan(columnsData...); err != nil {
+			return nil, err
+		}
+
+		object := warehouseObject{Type: objectType}
+		for i, col := range columnsData {
+			value, _ := (*(col.(*interface{}))).(string)
+			switch columns[i] {
+			case "name":
+				object.Name = value
+			case "database_name":
+				object.Database = value
+			case "schema_name":
+				object.Schema = value
+			}
+		}
+		objects = append(objects, object)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return objects, nil
+}
@@ -3,10 +3,18 @@ package integrations
 import (
 	"context"
 	"dataforge-be/integrations/destinations/apps"
+	"dataforge-be/integrations/destinations/databases"
+	"dataforge-be/integrations/destinations/files"
 	storage "dataforge-be/integrations/destinations/storage"
+	stream_destinations "dataforge-be/integrations/destinations/streams"
 	app_sources "dataforge-be/integrations/sources/apps"
+	database_sources "dataforge-be/integrations/sources/databases"
+	file_sources "dataforge-be/integrations/sources/files"
+	"dataforge-be/integrations/sources/models"
+	stream_sources "dataforge-be/integrations/sources/streams"
 	warehouse_sources "dataforge-be/integrations/sources/warehouses"
 	"dataforge-be/nats"
+	"net/http"
 
 	"github.com/nats-io/nats.go/jetstream"
 )
@@ -17,16 +25,63 @@ type Source interface {
 	Run(ctx context.Context, pipelineID int64, os jetstream.JetStream) error
 }
 
+type Teardown interface {
+	Teardown(ctx context.Context, pipelineID int64, js jetstream.JetStream) error
+}
+
+type Reconciler interface {
+	Reconcile(ctx context.Context, livePipelineIDs []int64, js jetstream.JetStream, drop bool) ([]string, error)
+}
+
+type Previewer interface {
+	Preview(ctx context.Context, query string, limit int) (*models.Preview, error)
+}
+
+// Ingester is implemented by push sources whose records arrive over HTTP
+// instead of being pulled by Run.
+type Ingester interface {
+	Stream() string
+	PrimaryKey() []string
+	MaxBodyBytes() int64
+	VerifyRequest(header http.Header, body []byte) error
+	// AllowsQueryToken reports whether the ingest token may be sent in the
+	// URL rather than a header.
+	AllowsQueryToken() bool
+}
+
 type Destination interface {
 	Initialize(config map[string]interface{}) error
 	DestinationID() string
 	Run(d nats.DestinationRecord) error
 }
 
+// Flusher is implemented by destinations that buffer writes. Flush returns
+// once everything passed to Run has been written.
+type Flusher interface {
+	Flush(ctx context.Context) error
+}
+
+// RunCompleter is implemented by destinations that finish a run's writes,
+// such as swapping in a rebuilt index, once the run's last batch is in.
+// CompleteRun is not called for a run with a batch that failed to deliver.
+type RunCompleter interface {
+	CompleteRun(ctx context.Context, pipelineID int64, run string) error
+}
+
 func FetchSources() map[string]Source {
 	return map[string]Source{
-		"snowflake": &warehouse_sources.Snowflake{},
-		"mongodb":   &app_sources.MongoDB{},
+		"snowflake":   &warehouse_sources.Snowflake{},
+		"mongodb":     &app_sources.MongoDB{},
+		"postgres":    &database_sources.Postgres{},
+		"mysql":       &database_sources.MySQL{},
+		"sql":         &database_sources.SQL{},
+		"mongodb_cdc": &database_sources.MongoDB{},
+		"webhook":     &app_sources.Webhook{},
+		"rest":        &app_sources.REST{},
+		"file":        &file_sources.File{},
+		"kafka":       &stream_sources.Kafka{},
+		"nats":        &stream_sources.NATS{},
+		"redis":       &stream_sources.Redis{},
 	}
 }
 
@@ -34,5 +89,12 @@ func FetchDestinations() map[string]Destination {
 	return map[string]Destination{
 		"algolia":       &apps.Algolia{},
 		"elasticsearch": &storage.ElasticSearch{},
+		"kafka":         &stream_destinations.Kafka{},
+		"redis":         &storage.Redis{},
+		"postgres":      &databases.Postgres{},
+		"mysql":         &databases.MySQL{},
+		"snowflake":     &databases.Snowflake{},
+		"file":          &files.File{},
+		"webhook":       &apps.Webhook{},
 	}
 }
@@ -4,8 +4,10 @@ import (
 	"context"
 	dataforgebe "dataforge-be/api"
 	"dataforge-be/db"
+	"dataforge-be/integrations"
 	"dataforge-be/integrations/destinations"
 	n "dataforge-be/nats"
+	"errors"
 	"log"
 	"net/http"
 	"os"
@@ -16,6 +18,12 @@ import (
 	"github.com/nats-io/nats.go/jetstream"
 )
 
+const (
+	// outputMaxDeliver is how many times an OUTPUT message is delivered
+	// before the destination consumer gives up on it.
+	outputMaxDeliver = 5
+)
+
 type Dataforge interface {
 	DBService() error
 	Nats() (*nats.Conn, error)
@@ -64,7 +72,7 @@ func (d *DataforgeService) NatsJS(nc *nats.Conn) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 	defer cancel()
 	kv, err := js.CreateKeyValue(ctx, jetstream.KeyValueConfig{
-		Bucket: "dataforge",
+		Bucket: n.KVBucket,
 	})
 
 	if err != nil {
@@ -83,7 +91,15 @@ func (d *DataforgeService) NatsJS(nc *nats.Conn) error {
 	}
 	d.os = os
 
-	log.Println("NATS KV, and Output stream initialized")
+	_, err = js.CreateOrUpdateObjectStore(context.Background(), jetstream.ObjectStoreConfig{
+		Bucket: n.SnapshotBucket,
+	})
+	if err != nil {
+		log.Fatal("Failed to create snapshot object store: ", err)
+		return err
+	}
+
+	log.Println("NATS KV, Output stream and snapshot store initialized")
 	return nil
 }
 
@@ -107,30 +123,67 @@ func RunApp(d Dataforge) *chi.Mux {
 	return d.APIService()
 }
 
+func reconcileWarehouseObjects(df *DataforgeService, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		orphans, err := integrations.ReconcileWarehouseObjects(context.Background(), df.db, df.js, false)
+		if err != nil {
+			log.Printf("Failed to reconcile warehouse objects: %v", err)
+			continue
+		}
+		for sourceID, objects := range orphans {
+			log.Printf("Source %d has %d orphaned warehouse objects: %v", sourceID, len(objects), objects)
+		}
+	}
+}
+
 func main() {
 	df := &DataforgeService{}
 
 	server := RunApp(df)
 
 	destinationsConsumer, err := df.os.CreateOrUpdateConsumer(context.Background(), jetstream.ConsumerConfig{
-		Durable:   "CONS",
-		AckPolicy: jetstream.AckExplicitPolicy,
+		Durable:    "CONS",
+		AckPolicy:  jetstream.AckExplicitPolicy,
+		AckWait:    n.OutputAckWait,
+		MaxDeliver: outputMaxDeliver,
 	})
 	if err != nil {
 		log.Fatalf("Failed to create or update consumer: %v", err)
 	}
 
 	_, err = destinationsConsumer.Consume(func(msg jetstream.Msg) {
-		msg.Ack()
-		err := destinations.HandleSendingToDestination(msg.Data(), df.db, df.kv)
+		delivery := n.Delivery{NumDelivered: 1}
+		if metadata, err := msg.Metadata(); err == nil {
+			delivery.Sequence = metadata.Sequence.Stream
+			delivery.NumDelivered = metadata.NumDelivered
+		}
+		delivery.Final = delivery.NumDelivered >= outputMaxDeliver
+		err := destinations.HandleSendingToDestination(msg.Data(), delivery, df.db, df.kv, df.js)
+
+		// A destination that asked to be retried later is redelivered once
+		// that time has passed. The message is not held here, since that
+		// would stall every other pipeline's batches behind it.
+		var retry *n.RetryAfterError
+		if errors.As(err, &retry) {
+			log.Printf("Failed to send message to destination: %v", err)
+			msg.NakWithDelay(retry.Delay)
+			return
+		}
 		if err != nil {
-			panic(err)
+			log.Printf("Failed to send message to destination: %v", err)
+			msg.NakWithDelay(5 * time.Second)
+			return
 		}
+		msg.Ack()
 	})
 	if err != nil {
 		log.Fatalf("Failed to consume messages: %v", err)
 	}
 
+	go reconcileWarehouseObjects(df, time.Hour)
+
 	if err := http.ListenAndServe(":3000", server); err != nil {
 		log.Fatalf("Failed to start server: %v", err)
 	}
@@ -0,0 +1,122 @@
+package nats
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+// OutputAckWait is how long the server waits for the destination consumer to
+// ack an OUTPUT message before delivering it again. Destinations keep the
+// work they do for one delivery well within it.
+const OutputAckWait = 30 * time.Second
+
+var (
+	// ErrRunPending is returned while a batch of the run is waiting to be
+	// redelivered.
+	ErrRunPending = errors.New("batches of the run are awaiting redelivery")
+	// ErrRunFailed is returned once a batch of the run has failed on its
+	// last delivery.
+	ErrRunFailed = errors.New("batches of the run failed to deliver")
+)
+
+// Delivery describes one attempt at delivering an OUTPUT message.
+type Delivery struct {
+	// Sequence is the message's stream sequence, the same on every attempt.
+	Sequence     uint64
+	NumDelivered uint64
+	// Final is set on the last attempt the consumer will make.
+	Final bool
+}
+
+// RetryAfterError is returned by a destination whose endpoint asked for the
+// batch to be sent again later, as with a 429 and a Retry-After header. The
+// consumer has the message delivered again after Delay, instead of its usual
+// backoff.
+type RetryAfterError struct {
+	Delay time.Duration
+	Err   error
+}
+
+func (e *RetryAfterError) Error() string {
+	return fmt.Sprintf("%v; retrying after %s", e.Err, e.Delay)
+}
+
+func (e *RetryAfterError) Unwrap() error {
+	return e.Err
+}
+
+// runDelivery is kept for a run once one of its batches fails: Retrying
+// holds the batches that failed and will be delivered again.
+type runDelivery struct {
+	Failed   bool     `json:"failed,omitempty"`
+	Retrying []uint64 `json:"retrying,omitempty"`
+}
+
+func deliveryState(run string) string {
+	return "delivery-" + run
+}
+
+// RecordDelivery notes the outcome of one attempt at delivering a batch of
+// run. A failure is only final on the last delivery; before that the batch
+// is tracked as retrying until a later attempt succeeds.
+func RecordDelivery(ctx context.Context, js jetstream.JetStream, pipelineID int64, run string, delivery Delivery, deliveryErr error) error {
+	// Nothing is stored for runs whose batches all succeed first time.
+	if deliveryErr == nil && delivery.NumDelivered <= 1 {
+		return nil
+	}
+
+	var state runDelivery
+	found, err := GetPipelineState(ctx, js, pipelineID, deliveryState(run), &state)
+	if err != nil {
+		return err
+	}
+	if deliveryErr == nil && !found {
+		return nil
+	}
+
+	retrying := state.Retrying[:0]
+	for _, sequence := range state.Retrying {
+		if sequence != delivery.Sequence {
+			retrying = append(retrying, sequence)
+		}
+	}
+	state.Retrying = retrying
+	switch {
+	case deliveryErr == nil:
+	case delivery.Final:
+		state.Failed = true
+	default:
+		state.Retrying = append(state.Retrying, delivery.Sequence)
+	}
+	return PutPipelineState(ctx, js, pipelineID, deliveryState(run), state)
+}
+
+// CheckRunDelivered returns nil when every batch of run delivered so far has
+// been written. It returns ErrRunPending while a batch is waiting to be
+// retried, unless delivery is the caller's own last attempt, in which case
+// the run is treated as failed.
+func CheckRunDelivered(ctx context.Context, js jetstream.JetStream, pipelineID int64, run string, delivery Delivery) error {
+	var state runDelivery
+	_, err := GetPipelineState(ctx, js, pipelineID, deliveryState(run), &state)
+	if err != nil {
+		return err
+	}
+	switch {
+	case state.Failed:
+		return ErrRunFailed
+	case len(state.Retrying) > 0 && delivery.Final:
+		return fmt.Errorf("%w: %d batches were still awaiting redelivery", ErrRunFailed, len(state.Retrying))
+	case len(state.Retrying) > 0:
+		return ErrRunPending
+	}
+	return nil
+}
+
+// ClearRunDelivery forgets what was recorded for run once it is finished.
+func ClearRunDelivery(ctx context.Context, js jetstream.JetStream, pipelineID int64, run string) error {
+	return DeletePipelineState(ctx, js, pipelineID, deliveryState(run))
+}
@@ -1,6 +1,24 @@
 package nats
 
-import "github.com/nats-io/nats.go"
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+const (
+	OutputSubject = "OUTPUT"
+
+	OperationInsert = "insert"
+	OperationUpdate = "update"
+	OperationDelete = "delete"
+)
 
 func NewNatsServer(url string) (*nats.Conn, error) {
 	nc, err := nats.Connect(url)
@@ -13,4 +31,79 @@ func NewNatsServer(url string) (*nats.Conn, error) {
 type DestinationRecord struct {
 	PipelineID int64    `json:"pipeline_id"`
 	Records    [][]byte `json:"records"`
+	Stream     string   `json:"stream,omitempty"`
+	PrimaryKey []string `json:"primary_key,omitempty"`
+	// Operation applies to every record in the batch. Empty means the
+	// records are plain rows to be written as they are.
+	Operation string `json:"operation,omitempty"`
+	// Partial marks updates that leave out columns whose values did not
+	// change, the same ones in every record of the batch. Destinations that
+	// replace whole records merge these into the ones they hold instead.
+	Partial bool `json:"partial,omitempty"`
+	// Snapshot is the diff run that produced the batch. The batch with
+	// Commit set is sent last, once every other batch of the run is out.
+	Snapshot string `json:"snapshot,omitempty"`
+	Commit   bool   `json:"commit,omitempty"`
+	// Run identifies the pipeline run that published the batch. Records
+	// ingested outside a run, such as through the ingest endpoint, have none.
+	Run string `json:"run,omitempty"`
+	// Complete carries no records: it follows the last batch of a run whose
+	// source finished on its own, rather than being stopped or failing.
+	Complete bool `json:"complete,omitempty"`
+	// Abandoned carries no records either: it follows the last batch of a
+	// run that was stopped or failed, so what was kept for the run can go.
+	Abandoned bool `json:"abandoned,omitempty"`
+}
+
+type runKey struct{}
+
+// WithRun tags ctx with a pipeline run so PublishRecords can stamp the
+// batches published under it.
+func WithRun(ctx context.Context, runID string) context.Context {
+	return context.WithValue(ctx, runKey{}, runID)
+}
+
+// RunFromContext returns the run set by WithRun, if any.
+func RunFromContext(ctx context.Context) string {
+	runID, _ := ctx.Value(runKey{}).(string)
+	return runID
+}
+
+// PrimaryKeyValue joins the record's primary key columns into a single ID.
+// It returns false if the record has no primary key.
+func PrimaryKeyValue(record map[string]interface{}, primaryKey []string) (string, bool) {
+	if len(primaryKey) == 0 {
+		return "", false
+	}
+
+	values := make([]string, len(primaryKey))
+	for i, column := range primaryKey {
+		value, ok := record[column]
+		if !ok || value == nil {
+			return "", false
+		}
+		if number, ok := value.(float64); ok {
+			values[i] = strconv.FormatFloat(number, 'f', -1, 64)
+		} else {
+			values[i] = fmt.Sprint(value)
+		}
+	}
+	return strings.Join(values, "-"), true
+}
+
+func PublishRecords(ctx context.Context, js jetstream.JetStream, record DestinationRecord) error {
+	if record.Run == "" {
+		record.Run = RunFromContext(ctx)
+	}
+	destRecordBytes, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("failed to marshal destination record: %w", err)
+	}
+
+	ack, err := js.Publish(ctx, OutputSubject, destRecordBytes)
+	if err != nil {
+		return fmt.Errorf("failed to publish message to OUTPUT subject: %w", err)
+	}
+	log.Printf("Message published to OUTPUT subject. Ack: Stream=%s, Seq=%d", ack.Stream, ack.Sequence)
+	return nil
 }
@@ -0,0 +1,94 @@
+// Package natstest runs an in-process JetStream server with the buckets and
+// streams the service creates at startup, for tests of code that publishes
+// records or keeps pipeline state.
+package natstest
+
+import (
+	"context"
+	n "dataforge-be/nats"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/nats-io/nats-server/v2/server"
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+const outputStream = "OUTPUTS"
+
+// JetStream starts a server that is shut down when the test ends.
+func JetStream(t testing.TB) jetstream.JetStream {
+	t.Helper()
+
+	ns, err := server.NewServer(&server.Options{
+		Host:      "127.0.0.1",
+		Port:      -1,
+		JetStream: true,
+		StoreDir:  t.TempDir(),
+		NoLog:     true,
+		NoSigs:    true,
+	})
+	if err != nil {
+		t.Fatalf("failed to create nats server: %v", err)
+	}
+	ns.Start()
+	if !ns.ReadyForConnections(10 * time.Second) {
+		t.Fatal("nats server did not start")
+	}
+	t.Cleanup(ns.Shutdown)
+
+	nc, err := nats.Connect(ns.ClientURL())
+	if err != nil {
+		t.Fatalf("failed to connect to nats: %v", err)
+	}
+	t.Cleanup(nc.Close)
+
+	js, err := jetstream.New(nc)
+	if err != nil {
+		t.Fatalf("failed to initialize JetStream: %v", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if _, err := js.CreateKeyValue(ctx, jetstream.KeyValueConfig{Bucket: n.KVBucket}); err != nil {
+		t.Fatalf("failed to create KeyValue store: %v", err)
+	}
+	if _, err := js.CreateOrUpdateStream(ctx, jetstream.StreamConfig{Name: outputStream, Subjects: []string{n.OutputSubject}}); err != nil {
+		t.Fatalf("failed to create output stream: %v", err)
+	}
+	if _, err := js.CreateOrUpdateObjectStore(ctx, jetstream.ObjectStoreConfig{Bucket: n.SnapshotBucket}); err != nil {
+		t.Fatalf("failed to create snapshot object store: %v", err)
+	}
+	return js
+}
+
+// Published returns every batch published to OUTPUT so far, in order.
+func Published(t testing.TB, js jetstream.JetStream) []n.DestinationRecord {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	stream, err := js.Stream(ctx, outputStream)
+	if err != nil {
+		t.Fatalf("failed to look up output stream: %v", err)
+	}
+	info, err := stream.Info(ctx)
+	if err != nil {
+		t.Fatalf("failed to read output stream info: %v", err)
+	}
+
+	var records []n.DestinationRecord
+	for sequence := info.State.FirstSeq; sequence <= info.State.LastSeq && info.State.Msgs > 0; sequence++ {
+		msg, err := stream.GetMsg(ctx, sequence)
+		if err != nil {
+			t.Fatalf("failed to read output message %d: %v", sequence, err)
+		}
+		var record n.DestinationRecord
+		if err := json.Unmarshal(msg.Data, &record); err != nil {
+			t.Fatalf("failed to decode output message %d: %v", sequence, err)
+		}
+		records = append(records, record)
+	}
+	return records
+}
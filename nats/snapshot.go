@@ -0,0 +1,154 @@
+package nats
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+const (
+	SnapshotBucket = "dataforge-snapshots"
+
+	snapshotState = "snapshot"
+)
+
+// Snapshot maps an encoded primary key to the hash of the row it identifies.
+type Snapshot map[string]uint64
+
+func snapshotPrefix(pipelineID int64, runID string) string {
+	return fmt.Sprintf("%d/%s/", pipelineID, runID)
+}
+
+func snapshotObjectName(pipelineID int64, runID, stream string) string {
+	return snapshotPrefix(pipelineID, runID) + stream
+}
+
+// LoadCommittedSnapshot returns the stream's snapshot from the pipeline's last
+// committed diff run, or an empty snapshot if there is none.
+func LoadCommittedSnapshot(ctx context.Context, js jetstream.JetStream, pipelineID int64, stream string) (Snapshot, error) {
+	var runID string
+	found, err := GetPipelineState(ctx, js, pipelineID, snapshotState, &runID)
+	if err != nil || !found {
+		return Snapshot{}, err
+	}
+
+	store, err := js.ObjectStore(ctx, SnapshotBucket)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open snapshot store: %w", err)
+	}
+
+	data, err := store.GetBytes(ctx, snapshotObjectName(pipelineID, runID, stream))
+	if errors.Is(err, jetstream.ErrObjectNotFound) {
+		return Snapshot{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get snapshot for %s: %w", stream, err)
+	}
+
+	snapshot := Snapshot{}
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return nil, fmt.Errorf("failed to decode snapshot for %s: %w", stream, err)
+	}
+	return snapshot, nil
+}
+
+// SavePendingSnapshot stores the stream's snapshot for runID. It is only read
+// back once CommitSnapshot has been called for the run.
+func SavePendingSnapshot(ctx context.Context, js jetstream.JetStream, pipelineID int64, runID, stream string, snapshot Snapshot) error {
+	store, err := js.ObjectStore(ctx, SnapshotBucket)
+	if err != nil {
+		return fmt.Errorf("failed to open snapshot store: %w", err)
+	}
+
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return fmt.Errorf("failed to encode snapshot for %s: %w", stream, err)
+	}
+
+	_, err = store.PutBytes(ctx, snapshotObjectName(pipelineID, runID, stream), data)
+	if err != nil {
+		return fmt.Errorf("failed to put snapshot for %s: %w", stream, err)
+	}
+	return nil
+}
+
+// SnapshotDeliveryRun names the diff run under which RecordDelivery tracks
+// the batches of snapshot runID.
+func SnapshotDeliveryRun(runID string) string {
+	return "snapshot-" + runID
+}
+
+// CommitSnapshot makes runID the snapshot later diff runs compare against and
+// removes the previously committed one. A run with a batch that failed for
+// good is discarded instead, and one with batches awaiting redelivery
+// returns ErrRunPending so the commit is retried after them.
+func CommitSnapshot(ctx context.Context, js jetstream.JetStream, pipelineID int64, runID string, delivery Delivery) error {
+	err := CheckRunDelivered(ctx, js, pipelineID, SnapshotDeliveryRun(runID), delivery)
+	switch {
+	case errors.Is(err, ErrRunFailed):
+		log.Printf("Not committing snapshot %s for pipeline %d: %v", runID, pipelineID, err)
+		if err := DeleteSnapshot(ctx, js, pipelineID, runID); err != nil {
+			return err
+		}
+		return ClearRunDelivery(ctx, js, pipelineID, SnapshotDeliveryRun(runID))
+	case err != nil:
+		return err
+	}
+
+	var previousRunID string
+	_, err = GetPipelineState(ctx, js, pipelineID, snapshotState, &previousRunID)
+	if err != nil {
+		return err
+	}
+
+	err = PutPipelineState(ctx, js, pipelineID, snapshotState, runID)
+	if err != nil {
+		return err
+	}
+	if err := ClearRunDelivery(ctx, js, pipelineID, SnapshotDeliveryRun(runID)); err != nil {
+		return err
+	}
+
+	if previousRunID == "" || previousRunID == runID {
+		return nil
+	}
+	return DeleteSnapshot(ctx, js, pipelineID, previousRunID)
+}
+
+func DeleteSnapshot(ctx context.Context, js jetstream.JetStream, pipelineID int64, runID string) error {
+	return deleteSnapshots(ctx, js, snapshotPrefix(pipelineID, runID))
+}
+
+func DeleteAllSnapshots(ctx context.Context, js jetstream.JetStream, pipelineID int64) error {
+	return deleteSnapshots(ctx, js, fmt.Sprintf("%d/", pipelineID))
+}
+
+func deleteSnapshots(ctx context.Context, js jetstream.JetStream, prefix string) error {
+	store, err := js.ObjectStore(ctx, SnapshotBucket)
+	if err != nil {
+		return fmt.Errorf("failed to open snapshot store: %w", err)
+	}
+
+	objects, err := store.List(ctx)
+	if errors.Is(err, jetstream.ErrNoObjectsFound) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to list snapshots: %w", err)
+	}
+
+	for _, object := range objects {
+		if !strings.HasPrefix(object.Name, prefix) {
+			continue
+		}
+		if err := store.Delete(ctx, object.Name); err != nil {
+			return fmt.Errorf("failed to delete snapshot %s: %w", object.Name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+package nats
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+const KVBucket = "dataforge"
+
+func PipelineKey(pipelineID int64, name string) string {
+	return fmt.Sprintf("%d-%s", pipelineID, name)
+}
+
+// GetPipelineState decodes the value stored under the pipeline's key into v.
+// It returns false if nothing has been stored yet.
+func GetPipelineState(ctx context.Context, js jetstream.JetStream, pipelineID int64, name string, v interface{}) (bool, error) {
+	kv, err := js.KeyValue(ctx, KVBucket)
+	if err != nil {
+		return false, fmt.Errorf("failed to open KV bucket: %w", err)
+	}
+
+	entry, err := kv.Get(ctx, PipelineKey(pipelineID, name))
+	if errors.Is(err, jetstream.ErrKeyNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to get %s state for pipeline %d: %w", name, pipelineID, err)
+	}
+
+	if err := json.Unmarshal(entry.Value(), v); err != nil {
+		return false, fmt.Errorf("failed to decode %s state for pipeline %d: %w", name, pipelineID, err)
+	}
+	return true, nil
+}
+
+func PutPipelineState(ctx context.Context, js jetstream.JetStream, pipelineID int64, name string, v interface{}) error {
+	kv, err := js.KeyValue(ctx, KVBucket)
+	if err != nil {
+		return fmt.Errorf("failed to open KV bucket: %w", err)
+	}
+
+	value, err := json.Marshal(v)
+	if err != nil {
+		return fmt.Errorf("failed to encode %s state for pipeline %d: %w", name, pipelineID, err)
+	}
+
+	_, err = kv.Put(ctx, PipelineKey(pipelineID, name), value)
+	if err != nil {
+		return fmt.Errorf("failed to put %s state for pipeline %d: %w", name, pipelineID, err)
+	}
+	return nil
+}
+
+func DeletePipelineState(ctx context.Context, js jetstream.JetStream, pipelineID int64, name string) error {
+	kv, err := js.KeyValue(ctx, KVBucket)
+	if err != nil {
+		return fmt.Errorf("failed to open KV bucket: %w", err)
+	}
+
+	err = kv.Delete(ctx, PipelineKey(pipelineID, name))
+	if err != nil && !errors.Is(err, jetstream.ErrKeyNotFound) {
+		return fmt.Errorf("failed to delete %s state for pipeline %d: %w", name, pipelineID, err)
+	}
+	return nil
+}
+
+// DeleteAllPipelineState removes every key stored for the pipeline.
+func DeleteAllPipelineState(ctx context.Context, kv jetstream.KeyValue, pipelineID int64) error {
+	lister, err := kv.ListKeys(ctx)
+	if err != nil {
+		if errors.Is(err, jetstream.ErrNoKeysFound) {
+			return nil
+		}
+		return fmt.Errorf("failed to list KV keys: %w", err)
+	}
+	defer lister.Stop()
+
+	prefix := PipelineKey(pipelineID, "")
+	var keys []string
+	for key := range lister.Keys() {
+		if strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+	}
+
+	for _, key := range keys {
+		if err := kv.Delete(ctx, key); err != nil {
+			return fmt.Errorf("failed to delete KV key %s: %w", key, err)
+		}
+	}
+	return nil
+}